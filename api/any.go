@@ -0,0 +1,98 @@
+package api
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// ErrNotAny the envelope does not carry an Any payload
+var ErrNotAny = errors.New("payload is not any")
+
+// anyTypes message types registered with RegisterAny, they are resolved
+// before the types of the global registry
+var anyTypes = new(protoregistry.Types)
+
+// RegisterAny register the types of the messages so Any payloads holding them can be
+// decoded, messages generated by protoc-gen-go are known without registration
+func RegisterAny(msgs ...proto.Message) error {
+	for _, m := range msgs {
+		mt := m.ProtoReflect().Type()
+		if _, err := anyTypes.FindMessageByName(mt.Descriptor().FullName()); err == nil {
+			continue
+		}
+
+		if err := anyTypes.RegisterMessage(mt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anyResolver resolves the registered types first and then the global registry
+type anyResolver struct{}
+
+func (anyResolver) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	if mt, err := anyTypes.FindMessageByName(name); err == nil {
+		return mt, nil
+	}
+	return protoregistry.GlobalTypes.FindMessageByName(name)
+}
+
+func (anyResolver) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	if mt, err := anyTypes.FindMessageByURL(url); err == nil {
+		return mt, nil
+	}
+	return protoregistry.GlobalTypes.FindMessageByURL(url)
+}
+
+func (anyResolver) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	return protoregistry.GlobalTypes.FindExtensionByName(field)
+}
+
+func (anyResolver) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+}
+
+// SetAny set the payload of the envelope to the message packed in Any
+func (x *Envelope) SetAny(m proto.Message) error {
+	a, err := anypb.New(m)
+	if err != nil {
+		return err
+	}
+
+	x.Payload = &Envelope_Any{Any: a}
+	return nil
+}
+
+// AnyType returns the full name of the message in the Any payload without decoding it,
+// empty when the envelope carries another payload
+func (x *Envelope) AnyType() protoreflect.FullName {
+	a := x.GetAny()
+	if a == nil {
+		return ""
+	}
+	return a.MessageName()
+}
+
+// UnmarshalAny decode the Any payload into a new message of the packed type,
+// it returns ErrNotAny when the envelope carries another payload
+func (x *Envelope) UnmarshalAny() (proto.Message, error) {
+	a := x.GetAny()
+	if a == nil {
+		return nil, ErrNotAny
+	}
+	return anypb.UnmarshalNew(a, proto.UnmarshalOptions{Resolver: anyResolver{}})
+}
+
+// UnmarshalAnyTo decode the Any payload into m, it fails when m is not of the packed type
+func (x *Envelope) UnmarshalAnyTo(m proto.Message) error {
+	a := x.GetAny()
+	if a == nil {
+		return ErrNotAny
+	}
+	return a.UnmarshalTo(m)
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestEnvelopeAny(t *testing.T) {
+	in := &Envelope{Cid: "session"}
+	if err := in.SetAny(&SessionNew{SessionID: "s1", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := proto.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &Envelope{}
+	if err := proto.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.AnyType() != "nakama.cluster.SessionNew" {
+		t.Fatalf("unexpected type %s", out.AnyType())
+	}
+
+	m, err := out.UnmarshalAny()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ok := m.(*SessionNew); !ok || s.SessionID != "s1" || s.UserID != "u1" {
+		t.Fatalf("unexpected message %v", m)
+	}
+
+	if err := out.UnmarshalAnyTo(&wrapperspb.StringValue{}); err == nil {
+		t.Fatal("expected mismatched type error")
+	}
+
+	if err := RegisterAny(&SessionNew{}, &SessionNew{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&Envelope{}).UnmarshalAny(); !errors.Is(err, ErrNotAny) {
+		t.Fatalf("expected ErrNotAny, got %v", err)
+	}
+}
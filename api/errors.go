@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NewError create error with the code and message
+func NewError(code Error_Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Errorf create error with the code and formatted message
+func Errorf(code Error_Code, format string, a ...any) *Error {
+	return NewError(code, fmt.Sprintf(format, a...))
+}
+
+// WithContext set additional error details
+func (x *Error) WithContext(k, v string) *Error {
+	if x.Context == nil {
+		x.Context = make(map[string]string)
+	}
+
+	x.Context[k] = v
+	return x
+}
+
+// Error implements the error interface
+func (x *Error) Error() string {
+	return fmt.Sprintf("%s: %s", x.GetCode(), x.GetMessage())
+}
+
+// GRPCStatus returns the gRPC status of the error, the error itself is
+// attached as status detail so the context survives the conversion
+func (x *Error) GRPCStatus() *status.Status {
+	s := status.New(ToGRPCCode(x.GetCode()), x.GetMessage())
+	if x.GetCode() == Error_OK {
+		return s
+	}
+
+	if sd, err := s.WithDetails(x); err == nil {
+		return sd
+	}
+	return s
+}
+
+// FromStatus convert the gRPC status to Error
+func FromStatus(s *status.Status) *Error {
+	for _, detail := range s.Details() {
+		if e, ok := detail.(*Error); ok {
+			return e
+		}
+	}
+	return NewError(FromGRPCCode(s.Code()), s.Message())
+}
+
+// AsError convert err to Error, gRPC status errors keep their code
+// and any other error is reported as UNKNOWN
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	if s, ok := status.FromError(err); ok {
+		return FromStatus(s)
+	}
+	return NewError(Error_UNKNOWN, err.Error())
+}
+
+// IsCode reports whether err is an Error or a gRPC status error with the code
+func IsCode(err error, code Error_Code) bool {
+	if err == nil {
+		return code == Error_OK
+	}
+	return AsError(err).GetCode() == code
+}
+
+// ToGRPCCode returns the gRPC status code of the error code
+func ToGRPCCode(code Error_Code) codes.Code {
+	if _, ok := Error_Code_name[int32(code)]; !ok {
+		return codes.Unknown
+	}
+	return codes.Code(code)
+}
+
+// FromGRPCCode returns the error code of the gRPC status code
+func FromGRPCCode(code codes.Code) Error_Code {
+	if _, ok := Error_Code_name[int32(code)]; !ok {
+		return Error_UNKNOWN
+	}
+	return Error_Code(code)
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorStatus(t *testing.T) {
+	var err error = NewError(Error_NOT_FOUND, "match not found").WithContext("match", "m1")
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != codes.NotFound {
+		t.Fatalf("unexpected status %v", s)
+	}
+
+	e := FromStatus(s)
+	if e.Code != Error_NOT_FOUND || e.Context["match"] != "m1" {
+		t.Fatalf("context lost in conversion: %v", e)
+	}
+
+	if !IsCode(status.Error(codes.Unavailable, "down"), Error_UNAVAILABLE) {
+		t.Fatal("expected UNAVAILABLE")
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// JsonContentType content type of Json payloads without one
+const JsonContentType = "application/json"
+
+// ErrNotJson the envelope does not carry a Json payload
+var ErrNotJson = errors.New("payload is not json")
+
+// NewJson create Json payload holding v encoded as JSON
+func NewJson(v any) (*Json, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Json{Data: b}, nil
+}
+
+// MediaType returns the content type of the document, JsonContentType when it is not set
+func (x *Json) MediaType() string {
+	if ct := x.GetContentType(); ct != "" {
+		return ct
+	}
+	return JsonContentType
+}
+
+// Unmarshal decode the document into v
+func (x *Json) Unmarshal(v any) error {
+	return json.Unmarshal(x.GetData(), v)
+}
+
+// SetJson set the payload of the envelope to v encoded as JSON
+func (x *Envelope) SetJson(v any) error {
+	j, err := NewJson(v)
+	if err != nil {
+		return err
+	}
+
+	x.Payload = &Envelope_Json{Json: j}
+	return nil
+}
+
+// UnmarshalJson decode the Json payload of the envelope into v,
+// it returns ErrNotJson when the envelope carries another payload
+func (x *Envelope) UnmarshalJson(v any) error {
+	j := x.GetJson()
+	if j == nil {
+		return ErrNotJson
+	}
+	return j.Unmarshal(v)
+}
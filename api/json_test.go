@@ -0,0 +1,44 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEnvelopeJson(t *testing.T) {
+	type match struct {
+		Id    string `json:"id"`
+		Size  int    `json:"size"`
+		Label string `json:"label"`
+	}
+
+	in := &Envelope{Cid: "match"}
+	if err := in.SetJson(match{Id: "m1", Size: 4, Label: "ranked"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := proto.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &Envelope{}
+	if err := proto.Unmarshal(b, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.GetJson().MediaType() != JsonContentType {
+		t.Fatalf("unexpected content type %s", out.GetJson().MediaType())
+	}
+
+	var m match
+	if err := out.UnmarshalJson(&m); err != nil || m.Id != "m1" || m.Size != 4 || m.Label != "ranked" {
+		t.Fatalf("unexpected document %+v %v", m, err)
+	}
+
+	if err := (&Envelope{Payload: &Envelope_Bytes{Bytes: []byte("{}")}}).UnmarshalJson(&m); !errors.Is(err, ErrNotJson) {
+		t.Fatalf("expected ErrNotJson, got %v", err)
+	}
+}
@@ -172,3 +172,261 @@ var ApiServer_ServiceDesc = grpc.ServiceDesc{
 	},
 	Metadata: "nakama_cluster_api.proto",
 }
+
+// ObserverClient is the client API for Observer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ObserverClient interface {
+	ListNodes(ctx context.Context, in *ListNodesRequest, opts ...grpc.CallOption) (*ListNodesResponse, error)
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (Observer_WatchEventsClient, error)
+	GetRing(ctx context.Context, in *GetRingRequest, opts ...grpc.CallOption) (*Ring, error)
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error)
+	ListStreams(ctx context.Context, in *ListStreamsRequest, opts ...grpc.CallOption) (*ListStreamsResponse, error)
+}
+
+type observerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewObserverClient(cc grpc.ClientConnInterface) ObserverClient {
+	return &observerClient{cc}
+}
+
+func (c *observerClient) ListNodes(ctx context.Context, in *ListNodesRequest, opts ...grpc.CallOption) (*ListNodesResponse, error) {
+	out := new(ListNodesResponse)
+	err := c.cc.Invoke(ctx, "/nakama.cluster.Observer/ListNodes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *observerClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (Observer_WatchEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Observer_ServiceDesc.Streams[0], "/nakama.cluster.Observer/WatchEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &observerWatchEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Observer_WatchEventsClient interface {
+	Recv() (*ClusterEvent, error)
+	grpc.ClientStream
+}
+
+type observerWatchEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *observerWatchEventsClient) Recv() (*ClusterEvent, error) {
+	m := new(ClusterEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *observerClient) GetRing(ctx context.Context, in *GetRingRequest, opts ...grpc.CallOption) (*Ring, error) {
+	out := new(Ring)
+	err := c.cc.Invoke(ctx, "/nakama.cluster.Observer/GetRing", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *observerClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, "/nakama.cluster.Observer/GetStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *observerClient) ListStreams(ctx context.Context, in *ListStreamsRequest, opts ...grpc.CallOption) (*ListStreamsResponse, error) {
+	out := new(ListStreamsResponse)
+	err := c.cc.Invoke(ctx, "/nakama.cluster.Observer/ListStreams", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ObserverServer is the server API for Observer service.
+// All implementations must embed UnimplementedObserverServer
+// for forward compatibility
+type ObserverServer interface {
+	ListNodes(context.Context, *ListNodesRequest) (*ListNodesResponse, error)
+	WatchEvents(*WatchEventsRequest, Observer_WatchEventsServer) error
+	GetRing(context.Context, *GetRingRequest) (*Ring, error)
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+	ListStreams(context.Context, *ListStreamsRequest) (*ListStreamsResponse, error)
+	mustEmbedUnimplementedObserverServer()
+}
+
+// UnimplementedObserverServer must be embedded to have forward compatible implementations.
+type UnimplementedObserverServer struct {
+}
+
+func (UnimplementedObserverServer) ListNodes(context.Context, *ListNodesRequest) (*ListNodesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListNodes not implemented")
+}
+func (UnimplementedObserverServer) WatchEvents(*WatchEventsRequest, Observer_WatchEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedObserverServer) GetRing(context.Context, *GetRingRequest) (*Ring, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRing not implemented")
+}
+func (UnimplementedObserverServer) GetStats(context.Context, *GetStatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedObserverServer) ListStreams(context.Context, *ListStreamsRequest) (*ListStreamsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListStreams not implemented")
+}
+func (UnimplementedObserverServer) mustEmbedUnimplementedObserverServer() {}
+
+// UnsafeObserverServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ObserverServer will
+// result in compilation errors.
+type UnsafeObserverServer interface {
+	mustEmbedUnimplementedObserverServer()
+}
+
+func RegisterObserverServer(s grpc.ServiceRegistrar, srv ObserverServer) {
+	s.RegisterService(&Observer_ServiceDesc, srv)
+}
+
+func _Observer_ListNodes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListNodesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ObserverServer).ListNodes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nakama.cluster.Observer/ListNodes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ObserverServer).ListNodes(ctx, req.(*ListNodesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Observer_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ObserverServer).WatchEvents(m, &observerWatchEventsServer{stream})
+}
+
+type Observer_WatchEventsServer interface {
+	Send(*ClusterEvent) error
+	grpc.ServerStream
+}
+
+type observerWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *observerWatchEventsServer) Send(m *ClusterEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Observer_GetRing_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ObserverServer).GetRing(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nakama.cluster.Observer/GetRing",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ObserverServer).GetRing(ctx, req.(*GetRingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Observer_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ObserverServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nakama.cluster.Observer/GetStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ObserverServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Observer_ListStreams_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListStreamsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ObserverServer).ListStreams(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/nakama.cluster.Observer/ListStreams",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ObserverServer).ListStreams(ctx, req.(*ListStreamsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Observer_ServiceDesc is the grpc.ServiceDesc for Observer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Observer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "nakama.cluster.Observer",
+	HandlerType: (*ObserverServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListNodes",
+			Handler:    _Observer_ListNodes_Handler,
+		},
+		{
+			MethodName: "GetRing",
+			Handler:    _Observer_GetRing_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _Observer_GetStats_Handler,
+		},
+		{
+			MethodName: "ListStreams",
+			Handler:    _Observer_ListStreams_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _Observer_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "nakama_cluster_api.proto",
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"sync"
+)
+
+var (
+	envelopePool = sync.Pool{New: func() any { return new(Envelope) }}
+	framePool    = sync.Pool{New: func() any { return new(Frame) }}
+)
+
+// AcquireEnvelope returns an empty envelope from the pool
+func AcquireEnvelope() *Envelope {
+	return envelopePool.Get().(*Envelope)
+}
+
+// ReleaseEnvelope resets the envelope and puts it back to the pool,
+// the envelope must not be used or referenced after release.
+func ReleaseEnvelope(e *Envelope) {
+	if e == nil {
+		return
+	}
+
+	e.Reset()
+	envelopePool.Put(e)
+}
+
+// AcquireFrame returns an empty frame from the pool
+func AcquireFrame() *Frame {
+	return framePool.Get().(*Frame)
+}
+
+// ReleaseFrame resets the frame and puts it back to the pool, the envelope
+// of the frame is not released. The frame must not be used or referenced after release.
+func ReleaseFrame(f *Frame) {
+	if f == nil {
+		return
+	}
+
+	f.Reset()
+	framePool.Put(f)
+}
@@ -0,0 +1,272 @@
+package nakamacluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+// audit actions
+const (
+	AUDIT_NODE_JOIN       = "node_join"       // a node joined the view, Target is the node
+	AUDIT_NODE_LEAVE      = "node_leave"      // a node left the view, Target is the node
+	AUDIT_NODE_UPDATE     = "node_update"     // the meta of a node changed, Target is the node
+	AUDIT_NODE_QUARANTINE = "node_quarantine" // a node was quarantined, Target is the node
+	AUDIT_NODE_RELEASE    = "node_release"    // the quarantine of a node ended, Target is the node
+	AUDIT_STATUS          = "status"          // the local node changed its status or vars, like a drain
+	AUDIT_FLAG            = "flag"            // a cluster flag was set or deleted, Target is the flag
+	AUDIT_CONTROL         = "control"         // a control command was run, Target is the cid
+)
+
+// audit initiators besides the node names of the callers
+const (
+	AUDIT_INITIATOR_LOCAL   = "local"   // the local process, like a call of UpdateMeta
+	AUDIT_INITIATOR_CLUSTER = "cluster" // a change observed through sd or gossip
+)
+
+// AuditRecord entry of the audit trail
+type AuditRecord struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Node      string            `json:"node"`
+	Action    string            `json:"action"`
+	Initiator string            `json:"initiator"`
+	Target    string            `json:"target,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// AuditSink append-only storage of the audit records
+type AuditSink interface {
+	// Append store the record, records are appended in Seq order
+	Append(ctx context.Context, record AuditRecord) error
+}
+
+// MemoryAuditSink in-memory audit sink
+type MemoryAuditSink struct {
+	records []AuditRecord
+	sync.RWMutex
+}
+
+func (s *MemoryAuditSink) Append(ctx context.Context, record AuditRecord) error {
+	s.Lock()
+	s.records = append(s.records, record)
+	s.Unlock()
+	return nil
+}
+
+// Records returns the records appended so far
+func (s *MemoryAuditSink) Records() []AuditRecord {
+	s.RLock()
+	defer s.RUnlock()
+	records := make([]AuditRecord, len(s.records))
+	copy(records, s.records)
+	return records
+}
+
+// FileAuditSink appends the records to a file as json lines
+type FileAuditSink struct {
+	file *os.File
+	sync.Mutex
+}
+
+// NewFileAuditSink open the file for appending, it is created when missing
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+func (s *FileAuditSink) Append(ctx context.Context, record AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+// Close close the file
+func (s *FileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// SdAuditSink writes every record to its own key under the prefix, the keys sort in the
+// order the records of a node were appended
+type SdAuditSink struct {
+	writer sd.KeyWriter
+	prefix string
+}
+
+// NewSdAuditSink create the sink writing under the prefix, like /nakama-cluster/services.audit/
+func NewSdAuditSink(writer sd.KeyWriter, prefix string) *SdAuditSink {
+	return &SdAuditSink{writer: writer, prefix: prefix}
+}
+
+func (s *SdAuditSink) Append(ctx context.Context, record AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.writer.PutKey(fmt.Sprintf("%s%s/%020d-%020d", s.prefix, record.Node, record.Time.UnixNano(), record.Seq), string(b))
+}
+
+// KafkaAuditSink writes the records to a kafka topic keyed by node
+type KafkaAuditSink struct {
+	writer KafkaWriter
+	topic  string
+}
+
+// NewKafkaAuditSink create the sink writing to the topic
+func NewKafkaAuditSink(writer KafkaWriter, topic string) *KafkaAuditSink {
+	return &KafkaAuditSink{writer: writer, topic: topic}
+}
+
+func (s *KafkaAuditSink) Append(ctx context.Context, record AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.writer.WriteMessages(ctx, KafkaMessage{
+		Topic:   s.topic,
+		Key:     []byte(record.Node),
+		Value:   b,
+		Headers: map[string]string{"action": record.Action},
+		Time:    record.Time,
+	})
+}
+
+// AuditLog records the membership changes, status changes, flag changes and control commands
+// of the node to the sink in order on its own goroutine, records are dropped when the queue is full
+type AuditLog struct {
+	ctx     context.Context
+	sink    AuditSink
+	node    string
+	queue   chan AuditRecord
+	seq     uint64
+	closer  io.Closer
+	metrics *Metrics
+	logger  *zap.Logger
+}
+
+// NewAuditLog create the audit log of the node, it is stopped when ctx is done
+func NewAuditLog(ctx context.Context, logger *zap.Logger, sink AuditSink, node string, queueSize int, metrics *Metrics) *AuditLog {
+	return openAuditLog(ctx, logger, sink, nil, node, queueSize, metrics)
+}
+
+// openAuditLog create the audit log closing closer once ctx is done
+func openAuditLog(ctx context.Context, logger *zap.Logger, sink AuditSink, closer io.Closer, node string, queueSize int, metrics *Metrics) *AuditLog {
+	if queueSize < 1 {
+		queueSize = 1024
+	}
+
+	if metrics == nil {
+		metrics = NewMetrics(nil)
+	}
+
+	a := &AuditLog{
+		ctx:     ctx,
+		sink:    sink,
+		node:    node,
+		queue:   make(chan AuditRecord, queueSize),
+		closer:  closer,
+		metrics: metrics,
+		logger:  logger,
+	}
+	go a.loop()
+	return a
+}
+
+// Record queue the record of the action, it is safe to call on a nil log
+func (a *AuditLog) Record(action, initiator, target string, details map[string]string) {
+	if a == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Seq:       atomic.AddUint64(&a.seq, 1),
+		Time:      time.Now(),
+		Node:      a.node,
+		Action:    action,
+		Initiator: initiator,
+		Target:    target,
+		Details:   details,
+	}
+
+	select {
+	case a.queue <- record:
+	default:
+		a.logger.Warn("Audit queue full, record dropped", zap.String("action", action), zap.String("target", target))
+		a.metrics.AuditDropped()
+	}
+}
+
+// recordEvent record the membership change of the cluster event
+func (a *AuditLog) recordEvent(e Event) {
+	var action string
+	switch e.Type {
+	case EVENT_NODE_JOIN:
+		action = AUDIT_NODE_JOIN
+	case EVENT_NODE_LEAVE:
+		action = AUDIT_NODE_LEAVE
+	case EVENT_NODE_UPDATE:
+		action = AUDIT_NODE_UPDATE
+	case EVENT_NODE_QUARANTINED:
+		action = AUDIT_NODE_QUARANTINE
+	case EVENT_NODE_RELEASED:
+		action = AUDIT_NODE_RELEASE
+	default:
+		return
+	}
+
+	a.Record(action, AUDIT_INITIATOR_CLUSTER, e.Node.Id, map[string]string{"name": e.Node.Name, "addr": e.Node.Addr, "status": e.Node.Status.String()})
+}
+
+func (a *AuditLog) loop() {
+	for {
+		select {
+		case record := <-a.queue:
+			if err := a.sink.Append(a.ctx, record); err != nil {
+				a.logger.Warn("Failed append audit record", zap.Error(err), zap.String("action", record.Action))
+				a.metrics.AuditFailed()
+			}
+
+		case <-a.ctx.Done():
+			if a.closer != nil {
+				a.closer.Close()
+			}
+			return
+		}
+	}
+}
+
+// newAuditLog create the audit log of the option sink or of the audit_log_file, nil when neither is set
+func newAuditLog(ctx context.Context, logger *zap.Logger, sink AuditSink, config Config, node string, metrics *Metrics) *AuditLog {
+	if sink != nil {
+		return NewAuditLog(ctx, logger, sink, node, config.BroadcastQueueSize, metrics)
+	}
+
+	if config.AuditLogFile == "" {
+		return nil
+	}
+
+	file, err := NewFileAuditSink(config.AuditLogFile)
+	if err != nil {
+		logger.Fatal("Failed open audit log", zap.Error(err), zap.String("path", config.AuditLogFile))
+	}
+
+	return openAuditLog(ctx, logger, file, file, node, config.BroadcastQueueSize, metrics)
+}
@@ -0,0 +1,167 @@
+package nakamacluster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func waitAudit(t *testing.T, sink *MemoryAuditSink, action string) AuditRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, record := range sink.Records() {
+			if record.Action == action {
+				return record
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("no %s record in %+v", action, sink.Records())
+	return AuditRecord{}
+}
+
+func TestAuditLog(t *testing.T) {
+	sink := &MemoryAuditSink{}
+	server := newTestServer(t, nil, WithAuditSink(sink))
+
+	if err := server.UpdateMeta(META_STATUS_DRAINING, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	record := waitAudit(t, sink, AUDIT_STATUS)
+	if record.Node != "node1" || record.Initiator != AUDIT_INITIATOR_LOCAL || record.Details["status"] != META_STATUS_DRAINING.String() {
+		t.Fatalf("unexpected record %+v", record)
+	}
+
+	server.Events().Publish(Event{Type: EVENT_NODE_QUARANTINED, Node: &Meta{Id: "node2", Name: "svc"}})
+	if record := waitAudit(t, sink, AUDIT_NODE_QUARANTINE); record.Target != "node2" || record.Initiator != AUDIT_INITIATOR_CLUSTER {
+		t.Fatalf("unexpected record %+v", record)
+	}
+
+	records := sink.Records()
+	for i := 1; i < len(records); i++ {
+		if records[i].Seq <= records[i-1].Seq {
+			t.Fatalf("records out of order %+v", records)
+		}
+	}
+}
+
+func TestAuditControlInitiator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newServer := func(id string, options ...Option) *Server {
+		config := testConfig(t)
+		config.ControlKey = "secret"
+		return NewServer(ctx, zap.NewNop(), store.NewClient(ctx), id, "svc", map[string]string{}, *config, options...)
+	}
+
+	sink := &MemoryAuditSink{}
+	server := newServer("node1", WithAuditSink(sink))
+	defer server.Stop()
+	caller := newServer("node2")
+	defer caller.Stop()
+	for {
+		if _, ok := server.GetPeers().Get("node2"); ok {
+			break
+		}
+
+		if ctx.Err() != nil {
+			t.Fatal("node2 not synced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := grpc.DialContext(ctx, server.GetMeta().Addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the initiator of a control call over grpc is the node calling from its address, or the
+	// id a caller announced marked unverified
+	client := api.NewApiServerClient(conn)
+	for i, id := range []string{"node2", "node3"} {
+		callCtx := outgoingCallerContext(ctx, &Meta{Id: id, Name: "svc"})
+		if _, err := client.Call(callCtx, NewControlEnvelope([]byte("secret"), CONTROL_CID_RESYNC, "node1", nil)); err != nil {
+			t.Fatal(err)
+		}
+
+		var controls []AuditRecord
+		for len(controls) <= i && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+			controls = controls[:0]
+			for _, record := range sink.Records() {
+				if record.Action == AUDIT_CONTROL {
+					controls = append(controls, record)
+				}
+			}
+		}
+
+		if ctx.Err() != nil {
+			t.Fatalf("control call of %s not recorded", id)
+		}
+
+		initiator := id
+		if id == "node3" {
+			initiator = "unverified:node3"
+		}
+
+		if record := controls[i]; record.Initiator != initiator || record.Target != CONTROL_CID_RESYNC {
+			t.Fatalf("unexpected record %+v", record)
+		}
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	path := filepath.Join(t.TempDir(), "audit.log")
+	config := NewConfig()
+	config.AuditLogFile = path
+	audit := newAuditLog(ctx, zap.NewNop(), nil, *config, "node1", nil)
+	audit.Record(AUDIT_CONTROL, "node2", "drain", map[string]string{"status": "draining"})
+	audit.Record(AUDIT_FLAG, "node2", "maintenance", map[string]string{"value": "on"})
+
+	var records []AuditRecord
+	deadline := time.Now().Add(5 * time.Second)
+	for len(records) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		records = records[:0]
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+		f.Close()
+	}
+
+	cancel()
+	if len(records) != 2 || records[0].Target != "drain" || records[1].Details["value"] != "on" || records[0].Node != "node1" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	if newAuditLog(context.Background(), zap.NewNop(), nil, *NewConfig(), "node1", nil) != nil {
+		t.Fatal("audit log created without a sink")
+	}
+}
@@ -0,0 +1,342 @@
+package nakamacluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+const (
+	// BLOB_CID_PREFIX cids reserved for blob transfers
+	BLOB_CID_PREFIX = "__blob."
+
+	blobCidOpen     = BLOB_CID_PREFIX + "open"
+	blobCidChunk    = BLOB_CID_PREFIX + "chunk"
+	blobCidCommit   = BLOB_CID_PREFIX + "commit"
+	blobVarName     = "blob_name"
+	blobVarSize     = "blob_size"
+	blobVarOffset   = "blob_offset"
+	blobVarChecksum = "blob_sha256"
+
+	// blobPartSuffix suffix of the blobs still being received by DirBlobStore
+	blobPartSuffix = ".part"
+
+	defaultBlobChunkSize = 256 << 10
+)
+
+var (
+	ErrInvalidBlobName = errors.New("invalid blob name")
+	ErrBlobChecksum    = errors.New("blob checksum mismatch")
+	ErrBlobNotEnabled  = errors.New("blob transfer not enabled")
+)
+
+// BlobStore storage of the blobs received from peers, a partially received
+// blob is kept so an interrupted transfer resumes where it stopped
+type BlobStore interface {
+	// Size bytes of the named blob received so far, 0 when no transfer was started
+	Size(name string) (int64, error)
+
+	// WriteAt write p at off of the partially received blob
+	WriteAt(name string, p []byte, off int64) error
+
+	// Commit verify the sha256 hex checksum of the received blob and publish it
+	Commit(name, checksum string) error
+
+	// Reset discard the partially received blob
+	Reset(name string) error
+}
+
+// BlobDelegate optional extension of ServerDelegate notified of the blobs received from peers
+type BlobDelegate interface {
+	// NotifyBlob the blob was received and its checksum verified, the sending node is available through FromContext
+	NotifyBlob(ctx context.Context, name string)
+}
+
+// DirBlobStore stores blobs as files of the directory, blobs being received
+// are written to name.part and renamed to name once the checksum matched
+type DirBlobStore struct {
+	dir string
+	sync.Mutex
+}
+
+// NewDirBlobStore create the store, dir is created when missing
+func NewDirBlobStore(dir string) (*DirBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirBlobStore{dir: dir}, nil
+}
+
+// Path path of the received blob
+func (s *DirBlobStore) Path(name string) (string, error) {
+	if err := checkBlobName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *DirBlobStore) Size(name string) (int64, error) {
+	p, err := s.Path(name)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(p + blobPartSuffix)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *DirBlobStore) WriteAt(name string, b []byte, off int64) error {
+	p, err := s.Path(name)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	f, err := os.OpenFile(p+blobPartSuffix, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteAt(b, off); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *DirBlobStore) Commit(name, checksum string) error {
+	p, err := s.Path(name)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	f, err := os.Open(p + blobPartSuffix)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != checksum {
+		os.Remove(p + blobPartSuffix)
+		return ErrBlobChecksum
+	}
+	return os.Rename(p+blobPartSuffix, p)
+}
+
+func (s *DirBlobStore) Reset(name string) error {
+	p, err := s.Path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p + blobPartSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// BlobOptions options of SendBlob
+type BlobOptions struct {
+	// ChunkSize bytes sent in every stream message, default 256 KB
+	ChunkSize int
+
+	// Progress is called with the bytes acknowledged by the receiver, including
+	// the bytes already received when a transfer resumes
+	Progress func(sent, total int64)
+}
+
+// SendBlob transfer size bytes of r to node over a peer stream, the receiver
+// needs a BlobStore, see WithBlobStore. When the receiver already holds part of
+// the blob from an interrupted transfer only the remaining bytes are sent, the
+// blob is published once its sha256 checksum was verified by the receiver.
+func SendBlob(ctx context.Context, peers Peer, node *Meta, name string, r io.ReaderAt, size int64, opts BlobOptions) error {
+	if err := checkBlobName(name); err != nil {
+		return err
+	}
+
+	if opts.ChunkSize < 1 {
+		opts.ChunkSize = defaultBlobChunkSize
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+
+	clientId := BLOB_CID_PREFIX + node.Id
+	request := func(in *api.Envelope) (*api.Envelope, error) {
+		ch, err := peers.SendStreamRequest(ctx, clientId, node, in, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case out, ok := <-ch:
+			if !ok {
+				return nil, ErrStreamClosed
+			}
+
+			if e := out.GetError(); e != nil {
+				return nil, e
+			}
+			return out, nil
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	out, err := request(&api.Envelope{Cid: blobCidOpen, Vars: map[string]string{
+		blobVarName: name,
+		blobVarSize: strconv.FormatInt(size, 10),
+	}})
+	if err != nil {
+		return err
+	}
+
+	offset, err := strconv.ParseInt(out.Vars[blobVarOffset], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, opts.ChunkSize)
+	for {
+		if opts.Progress != nil {
+			opts.Progress(offset, size)
+		}
+
+		if offset >= size {
+			break
+		}
+
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+			return err
+		}
+
+		if _, err := request(&api.Envelope{
+			Cid:     blobCidChunk,
+			Payload: &api.Envelope_Bytes{Bytes: buf[:n]},
+			Vars: map[string]string{
+				blobVarName:   name,
+				blobVarOffset: strconv.FormatInt(offset, 10),
+			},
+		}); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+
+	_, err = request(&api.Envelope{Cid: blobCidCommit, Vars: map[string]string{
+		blobVarName:     name,
+		blobVarChecksum: checksum,
+	}})
+	return err
+}
+
+func (s *Server) handleBlob(ctx context.Context, fn ServerDelegate, in *api.Envelope) *api.Envelope {
+	out, err := handleBlob(s.blobs, in)
+	if err != nil {
+		s.logger.Warn("Failed handle blob", zap.Error(err), zap.String("cid", in.Cid))
+		return &api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Error{Error: api.AsError(err)}}
+	}
+
+	if delegate, ok := fn.(BlobDelegate); ok && in.Cid == blobCidCommit {
+		delegate.NotifyBlob(ctx, in.Vars[blobVarName])
+	}
+	return out
+}
+
+// handleBlob serve the blob transfer requests of peers
+func handleBlob(store BlobStore, in *api.Envelope) (*api.Envelope, error) {
+	if store == nil {
+		return nil, api.NewError(api.Error_UNIMPLEMENTED, ErrBlobNotEnabled.Error())
+	}
+
+	name := in.Vars[blobVarName]
+	if err := checkBlobName(name); err != nil {
+		return nil, api.NewError(api.Error_INVALID_ARGUMENT, err.Error())
+	}
+
+	switch in.Cid {
+	case blobCidOpen:
+		size, err := strconv.ParseInt(in.Vars[blobVarSize], 10, 64)
+		if err != nil {
+			return nil, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid blob size %q", in.Vars[blobVarSize])
+		}
+
+		offset, err := store.Size(name)
+		if err != nil {
+			return nil, err
+		}
+
+		// a larger partial blob belongs to another version of the blob
+		if offset > size {
+			if err := store.Reset(name); err != nil {
+				return nil, err
+			}
+			offset = 0
+		}
+		return &api.Envelope{Cid: in.Cid, Vars: map[string]string{blobVarOffset: strconv.FormatInt(offset, 10)}}, nil
+
+	case blobCidChunk:
+		offset, err := strconv.ParseInt(in.Vars[blobVarOffset], 10, 64)
+		if err != nil || offset < 0 {
+			return nil, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid blob offset %q", in.Vars[blobVarOffset])
+		}
+
+		b := in.GetBytes()
+		if err := store.WriteAt(name, b, offset); err != nil {
+			return nil, err
+		}
+		return &api.Envelope{Cid: in.Cid, Vars: map[string]string{blobVarOffset: strconv.FormatInt(offset+int64(len(b)), 10)}}, nil
+
+	case blobCidCommit:
+		if err := store.Commit(name, in.Vars[blobVarChecksum]); err != nil {
+			if errors.Is(err, ErrBlobChecksum) {
+				return nil, api.NewError(api.Error_DATA_LOSS, err.Error())
+			}
+			return nil, err
+		}
+		return &api.Envelope{Cid: in.Cid}, nil
+	}
+	return nil, api.Errorf(api.Error_UNIMPLEMENTED, "unknown blob cid %s", in.Cid)
+}
+
+func isBlobCid(cid string) bool {
+	return strings.HasPrefix(cid, BLOB_CID_PREFIX)
+}
+
+func checkBlobName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.HasSuffix(name, blobPartSuffix) {
+		return ErrInvalidBlobName
+	}
+	return nil
+}
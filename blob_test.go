@@ -0,0 +1,112 @@
+package nakamacluster
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/doublemo/nakama-cluster/api"
+)
+
+func TestHandleBlobResume(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDirBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("nakama"), 1000)
+	sum := sha256.Sum256(data)
+	open := func() int64 {
+		out, err := handleBlob(store, &api.Envelope{Cid: blobCidOpen, Vars: map[string]string{
+			blobVarName: "replay.bin",
+			blobVarSize: strconv.Itoa(len(data)),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		offset, _ := strconv.ParseInt(out.Vars[blobVarOffset], 10, 64)
+		return offset
+	}
+
+	chunk := func(offset, end int) {
+		if _, err := handleBlob(store, &api.Envelope{
+			Cid:     blobCidChunk,
+			Payload: &api.Envelope_Bytes{Bytes: data[offset:end]},
+			Vars:    map[string]string{blobVarName: "replay.bin", blobVarOffset: strconv.Itoa(offset)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if offset := open(); offset != 0 {
+		t.Fatalf("offset %d", offset)
+	}
+
+	chunk(0, 2500)
+	offset := open()
+	if offset != 2500 {
+		t.Fatalf("resume offset %d", offset)
+	}
+
+	chunk(int(offset), len(data))
+	if _, err := handleBlob(store, &api.Envelope{Cid: blobCidCommit, Vars: map[string]string{
+		blobVarName:     "replay.bin",
+		blobVarChecksum: hex.EncodeToString(sum[:]),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "replay.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(received, data) {
+		t.Fatal("received blob mismatch")
+	}
+}
+
+func TestHandleBlobChecksum(t *testing.T) {
+	store, err := NewDirBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := handleBlob(store, &api.Envelope{
+		Cid:     blobCidChunk,
+		Payload: &api.Envelope_Bytes{Bytes: []byte("asset")},
+		Vars:    map[string]string{blobVarName: "asset.bundle", blobVarOffset: "0"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = handleBlob(store, &api.Envelope{Cid: blobCidCommit, Vars: map[string]string{
+		blobVarName:     "asset.bundle",
+		blobVarChecksum: "00",
+	}})
+	if !api.IsCode(err, api.Error_DATA_LOSS) {
+		t.Fatalf("expected data loss, got %v", err)
+	}
+
+	if size, _ := store.Size("asset.bundle"); size != 0 {
+		t.Fatalf("partial blob kept %d", size)
+	}
+}
+
+func TestCheckBlobName(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../etc", "a/b", `a\b`, "x.part"} {
+		if checkBlobName(name) == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+
+	if err := checkBlobName("match-1.replay"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,103 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrBootstrapping the node waits for the bootstrap quorum and can not report ready yet
+var ErrBootstrapping = errors.New("node bootstrapping")
+
+// bootstrapCoordinator holds a node in META_STATUS_BOOTSTRAPPING on a cold start until
+// enough nodes of its service are up, so the first node does not take all the traffic
+type bootstrapCoordinator struct {
+	expect  int
+	nodes   []string
+	timeout time.Duration
+	done    int32
+}
+
+// newBootstrapCoordinator returns nil when the config has no bootstrap quorum
+func newBootstrapCoordinator(config Config) *bootstrapCoordinator {
+	if config.BootstrapExpect < 1 && len(config.BootstrapNodes) < 1 {
+		return nil
+	}
+
+	return &bootstrapCoordinator{
+		expect:  config.BootstrapExpect,
+		nodes:   config.BootstrapNodes,
+		timeout: time.Duration(config.BootstrapTimeout) * time.Second,
+	}
+}
+
+// pending reports whether the node still waits for the quorum
+func (b *bootstrapCoordinator) pending() bool {
+	return b != nil && atomic.LoadInt32(&b.done) == 0
+}
+
+// quorum reports whether the nodes of the service of local that are not stopped,
+// local included, meet the expected count and contain the expected ids
+func (b *bootstrapCoordinator) quorum(local *Meta, nodes []*Meta) bool {
+	up := map[string]bool{local.Id: true}
+	for _, node := range nodes {
+		if node.Namespace == local.Namespace && node.Name == local.Name && node.Status != META_STATUS_STOPED {
+			up[node.Id] = true
+		}
+	}
+
+	for _, id := range b.nodes {
+		if !up[id] {
+			return false
+		}
+	}
+	return len(up) >= b.expect
+}
+
+// run wait for the quorum or the timeout and call ready, it returns when ctx is done first
+func (b *bootstrapCoordinator) run(ctx context.Context, logger *zap.Logger, events *EventBus, peers Peer, local func() *Meta, ready func() error) {
+	changed := make(chan struct{}, 1)
+	unsubscribe := events.Subscribe(func(e Event) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	var timeout <-chan time.Time
+	if b.timeout > 0 {
+		t := time.NewTimer(b.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	met := true
+	for !b.quorum(local(), peers.All()) {
+		select {
+		case <-changed:
+			continue
+
+		case <-timeout:
+			logger.Warn("Bootstrap quorum not met in time, reporting ready", zap.Int("expect", b.expect), zap.Strings("nodes", b.nodes), zap.Int("size", peers.SizeByName(local().Name)))
+			met = false
+
+		case <-ctx.Done():
+			return
+		}
+		break
+	}
+
+	atomic.StoreInt32(&b.done, 1)
+	if err := ready(); err != nil {
+		logger.Warn("Failed to report ready after bootstrap", zap.Error(err))
+		return
+	}
+
+	if met {
+		logger.Info("Bootstrap quorum met", zap.Int("size", peers.SizeByName(local().Name)))
+	}
+}
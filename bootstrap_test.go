@@ -0,0 +1,98 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestBootstrapQuorum(t *testing.T) {
+	local := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	node2 := NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{})
+	other := NewNodeMeta("node3", "other", "127.0.0.1:3", NODE_TYPE_MICROSERVICES, map[string]string{})
+	stopped := NewNodeMeta("node4", "svc", "127.0.0.1:4", NODE_TYPE_MICROSERVICES, map[string]string{})
+	stopped.Status = META_STATUS_STOPED
+
+	b := &bootstrapCoordinator{expect: 2}
+	if b.quorum(local, []*Meta{local, other, stopped}) {
+		t.Fatal("quorum met by other services and stopped nodes")
+	}
+
+	if !b.quorum(local, []*Meta{local, node2}) {
+		t.Fatal("quorum not met")
+	}
+
+	b = &bootstrapCoordinator{nodes: []string{"node1", "node4"}}
+	if b.quorum(local, []*Meta{node2, stopped}) {
+		t.Fatal("quorum met without the named nodes")
+	}
+
+	stopped.Status = META_STATUS_WAIT_READY
+	if !b.quorum(local, []*Meta{node2, stopped}) {
+		t.Fatal("quorum of the named nodes not met")
+	}
+}
+
+func TestServerBootstrap(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newServer := func(id string) *Server {
+		config := testConfig(t)
+		config.BootstrapExpect = 2
+		return NewServer(ctx, zap.NewNop(), store.NewClient(ctx), id, "svc", map[string]string{}, *config)
+	}
+
+	waitStatus := func(s *Server, status MetaStatus) {
+		for s.GetMeta().Status != status {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatalf("%s status %s, expected %s", s.GetMeta().Id, s.GetMeta().Status, status)
+			}
+		}
+	}
+
+	server1 := newServer("node1")
+	defer server1.Stop()
+	if status := server1.GetMeta().Status; status != META_STATUS_BOOTSTRAPPING {
+		t.Fatalf("status %s", status)
+	}
+
+	if err := server1.UpdateMeta(META_STATUS_READYED, nil); !errors.Is(err, ErrBootstrapping) {
+		t.Fatalf("expected bootstrapping error, got %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if status := server1.GetMeta().Status; status != META_STATUS_BOOTSTRAPPING {
+		t.Fatalf("ready without quorum, status %s", status)
+	}
+
+	server2 := newServer("node2")
+	defer server2.Stop()
+	waitStatus(server1, META_STATUS_READYED)
+	waitStatus(server2, META_STATUS_READYED)
+}
+
+func TestServerBootstrapTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, func(c *Config) {
+		c.BootstrapNodes = []string{"node1", "node2"}
+		c.BootstrapTimeout = 1
+	})
+
+	for server.GetMeta().Status != META_STATUS_READYED {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("not ready after the bootstrap timeout, status %s", server.GetMeta().Status)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package nakamacluster
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/doublemo/nakama-cluster/api"
@@ -12,7 +14,9 @@ import (
 type Broadcast struct {
 	name     string
 	payload  *api.Frame
+	signer   *gossipSigner
 	finished chan struct{}
+	once     sync.Once
 }
 
 // Invalidates checks if enqueuing the current broadcast
@@ -29,13 +33,17 @@ func (b *Broadcast) Invalidates(other memberlist.Broadcast) bool {
 // Returns a byte form of the message
 func (b *Broadcast) Message() []byte {
 	bytes, _ := proto.Marshal(b.payload)
-	return bytes
+	return b.signer.sign(bytes)
 }
 
 // Finished is invoked when the message will no longer
 // be broadcast, either due to invalidation or to the
 // transmit limit being reached
 func (b *Broadcast) Finished() {
+	b.once.Do(func() {
+		api.ReleaseFrame(b.payload)
+	})
+
 	select {
 	case b.finished <- struct{}{}:
 	default:
@@ -83,3 +91,38 @@ func NewBroadcast(frame *api.Frame) *Broadcast {
 		finished: make(chan struct{}),
 	}
 }
+
+// newBroadcasts create broadcasts for the frame, frames larger than
+// the gossip packet size are split into chunks. The broadcasts take
+// ownership of the frame and release it when finished.
+func (s *Client) newBroadcasts(frame *api.Frame) []*Broadcast {
+	size := s.config.MaxGossipPacketSize - chunkOverhead
+	if s.signer != nil {
+		size -= len(gossipSignMagic) + gossipHeaderSize
+	}
+
+	if size < 1 || proto.Size(frame) <= size {
+		b := NewBroadcast(frame)
+		b.signer = s.signer
+		return []*Broadcast{b}
+	}
+
+	defer api.ReleaseFrame(frame)
+	frameBytes, err := proto.Marshal(frame)
+	if err != nil {
+		return nil
+	}
+
+	chunks := SplitChunks(frame.Id, frameBytes, size)
+	broadcasts := make([]*Broadcast, len(chunks))
+	for i, chunk := range chunks {
+		chunkFrame := api.AcquireFrame()
+		chunkFrame.Id = fmt.Sprintf("%s.%d", frame.Id, chunk.Index)
+		chunkFrame.Node = frame.Node
+		chunkFrame.Direct = frame.Direct
+		chunkFrame.Chunk = chunk
+		broadcasts[i] = NewBroadcast(chunkFrame)
+		broadcasts[i].signer = s.signer
+	}
+	return broadcasts
+}
@@ -0,0 +1,162 @@
+package nakamacluster
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	callerMetadataNodeId   = "nk-caller-id"
+	callerMetadataNodeName = "nk-caller-name"
+	callerMetadataTraceId  = "nk-trace-id"
+	callerMetadataEpoch    = "nk-caller-epoch"
+	callerMetadataProtocol = "nk-protocol"
+)
+
+type callerContextKey struct{}
+
+type traceContextKey struct{}
+
+// CallerInfo identity of the node that sent the request being served. The node is announced by
+// the caller in the request metadata and is advisory, only Verified tells the connection came
+// from the address of the node, check it before trusting the identity
+type CallerInfo struct {
+	// NodeId id of the calling node, empty when the caller did not announce itself
+	NodeId string
+
+	// NodeName service name of the calling node
+	NodeName string
+
+	// Epoch registration epoch of the calling node
+	Epoch int64
+
+	// ProtocolVersion protocol version of the caller, 0 when the caller is older than the
+	// versioning or did not announce it
+	ProtocolVersion uint32
+
+	// Node meta of the calling node, nil when the node is not known to the local peers
+	Node *Meta
+
+	// Verified reports whether the connection of the request came from an address of Node
+	Verified bool
+
+	// TraceId trace id propagated by the caller, a new one is made for every call without one
+	TraceId string
+
+	// Deadline deadline of the request, zero when it has none
+	Deadline time.Time
+
+	// Metadata gRPC metadata of the request
+	Metadata metadata.MD
+}
+
+// FromContext returns the caller of the request served with ctx
+func FromContext(ctx context.Context) (*CallerInfo, bool) {
+	caller, ok := ctx.Value(callerContextKey{}).(*CallerInfo)
+	return caller, ok && caller != nil
+}
+
+// WithTraceId set the trace id propagated to peers called with ctx
+func WithTraceId(ctx context.Context, traceId string) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, traceId)
+}
+
+// TraceIdFromContext returns the trace id set on ctx or received from the caller
+func TraceIdFromContext(ctx context.Context) (string, bool) {
+	if traceId, ok := ctx.Value(traceContextKey{}).(string); ok && traceId != "" {
+		return traceId, true
+	}
+
+	if caller, ok := FromContext(ctx); ok && caller.TraceId != "" {
+		return caller.TraceId, true
+	}
+	return "", false
+}
+
+// outgoingCallerContext attach the local node identity and the trace id to the outgoing gRPC metadata
+func outgoingCallerContext(ctx context.Context, local *Meta) context.Context {
+	traceId, ok := TraceIdFromContext(ctx)
+	if !ok {
+		traceId = uuid.Must(uuid.NewV4()).String()
+	}
+
+	kv := []string{callerMetadataTraceId, traceId, callerMetadataProtocol, strconv.FormatUint(uint64(ProtocolVersion), 10)}
+	if local != nil {
+		kv = append(kv, callerMetadataNodeId, local.Id, callerMetadataNodeName, local.Name, callerMetadataEpoch, strconv.FormatInt(local.Epoch, 10))
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// incomingCallerContext extract the caller from the incoming gRPC metadata of ctx
+func incomingCallerContext(ctx context.Context, peers Peer) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	caller := &CallerInfo{Metadata: md}
+	if v := md.Get(callerMetadataNodeId); len(v) > 0 {
+		caller.NodeId = v[0]
+		if node, ok := peers.Get(caller.NodeId); ok {
+			caller.Node = node
+			caller.Verified = fromNodeAddr(ctx, peers, node)
+		}
+	}
+
+	if v := md.Get(callerMetadataNodeName); len(v) > 0 {
+		caller.NodeName = v[0]
+	}
+
+	if v := md.Get(callerMetadataEpoch); len(v) > 0 {
+		caller.Epoch, _ = strconv.ParseInt(v[0], 10, 64)
+	}
+
+	if v := md.Get(callerMetadataProtocol); len(v) > 0 {
+		version, _ := strconv.ParseUint(v[0], 10, 32)
+		caller.ProtocolVersion = uint32(version)
+	}
+
+	if v := md.Get(callerMetadataTraceId); len(v) > 0 {
+		caller.TraceId = v[0]
+	}
+
+	caller.Deadline, _ = ctx.Deadline()
+	return context.WithValue(ctx, callerContextKey{}, caller)
+}
+
+// fromNodeAddr reports whether the connection of the request served with ctx came from the
+// address of the node, or from an address its dns name last resolved to
+func fromNodeAddr(ctx context.Context, peers Peer, node *Meta) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return false
+	}
+
+	remote, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(node.Addr)
+	if err != nil {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(net.ParseIP(remote))
+	}
+
+	if local, ok := peers.(*LocalPeer); ok {
+		if resolved, ok := local.resolved.Load(node.Id); ok {
+			for _, addr := range strings.Split(resolved.(string), ",") {
+				if net.ParseIP(addr).Equal(net.ParseIP(remote)) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
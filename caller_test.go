@@ -0,0 +1,65 @@
+package nakamacluster
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestIncomingCallerContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peers := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MessageQueueSize: 8})
+	peers.Sync(
+		&Meta{Id: "node1", Name: "svc", Addr: "10.0.0.1:7350", Status: META_STATUS_READYED},
+		&Meta{Id: "node2", Name: "svc", Addr: "svc-2.local:7350", Status: META_STATUS_READYED},
+	)
+	peers.resolved.Store("node2", "10.0.0.2,10.0.0.3")
+
+	caller := func(id, remote string) *CallerInfo {
+		local := &Meta{Id: id, Name: "svc", Epoch: 7}
+		md, _ := metadata.FromOutgoingContext(outgoingCallerContext(ctx, local))
+		in := metadata.NewIncomingContext(ctx, md)
+		in = peer.NewContext(in, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(remote), Port: 40000}})
+		info, ok := FromContext(incomingCallerContext(in, peers))
+		if !ok {
+			t.Fatal("caller missing")
+		}
+		return info
+	}
+
+	if info := caller("node1", "10.0.0.1"); info.Node == nil || !info.Verified || info.Epoch != 7 || info.TraceId == "" {
+		t.Fatalf("unexpected caller %+v", info)
+	}
+
+	if info := caller("node2", "10.0.0.3"); !info.Verified {
+		t.Fatal("caller from a resolved address of its dns name not verified")
+	}
+
+	// the announced identity is advisory, a caller elsewhere claiming a node is not verified
+	if info := caller("node1", "10.0.0.9"); info.NodeId != "node1" || info.Verified {
+		t.Fatalf("spoofed caller verified %+v", info)
+	}
+
+	if info := caller("node3", "10.0.0.1"); info.Node != nil || info.Verified {
+		t.Fatalf("unknown caller verified %+v", info)
+	}
+
+	// control commands are logged with the verified id or the announced one marked as such
+	callerOf := func(info *CallerInfo) string {
+		return controlCaller(context.WithValue(ctx, callerContextKey{}, info))
+	}
+
+	if id := callerOf(caller("node1", "10.0.0.1")); id != "node1" {
+		t.Fatalf("unexpected control caller %s", id)
+	}
+
+	if id := callerOf(caller("node1", "10.0.0.9")); id != "unverified:node1" {
+		t.Fatalf("unexpected control caller %s", id)
+	}
+}
@@ -0,0 +1,250 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/gofrs/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+// chunkOverhead reserved bytes for the frame header wrapped around each chunk
+const chunkOverhead = 256
+
+const (
+	defaultChunkMaxTotal = 16384    // chunks of a payload
+	defaultChunkMaxBytes = 64 << 20 // bytes of the incomplete payloads of a sender
+)
+
+var (
+	ErrChunkInvalid = errors.New("invalid chunk")
+
+	// ErrChunkLimit the payload has more chunks than allowed or the incomplete payloads
+	// of the sender hold too many bytes, the payload is dropped
+	ErrChunkLimit = errors.New("chunk limit exceeded")
+)
+
+type chunkEntry struct {
+	from     string
+	parts    [][]byte
+	received uint32
+	size     int
+	deadline time.Time
+}
+
+// ChunkBuffer reassemble chunks into the original payload, incomplete payloads are dropped
+// after the timeout. A payload may have at most maxTotal chunks and the incomplete payloads
+// of a sender at most maxBytes bytes, so a peer cannot make the buffer allocate without bound
+type ChunkBuffer struct {
+	ctx      context.Context
+	timeout  time.Duration
+	maxTotal uint32
+	maxBytes int
+	entries  map[string]*chunkEntry
+	pending  map[string]int
+	sync.Mutex
+}
+
+// Add stores the chunk and returns the payload once every chunk of it has arrived
+func (b *ChunkBuffer) Add(from string, chunk *api.Chunk) ([]byte, bool, error) {
+	if chunk.Total < 1 || chunk.Index >= chunk.Total {
+		return nil, false, ErrChunkInvalid
+	}
+
+	if chunk.Total > b.maxTotal {
+		return nil, false, ErrChunkLimit
+	}
+
+	k := from + "/" + chunk.Id
+	now := time.Now()
+	b.Lock()
+	defer b.Unlock()
+	entry, ok := b.entries[k]
+	if ok && now.After(entry.deadline) {
+		b.drop(k, entry)
+		ok = false
+	}
+
+	if !ok {
+		entry = &chunkEntry{
+			from:     from,
+			parts:    make([][]byte, chunk.Total),
+			deadline: now.Add(b.timeout),
+		}
+		b.entries[k] = entry
+	}
+
+	if int(chunk.Total) != len(entry.parts) {
+		b.drop(k, entry)
+		return nil, false, ErrChunkInvalid
+	}
+
+	if entry.parts[chunk.Index] != nil {
+		return nil, false, nil
+	}
+
+	if b.pending[from]+len(chunk.Data) > b.maxBytes {
+		b.expire(now)
+	}
+
+	if b.pending[from]+len(chunk.Data) > b.maxBytes {
+		b.drop(k, entry)
+		return nil, false, ErrChunkLimit
+	}
+
+	entry.parts[chunk.Index] = chunk.Data
+	entry.received++
+	entry.size += len(chunk.Data)
+	b.pending[from] += len(chunk.Data)
+	if entry.received < chunk.Total {
+		return nil, false, nil
+	}
+
+	b.drop(k, entry)
+	payload := make([]byte, 0, entry.size)
+	for _, part := range entry.parts {
+		payload = append(payload, part...)
+	}
+	return payload, true, nil
+}
+
+// expire drop the incomplete payloads past their deadline, b must be locked
+func (b *ChunkBuffer) expire(now time.Time) {
+	for k, entry := range b.entries {
+		if now.After(entry.deadline) {
+			b.drop(k, entry)
+		}
+	}
+}
+
+// drop remove the entry and release its bytes from the sender, b must be locked
+func (b *ChunkBuffer) drop(k string, entry *chunkEntry) {
+	delete(b.entries, k)
+	if b.pending[entry.from] -= entry.size; b.pending[entry.from] < 1 {
+		delete(b.pending, entry.from)
+	}
+}
+
+// AddEnvelope stores the envelope when it is a chunk and returns the
+// original envelope once every chunk of it has arrived
+func (b *ChunkBuffer) AddEnvelope(from string, in *api.Envelope) (*api.Envelope, bool, error) {
+	chunk := in.GetChunk()
+	if chunk == nil {
+		return in, true, nil
+	}
+
+	payload, ok, err := b.Add(from, chunk)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	var out api.Envelope
+	if err := proto.Unmarshal(payload, &out); err != nil {
+		return nil, false, err
+	}
+	return &out, true, nil
+}
+
+// Size returns the number of incomplete payloads
+func (b *ChunkBuffer) Size() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.entries)
+}
+
+func (b *ChunkBuffer) gc() {
+	t := time.NewTicker(b.timeout)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			b.Lock()
+			b.expire(now)
+			b.Unlock()
+
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// NewChunkBuffer create chunk buffer with the default limits, it is released when ctx is done
+func NewChunkBuffer(ctx context.Context, timeout time.Duration) *ChunkBuffer {
+	return NewChunkBufferWithLimits(ctx, timeout, 0, 0)
+}
+
+// NewChunkBufferWithLimits create chunk buffer accepting payloads of at most maxTotal chunks and
+// at most maxBytes bytes of incomplete payloads per sender, 0 uses the defaults
+func NewChunkBufferWithLimits(ctx context.Context, timeout time.Duration, maxTotal, maxBytes int) *ChunkBuffer {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	if maxTotal < 1 {
+		maxTotal = defaultChunkMaxTotal
+	}
+
+	if maxBytes < 1 {
+		maxBytes = defaultChunkMaxBytes
+	}
+
+	b := &ChunkBuffer{
+		ctx:      ctx,
+		timeout:  timeout,
+		maxTotal: uint32(maxTotal),
+		maxBytes: maxBytes,
+		entries:  make(map[string]*chunkEntry),
+		pending:  make(map[string]int),
+	}
+	go b.gc()
+	return b
+}
+
+// SplitChunks split the payload into chunks of at most size bytes
+func SplitChunks(id string, payload []byte, size int) []*api.Chunk {
+	if size < 1 {
+		size = len(payload)
+	}
+
+	total := (len(payload) + size - 1) / size
+	chunks := make([]*api.Chunk, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		chunks = append(chunks, &api.Chunk{
+			Id:    id,
+			Index: uint32(i),
+			Total: uint32(total),
+			Data:  payload[i*size : end],
+		})
+	}
+	return chunks
+}
+
+// SplitEnvelope split the envelope into chunk envelopes when it is larger than size bytes,
+// chunk envelopes are acquired from the pool and can be released once sent
+func SplitEnvelope(in *api.Envelope, size int) ([]*api.Envelope, error) {
+	if size <= chunkOverhead || proto.Size(in) <= size {
+		return []*api.Envelope{in}, nil
+	}
+
+	payload, err := proto.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := SplitChunks(uuid.Must(uuid.NewV4()).String(), payload, size-chunkOverhead)
+	envelopes := make([]*api.Envelope, len(chunks))
+	for i, chunk := range chunks {
+		envelopes[i] = api.AcquireEnvelope()
+		envelopes[i].Cid = in.Cid
+		envelopes[i].Payload = &api.Envelope_Chunk{Chunk: chunk}
+	}
+	return envelopes, nil
+}
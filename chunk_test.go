@@ -0,0 +1,121 @@
+package nakamacluster
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestChunkBuffer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	payload := bytes.Repeat([]byte("nakama-cluster"), 100)
+	chunks := SplitChunks("1", payload, 64)
+	buffer := NewChunkBuffer(ctx, time.Second)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		out, ok, err := buffer.Add("node1", chunks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != (i == 0) {
+			t.Fatalf("chunk %d: unexpected completion %v", i, ok)
+		}
+
+		if ok && !bytes.Equal(out, payload) {
+			t.Fatal("reassembled payload mismatch")
+		}
+	}
+
+	if buffer.Size() != 0 {
+		t.Fatalf("expected empty buffer, got %d", buffer.Size())
+	}
+
+	buffer.Add("node1", chunks[0])
+	time.Sleep(2500 * time.Millisecond)
+	if buffer.Size() != 0 {
+		t.Fatal("incomplete payload not dropped after timeout")
+	}
+}
+
+func TestSplitEnvelope(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := &api.Envelope{Cid: "1", Payload: &api.Envelope_Bytes{Bytes: bytes.Repeat([]byte{0x1}, 4096)}}
+	envelopes, err := SplitEnvelope(in, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(envelopes) < 2 {
+		t.Fatalf("expected chunks, got %d envelopes", len(envelopes))
+	}
+
+	buffer := NewChunkBuffer(ctx, time.Second)
+	var out *api.Envelope
+	for _, envelope := range envelopes {
+		if m, ok, err := buffer.AddEnvelope("", envelope); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			out = m
+		}
+	}
+
+	if !proto.Equal(in, out) {
+		t.Fatal("reassembled envelope mismatch")
+	}
+}
+
+func TestChunkBufferLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buffer := NewChunkBufferWithLimits(ctx, time.Minute, 4, 100)
+	if _, _, err := buffer.Add("node1", &api.Chunk{Id: "1", Index: 0, Total: 1 << 30, Data: []byte{0x1}}); err != ErrChunkLimit {
+		t.Fatalf("expected ErrChunkLimit for a huge total, got %v", err)
+	}
+
+	if buffer.Size() != 0 {
+		t.Fatalf("expected empty buffer, got %d", buffer.Size())
+	}
+
+	// the incomplete payloads of a sender share its byte budget
+	chunks := SplitChunks("2", bytes.Repeat([]byte{0x1}, 240), 60)
+	for _, chunk := range chunks[:1] {
+		if _, _, err := buffer.Add("node1", chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := SplitChunks("3", bytes.Repeat([]byte{0x2}, 240), 60)
+	if _, _, err := buffer.Add("node1", other[0]); err != ErrChunkLimit {
+		t.Fatalf("expected ErrChunkLimit over the byte budget, got %v", err)
+	}
+
+	if _, _, err := buffer.Add("node2", other[0]); err != nil {
+		t.Fatalf("the budget of another sender is not shared: %v", err)
+	}
+
+	// an expired incomplete payload is replaced and releases its bytes
+	buffer.Lock()
+	for _, entry := range buffer.entries {
+		entry.deadline = time.Now().Add(-time.Second)
+	}
+	buffer.Unlock()
+	if _, _, err := buffer.Add("node1", other[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer.Lock()
+	pending := buffer.pending["node1"]
+	buffer.Unlock()
+	if pending != len(other[0].Data) {
+		t.Fatalf("expected the expired bytes released, got %d pending", pending)
+	}
+}
@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/doublemo/nakama-cluster/api"
 	"github.com/doublemo/nakama-cluster/sd"
+	"github.com/gofrs/uuid"
 	"github.com/hashicorp/memberlist"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -26,6 +29,9 @@ var (
 	ErrMessageNotWaitReply = errors.New("invalid message")
 	ErrMessageSendFailed   = errors.New("failed message send to node")
 	ErrNodeNotFound        = errors.New("not found")
+	ErrInvalidHops         = errors.New("invalid hops")
+	ErrStreamClosed        = errors.New("stream closed")
+	ErrGossipDisabled      = errors.New("gossip disabled")
 )
 
 type Client struct {
@@ -35,21 +41,85 @@ type Client struct {
 	incomingCh       chan *Message
 	peers            Peer
 	nodes            map[string]*memberlist.Node
+	announced        map[string]*Meta
+	notifyMu         sync.Mutex
 	memberlist       *memberlist.Memberlist
 	messageQueue     *memberlist.TransmitLimitedQueue
+	relayQueue       *memberlist.TransmitLimitedQueue
 	messageWaitQueue sync.Map
 	messageSeq       *MessageSeq
 	messageCursor    *MessageCursor
+	chunks           *ChunkBuffer
+	sendPool         *KeyedWorkerPool
+	notifyPool       *KeyedWorkerPool
+	signer           *gossipSigner
+	sessions         *SessionStore
+	flags            *Flags
+	cordons          *CordonList
+	kafka            *KafkaSink
+	traces           *TraceBuffer
+	outbox           *Outbox
+	overload         *OverloadController
+	watchdog         *watchdog
+	conflicts        *conflictHandler
+	varSchema        VarSchema
+	lifecycle        *lifecycle
+	bootstrap        *bootstrapCoordinator
+	ready            *readiness
+	audit            *AuditLog
+	control          *controlHandler
 	wathcer          *Watcher
 	meta             atomic.Value
 	delegate         atomic.Value
+	states           sync.Map
+	onBroadcast      sync.Map
+	onBroadcastId    uint64
+	events           *EventBus
+	metrics          *Metrics
 	logger           *zap.Logger
 	once             sync.Once
 	sync.Mutex
 }
 
+// OnDelegate set the delegate, the nakama nodes that already joined are replayed to it as
+// NotifyJoin calls before it gets any later notification, so a delegate set after startup
+// misses no join and sees no leave of a node it was not told about
 func (s *Client) OnDelegate(delegate Delegate) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
 	s.delegate.Store(delegate)
+	for _, node := range s.joinedNodes() {
+		delegate.NotifyJoin(node)
+	}
+}
+
+// Events returns the cluster event bus
+func (s *Client) Events() *EventBus {
+	return s.events
+}
+
+// WaitReady block until the nodes were read from sd and the local node registered and joined the gossip, so
+// sends do not race an empty peer table. A *ReadyError naming the pending steps is returned
+// when ctx is done or a step gave up first
+func (s *Client) WaitReady(ctx context.Context) error {
+	return s.ready.wait(ctx)
+}
+
+// OnBroadcast add f invoked for every broadcast sent by the local node or received from other
+// nodes, every listener added is invoked until the returned function removes it
+func (s *Client) OnBroadcast(f func(node string, in *api.Envelope)) func() {
+	id := atomic.AddUint64(&s.onBroadcastId, 1)
+	s.onBroadcast.Store(id, f)
+	return func() {
+		s.onBroadcast.Delete(id)
+	}
+}
+
+func (s *Client) notifyBroadcast(node string, in *api.Envelope) {
+	s.onBroadcast.Range(func(key, value any) bool {
+		value.(func(node string, in *api.Envelope))(node, in)
+		return true
+	})
 }
 
 func (s *Client) GetMeta() *Meta {
@@ -61,17 +131,113 @@ func (s *Client) GetMeta() *Meta {
 	return meta.Clone()
 }
 
+// Outbox returns the outbox, nil when no outbox storage was set with WithOutbox
+func (s *Client) Outbox() *Outbox {
+	return s.outbox
+}
+
+// Sessions returns the session ownership store
+func (s *Client) Sessions() *SessionStore {
+	return s.sessions
+}
+
+// Flags returns the cluster-wide flags
+func (s *Client) Flags() *Flags {
+	return s.flags
+}
+
+// Cordons returns the cordon list of the cluster
+func (s *Client) Cordons() *CordonList {
+	return s.cordons
+}
+
+// GetLocalNode returns the memberlist node of the client, without gossip it only has the name and meta
 func (s *Client) GetLocalNode() *memberlist.Node {
+	if s.memberlist == nil {
+		meta := s.GetMeta()
+		b, _ := meta.Marshal()
+		return &memberlist.Node{Name: meta.Id, Meta: b}
+	}
 	return s.memberlist.LocalNode()
 }
 
+// NewSharding create sharding of the service of the node, it runs until the node stops
+func (s *Client) NewSharding(options ShardingOptions) *Sharding {
+	return NewSharding(s.ctx, s.logger, s.wathcer.sdClient, s.config.Prefix, s.peers, s.events, s.GetMeta, options)
+}
+
+// UpdateMeta change the status and vars of the node, the status must be a legal
+// transition from the current one. The change is gossiped and written to sd.
 func (s *Client) UpdateMeta(status MetaStatus, vars map[string]string) error {
 	meta := s.GetMeta()
+	if s.bootstrap.pending() && status.Routable() {
+		return ErrBootstrapping
+	}
+
+	if err := meta.Status.CheckTransition(status); err != nil {
+		return err
+	}
+
+	vars, err := protectReservedVars(meta.Vars, vars)
+	if err != nil {
+		return err
+	}
+
+	if err := s.varSchema.Check(vars); err != nil {
+		return err
+	}
+
 	meta.Status = status
 	meta.Vars = vars
+	meta.Version++
 	s.meta.Store(meta)
+	s.peers.Merge(meta)
 
-	return s.memberlist.UpdateNode(time.Second * 30)
+	s.audit.Record(AUDIT_STATUS, AUDIT_INITIATOR_LOCAL, meta.Id, map[string]string{"status": status.String(), "version": strconv.FormatUint(meta.Version, 10)})
+	if s.memberlist != nil {
+		if err := s.memberlist.UpdateNode(time.Second * 30); err != nil {
+			return err
+		}
+	}
+	return s.updateSd(meta)
+}
+
+// SetMaintenance move the node in or out of maintenance, nodes in maintenance get
+// no traffic but keep gossiping and answering control envelopes
+func (s *Client) SetMaintenance(on bool) error {
+	return setMaintenance(s.GetMeta(), on, s.UpdateMeta)
+}
+
+// SetLogLevel set the level of the logger of the node created WithLogLevel,
+// the previous level is restored after ttl when it is positive
+func (s *Client) SetLogLevel(level zapcore.Level, ttl time.Duration) error {
+	return s.control.setLevel(level, ttl)
+}
+
+// BroadcastLogLevel set the log level of every node sharing the control key like SetLogLevel,
+// nakama nodes get it through gossip and service nodes over grpc
+func (s *Client) BroadcastLogLevel(level zapcore.Level, ttl time.Duration) error {
+	in, err := s.control.broadcastLevel(level, ttl)
+	if err != nil {
+		return err
+	}
+	return s.Broadcast(NewMessage(in))
+}
+
+// UpdateLabels replace the node labels, the change is gossiped and written to sd
+func (s *Client) UpdateLabels(labels map[string]string) error {
+	meta := s.GetMeta()
+	meta.Labels = cloneStringMap(labels)
+	meta.Version++
+	s.meta.Store(meta)
+	s.peers.Merge(meta)
+
+	if s.memberlist != nil {
+		if err := s.memberlist.UpdateNode(time.Second * 30); err != nil {
+			return err
+		}
+	}
+	return s.updateSd(meta)
 }
 
 func (s *Client) GetNodesByNakama() []string {
@@ -83,19 +249,82 @@ func (s *Client) GetNodesByNakama() []string {
 	return nodes
 }
 
+// join the gossip of the nakama nodes retrying failed joins, the joined event is published
+// once the node is also registered in sd. A node without nakama nodes to join starts the gossip,
+// observers wait for one
+func (s *Client) join(retry joinRetry) {
+	join := func() error {
+		nodes := s.GetNodesByNakama()
+		switch {
+		case s.memberlist == nil:
+			return nil
+		case len(nodes) < 1 && s.Observer():
+			return fmt.Errorf("nakama %w", ErrNodeNotFound)
+		case len(nodes) < 1:
+			return nil
+		}
+
+		_, err := s.memberlist.Join(nodes)
+		return err
+	}
+
+	err := retry.do(s.ctx, s.logger, "gossip", func() error {
+		err := join()
+		s.ready.report(READY_STEP_GOSSIP, err)
+		return err
+	})
+	if err != nil {
+		s.logger.Warn("Failed to join cluster", zap.Error(err))
+		s.ready.fail(READY_STEP_GOSSIP, err)
+		return
+	}
+
+	s.ready.done(READY_STEP_GOSSIP)
+	select {
+	case <-s.wathcer.Registered():
+		s.ready.done(READY_STEP_REGISTER)
+		s.events.Publish(Event{Type: EVENT_CLUSTER_JOINED, Node: s.GetMeta()})
+	case <-s.wathcer.registerFailed:
+		s.ready.fail(READY_STEP_REGISTER, s.wathcer.RegisterError())
+	case <-s.ctx.Done():
+	}
+}
+
 func (s *Client) Broadcast(msg *Message) error {
+	if s.memberlist == nil {
+		return ErrGossipDisabled
+	}
+
 	select {
 	case s.incomingCh <- msg:
 	default:
+		s.metrics.GossipDropped("outbound")
 		return ErrMessageQueueFull
 	}
 	return nil
 }
 
+// BroadcastTTL broadcast the envelope through gossip, every node that receives it
+// relays it to its own gossip targets until it has travelled hops hops
+func (s *Client) BroadcastTTL(in *api.Envelope, hops int) error {
+	if hops < 1 {
+		return ErrInvalidHops
+	}
+
+	msg := NewMessage(in)
+	msg.hops = hops
+	return s.Broadcast(msg)
+}
+
 func (s *Client) Send(msg *Message, to ...string) ([]*api.Envelope, error) {
+	if s.memberlist == nil {
+		return nil, ErrGossipDisabled
+	}
+
 	select {
 	case s.incomingCh <- msg:
 	default:
+		s.metrics.GossipDropped("outbound")
 		return nil, ErrMessageQueueFull
 	}
 
@@ -117,11 +346,11 @@ func (s *Client) RPCCall(ctx context.Context, name, key, cid string, vars map[st
 		return nil, ErrNodeNotFound
 	}
 
-	request := &api.Envelope{
-		Cid:     cid,
-		Payload: &api.Envelope_Bytes{Bytes: in},
-		Vars:    vars,
-	}
+	request := api.AcquireEnvelope()
+	request.Cid = cid
+	request.Payload = &api.Envelope_Bytes{Bytes: in}
+	request.Vars = vars
+	defer api.ReleaseEnvelope(request)
 
 	out, err := s.peers.Send(ctx, node, request)
 	if err != nil {
@@ -132,25 +361,76 @@ func (s *Client) RPCCall(ctx context.Context, name, key, cid string, vars map[st
 }
 
 func (s *Client) Stop() {
+	if err := s.StopContext(context.Background()); err != nil {
+		s.logger.Warn("Lifecycle hook failed", zap.Error(err))
+	}
+}
+
+// StopContext stop the client like Stop and return the first error of the leave and stop hooks
+func (s *Client) StopContext(ctx context.Context) error {
+	var err error
 	s.once.Do(func() {
 		if s.cancelFn != nil {
-			s.wathcer.Stop()
-			s.cancelFn()
+			err = s.lifecycle.stop(ctx, func() {
+				s.wathcer.Stop()
+				s.cancelFn()
+				unregisterGossipMetrics(s.GetMeta().Id)
+			})
 		}
 	})
+	return err
 }
 
 func (s *Client) onUpdate(metas []*Meta) {
+	s.peers.Sync(s.validNodes(metas)...)
+	if drained, ok := sdDrain(s.GetMeta(), metas); ok {
+		s.adoptDrain(drained)
+	}
+}
+
+// adoptDrain take the drain written to sd by an operator, the version moves past the one in sd
+// so the next update of the node neither overwrites the drain nor reuses its version
+func (s *Client) adoptDrain(drained *Meta) {
+	meta := s.GetMeta()
+	meta.Version = drained.Version
+	s.meta.Store(meta)
+	if err := s.UpdateMeta(META_STATUS_DRAINING, meta.Vars); err != nil {
+		s.logger.Warn("Failed to take the drain of sd", zap.Error(err))
+	}
+}
+
+// validNodes returns the nodes of metas the local node may route to
+func (s *Client) validNodes(metas []*Meta) []*Meta {
 	newMetas := make([]*Meta, 0, len(metas))
 	for _, meta := range metas {
-		if meta.Type == NODE_TYPE_MICROSERVICES && meta.Name == NAKAMA {
+		if meta.Type != NODE_TYPE_NAKAMA && meta.Name == NAKAMA {
 			s.logger.Warn("Invalid node name", zap.String("ID", meta.Id))
 			continue
 		}
 
+		if err := CheckProtocolVersion(meta.ProtocolVersion); err != nil {
+			s.logger.Warn("Invalid node protocol version", zap.String("ID", meta.Id), zap.Error(err))
+			continue
+		}
+
+		if err := CheckCluster(s.config.ClusterName, meta); err != nil {
+			s.logger.Error("Node of another cluster", zap.String("ID", meta.Id), zap.Error(err))
+			continue
+		}
+
+		if err := CheckNodeType(meta); err != nil {
+			s.logger.Warn("Invalid node type", zap.String("ID", meta.Id), zap.Error(err))
+			continue
+		}
+
+		if err := s.varSchema.Check(meta.Vars); err != nil {
+			s.logger.Warn("Invalid node vars", zap.String("ID", meta.Id), zap.Error(err))
+			continue
+		}
+
 		newMetas = append(newMetas, meta)
 	}
-	s.peers.Sync(newMetas...)
+	return newMetas
 }
 
 func (s *Client) processIncoming() {
@@ -162,12 +442,12 @@ func (s *Client) processIncoming() {
 			}
 
 			toSize := len(message.To())
-			frame := api.Frame{
-				Id:       message.ID().String(),
-				Node:     s.GetLocalNode().Name,
-				Envelope: message.Payload(),
-				Direct:   api.Frame_Send,
-			}
+			frame := api.AcquireFrame()
+			frame.Id = message.ID().String()
+			frame.Node = s.GetLocalNode().Name
+			frame.Envelope = message.Payload()
+			frame.Direct = api.Frame_Send
+			stampEnvelopeVersion(frame.Envelope)
 
 			if toSize < 1 {
 				frame.Direct = api.Frame_Broadcast
@@ -176,9 +456,21 @@ func (s *Client) processIncoming() {
 
 			switch frame.Direct {
 			case api.Frame_Broadcast:
-				broadcast := NewBroadcast(&frame)
 				// to udp
-				s.messageQueue.QueueBroadcast(broadcast)
+				s.kafka.PublishEnvelope("", frame.Envelope)
+				s.traces.Record(TRACE_OUT, TRACE_GOSSIP, "", frame.Envelope)
+				if sendToTarget(frame.Envelope, frame.Node) {
+					s.notifyBroadcast(frame.Node, frame.Envelope)
+				}
+				queue := s.messageQueue
+				if message.hops > 0 {
+					frame.Hops = uint32(message.hops)
+					queue = s.relayQueue
+				}
+
+				for _, broadcast := range s.newBroadcasts(frame) {
+					queue.QueueBroadcast(broadcast)
+				}
 
 				// stat
 
@@ -194,19 +486,30 @@ func (s *Client) processIncoming() {
 					}
 
 					frame.SeqID = s.messageSeq.NextID(node)
-					messageBytes, err := proto.Marshal(&frame)
+					s.kafka.PublishEnvelope(node, frame.Envelope)
+					s.traces.Record(TRACE_OUT, TRACE_GOSSIP, node, frame.Envelope)
+					messageBytes, err := proto.Marshal(frame)
 					if err != nil {
 						message.SendErr(err)
 						continue
 					}
 
-					if err := s.memberlist.SendReliable(memberlistNode, messageBytes); err != nil {
+					// sends to a node run on the same worker so they keep their order
+					err = s.sendPool.Submit(s.ctx, node, func() {
+						if err := s.memberlist.SendReliable(memberlistNode, s.signer.sign(messageBytes)); err != nil {
+							message.SendErr(err)
+						}
+					})
+
+					if err != nil {
 						message.SendErr(err)
 						continue
 					}
 				}
+				api.ReleaseFrame(frame)
 
 			default:
+				api.ReleaseFrame(frame)
 				continue
 			}
 
@@ -216,78 +519,422 @@ func (s *Client) processIncoming() {
 	}
 }
 
-func NewClient(ctx context.Context, logger *zap.Logger, sdclient sd.Client, id string, vars map[string]string, config Config) *Client {
+// sendDirect send the envelope to the node over the reliable memberlist
+// transport without waiting for a reply
+func (s *Client) sendDirect(ctx context.Context, node string, in *api.Envelope) error {
+	done, err := s.submitDirect(ctx, node, in)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// submitDirect queue the send of the envelope to the node on the send pool, the
+// returned channel receives the result of the send
+func (s *Client) submitDirect(ctx context.Context, node string, in *api.Envelope) (<-chan error, error) {
+	if s.memberlist == nil {
+		return nil, ErrGossipDisabled
+	}
+
+	s.Lock()
+	memberlistNode, ok := s.nodes[node]
+	s.Unlock()
+	if !ok || memberlistNode == nil {
+		return nil, fmt.Errorf("node %s %w", node, ErrNodeNotFound)
+	}
+
+	stampEnvelopeVersion(in)
+	s.traces.Record(TRACE_OUT, TRACE_GOSSIP, node, in)
+	frame := api.AcquireFrame()
+	frame.Id = uuid.Must(uuid.NewV4()).String()
+	frame.Node = s.GetLocalNode().Name
+	frame.SeqID = s.messageSeq.NextID(node)
+	frame.Envelope = in
+	frame.Direct = api.Frame_Send
+	messageBytes, err := proto.Marshal(frame)
+	frame.Envelope = nil
+	api.ReleaseFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	if err := s.sendPool.Submit(ctx, node, func() {
+		done <- s.memberlist.SendReliable(memberlistNode, s.signer.sign(messageBytes))
+	}); err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+func NewClient(ctx context.Context, logger *zap.Logger, sdclient sd.Client, id string, vars map[string]string, config Config, opts ...Option) *Client {
 	var err error
 	ctx, cancel := context.WithCancel(ctx)
+	o := newOptions(opts...)
+	metrics := NewMetrics(o.metricsScope)
+	events := NewEventBus(ctx, config.BroadcastQueueSize)
+	traces := NewTraceBuffer(config.TraceBufferSize, config.TraceSampleRate)
+	var kafka *KafkaSink
+	if o.kafka != nil {
+		kafka = NewKafkaSink(ctx, logger, o.kafka, KafkaSinkOptions{
+			EventsTopic:    config.KafkaEventsTopic,
+			EnvelopesTopic: config.KafkaEnvelopesTopic,
+			Routes:         config.KafkaRoutes,
+			BatchSize:      config.KafkaBatchSize,
+			BatchTimeout:   time.Duration(config.KafkaBatchTimeout) * time.Millisecond,
+			QueueSize:      config.KafkaQueueSize,
+		}, metrics)
+		events.Subscribe(kafka.PublishEvent)
+	}
+
+	audit := newAuditLog(ctx, logger, o.audit, config, id, metrics)
+	if audit != nil {
+		events.Subscribe(audit.recordEvent)
+	}
+
+	strategy, err := NewStrategy(config.SendStrategy)
+	if err != nil {
+		logger.Fatal("Invalid send strategy", zap.Error(err))
+	}
+
+	ring := RingOptions{Hash: config.RingHash, VirtualNodes: config.RingVirtualNodes}
+	if err := CheckRingOptions(ring); err != nil {
+		logger.Fatal("Invalid ring hash", zap.Error(err))
+	}
+
+	for name, ring := range o.rings {
+		if err := CheckRingOptions(ring); err != nil {
+			logger.Fatal("Invalid ring hash", zap.Error(err), zap.String("service", name))
+		}
+	}
+
+	throttle := o.throttle
+	if throttle == nil && (config.EgressNodeRate > 0 || config.EgressRate > 0) {
+		throttle = NewThrottle(config.EgressNodeRate, config.EgressRate)
+	}
+
+	// nakama nodes serve no replay requests, the journal of WithJournal is kept by service nodes only
+	if o.journal != nil {
+		logger.Warn("Journal ignored, only service nodes keep a journal")
+	}
 	meta := NewNodeMetaFromConfig(id, NAKAMA, NODE_TYPE_NAKAMA, vars, config)
+	registered := meta
+	if o.observer {
+		meta = NewNodeMetaFromConfig(id, OBSERVER, NODE_TYPE_OBSERVER, vars, config)
+		registered = nil
+	}
+	bootstrap := newBootstrapCoordinator(config)
+	if bootstrap != nil {
+		meta.Status = META_STATUS_BOOTSTRAPPING
+	}
+
+	if err := checkLocalVars(config, meta); err != nil {
+		logger.Fatal("Invalid node vars", zap.Error(err))
+	}
 	addr := "0.0.0.0"
 	if config.Addr != "" {
 		addr = config.Addr
 	}
 
-	s := &Client{
+	peerTLS, err := newPeerTLS(config)
+	if err != nil {
+		logger.Fatal("Failed load peer tls", zap.Error(err))
+	}
+
+	var s *Client
+	localMeta := func() *Meta { return s.GetMeta() }
+	source := func() ([]*Meta, error) {
+		metas, err := s.wathcer.GetEntries()
+		if err != nil {
+			return nil, err
+		}
+		return s.validNodes(metas), nil
+	}
+	s = &Client{
 		ctx:        ctx,
 		cancelFn:   cancel,
 		logger:     logger,
 		config:     &config,
+		varSchema:  config.VarSchema,
 		incomingCh: make(chan *Message, config.BroadcastQueueSize),
 		peers: NewPeer(ctx, logger, PeerOptions{
-			MaxIdle:              config.GrpcPoolMaxIdle,
-			MaxActive:            config.GrpcPoolMaxActive,
-			MaxConcurrentStreams: config.GrpcPoolMaxConcurrentStreams,
-			Reuse:                config.GrpcPoolReuse,
+			Connections:          config.GrpcPoolSize,
+			DialTimeout:          time.Duration(config.GrpcDialTimeout) * time.Second,
+			TLS:                  peerTLS,
+			Dialer:               o.dialer,
+			DialOptions:          o.dialOptions,
 			MessageQueueSize:     config.MaxGossipPacketSize,
+			MaxStreamMessageSize: config.MaxStreamMessageSize,
+			ChunkTimeout:         time.Duration(config.ChunkTimeout) * time.Second,
+			ChunkMaxTotal:        config.ChunkMaxTotal,
+			ChunkMaxBytes:        config.ChunkMaxBytes,
+			AsyncWorkers:         config.AsyncSendWorkers,
+			AsyncQueueSize:       config.AsyncSendQueueSize,
+			Timeout:              time.Duration(config.RPCTimeout) * time.Millisecond,
+			ResolveInterval:      time.Duration(config.ResolveInterval) * time.Second,
+			Namespace:            config.Namespace,
+			Events:               events,
+			Kafka:                kafka,
+			Traces:               traces,
+			LocalMeta:            localMeta,
+			Source:               source,
+			Strategy:             strategy,
+			Strategies:           o.strategies,
+			Throttle:             throttle,
+			StreamIdleTimeout:    time.Duration(config.StreamIdleTimeout) * time.Second,
+			StreamTTL:            time.Duration(config.StreamTTL) * time.Second,
+			StreamStatsRetention: time.Duration(config.StreamStatsRetention) * time.Second,
+			StreamCoalesceLinger: time.Duration(config.StreamCoalesceLinger) * time.Microsecond,
+			HeartbeatInterval:    time.Duration(config.HeartbeatInterval) * time.Second,
+			HeartbeatQuarantine:  heartbeatQuarantine(config),
+			PoolLeakThreshold:    time.Duration(config.GrpcPoolLeakThreshold) * time.Second,
+			Compression:          grpcCompression(logger, config),
+			CompressionMinSize:   config.GrpcCompressionMinSize,
+			Ring:                 ring,
+			Rings:                o.rings,
+			Services:             o.services,
+			RingVars:             config.RingVars,
+			KeyMappers:           o.keyMappers,
+			FlapThreshold:        config.FlapThreshold,
+			FlapWindow:           time.Duration(config.FlapWindow) * time.Second,
+			FlapCooldown:         time.Duration(config.FlapCooldown) * time.Second,
+			Metrics:              metrics,
 		}),
 		messageSeq:    NewMessageSeq(),
 		messageCursor: NewMessageCursor(64),
+		chunks:        NewChunkBufferWithLimits(ctx, time.Duration(config.ChunkTimeout)*time.Second, config.ChunkMaxTotal, config.ChunkMaxBytes),
+		sendPool:      NewKeyedWorkerPool(ctx, "send", config.SendWorkers, config.SendQueueSize, metrics),
 		nodes:         make(map[string]*memberlist.Node),
+		announced:     make(map[string]*Meta),
+		events:        events,
+		kafka:         kafka,
+		traces:        traces,
+		lifecycle:     newLifecycle(logger, o),
+		bootstrap:     bootstrap,
+		metrics:       metrics,
 	}
 
 	s.meta.Store(meta)
-	memberlistConfig := memberlist.DefaultLocalConfig()
-	memberlistConfig.BindAddr = addr
-	memberlistConfig.BindPort = config.Port
-	memberlistConfig.PushPullInterval = time.Duration(config.PushPullInterval) * time.Second
-	memberlistConfig.GossipInterval = time.Duration(config.GossipInterval) * time.Millisecond
-	memberlistConfig.ProbeInterval = time.Duration(config.ProbeInterval) * time.Second
-	memberlistConfig.ProbeTimeout = time.Duration(config.ProbeTimeout) * time.Millisecond
-	memberlistConfig.UDPBufferSize = config.MaxGossipPacketSize
-	memberlistConfig.TCPTimeout = time.Duration(config.TCPTimeout) * time.Second
-	memberlistConfig.RetransmitMult = config.RetransmitMult
-	memberlistConfig.Name = id
-	memberlistConfig.Ping = s
-	memberlistConfig.Delegate = s
-	memberlistConfig.Events = s
-	memberlistConfig.Alive = s
-	memberlistConfig.Logger = log.New(os.Stdout, "nakama-cluster", 0)
-
-	if !logger.Core().Enabled(zapcore.DebugLevel) {
-		memberlistConfig.Logger.SetOutput(io.Discard)
-	}
-
-	s.messageQueue = &memberlist.TransmitLimitedQueue{
-		NumNodes: func() int {
-			return s.memberlist.NumMembers()
+	s.audit = audit
+	s.control = &controlHandler{
+		key:    []byte(config.ControlKey),
+		level:  o.logLevel,
+		local:  s.GetMeta,
+		update: s.UpdateMeta,
+		peers:  s.peers,
+		resync: func() { s.wathcer.update() },
+		traces: traces,
+		audit:  audit,
+		logger: logger,
+	}
+	s.sessions = NewSessionStore(s)
+	s.flags = NewFlags(s)
+	s.flags.audit = audit
+	s.control.flags = s.flags
+	s.cordons = newCordonList(ctx, logger, sdclient, config.Prefix, s.peers)
+	s.control.cordons = s.cordons
+	if config.NotifyWorkers > 0 {
+		s.notifyPool = NewKeyedWorkerPool(ctx, "notify", config.NotifyWorkers, config.NotifyQueueSize, metrics)
+	}
+
+	s.signer = newGossipSigner(config.GossipSigningKey, time.Duration(config.GossipReplayWindow)*time.Second)
+	s.overload = newOverloadController(ctx, config, s.peers, metrics)
+	s.watchdog = newWatchdog(config, logger, metrics)
+	if o.outbox != nil {
+		s.outbox = NewOutbox(ctx, logger, o.outbox, s.peers, OutboxOptions{
+			RetryInterval: time.Duration(config.OutboxRetryInterval) * time.Second,
+			TTL:           time.Duration(config.OutboxTTL) * time.Second,
+		}, metrics)
+	}
+	s.overload.Watch("send", poolDepth(s.sendPool))
+	if s.notifyPool != nil {
+		s.overload.Watch("notify", poolDepth(s.notifyPool))
+	}
+
+	if !config.GossipDisabled {
+		memberlistConfig := memberlist.DefaultLocalConfig()
+		memberlistConfig.BindAddr = addr
+		memberlistConfig.BindPort = config.Port
+		if config.AdvertiseAddr != "" || config.AdvertisePort > 0 {
+			memberlistConfig.AdvertiseAddr, memberlistConfig.AdvertisePort, err = advertiseAddr(config)
+			if err != nil {
+				logger.Fatal("Failed to resolve advertise address", zap.Error(err), zap.String("addr", config.AdvertiseAddr))
+			}
+		}
+		memberlistConfig.PushPullInterval = time.Duration(config.PushPullInterval) * time.Second
+		memberlistConfig.GossipInterval = time.Duration(config.GossipInterval) * time.Millisecond
+		memberlistConfig.ProbeInterval = time.Duration(config.ProbeInterval) * time.Second
+		memberlistConfig.ProbeTimeout = time.Duration(config.ProbeTimeout) * time.Millisecond
+		memberlistConfig.UDPBufferSize = config.MaxGossipPacketSize
+		memberlistConfig.TCPTimeout = time.Duration(config.TCPTimeout) * time.Second
+		memberlistConfig.RetransmitMult = config.RetransmitMult
+		memberlistConfig.GossipToTheDeadTime = time.Duration(config.GossipToTheDeadTime) * time.Second
+		memberlistConfig.EnableCompression = config.GossipCompression
+		if config.GossipNodes > 0 {
+			memberlistConfig.GossipNodes = config.GossipNodes
+		}
+
+		if config.IndirectChecks > 0 {
+			memberlistConfig.IndirectChecks = config.IndirectChecks
+		}
+
+		if config.SuspicionMult > 0 {
+			memberlistConfig.SuspicionMult = config.SuspicionMult
+		}
+
+		if config.SuspicionMaxTimeoutMult > 0 {
+			memberlistConfig.SuspicionMaxTimeoutMult = config.SuspicionMaxTimeoutMult
+		}
+
+		if config.AwarenessMaxMultiplier > 0 {
+			memberlistConfig.AwarenessMaxMultiplier = config.AwarenessMaxMultiplier
+		}
+		if o.transport != nil {
+			// the node is joined at the address of the transport instead of the bind address
+			ip, port, err := o.transport.FinalAdvertiseAddr(memberlistConfig.AdvertiseAddr, memberlistConfig.AdvertisePort)
+			if err != nil {
+				logger.Fatal("Failed to resolve transport address", zap.Error(err))
+			}
+			meta.Addr = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			memberlistConfig.Transport = o.transport
+		}
+		memberlistConfig.Name = id
+		memberlistConfig.Label = config.Namespace
+		memberlistConfig.Ping = s
+		memberlistConfig.Delegate = s
+		memberlistConfig.Events = s
+		memberlistConfig.Alive = s
+		memberlistConfig.Merge = s
+		memberlistConfig.Conflict = s
+		memberlistConfig.Logger = log.New(os.Stdout, "nakama-cluster", 0)
+		if o.metricsScope != nil && config.GossipMetrics {
+			memberlistConfig.MetricLabels = registerGossipMetrics(id, metrics.scope)
+		}
+
+		if !logger.Core().Enabled(zapcore.DebugLevel) {
+			memberlistConfig.Logger.SetOutput(io.Discard)
+		}
+
+		s.messageQueue = &memberlist.TransmitLimitedQueue{
+			NumNodes: func() int {
+				return s.memberlist.NumMembers()
+			},
+
+			RetransmitMult: config.RetransmitMult,
+		}
+
+		s.relayQueue = &memberlist.TransmitLimitedQueue{
+			NumNodes: func() int {
+				return s.memberlist.NumMembers()
+			},
+
+			RetransmitMult: config.RelayRetransmitMult,
+		}
+		s.memberlist, err = memberlist.Create(memberlistConfig)
+		if err != nil {
+			logger.Fatal("Failed to create memberlist", zap.Error(err))
+		}
+	} else {
+		// without gossip the delegate learns about the nakama nodes from sd
+		events.Subscribe(s.notifyEvent)
+	}
+
+	if err := s.lifecycle.run(ctx, stageStart); err != nil {
+		logger.Fatal("Failed to start node", zap.Error(err))
+	}
+
+	if err := checkClusterOnStart(sdclient, config.Prefix, meta); err != nil {
+		logger.Fatal("Failed to register node", zap.Error(err))
+	}
+
+	if err := checkDuplicateOnStart(sdclient, config.Prefix, config.DuplicateIdPolicy, meta); err != nil {
+		logger.Fatal("Failed to register node", zap.Error(err))
+	}
+
+	s.conflicts = &conflictHandler{
+		policy: config.DuplicateIdPolicy,
+		local:  s.GetMeta,
+		delegate: func() ConflictDelegate {
+			fn, _ := s.delegate.Load().(ConflictDelegate)
+			return fn
 		},
+		stop:     s.Stop,
+		reassert: func(meta *Meta) error { return s.wathcer.Update(meta) },
+	}
+	retry := newJoinRetry(config)
+	s.wathcer = newWatcher(ctx, logger, sdclient, config.Prefix, registered, retry)
+	s.ready = newReadiness(READY_STEP_SD, READY_STEP_REGISTER, READY_STEP_GOSSIP)
+	s.ready.lastError(READY_STEP_REGISTER, s.wathcer.RegisterError)
+	s.wathcer.OnResync(func(err error) {
+		events.Publish(Event{Type: EVENT_RESYNC_REQUIRED, Node: s.GetMeta()})
+	})
+	if o.snapshot != nil {
+		s.onUpdate(o.snapshot.Nodes)
+	}
 
-		RetransmitMult: config.RetransmitMult,
+	cache := NewPeerCache(logger, config.PeerCacheFile, time.Duration(config.PeerCacheMaxAge)*time.Second)
+	if nodes := cache.Load(); len(nodes) > 0 {
+		s.onUpdate(nodes)
 	}
-	s.memberlist, err = memberlist.Create(memberlistConfig)
-	if err != nil {
-		logger.Fatal("Failed to create memberlist", zap.Error(err))
+
+	// a node starting from a snapshot or the peer cache does not wait for sd
+	entriesRetry := retry
+	if o.snapshot != nil || s.peers.Size() > 0 {
+		entriesRetry = joinRetry{}
 	}
 
-	s.wathcer = NewWatcher(ctx, logger, sdclient, config.Prefix, meta)
-	metas, err := s.wathcer.GetEntries()
-	if err != nil {
+	var metas []*Meta
+	err = entriesRetry.do(ctx, logger, "sd", func() (err error) {
+		metas, err = s.wathcer.GetEntries()
+		return err
+	})
+	switch {
+	case err == nil:
+		s.ready.done(READY_STEP_SD)
+		s.onUpdate(metas)
+		cache.Save(metas)
+		s.lifecycle.sync(s.ctx, s.GetMeta().Id, metas)
+		if err := s.conflicts.check(metas); err != nil {
+			logger.Warn("Node stepped down", zap.Error(err))
+		}
+
+	case o.snapshot != nil || s.peers.Size() > 0:
+		logger.Warn("Failed to read sd, starting from snapshot", zap.Error(err))
+		s.ready.report(READY_STEP_SD, err)
+
+	default:
 		logger.Fatal(err.Error())
 	}
-	s.onUpdate(metas)
-	s.wathcer.OnUpdate(s.onUpdate)
-	if _, err := s.memberlist.Join(s.GetNodesByNakama()); err != nil {
-		logger.Warn("Failed to join cluster", zap.Error(err))
+	s.wathcer.OnUpdate(func(metas []*Meta) {
+		s.ready.done(READY_STEP_SD)
+		s.onUpdate(metas)
+		cache.Save(metas)
+		s.lifecycle.sync(s.ctx, s.GetMeta().Id, metas)
+		if err := s.conflicts.check(metas); err != nil {
+			logger.Warn("Node stepped down", zap.Error(err))
+		}
+	})
+	go s.join(retry)
+
+	if s.bootstrap != nil {
+		go s.bootstrap.run(s.ctx, logger, events, s.peers, s.GetMeta, func() error {
+			return s.UpdateMeta(META_STATUS_READYED, s.GetMeta().Vars)
+		})
+	}
+
+	if s.memberlist == nil {
+		return s
 	}
 
 	go s.processIncoming()
+	if o.metricsScope != nil {
+		go s.reportGossip(time.Second)
+	}
 	return s
 }
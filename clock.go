@@ -0,0 +1,20 @@
+package nakamacluster
+
+import "time"
+
+// clock source of the time of the peer, simulations replace the real clock with a virtual one
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func())
+}
+
+// realClock the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
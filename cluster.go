@@ -0,0 +1,42 @@
+package nakamacluster
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/doublemo/nakama-cluster/sd"
+)
+
+// ErrClusterMismatch the node belongs to another cluster, its prefix or sd endpoints
+// point at the nodes of another environment
+var ErrClusterMismatch = errors.New("cluster mismatch")
+
+// CheckCluster returns an error when the node announces a cluster other than the local one,
+// nodes announcing no cluster are accepted so the name can be rolled out node by node
+func CheckCluster(local string, node *Meta) error {
+	if local == "" || node.Cluster == "" || node.Cluster == local {
+		return nil
+	}
+	return fmt.Errorf("%w: node %s belongs to cluster %q, expected %q", ErrClusterMismatch, node.Id, node.Cluster, local)
+}
+
+// checkClusterOnStart returns an error when a node of another cluster is registered under the prefix
+func checkClusterOnStart(sdclient sd.Client, prefix string, local *Meta) error {
+	if local.Cluster == "" {
+		return nil
+	}
+
+	values, err := sdclient.GetEntries(prefix)
+	if err != nil {
+		return nil
+	}
+
+	for _, value := range values {
+		if meta := NewNodeMetaFromJSON([]byte(value)); meta != nil && meta.Id != local.Id {
+			if err := CheckCluster(local.Cluster, meta); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
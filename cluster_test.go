@@ -0,0 +1,49 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"github.com/hashicorp/memberlist"
+	"go.uber.org/zap"
+)
+
+func TestCheckCluster(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prod := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	prod.Cluster = "prod"
+	staging := NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{})
+	staging.Cluster = "staging"
+	unnamed := NewNodeMeta("node3", "svc", "127.0.0.1:3", NODE_TYPE_MICROSERVICES, map[string]string{})
+
+	if err := CheckCluster("prod", staging); !errors.Is(err, ErrClusterMismatch) {
+		t.Fatalf("expected ErrClusterMismatch, got %v", err)
+	}
+
+	if CheckCluster("prod", prod) != nil || CheckCluster("prod", unnamed) != nil || CheckCluster("", staging) != nil {
+		t.Fatal("node of the cluster rejected")
+	}
+
+	client := sd.NewMemoryStore().NewClient(ctx)
+	b, _ := staging.Marshal()
+	if err := client.Register(sd.Service{Key: "/nakama-cluster/services/node2", Value: string(b)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkClusterOnStart(client, "/nakama-cluster/services/", prod); !errors.Is(err, ErrClusterMismatch) {
+		t.Fatalf("expected start rejected, got %v", err)
+	}
+
+	s := &Client{config: &Config{ClusterName: "prod"}, logger: zap.NewNop()}
+	if err := s.NotifyMerge([]*memberlist.Node{{Name: "node2", Meta: b}}); !errors.Is(err, ErrClusterMismatch) {
+		t.Fatalf("expected merge rejected, got %v", err)
+	}
+
+	if err := s.NotifyAlive(&memberlist.Node{Name: "node2", Meta: b}); !errors.Is(err, ErrClusterMismatch) {
+		t.Fatalf("expected alive node rejected, got %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+// Package clusterbench runs in-process clusters under synthetic load and reports
+// throughput and latency percentiles of the peer layer.
+package clusterbench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nakamacluster "github.com/doublemo/nakama-cluster"
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+const (
+	// MODE_RPC unary calls through Peer.Send
+	MODE_RPC = "rpc"
+
+	// MODE_STREAM request and reply over Peer.SendStreamRequest
+	MODE_STREAM = "stream"
+
+	// MODE_GOSSIP broadcasts through the memberlist gossip of nakama nodes
+	MODE_GOSSIP = "gossip"
+)
+
+const (
+	benchService = "clusterbench"
+	benchCid     = "clusterbench.echo"
+	benchSentAt  = "clusterbench.sent_at"
+)
+
+var (
+	ErrInvalidMode    = errors.New("invalid bench mode")
+	ErrNotEnoughNodes = errors.New("bench needs at least one node")
+)
+
+// Options controls the size of the cluster and the generated load
+type Options struct {
+	// Mode is one of MODE_RPC, MODE_STREAM or MODE_GOSSIP
+	Mode string
+
+	// Nodes number of in-process nodes
+	Nodes int
+
+	// Concurrency number of workers generating load
+	Concurrency int
+
+	// Duration of the measured run
+	Duration time.Duration
+
+	// Warmup time given to the cluster to converge before measuring
+	Warmup time.Duration
+
+	// Rate maximum operations per second over all workers, 0 is unlimited
+	Rate int
+
+	// PayloadSize bytes of payload in every envelope
+	PayloadSize int
+
+	// Timeout of a single operation
+	Timeout time.Duration
+
+	// Config base config of every node, Addr and Port are assigned per node
+	Config *nakamacluster.Config
+}
+
+// Report summary of a run, latencies are measured from send to reply for rpc and
+// stream, and from broadcast to delivery on every other node for gossip
+type Report struct {
+	Mode        string
+	Nodes       int
+	Concurrency int
+	Elapsed     time.Duration
+	Sent        int64
+	Completed   int64
+	Errors      int64
+	Throughput  float64
+	Min         time.Duration
+	Mean        time.Duration
+	P50         time.Duration
+	P90         time.Duration
+	P99         time.Duration
+	Max         time.Duration
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf(
+		"mode=%s nodes=%d concurrency=%d elapsed=%s sent=%d completed=%d errors=%d throughput=%.1f/s min=%s mean=%s p50=%s p90=%s p99=%s max=%s",
+		r.Mode, r.Nodes, r.Concurrency, r.Elapsed.Round(time.Millisecond), r.Sent, r.Completed, r.Errors, r.Throughput,
+		r.Min, r.Mean, r.P50, r.P90, r.P99, r.Max,
+	)
+}
+
+type echoDelegate struct{}
+
+func (echoDelegate) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+	return in, nil
+}
+
+func (echoDelegate) Stream(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error {
+	client(in)
+	return nil
+}
+
+func (echoDelegate) OnStreamClose(ctx context.Context) {}
+
+// Run start the cluster, generate load until opts.Duration elapsed or ctx is done
+// and stop every node before returning the report
+func Run(ctx context.Context, logger *zap.Logger, opts Options) (*Report, error) {
+	if opts.Nodes < 1 {
+		return nil, ErrNotEnoughNodes
+	}
+
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	if opts.Config == nil {
+		opts.Config = nakamacluster.NewConfig()
+	}
+
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	rec := newRecorder(1024)
+	var (
+		sent    int64
+		elapsed time.Duration
+		err     error
+	)
+
+	switch opts.Mode {
+	case MODE_RPC, MODE_STREAM:
+		elapsed, err = runServers(ctx, logger, store, opts, rec, &sent)
+
+	case MODE_GOSSIP:
+		elapsed, err = runClients(ctx, logger, store, opts, rec, &sent)
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMode, opts.Mode)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := rec.report(elapsed)
+	report.Mode = opts.Mode
+	report.Nodes = opts.Nodes
+	report.Concurrency = opts.Concurrency
+	report.Sent = atomic.LoadInt64(&sent)
+	return &report, nil
+}
+
+func runServers(ctx context.Context, logger *zap.Logger, store *sd.MemoryStore, opts Options, rec *recorder, sent *int64) (time.Duration, error) {
+	servers := make([]*nakamacluster.Server, 0, opts.Nodes)
+	defer func() {
+		for _, server := range servers {
+			server.Stop()
+		}
+	}()
+
+	for i := 0; i < opts.Nodes; i++ {
+		config, err := nodeConfig(opts.Config)
+		if err != nil {
+			return 0, err
+		}
+
+		id := benchService + "-" + strconv.Itoa(i)
+		server := nakamacluster.NewServer(ctx, logger.With(zap.String("node", id)), store.NewClient(ctx), id, benchService, map[string]string{}, *config)
+		server.OnDelegate(echoDelegate{})
+		servers = append(servers, server)
+	}
+
+	if err := waitPeers(ctx, opts.Warmup, func() bool {
+		for _, server := range servers {
+			if server.GetPeers().SizeByName(benchService) < opts.Nodes {
+				return false
+			}
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	payload := make([]byte, opts.PayloadSize)
+	return generate(ctx, opts, func(worker int, seq int64) error {
+		peers := servers[worker%len(servers)].GetPeers()
+		nodes := peers.GetByName(benchService)
+		if len(nodes) < 1 {
+			return nakamacluster.ErrNodeNotFound
+		}
+
+		node := nodes[int(seq)%len(nodes)]
+		in := &api.Envelope{Cid: benchCid, Payload: &api.Envelope_Bytes{Bytes: payload}}
+		ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+
+		atomic.AddInt64(sent, 1)
+		start := time.Now()
+		if opts.Mode == MODE_RPC {
+			if _, err := peers.Send(ctx, node, in); err != nil {
+				return err
+			}
+
+			rec.observe(time.Since(start))
+			return nil
+		}
+
+		ch, err := peers.SendStreamRequest(ctx, "clusterbench-"+strconv.Itoa(worker)+"-"+node.Id, node, in, nil)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return nakamacluster.ErrStreamClosed
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		rec.observe(time.Since(start))
+		return nil
+	}, rec), nil
+}
+
+func runClients(ctx context.Context, logger *zap.Logger, store *sd.MemoryStore, opts Options, rec *recorder, sent *int64) (time.Duration, error) {
+	clients := make([]*nakamacluster.Client, 0, opts.Nodes)
+	defer func() {
+		for _, client := range clients {
+			client.Stop()
+		}
+	}()
+
+	var measuring int32
+	for i := 0; i < opts.Nodes; i++ {
+		config, err := nodeConfig(opts.Config)
+		if err != nil {
+			return 0, err
+		}
+
+		id := benchService + "-" + strconv.Itoa(i)
+		client := nakamacluster.NewClient(ctx, logger.With(zap.String("node", id)), store.NewClient(ctx), id, map[string]string{}, *config)
+		client.OnBroadcast(func(node string, in *api.Envelope) {
+			if node == id || in.GetCid() != benchCid || atomic.LoadInt32(&measuring) == 0 {
+				return
+			}
+
+			sentAt, err := strconv.ParseInt(in.Vars[benchSentAt], 10, 64)
+			if err != nil {
+				return
+			}
+			rec.observe(time.Since(time.Unix(0, sentAt)))
+		})
+		clients = append(clients, client)
+
+		// nakama nodes join the members found in sd when created, the next node
+		// must see this one registered or it starts a cluster of its own
+		size := len(clients)
+		if err := waitPeers(ctx, 0, func() bool { return len(client.GetNodesByNakama()) >= size }); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := waitPeers(ctx, opts.Warmup, func() bool {
+		for _, client := range clients {
+			if len(client.GetNodesByNakama()) < opts.Nodes {
+				return false
+			}
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	payload := make([]byte, opts.PayloadSize)
+	atomic.StoreInt32(&measuring, 1)
+	elapsed := generate(ctx, opts, func(worker int, seq int64) error {
+		in := &api.Envelope{
+			Cid:     benchCid,
+			Payload: &api.Envelope_Bytes{Bytes: payload},
+			Vars:    map[string]string{benchSentAt: strconv.FormatInt(time.Now().UnixNano(), 10)},
+		}
+
+		atomic.AddInt64(sent, 1)
+		return clients[worker%len(clients)].Broadcast(nakamacluster.NewMessage(in))
+	}, rec)
+
+	// give in flight broadcasts a chance to be delivered
+	select {
+	case <-time.After(opts.Timeout):
+	case <-ctx.Done():
+	}
+	atomic.StoreInt32(&measuring, 0)
+	return elapsed, nil
+}
+
+// generate run opts.Concurrency workers calling op until opts.Duration elapsed
+func generate(ctx context.Context, opts Options, op func(worker int, seq int64) error, rec *recorder) time.Duration {
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	var interval time.Duration
+	if opts.Rate > 0 {
+		interval = time.Duration(opts.Concurrency) * time.Second / time.Duration(opts.Rate)
+	}
+
+	var (
+		wg  sync.WaitGroup
+		seq int64
+	)
+
+	start := time.Now()
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			next := time.Now()
+			for ctx.Err() == nil {
+				if interval > 0 {
+					next = next.Add(interval)
+					if wait := time.Until(next); wait > 0 {
+						select {
+						case <-time.After(wait):
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+
+				if err := op(worker, atomic.AddInt64(&seq, 1)); err != nil && ctx.Err() == nil {
+					rec.fail()
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	return time.Since(start)
+}
+
+// waitPeers wait until ready reports the cluster converged, then for warmup
+func waitPeers(ctx context.Context, warmup time.Duration, ready func() bool) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !ready() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case <-time.After(warmup):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// nodeConfig copy the base config bound to a free loopback port
+func nodeConfig(base *nakamacluster.Config) (*nakamacluster.Config, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+	if err := l.Close(); err != nil {
+		return nil, err
+	}
+
+	config := *base
+	config.Addr = "127.0.0.1"
+	config.Port = port
+	return &config, nil
+}
@@ -0,0 +1,83 @@
+package clusterbench
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recorder collects the latency samples of a run
+type recorder struct {
+	sync.Mutex
+	samples []time.Duration
+	errors  int64
+}
+
+func newRecorder(capacity int) *recorder {
+	return &recorder{samples: make([]time.Duration, 0, capacity)}
+}
+
+func (r *recorder) observe(d time.Duration) {
+	r.Lock()
+	r.samples = append(r.samples, d)
+	r.Unlock()
+}
+
+func (r *recorder) fail() {
+	r.Lock()
+	r.errors++
+	r.Unlock()
+}
+
+// report summarise the samples recorded during elapsed
+func (r *recorder) report(elapsed time.Duration) Report {
+	r.Lock()
+	samples := make([]time.Duration, len(r.samples))
+	copy(samples, r.samples)
+	errors := r.errors
+	r.Unlock()
+
+	report := Report{Elapsed: elapsed, Completed: int64(len(samples)), Errors: errors}
+	if elapsed > 0 {
+		report.Throughput = float64(len(samples)) / elapsed.Seconds()
+	}
+
+	if len(samples) < 1 {
+		return report
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+
+	var total time.Duration
+	for _, d := range samples {
+		total += d
+	}
+
+	report.Min = samples[0]
+	report.Max = samples[len(samples)-1]
+	report.Mean = total / time.Duration(len(samples))
+	report.P50 = percentile(samples, 50)
+	report.P90 = percentile(samples, 90)
+	report.P99 = percentile(samples, 99)
+	return report
+}
+
+// percentile nearest-rank percentile of the sorted samples
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) < 1 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,43 @@
+package clusterbench
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecorderReport(t *testing.T) {
+	rec := newRecorder(100)
+	for i := 100; i > 0; i-- {
+		rec.observe(time.Duration(i) * time.Millisecond)
+	}
+	rec.fail()
+
+	report := rec.report(2 * time.Second)
+	if report.Completed != 100 || report.Errors != 1 {
+		t.Fatalf("completed %d errors %d", report.Completed, report.Errors)
+	}
+
+	if report.Throughput != 50 {
+		t.Fatalf("throughput %f", report.Throughput)
+	}
+
+	expected := map[string][2]time.Duration{
+		"min":  {report.Min, time.Millisecond},
+		"p50":  {report.P50, 50 * time.Millisecond},
+		"p90":  {report.P90, 90 * time.Millisecond},
+		"p99":  {report.P99, 99 * time.Millisecond},
+		"max":  {report.Max, 100 * time.Millisecond},
+		"mean": {report.Mean, 50500 * time.Microsecond},
+	}
+	for name, v := range expected {
+		if v[0] != v[1] {
+			t.Errorf("%s %s expected %s", name, v[0], v[1])
+		}
+	}
+}
+
+func TestPercentileEmpty(t *testing.T) {
+	if d := percentile(nil, 99); d != 0 {
+		t.Fatalf("percentile %s", d)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/clusterbench"
+	"go.uber.org/zap"
+)
+
+const usage = `clusterbench runs an in-process cluster under synthetic load and reports
+throughput and latency percentiles.
+
+Usage:
+  clusterbench [flags]
+
+Modes:
+  rpc      unary calls between microservice nodes
+  stream   request and reply over peer streams
+  gossip   memberlist broadcasts between nakama nodes
+
+Flags:
+`
+
+func main() {
+	mode := flag.String("mode", clusterbench.MODE_RPC, "load pattern: rpc, stream or gossip")
+	nodes := flag.Int("nodes", 3, "number of in-process nodes")
+	concurrency := flag.Int("concurrency", 16, "number of workers generating load")
+	duration := flag.Duration("duration", 10*time.Second, "measured run duration")
+	warmup := flag.Duration("warmup", time.Second, "time given to the cluster to converge before measuring")
+	rate := flag.Int("rate", 0, "maximum operations per second, 0 is unlimited")
+	payload := flag.Int("payload", 128, "payload size in bytes")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout of a single operation")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	verbose := flag.Bool("v", false, "log node output")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	logger := zap.NewNop()
+	if *verbose {
+		logger, _ = zap.NewDevelopment()
+	}
+
+	report, err := clusterbench.Run(ctx, logger, clusterbench.Options{
+		Mode:        *mode,
+		Nodes:       *nodes,
+		Concurrency: *concurrency,
+		Duration:    *duration,
+		Warmup:      *warmup,
+		Rate:        *rate,
+		PayloadSize: *payload,
+		Timeout:     *timeout,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, clusterbench.ErrInvalidMode) || errors.Is(err, clusterbench.ErrNotEnoughNodes) {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Println(report)
+}
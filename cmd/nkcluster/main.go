@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	nakamacluster "github.com/doublemo/nakama-cluster"
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const usage = `nkcluster inspects and administers a nakama-cluster through the sd backend.
+
+Usage:
+  nkcluster [flags] <command> [arguments]
+
+Commands:
+  nodes                      list registered nodes
+  owner <name> <key>         show the hashring owner of key for the service name, cordoned nodes are left
+                             out of the ring. The ring is built with -ring-hash and -ring-vnodes, the key is
+                             looked up as it is: RingVars rings and KeyMappers of the nodes are not applied
+  drain <id>                 mark the node draining so peers stop routing to it, the node keeps the drain
+  maintenance <id> on|off    move the node in or out of maintenance, needs -control-key
+  control <id> <cmd> [k=v]   send a control command like drain, quarantine peer=<id>, resync, refresh,
+                             log_level level=debug ttl=10m, goroutines, topology format=dot or traces peer=<id>
+                             cid=<prefix> direction=in|out since=10m limit=100, streams client=<prefix> limit=10 to the node,
+                             needs -control-key. log_level may be sent to every service node with id *
+  topology [json|dot]        print the cluster graph merged from every service node with the
+                             rtts they measured, for grafana node graphs or graphviz, needs -control-key
+  send <id> <cid> [payload]  send a test envelope to the node and print the reply
+  events                     tail node join, leave and update events
+  snapshot [file]            export the cluster view as a JSON snapshot
+
+Flags:
+`
+
+var ErrUsage = errors.New("invalid arguments")
+
+type cli struct {
+	ctx        context.Context
+	sd         sd.Client
+	prefix     string
+	namespace  string
+	timeout    time.Duration
+	controlKey []byte
+	ring       nakamacluster.RingOptions
+}
+
+func (c *cli) entries() ([]*nakamacluster.Meta, error) {
+	values, err := c.sd.GetEntries(c.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	metas := make([]*nakamacluster.Meta, 0, len(values))
+	for _, value := range values {
+		if meta := nakamacluster.NewNodeMetaFromJSON([]byte(value)); meta != nil && (c.namespace == "*" || meta.Namespace == c.namespace) {
+			metas = append(metas, meta)
+		}
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Id < metas[j].Id
+	})
+	return metas, nil
+}
+
+func (c *cli) entry(id string) (*nakamacluster.Meta, error) {
+	metas, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, meta := range metas {
+		if meta.Id == id {
+			return meta, nil
+		}
+	}
+	return nil, fmt.Errorf("node %s %w", id, nakamacluster.ErrNodeNotFound)
+}
+
+func (c *cli) peer(metas ...*nakamacluster.Meta) *nakamacluster.LocalPeer {
+	namespace := c.namespace
+	if namespace == "*" {
+		namespace = ""
+	}
+
+	peer := nakamacluster.NewPeer(c.ctx, zap.NewNop(), nakamacluster.PeerOptions{
+		Connections: 1,
+		Namespace:   namespace,
+		Ring:        c.ring,
+	})
+	peer.Sync(metas...)
+	return peer
+}
+
+func (c *cli) nodes(args []string) error {
+	metas, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tADDR\tTYPE\tSTATUS\tLABELS\tVARS")
+	for _, meta := range metas {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\t%v\n", meta.Id, meta.Name, meta.Addr, meta.Type, meta.Status, meta.Labels, meta.Vars)
+	}
+	return w.Flush()
+}
+
+func (c *cli) owner(args []string) error {
+	if len(args) != 2 {
+		return ErrUsage
+	}
+
+	metas, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	// the peers keep cordoned nodes out of the rings
+	cordons, err := nakamacluster.ListCordons(c.sd, c.prefix)
+	if err != nil && !errors.Is(err, nakamacluster.ErrCordonUnsupported) {
+		return err
+	}
+
+	routable := metas[:0]
+	for _, meta := range metas {
+		if _, ok := cordons[meta.Id]; !ok {
+			routable = append(routable, meta)
+		}
+	}
+
+	node, ok := c.peer(routable...).GetWithHashRing(args[0], args[1])
+	if !ok {
+		return fmt.Errorf("service %s %w", args[0], nakamacluster.ErrNodeNotFound)
+	}
+
+	fmt.Printf("%s\t%s\n", node.Id, node.Addr)
+	return nil
+}
+
+func (c *cli) drain(args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	meta, err := c.entry(args[0])
+	if err != nil {
+		return err
+	}
+
+	// the node takes the drain and writes it again with a newer version
+	meta.Status = nakamacluster.META_STATUS_DRAINING
+	meta.Version++
+	value, err := meta.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return c.sd.Update(sd.Service{Key: c.prefix + meta.Id, Value: string(value)})
+}
+
+func (c *cli) maintenance(args []string) error {
+	if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+		return ErrUsage
+	}
+
+	meta, err := c.entry(args[0])
+	if err != nil {
+		return err
+	}
+
+	in := nakamacluster.NewControlEnvelope(c.controlKey, nakamacluster.CONTROL_CID_MAINTENANCE, meta.Id, map[string]string{
+		nakamacluster.CONTROL_VAR_ENABLED: strconv.FormatBool(args[1] == "on"),
+	})
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+	defer cancel()
+	out, err := c.peer(meta).Send(ctx, meta, in)
+	if err != nil {
+		return err
+	}
+
+	if meta = nakamacluster.NewNodeMetaFromJSON(out.GetBytes()); meta != nil {
+		fmt.Printf("%s\t%s\n", meta.Id, meta.Status)
+	}
+	return nil
+}
+
+func (c *cli) control(args []string) error {
+	if len(args) < 2 {
+		return ErrUsage
+	}
+
+	vars := make(map[string]string, len(args)-2)
+	for _, arg := range args[2:] {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			return ErrUsage
+		}
+		vars[k] = v
+	}
+
+	in := nakamacluster.NewControlEnvelope(c.controlKey, nakamacluster.CONTROL_CID_PREFIX+args[1], args[0], vars)
+	if args[0] == nakamacluster.CONTROL_NODE_ALL {
+		metas, err := c.entries()
+		if err != nil {
+			return err
+		}
+
+		for _, meta := range metas {
+			if meta.Type == nakamacluster.NODE_TYPE_NAKAMA {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+			result := "ok"
+			if _, err := c.peer(meta).Send(ctx, meta, in); err != nil {
+				result = err.Error()
+			}
+			cancel()
+			fmt.Printf("%s\t%s\n", meta.Id, result)
+		}
+		return nil
+	}
+
+	meta, err := c.entry(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+	defer cancel()
+	out, err := c.peer(meta).Send(ctx, meta, in)
+	if err != nil {
+		return err
+	}
+
+	if b := out.GetBytes(); b != nil {
+		fmt.Println(string(b))
+		return nil
+	}
+
+	fmt.Println(protojson.Format(out))
+	return nil
+}
+
+func (c *cli) topology(args []string) error {
+	if len(args) > 1 {
+		return ErrUsage
+	}
+
+	format := "json"
+	if len(args) == 1 {
+		format = args[0]
+	}
+
+	if format != "json" && format != "dot" {
+		return ErrUsage
+	}
+
+	metas, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	topologies := make([]*nakamacluster.Topology, 0, len(metas))
+	for _, meta := range metas {
+		if meta.Type == nakamacluster.NODE_TYPE_NAKAMA {
+			continue
+		}
+
+		in := nakamacluster.NewControlEnvelope(c.controlKey, nakamacluster.CONTROL_CID_TOPOLOGY, meta.Id, nil)
+		ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+		out, err := c.peer(meta).Send(ctx, meta, in)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\t%v\n", meta.Id, err)
+			continue
+		}
+
+		var t nakamacluster.Topology
+		if err := json.Unmarshal(out.GetBytes(), &t); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\t%v\n", meta.Id, err)
+			continue
+		}
+		topologies = append(topologies, &t)
+	}
+
+	t := nakamacluster.MergeTopology(topologies...)
+	if format == "dot" {
+		fmt.Print(t.DOT())
+		return nil
+	}
+
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(b))
+	return nil
+}
+
+func (c *cli) send(args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return ErrUsage
+	}
+
+	meta, err := c.entry(args[0])
+	if err != nil {
+		return err
+	}
+
+	in := &api.Envelope{Cid: args[1]}
+	if len(args) == 3 {
+		in.Payload = &api.Envelope_Bytes{Bytes: []byte(args[2])}
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	out, err := c.peer(meta).Send(ctx, meta, in)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s (%s)\n", protojson.Format(out), time.Since(start))
+	return nil
+}
+
+func (c *cli) events(args []string) error {
+	metas, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	last := make(map[string]*nakamacluster.Meta, len(metas))
+	for _, meta := range metas {
+		last[meta.Id] = meta
+	}
+
+	ch := make(chan struct{}, 1)
+	go c.sd.WatchPrefix(c.prefix, ch)
+	for {
+		select {
+		case <-ch:
+		case <-c.ctx.Done():
+			return nil
+		}
+
+		metas, err := c.entries()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+
+		now := time.Now().Format(time.RFC3339)
+		current := make(map[string]*nakamacluster.Meta, len(metas))
+		for _, meta := range metas {
+			current[meta.Id] = meta
+			prev, ok := last[meta.Id]
+			switch {
+			case !ok:
+				fmt.Printf("%s\tJOIN\t%s\t%s\t%s\n", now, meta.Id, meta.Name, meta.Addr)
+			case !reflect.DeepEqual(prev, meta):
+				fmt.Printf("%s\tUPDATE\t%s\t%s\t%s\tstatus=%d\n", now, meta.Id, meta.Name, meta.Addr, meta.Status)
+			}
+		}
+
+		for id, meta := range last {
+			if _, ok := current[id]; !ok {
+				fmt.Printf("%s\tLEAVE\t%s\t%s\t%s\n", now, meta.Id, meta.Name, meta.Addr)
+			}
+		}
+		last = current
+	}
+}
+
+func (c *cli) snapshot(args []string) error {
+	if len(args) > 1 {
+		return ErrUsage
+	}
+
+	metas, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	snapshot := nakamacluster.NewSnapshot(metas...)
+	if len(args) == 1 {
+		return snapshot.WriteFile(args[0])
+	}
+
+	b, err := snapshot.Marshal()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(b))
+	return nil
+}
+
+func main() {
+	endpoints := flag.String("etcd", "127.0.0.1:2379", "comma separated etcd endpoints")
+	fallback := flag.String("etcd-fallback", "", "comma separated etcd endpoints of the cluster used while the primary one is down")
+	prefix := flag.String("prefix", nakamacluster.NewConfig().Prefix, "service prefix")
+	namespace := flag.String("namespace", "", "only show nodes of the namespace, * shows every namespace")
+	cert := flag.String("cert", "", "etcd client certificate")
+	key := flag.String("key", "", "etcd client key")
+	cacert := flag.String("cacert", "", "etcd trusted ca")
+	username := flag.String("username", "", "etcd username")
+	password := flag.String("password", "", "etcd password")
+	timeout := flag.Duration("timeout", 5*time.Second, "request timeout")
+	controlKey := flag.String("control-key", "", "control_key of the nodes signing control envelopes")
+	ringHash := flag.String("ring-hash", nakamacluster.NewConfig().RingHash, "ring_hash of the nodes, used by owner")
+	ringVnodes := flag.Int("ring-vnodes", nakamacluster.NewConfig().RingVirtualNodes, "ring_virtual_nodes of the nodes, used by owner")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	options := sd.EtcdClientOptions{
+		Cert:        *cert,
+		Key:         *key,
+		CACert:      *cacert,
+		DialTimeout: *timeout,
+		Username:    *username,
+		Password:    *password,
+	}
+
+	client, err := sd.NewEtcdV3Client(ctx, strings.Split(*endpoints, ","), options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect to etcd:", err)
+		os.Exit(1)
+	}
+
+	if *fallback != "" {
+		standby, err := sd.NewEtcdV3Client(ctx, strings.Split(*fallback, ","), options)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to connect to fallback etcd:", err)
+			os.Exit(1)
+		}
+
+		if client, err = sd.NewFailoverClient(ctx, sd.FailoverOptions{CheckTimeout: *timeout}, client, standby); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to create failover client:", err)
+			os.Exit(1)
+		}
+	}
+
+	c := &cli{ctx: ctx, sd: client, prefix: *prefix, namespace: *namespace, timeout: *timeout, controlKey: []byte(*controlKey)}
+	c.ring = nakamacluster.RingOptions{Hash: *ringHash, VirtualNodes: *ringVnodes}
+	commands := map[string]func(args []string) error{
+		"nodes":       c.nodes,
+		"owner":       c.owner,
+		"drain":       c.drain,
+		"maintenance": c.maintenance,
+		"control":     c.control,
+		"topology":    c.topology,
+		"send":        c.send,
+		"events":      c.events,
+		"snapshot":    c.snapshot,
+	}
+
+	command, ok := commands[args[0]]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := command(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, ErrUsage) {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
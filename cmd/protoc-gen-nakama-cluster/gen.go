@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+const (
+	contextPackage = protogen.GoImportPath("context")
+	clusterPackage = protogen.GoImportPath("github.com/doublemo/nakama-cluster")
+	apiPackage     = protogen.GoImportPath("github.com/doublemo/nakama-cluster/api")
+)
+
+// generateFile generate the cluster wrappers of the services of the file, files without services generate nothing
+func generateFile(gen *protogen.Plugin, file *protogen.File) *protogen.GeneratedFile {
+	if len(file.Services) < 1 {
+		return nil
+	}
+
+	g := gen.NewGeneratedFile(file.GeneratedFilenamePrefix+"_cluster.pb.go", file.GoImportPath)
+	g.P("// Code generated by protoc-gen-nakama-cluster. DO NOT EDIT.")
+	g.P("// source: ", file.Desc.Path())
+	g.P()
+	g.P("package ", file.GoPackageName)
+	g.P()
+	for _, service := range file.Services {
+		generateService(g, service)
+	}
+	return g
+}
+
+// supported reports whether the method is generated, the envelopes of a cluster stream carry
+// one request and the replies to it
+func supported(method *protogen.Method) bool {
+	return !method.Desc.IsStreamingClient()
+}
+
+// cid returns the name of the constant of the cid of the method
+func cid(method *protogen.Method) string {
+	return method.Parent.GoName + "_" + method.GoName + "_Cid"
+}
+
+func generateService(g *protogen.GeneratedFile, service *protogen.Service) {
+	clientName := service.GoName + "ClusterClient"
+	serverName := service.GoName + "ClusterServer"
+
+	g.P("// cids of the methods of the ", service.Desc.FullName(), " service")
+	g.P("const (")
+	for _, method := range service.Methods {
+		if supported(method) {
+			g.P(cid(method), " = \"", method.Desc.FullName(), "\"")
+		}
+	}
+	g.P(")")
+	g.P()
+
+	// client
+	g.P("// ", clientName, " client of the ", service.Desc.FullName(), " service over the cluster peers")
+	g.P("type ", clientName, " interface {")
+	for _, method := range service.Methods {
+		if !supported(method) {
+			g.P("// ", method.GoName, " not generated, client streaming methods are not supported")
+			continue
+		}
+		g.P(method.Comments.Leading, clientSignature(g, method))
+	}
+	g.P("}")
+	g.P()
+
+	g.P("type ", unexport(clientName), " struct {")
+	g.P("peers ", clusterPackage.Ident("Peer"))
+	g.P("name string")
+	g.P("}")
+	g.P()
+
+	g.P("// New", clientName, " create the client sending the requests to the nodes of the named service")
+	g.P("func New", clientName, "(peers ", clusterPackage.Ident("Peer"), ", name string) ", clientName, " {")
+	g.P("return &", unexport(clientName), "{peers: peers, name: name}")
+	g.P("}")
+	g.P()
+
+	for _, method := range service.Methods {
+		if !supported(method) {
+			continue
+		}
+
+		g.P("func (c *", unexport(clientName), ") ", clientSignature(g, method), " {")
+		if !method.Desc.IsStreamingServer() {
+			g.P("out := new(", method.Output.GoIdent, ")")
+			g.P("if err := ", clusterPackage.Ident("Invoke"), "(ctx, c.peers, c.name, ", cid(method), ", in, out, opts...); err != nil {")
+			g.P("return nil, err")
+			g.P("}")
+			g.P("return out, nil")
+			g.P("}")
+			g.P()
+			continue
+		}
+
+		g.P("ch, err := ", clusterPackage.Ident("InvokeStream"), "(ctx, c.peers, clientId, node, ", cid(method), ", in)")
+		g.P("if err != nil {")
+		g.P("return nil, err")
+		g.P("}")
+		g.P()
+		g.P("out := make(chan *", method.Output.GoIdent, ", cap(ch))")
+		g.P("go func() {")
+		g.P("defer close(out)")
+		g.P("for envelope := range ch {")
+		g.P("reply := new(", method.Output.GoIdent, ")")
+		g.P("// an error payload ends the replies")
+		g.P("if err := envelope.UnmarshalAnyTo(reply); err != nil {")
+		g.P("return")
+		g.P("}")
+		g.P()
+		g.P("select {")
+		g.P("case out <- reply:")
+		g.P("case <-ctx.Done():")
+		g.P("return")
+		g.P("}")
+		g.P("}")
+		g.P("}()")
+		g.P("return out, nil")
+		g.P("}")
+		g.P()
+	}
+
+	// server
+	g.P("// ", serverName, " server of the ", service.Desc.FullName(), " service, register it with Register", serverName)
+	g.P("type ", serverName, " interface {")
+	for _, method := range service.Methods {
+		if supported(method) {
+			g.P(method.Comments.Leading, serverSignature(g, method))
+		}
+	}
+	g.P("}")
+	g.P()
+
+	g.P("// Register", serverName, " register the methods of the server on the mux")
+	g.P("func Register", serverName, "(mux *", clusterPackage.Ident("ServiceMux"), ", srv ", serverName, ") {")
+	first := true
+	for _, method := range service.Methods {
+		if !supported(method) {
+			continue
+		}
+
+		if !first {
+			g.P()
+		}
+		first = false
+
+		if !method.Desc.IsStreamingServer() {
+			g.P("mux.HandleCall(", cid(method), ", func(ctx ", contextPackage.Ident("Context"), ", in *", apiPackage.Ident("Envelope"), ") (*", apiPackage.Ident("Envelope"), ", error) {")
+			g.P("req := new(", method.Input.GoIdent, ")")
+			g.P("if err := in.UnmarshalAnyTo(req); err != nil {")
+			g.P("return nil, ", apiPackage.Ident("NewError"), "(", apiPackage.Ident("Error_INVALID_ARGUMENT"), ", err.Error())")
+			g.P("}")
+			g.P()
+			g.P("reply, err := srv.", method.GoName, "(ctx, req)")
+			g.P("if err != nil {")
+			g.P("return nil, err")
+			g.P("}")
+			g.P()
+			g.P("out := &", apiPackage.Ident("Envelope"), "{Cid: in.Cid}")
+			g.P("if err := out.SetAny(reply); err != nil {")
+			g.P("return nil, err")
+			g.P("}")
+			g.P("return out, nil")
+			g.P("})")
+			continue
+		}
+
+		g.P("mux.HandleStream(", cid(method), ", func(ctx ", contextPackage.Ident("Context"), ", client func(out *", apiPackage.Ident("Envelope"), ") bool, in *", apiPackage.Ident("Envelope"), ") error {")
+		g.P("// errors are replied to the request, returning them would close the stream shared by other requests")
+		g.P("req := new(", method.Input.GoIdent, ")")
+		g.P("err := in.UnmarshalAnyTo(req)")
+		g.P("if err != nil {")
+		g.P("err = ", apiPackage.Ident("NewError"), "(", apiPackage.Ident("Error_INVALID_ARGUMENT"), ", err.Error())")
+		g.P("} else {")
+		g.P("err = srv.", method.GoName, "(ctx, req, func(reply *", method.Output.GoIdent, ") bool {")
+		g.P("out := &", apiPackage.Ident("Envelope"), "{Cid: in.Cid}")
+		g.P("if err := out.SetAny(reply); err != nil {")
+		g.P("return false")
+		g.P("}")
+		g.P("return client(out)")
+		g.P("})")
+		g.P("}")
+		g.P()
+		g.P("if err != nil {")
+		g.P("client(&", apiPackage.Ident("Envelope"), "{Cid: in.Cid, Payload: &", apiPackage.Ident("Envelope_Error"), "{Error: ", apiPackage.Ident("AsError"), "(err)}})")
+		g.P("}")
+		g.P("return nil")
+		g.P("})")
+	}
+	g.P("}")
+	g.P()
+}
+
+func clientSignature(g *protogen.GeneratedFile, method *protogen.Method) string {
+	ctx := g.QualifiedGoIdent(contextPackage.Ident("Context"))
+	in := g.QualifiedGoIdent(method.Input.GoIdent)
+	out := g.QualifiedGoIdent(method.Output.GoIdent)
+	if method.Desc.IsStreamingServer() {
+		return method.GoName + "(ctx " + ctx + ", clientId string, node *" + g.QualifiedGoIdent(clusterPackage.Ident("Meta")) + ", in *" + in + ") (<-chan *" + out + ", error)"
+	}
+	return method.GoName + "(ctx " + ctx + ", in *" + in + ", opts ..." + g.QualifiedGoIdent(clusterPackage.Ident("SendOption")) + ") (*" + out + ", error)"
+}
+
+func serverSignature(g *protogen.GeneratedFile, method *protogen.Method) string {
+	ctx := g.QualifiedGoIdent(contextPackage.Ident("Context"))
+	in := g.QualifiedGoIdent(method.Input.GoIdent)
+	out := g.QualifiedGoIdent(method.Output.GoIdent)
+	if method.Desc.IsStreamingServer() {
+		return method.GoName + "(ctx " + ctx + ", in *" + in + ", send func(*" + out + ") bool) error"
+	}
+	return method.GoName + "(ctx " + ctx + ", in *" + in + ") (*" + out + ", error)"
+}
+
+func unexport(s string) string {
+	return strings.ToLower(s[:1]) + s[1:]
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+func TestGenerateFile(t *testing.T) {
+	message := func(name string) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name)}
+	}
+
+	method := func(name, in, out string, clientStreaming, serverStreaming bool) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(name),
+			InputType:       proto.String(".helloworld." + in),
+			OutputType:      proto.String(".helloworld." + out),
+			ClientStreaming: proto.Bool(clientStreaming),
+			ServerStreaming: proto.Bool(serverStreaming),
+		}
+	}
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:        proto.String("greeter.proto"),
+		Package:     proto.String("helloworld"),
+		Syntax:      proto.String("proto3"),
+		Options:     &descriptorpb.FileOptions{GoPackage: proto.String("example.com/helloworld;helloworld")},
+		MessageType: []*descriptorpb.DescriptorProto{message("HelloRequest"), message("HelloReply")},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("SayHello", "HelloRequest", "HelloReply", false, false),
+				method("Watch", "HelloRequest", "HelloReply", false, true),
+				method("Chat", "HelloRequest", "HelloReply", true, true),
+			},
+		}},
+	}
+
+	gen, err := protogen.Options{}.New(&pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{"greeter.proto"},
+		ProtoFile:      []*descriptorpb.FileDescriptorProto{file},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range gen.Files {
+		if f.Generate {
+			generateFile(gen, f)
+		}
+	}
+
+	resp := gen.Response()
+	if resp.Error != nil {
+		t.Fatal(resp.GetError())
+	}
+
+	if len(resp.File) != 1 || resp.File[0].GetName() != "example.com/helloworld/greeter_cluster.pb.go" {
+		t.Fatalf("unexpected files %v", resp.File)
+	}
+
+	content := resp.File[0].GetContent()
+	if _, err := parser.ParseFile(token.NewFileSet(), "greeter_cluster.pb.go", content, 0); err != nil {
+		t.Fatalf("generated code does not parse: %v\n%s", err, content)
+	}
+
+	for _, want := range []string{
+		`Greeter_SayHello_Cid = "helloworld.Greeter.SayHello"`,
+		`SayHello(ctx context.Context, in *HelloRequest, opts ...nakama_cluster.SendOption) (*HelloReply, error)`,
+		`Watch(ctx context.Context, clientId string, node *nakama_cluster.Meta, in *HelloRequest) (<-chan *HelloReply, error)`,
+		`Watch(ctx context.Context, in *HelloRequest, send func(*HelloReply) bool) error`,
+		`func RegisterGreeterClusterServer(mux *nakama_cluster.ServiceMux, srv GreeterClusterServer)`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Fatalf("missing %q in\n%s", want, content)
+		}
+	}
+
+	if strings.Contains(content, "Greeter_Chat_Cid") {
+		t.Fatal("client streaming method generated")
+	}
+}
@@ -0,0 +1,26 @@
+// protoc-gen-nakama-cluster generates typed cluster clients and servers of the services of
+// proto files, the messages are sent as Any payloads of envelopes with one cid per method.
+//
+// Usage:
+//
+//	protoc --go_out=. --nakama-cluster_out=. greeter.proto
+//
+// Unary methods are sent to a node of the service with SendToName and served by Call, server
+// streaming methods are sent with SendStreamRequest and served by Stream. Client and bidi
+// streaming methods are not generated.
+package main
+
+import (
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+func main() {
+	protogen.Options{}.Run(func(gen *protogen.Plugin) error {
+		for _, f := range gen.Files {
+			if f.Generate {
+				generateFile(gen, f)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,72 @@
+package nakamacluster
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/protobuf/proto"
+)
+
+// COMPRESSION_GZIP name of the grpc gzip compressor registered by the package, other
+// compressors can be used by their name once the application registered them
+const COMPRESSION_GZIP = gzip.Name
+
+type callCompressionKey struct{}
+
+// WithCallCompression returns a context compressing the peer calls made with it by the named
+// compressor whatever their size, an empty name sends them uncompressed
+func WithCallCompression(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, callCompressionKey{}, name)
+}
+
+// callCompression compression of the calls to other nodes, requests smaller than minSize
+// are sent uncompressed. The node called replies with the compressor of the request
+type callCompression struct {
+	name    string
+	minSize int
+}
+
+// grpcCompression returns the compressor of the calls of the config, empty when it is not registered
+func grpcCompression(logger *zap.Logger, c Config) string {
+	if c.GrpcCompression != "" && encoding.GetCompressor(c.GrpcCompression) == nil {
+		logger.Warn("Unknown grpc compressor, calls are not compressed", zap.String("compression", c.GrpcCompression))
+		return ""
+	}
+	return c.GrpcCompression
+}
+
+// compressor returns the compressor of a call with the request of the size, streams have no size
+func (c callCompression) compressor(ctx context.Context, size int) string {
+	if name, ok := ctx.Value(callCompressionKey{}).(string); ok {
+		return name
+	}
+
+	if size < 0 || size < c.minSize {
+		return ""
+	}
+	return c.name
+}
+
+func (c callCompression) unaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	size := -1
+	if m, ok := req.(proto.Message); ok {
+		size = proto.Size(m)
+	}
+
+	if name := c.compressor(ctx, size); name != "" {
+		opts = append(opts, grpc.UseCompressor(name))
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// streamClientInterceptor compress the streams opened with WithCallCompression, the size of
+// the messages of a stream is not known when it is opened
+func (c callCompression) streamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if name := c.compressor(ctx, -1); name != "" {
+		opts = append(opts, grpc.UseCompressor(name))
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
@@ -0,0 +1,82 @@
+package nakamacluster
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/encoding"
+)
+
+// countingCompressor gzip compressor counting the messages it compressed
+type countingCompressor struct {
+	encoding.Compressor
+	compressed int32
+}
+
+func (c *countingCompressor) Name() string {
+	return "counting-gzip"
+}
+
+func (c *countingCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	atomic.AddInt32(&c.compressed, 1)
+	return c.Compressor.Compress(w)
+}
+
+var testCompressor = &countingCompressor{Compressor: encoding.GetCompressor(COMPRESSION_GZIP)}
+
+func init() {
+	encoding.RegisterCompressor(testCompressor)
+}
+
+func TestCallCompression(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(echoServerDelegate{})
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, Compression: testCompressor.Name(), CompressionMinSize: 512})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	send := func(ctx context.Context, size int) int32 {
+		before := atomic.LoadInt32(&testCompressor.compressed)
+		payload := bytes.Repeat([]byte("a"), size)
+		out, err := peer.Send(ctx, node, &api.Envelope{Cid: "echo", Payload: &api.Envelope_Bytes{Bytes: payload}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(out.GetBytes(), payload) {
+			t.Fatalf("payload of %d bytes changed", size)
+		}
+		return atomic.LoadInt32(&testCompressor.compressed) - before
+	}
+
+	if n := send(ctx, 16); n != 0 {
+		t.Fatalf("small request compressed %d times", n)
+	}
+
+	// the request is compressed and the server replies with the same compressor
+	if n := send(ctx, 4096); n != 2 {
+		t.Fatalf("large call compressed %d times", n)
+	}
+
+	if n := send(WithCallCompression(ctx, ""), 4096); n != 0 {
+		t.Fatalf("call compressed %d times without compression", n)
+	}
+
+	if n := send(WithCallCompression(ctx, testCompressor.Name()), 16); n != 2 {
+		t.Fatalf("forced call compressed %d times", n)
+	}
+
+	if grpcCompression(zap.NewNop(), Config{GrpcCompression: "unknown"}) != "" {
+		t.Fatal("unknown compressor used")
+	}
+}
@@ -4,6 +4,14 @@ package nakamacluster
 type Config struct {
 	Addr                         string `yaml:"gossip_bindaddr" json:"gossip_bindaddr" usage:"Interface address to bind Nakama to for discovery. By default listening on all interfaces."`
 	Port                         int    `yaml:"gossip_bindport" json:"gossip_bindport" usage:"Port number to bind Nakama to for discovery. Default value is 7352."`
+	AdvertiseAddr                string `yaml:"advertise_addr" json:"advertise_addr" usage:"advertise_addr is the externally reachable address announced to other nodes when it differs from the bind address, e.g. behind NAT. Empty uses the bind address."`
+	AdvertisePort                int    `yaml:"advertise_port" json:"advertise_port" usage:"advertise_port is the externally reachable port announced to other nodes. 0 uses the bind port."`
+	DuplicateIdPolicy            string `yaml:"duplicate_id_policy" json:"duplicate_id_policy" usage:"duplicate_id_policy decides which node steps down when two nodes register the same id: reject the newer node, evict the older node, or epoch to evict the older node and fence its calls, Default value is evict"`
+	SendStrategy                 string `yaml:"send_strategy" json:"send_strategy" usage:"send_strategy picks the node of a service serving SendToName: round_robin, random or latency, Default value is round_robin"`
+	RingHash                     string `yaml:"ring_hash" json:"ring_hash" usage:"ring_hash is the hash function of the service hashrings: md5, xxhash or murmur3, Default value is md5"`
+	RingVirtualNodes             int    `yaml:"ring_virtual_nodes" json:"ring_virtual_nodes" usage:"ring_virtual_nodes is the number of hashring points of every unit of node weight, Default value is 1"`
+	Namespace                    string `yaml:"namespace" json:"namespace" usage:"namespace isolates nodes sharing the sd prefix, nodes only see, route to and gossip with nodes of the same namespace"`
+	ClusterName                  string `yaml:"cluster_name" json:"cluster_name" usage:"cluster_name identifies the cluster, nodes of another cluster are rejected from the gossip and sd and a node finding one under its prefix fails to start, Default value is empty and no node is rejected"`
 	Domain                       string `yaml:"domain" json:"domain" usage:"Domain"`
 	Prefix                       string `yaml:"prefix" json:"prefix" usage:"service prefix"`
 	Weight                       int    `yaml:"weight" json:"weight" usage:"Peer weight"`
@@ -13,37 +21,254 @@ type Config struct {
 	ProbeTimeout                 int    `yaml:"probe_timeout" json:"probe_timeout" usage:"probe_timeout is the timeout to wait for an ack from a probed node before assuming it is unhealthy. This should be set to 99-percentile of RTT (round-trip time) on your network, Default value is 500 Millisecond"`
 	ProbeInterval                int    `yaml:"probe_interval" json:"probe_interval" usage:"probe_interval is the interval between random node probes. Setting this lower (more frequent) will cause the memberlist cluster to detect failed nodes more quickly at the expense of increased bandwidth usage., Default value is 1 Second"`
 	RetransmitMult               int    `yaml:"retransmit_mult" json:"retransmit_mult" usage:"retransmit_mult is the multiplier used to determine the maximum number of retransmissions attempted, Default value is 2"`
+	GossipNodes                  int    `yaml:"gossip_nodes" json:"gossip_nodes" usage:"gossip_nodes is the number of random nodes gossip messages are sent to per gossip_interval, Default value is 3"`
+	IndirectChecks               int    `yaml:"indirect_checks" json:"indirect_checks" usage:"indirect_checks is the number of nodes asked to perform an indirect probe of a node that failed a direct probe, Default value is 1"`
+	SuspicionMult                int    `yaml:"suspicion_mult" json:"suspicion_mult" usage:"suspicion_mult is the multiplier for determining the time a suspect node is considered alive before it is declared dead, raise it on congested networks, Default value is 3"`
+	SuspicionMaxTimeoutMult      int    `yaml:"suspicion_max_timeout_mult" json:"suspicion_max_timeout_mult" usage:"suspicion_max_timeout_mult is the multiplier applied to the suspicion timeout to get the upper bound while few nodes have confirmed the suspicion, Default value is 6"`
+	AwarenessMaxMultiplier       int    `yaml:"awareness_max_multiplier" json:"awareness_max_multiplier" usage:"awareness_max_multiplier limits how much a node slows its probe interval when it is itself degraded, Default value is 8"`
+	DNSName                      string `yaml:"dns_name" json:"dns_name" usage:"dns_name is registered as the node address instead of the resolved ip, use it for nodes behind a k8s Service or NAT"`
+	ResolveInterval              int    `yaml:"resolve_interval" json:"resolve_interval" usage:"resolve_interval is the interval for re-resolving node addresses registered as dns names, 0 only re-resolves on dial failures, Default value is 30 Second"`
+	GossipToTheDeadTime          int    `yaml:"gossip_to_the_dead_time" json:"gossip_to_the_dead_time" usage:"gossip_to_the_dead_time is the interval after which a node has died that we will still try to gossip to it, Default value is 15 Second"`
+	GossipCompression            bool   `yaml:"gossip_compression" json:"gossip_compression" usage:"gossip_compression compresses gossip messages, Default value is true"`
+	GossipMetrics                bool   `yaml:"gossip_metrics" json:"gossip_metrics" usage:"gossip_metrics reports the memberlist metrics to the metrics scope, it replaces the global go-metrics sink of the process, Default value is true"`
+	GossipDisabled               bool   `yaml:"gossip_disabled" json:"gossip_disabled" usage:"gossip_disabled runs nakama nodes without memberlist for networks without udp, membership comes from sd only, nodes failing their grpc heartbeats are quarantined and nakama nodes cannot broadcast or send messages to each other, Default value is false"`
+	GossipSigningKey             string `yaml:"gossip_signing_key" json:"gossip_signing_key" usage:"gossip_signing_key is the secret signing the messages sent through gossip, unsigned messages and messages with a bad signature are dropped, nodes without it accept signed messages so it can be enabled node by node"`
+	GossipReplayWindow           int    `yaml:"gossip_replay_window" json:"gossip_replay_window" usage:"gossip_replay_window is the age signed gossip messages are accepted within, a message replayed within it is dropped, Default value is 30 Second"`
+	ExpirySkewTolerance          int    `yaml:"expiry_skew_tolerance" json:"expiry_skew_tolerance" usage:"expiry_skew_tolerance is the clock skew allowed when discarding expired envelopes, Default value is 500 Millisecond"`
+	RPCTimeout                   int    `yaml:"rpc_timeout" json:"rpc_timeout" usage:"rpc_timeout is the timeout of peer calls whose context has no deadline, 0 disables it, Default value is 0 Millisecond"`
 	MaxGossipPacketSize          int    `yaml:"max_gossip_packet_size" json:"max_gossip_packet_size" usage:"max_gossip_packet_size Maximum number of bytes that memberlist will put in a packet (this will be for UDP packets by default with a NetTransport), Default value is 1400"`
 	BroadcastQueueSize           int    `yaml:"broadcast_queue_size" json:"broadcast_queue_size" usage:"broadcast message queue size"`
 	GrpcX509Pem                  string `yaml:"grpc_x509_pem" json:"grpc_x509_pem" usage:"ssl pem"`
 	GrpcX509Key                  string `yaml:"grpc_x509_key" json:"grpc_x509_key" usage:"ssl key"`
 	GrpcToken                    string `yaml:"grpc_token" json:"grpc_token" usage:"token"`
-	GrpcPoolMaxIdle              int    `yaml:"grpc_pool_max_idle" json:"grpc_pool_max_idle" usage:"Maximum number of idle connections in the grpc pool"`
-	GrpcPoolMaxActive            int    `yaml:"grpc_pool_max_active" json:"grpc_pool_max_active" usage:"Maximum number of connections allocated by the grpc pool at a given time."`
-	GrpcPoolMaxConcurrentStreams int    `yaml:"grpc_pool_max_concurrent_streams" json:"grpc_pool_max_concurrent_streams" usage:"MaxConcurrentStreams limit on the number of concurrent grpc streams to each single connection,create a one-time connection to return."`
-	GrpcPoolReuse                bool   `yaml:"grpc_pool_reuse" json:"grpc_pool_reuse" usage:"If Reuse is true and the pool is at the GrpcPoolMaxActive limit, then Get() reuse,the connection to return, If Reuse is false and the pool is at the MaxActive limit"`
+	ControlKey                   string `yaml:"control_key" json:"control_key" usage:"control_key is the secret signing control envelopes like remote maintenance toggles, control envelopes are rejected when it is empty"`
+	AuditLogFile                 string `yaml:"audit_log_file" json:"audit_log_file" usage:"audit_log_file is the file the membership changes, status changes, flag changes and control commands of the node are appended to as json lines, empty disables it unless an audit sink is set with WithAuditSink"`
+	GrpcX509Ca                   string `yaml:"grpc_x509_ca" json:"grpc_x509_ca" usage:"grpc_x509_ca is the ca certificate verifying the grpc listeners of other nodes, connections to them use tls when it is set and present grpc_x509_pem as client certificate"`
+	GrpcServerName               string `yaml:"grpc_server_name" json:"grpc_server_name" usage:"grpc_server_name is the name verified in the certificates of other nodes instead of their address"`
+	GrpcUnixSocket               string `yaml:"grpc_unix_socket" json:"grpc_unix_socket" usage:"grpc_unix_socket is the path of a unix socket the cluster listener also serves on, nodes of the same host_id call the node over it instead of tcp"`
+	HostId                       string `yaml:"host_id" json:"host_id" usage:"host_id identifies the host of the node, nodes of the same host call each other over their grpc_unix_socket, Default value is the hostname when grpc_unix_socket is set"`
+	GrpcPoolSize                 int    `yaml:"grpc_pool_size" json:"grpc_pool_size" usage:"grpc_pool_size is the number of connections to every node the grpc calls are spread over, Default value is 4"`
+	GrpcDialTimeout              int    `yaml:"grpc_dial_timeout" json:"grpc_dial_timeout" usage:"grpc_dial_timeout is the time a connection to a node may take to become ready, Default value is 5 Second"`
+	GrpcPoolMaxIdle              int    `yaml:"grpc_pool_max_idle" json:"grpc_pool_max_idle" usage:"Deprecated: ignored, use grpc_pool_size"`
+	GrpcPoolMaxActive            int    `yaml:"grpc_pool_max_active" json:"grpc_pool_max_active" usage:"Deprecated: ignored, use grpc_pool_size"`
+	GrpcPoolMaxConcurrentStreams int    `yaml:"grpc_pool_max_concurrent_streams" json:"grpc_pool_max_concurrent_streams" usage:"Deprecated: ignored, use grpc_pool_size"`
+	GrpcPoolReuse                bool   `yaml:"grpc_pool_reuse" json:"grpc_pool_reuse" usage:"Deprecated: ignored, use grpc_pool_size"`
+	GrpcPoolLeakThreshold        int    `yaml:"grpc_pool_leak_threshold" json:"grpc_pool_leak_threshold" usage:"grpc_pool_leak_threshold logs the call sites holding a pooled grpc connection longer than it, 0 disables leak detection, Default value is 60 Second"`
+	GrpcCompression              string `yaml:"grpc_compression" json:"grpc_compression" usage:"grpc_compression is the name of the grpc compressor of the calls to other nodes like gzip, every node must know it, empty sends them uncompressed"`
+	GrpcCompressionMinSize       int    `yaml:"grpc_compression_min_size" json:"grpc_compression_min_size" usage:"grpc_compression_min_size is the size in bytes of the smallest request compressed, Default value is 1024"`
 	GrpcPoolMessageQueueSize     int    `yaml:"grpc_pool_message_queue_size" json:"grpc_pool_message_queue_size" usage:"grpc message queue size"`
+	MaxStreamMessageSize         int    `yaml:"max_stream_message_size" json:"max_stream_message_size" usage:"max_stream_message_size Maximum number of bytes of a single stream message, larger messages are sent in chunks, Default value is 4194304"`
+	ChunkTimeout                 int    `yaml:"chunk_timeout" json:"chunk_timeout" usage:"chunk_timeout is the timeout for receiving every chunk of a large message before it is dropped, Default value is 10 Second"`
+	ChunkMaxTotal                int    `yaml:"chunk_max_total" json:"chunk_max_total" usage:"chunk_max_total is the maximum number of chunks of a large message, messages announcing more are dropped, Default value is 16384"`
+	ChunkMaxBytes                int    `yaml:"chunk_max_bytes" json:"chunk_max_bytes" usage:"chunk_max_bytes is the maximum number of bytes of the incomplete large messages buffered per sender, Default value is 67108864"`
+	SendWorkers                  int    `yaml:"send_workers" json:"send_workers" usage:"send_workers is the maximum number of concurrent outbound sends, sends to a node run in order on the same worker, Default value is 16"`
+	SendQueueSize                int    `yaml:"send_queue_size" json:"send_queue_size" usage:"send_queue_size is the number of outbound sends waiting for every worker, Default value is 64"`
+	EgressNodeRate               int    `yaml:"egress_node_rate" json:"egress_node_rate" usage:"egress_node_rate is the maximum bytes per second sent to a single node over grpc, 0 disables the limit"`
+	EgressRate                   int    `yaml:"egress_rate" json:"egress_rate" usage:"egress_rate is the maximum bytes per second sent to all nodes together over grpc, 0 disables the limit"`
+	NotifyWorkers                int    `yaml:"notify_workers" json:"notify_workers" usage:"notify_workers is the number of goroutines handling inbound gossip messages, messages of a node are handled in order by the same worker, 0 handles them on the memberlist goroutine, Default value is 8"`
+	NotifyQueueSize              int    `yaml:"notify_queue_size" json:"notify_queue_size" usage:"notify_queue_size is the number of inbound gossip messages waiting for every worker, messages are dropped when it is full, Default value is 256"`
+	FlapThreshold                int    `yaml:"flap_threshold" json:"flap_threshold" usage:"flap_threshold quarantines nodes that join or leave more than it within flap_window, 0 disables flap detection, Default value is 5"`
+	FlapWindow                   int    `yaml:"flap_window" json:"flap_window" usage:"flap_window is the window joins and leaves of a node are counted in, Default value is 60 Second"`
+	FlapCooldown                 int    `yaml:"flap_cooldown" json:"flap_cooldown" usage:"flap_cooldown is the time a flapping node gets no traffic and is not dialed, Default value is 300 Second"`
+	StreamIdleTimeout            int    `yaml:"stream_idle_timeout" json:"stream_idle_timeout" usage:"stream_idle_timeout closes peer streams without messages sent or received for it, 0 disables it, Default value is 600 Second"`
+	StreamTTL                    int    `yaml:"stream_ttl" json:"stream_ttl" usage:"stream_ttl closes peer streams older than it, 0 disables it, Default value is 0 Second"`
+	StreamStatsRetention         int    `yaml:"stream_stats_retention" json:"stream_stats_retention" usage:"stream_stats_retention keeps the traffic stats of a stream client id without open streams for it, 0 forgets them once its last stream closed, Default value is 3600 Second"`
+	HeartbeatInterval            int    `yaml:"heartbeat_interval" json:"heartbeat_interval" usage:"heartbeat_interval is the interval of the pings measuring the round trip time to connected nodes, 0 disables them, Default value is 5 Second"`
+	StreamCoalesceLinger         int    `yaml:"stream_coalesce_linger" json:"stream_coalesce_linger" usage:"stream_coalesce_linger is the time the sends on a peer stream wait to be written together with the next ones in one batch, 0 writes every send at once, Default value is 0 Microsecond"`
+	StreamWindowSize             int    `yaml:"stream_window_size" json:"stream_window_size" usage:"stream_window_size is the number of stream messages a sender may have in flight before waiting for the receiver, 0 disables flow control, Default value is 256"`
+	AsyncSendWorkers             int    `yaml:"async_send_workers" json:"async_send_workers" usage:"async_send_workers is the maximum number of concurrent asynchronous peer sends, Default value is 8"`
+	AsyncSendQueueSize           int    `yaml:"async_send_queue_size" json:"async_send_queue_size" usage:"async_send_queue_size is the number of asynchronous peer sends waiting for a worker, Default value is 1024"`
+	GrpcErrorStatus              bool   `yaml:"grpc_error_status" json:"grpc_error_status" usage:"grpc_error_status returns envelopes carrying an error payload as gRPC status errors"`
+	GrpcReflection               bool   `yaml:"grpc_reflection" json:"grpc_reflection" usage:"grpc_reflection registers the grpc reflection service on the cluster listener for tools like grpcurl"`
+	GrpcHealth                   bool   `yaml:"grpc_health" json:"grpc_health" usage:"grpc_health registers the grpc health/v1 service on the cluster listener for liveness probes, it is not guarded by grpc_token, Default value is true"`
+	GrpcObserver                 bool   `yaml:"grpc_observer" json:"grpc_observer" usage:"grpc_observer registers the read-only observer service listing the nodes, events, rings and stats of the cluster on the cluster listener for dashboards, it needs no control_key"`
+	RelayRetransmitMult          int    `yaml:"relay_retransmit_mult" json:"relay_retransmit_mult" usage:"relay_retransmit_mult is the multiplier used to determine the number of nodes each hop of a hop-limited broadcast is sent to, Default value is 1"`
+	BootstrapExpect              int    `yaml:"bootstrap_expect" json:"bootstrap_expect" usage:"bootstrap_expect is the number of nodes of the service, this one included, that must be up before the node reports ready on start, 0 disables it"`
+	BootstrapTimeout             int    `yaml:"bootstrap_timeout" json:"bootstrap_timeout" usage:"bootstrap_timeout is the time a node waits for the bootstrap quorum before it reports ready anyway, 0 waits forever, Default value is 120 Second"`
+	IdempotencyTTL               int    `yaml:"idempotency_ttl" json:"idempotency_ttl" usage:"idempotency_ttl is the time the reply of a call with an idempotency key is returned to its retries instead of executing them, 0 disables deduplication, Default value is 300 Second"`
+	IdempotencyMaxKeys           int    `yaml:"idempotency_max_keys" json:"idempotency_max_keys" usage:"idempotency_max_keys is the maximum number of idempotency keys remembered, the oldest are forgotten first, 0 is unlimited, Default value is 65536"`
+	OutboxRetryInterval          int    `yaml:"outbox_retry_interval" json:"outbox_retry_interval" usage:"outbox_retry_interval is the interval unacknowledged outbox envelopes are sent again at when an outbox storage is set, Default value is 5 Second"`
+	OutboxTTL                    int    `yaml:"outbox_ttl" json:"outbox_ttl" usage:"outbox_ttl drops outbox envelopes not delivered within it, 0 retries them forever, Default value is 0 Second"`
+	OverloadShedLow              int    `yaml:"overload_shed_low" json:"overload_shed_low" usage:"overload_shed_low is the pressure in percent of the fullest queue or of overload_latency from which envelopes of shed_routes are shed, 0 never sheds them"`
+	OverloadShedNormal           int    `yaml:"overload_shed_normal" json:"overload_shed_normal" usage:"overload_shed_normal is the pressure in percent from which every envelope but control and realtime_routes ones is shed, 0 never sheds them"`
+	OverloadLatency              int    `yaml:"overload_latency" json:"overload_latency" usage:"overload_latency is the average handling latency of inbound envelopes counted as a pressure of 100 percent, 0 ignores latency, Default value is 0 Millisecond"`
+	SloLatency                   int    `yaml:"slo_latency" json:"slo_latency" usage:"slo_latency is the handling latency above which a request of slo_routes counts against the error budget, 0 ignores latency, Default value is 0 Millisecond"`
+	SloWindow                    int    `yaml:"slo_window" json:"slo_window" usage:"slo_window is the rolling window the success ratio and error budget of slo_routes are measured on, Default value is 300 Second"`
+	SloMinRequests               int    `yaml:"slo_min_requests" json:"slo_min_requests" usage:"slo_min_requests is the number of requests of a route in slo_window below which its breaker never trips, Default value is 20"`
+	SloBreakerCooldown           int    `yaml:"slo_breaker_cooldown" json:"slo_breaker_cooldown" usage:"slo_breaker_cooldown is the time a route that exhausted its error budget rejects requests, 0 never rejects them, Default value is 0 Second"`
+	JoinRetryInterval            int    `yaml:"join_retry_interval" json:"join_retry_interval" usage:"join_retry_interval is the first delay between the retries of a failed sd read, sd registration or gossip join at startup, the delay doubles after every retry. Default value is 500 Millisecond"`
+	JoinRetryMaxInterval         int    `yaml:"join_retry_max_interval" json:"join_retry_max_interval" usage:"join_retry_max_interval is the maximum delay between the startup retries. Default value is 10000 Millisecond"`
+	JoinDeadline                 int    `yaml:"join_deadline" json:"join_deadline" usage:"join_deadline is the time the startup retries give up after, a node without sd entries exits, 0 tries once. Default value is 60 Second"`
+	WatchdogThreshold            int    `yaml:"watchdog_threshold" json:"watchdog_threshold" usage:"watchdog_threshold is the time a delegate Call, Stream or NotifyMsg may run before it is logged and counted as stuck, 0 disables the warnings. Default value is 10000 Millisecond"`
+	WatchdogCancel               bool   `yaml:"watchdog_cancel" json:"watchdog_cancel" usage:"watchdog_cancel cancels the context of Call and Stream handlers running past watchdog_threshold, Default value is false"`
+
+	Labels              map[string]string `yaml:"labels" json:"labels" usage:"labels are structured node labels matched by label selectors"`
+	BootstrapNodes      []string          `yaml:"bootstrap_nodes" json:"bootstrap_nodes" usage:"bootstrap_nodes are the ids of the nodes of the service that must be up before the node reports ready on start"`
+	PeerCacheFile       string            `yaml:"peer_cache_file" json:"peer_cache_file" usage:"peer_cache_file persists the last-known nodes for routing on startup before sd has been read, empty disables the cache"`
+	PeerCacheMaxAge     int               `yaml:"peer_cache_max_age" json:"peer_cache_max_age" usage:"peer_cache_max_age is the age after which the peer cache is ignored, Default value is 3600 Second"`
+	JournalRetention    int               `yaml:"journal_retention" json:"journal_retention" usage:"journal_retention is the time outbound messages are kept in the journal when it is enabled, Default value is 60 Second"`
+	TraceBufferSize     int               `yaml:"trace_buffer_size" json:"trace_buffer_size" usage:"trace_buffer_size is the number of recent inbound and outbound envelopes kept for the traces control command, 0 disables tracing, Default value is 1024"`
+	TraceSampleRate     int               `yaml:"trace_sample_rate" json:"trace_sample_rate" usage:"trace_sample_rate keeps the payload of one in trace_sample_rate traced envelopes, 0 keeps headers only"`
+	JournalMaxBytes     int               `yaml:"journal_max_bytes" json:"journal_max_bytes" usage:"journal_max_bytes is the maximum size of the journal, the oldest messages are dropped first, Default value is 67108864"`
+	JournalKey          string            `yaml:"journal_key" json:"journal_key" usage:"journal_key is the secret signing the journal replay requests between service nodes, replays are refused when it is empty"`
+	KafkaEventsTopic    string            `yaml:"kafka_events_topic" json:"kafka_events_topic" usage:"kafka_events_topic is the kafka topic of cluster events, empty disables publishing events"`
+	KafkaEnvelopesTopic string            `yaml:"kafka_envelopes_topic" json:"kafka_envelopes_topic" usage:"kafka_envelopes_topic is the kafka topic of envelopes sent to peers, empty disables publishing envelopes"`
+	KafkaRoutes         []string          `yaml:"kafka_routes" json:"kafka_routes" usage:"kafka_routes are the cid patterns of the envelopes published to kafka, e.g. match.*"`
+	KafkaBatchSize      int               `yaml:"kafka_batch_size" json:"kafka_batch_size" usage:"kafka_batch_size is the maximum number of messages written to kafka at once, Default value is 100"`
+	KafkaBatchTimeout   int               `yaml:"kafka_batch_timeout" json:"kafka_batch_timeout" usage:"kafka_batch_timeout is the maximum time a message waits for its batch to fill, Default value is 1000 Millisecond"`
+	KafkaQueueSize      int               `yaml:"kafka_queue_size" json:"kafka_queue_size" usage:"kafka_queue_size is the number of messages waiting to be written to kafka, Default value is 4096"`
+	RingVars            []string          `yaml:"ring_vars" json:"ring_vars" usage:"ring_vars are the vars nodes are also placed on a hashring per value of, e.g. region, routing to the ring of a value like a service name"`
+	ShedRoutes          []string          `yaml:"shed_routes" json:"shed_routes" usage:"shed_routes are the cid patterns of the low priority envelopes shed first under overload, e.g. stats.*"`
+	RealtimeRoutes      []string          `yaml:"realtime_routes" json:"realtime_routes" usage:"realtime_routes are the cid patterns of the envelopes never shed under overload, e.g. match.*"`
+	SloRoutes           []string          `yaml:"slo_routes" json:"slo_routes" usage:"slo_routes are the cid patterns of the routes whose success ratio, latency and error budget are tracked, e.g. match.*"`
+	SloObjective        float64           `yaml:"slo_objective" json:"slo_objective" usage:"slo_objective is the ratio of the requests of a route of slo_routes that must succeed, Default value is 0.999"`
+	VarSchema           map[string]string `yaml:"var_schema" json:"var_schema" usage:"var_schema maps the vars every node must announce to their type: string, int, bool or duration, nodes missing one or announcing one of another type are rejected, e.g. region: string"`
 }
 
 func NewConfig() *Config {
 	c := &Config{
-		Addr:                         "0.0.0.0",
-		Port:                         7355,
-		Prefix:                       "/nakama-cluster/services/",
-		Weight:                       1,
-		PushPullInterval:             10,
-		GossipInterval:               200,
-		TCPTimeout:                   10,
-		ProbeTimeout:                 500,
-		ProbeInterval:                1,
-		RetransmitMult:               2,
-		MaxGossipPacketSize:          1400,
-		BroadcastQueueSize:           32,
-		GrpcPoolMaxIdle:              8,
-		GrpcPoolMaxActive:            64,
-		GrpcPoolMaxConcurrentStreams: 64,
-		GrpcPoolReuse:                true,
-		GrpcPoolMessageQueueSize:     1,
+		Addr:                     "0.0.0.0",
+		Port:                     7355,
+		Prefix:                   "/nakama-cluster/services/",
+		Weight:                   1,
+		DuplicateIdPolicy:        DUPLICATE_ID_EVICT,
+		SendStrategy:             STRATEGY_ROUND_ROBIN,
+		RingHash:                 RING_HASH_MD5,
+		RingVirtualNodes:         1,
+		PushPullInterval:         10,
+		GossipInterval:           200,
+		TCPTimeout:               10,
+		ProbeTimeout:             500,
+		ProbeInterval:            1,
+		RetransmitMult:           2,
+		GossipNodes:              3,
+		IndirectChecks:           1,
+		SuspicionMult:            3,
+		SuspicionMaxTimeoutMult:  6,
+		AwarenessMaxMultiplier:   8,
+		ResolveInterval:          30,
+		GossipToTheDeadTime:      15,
+		GossipCompression:        true,
+		GossipMetrics:            true,
+		ExpirySkewTolerance:      500,
+		MaxGossipPacketSize:      1400,
+		BroadcastQueueSize:       32,
+		GrpcPoolSize:             4,
+		GrpcDialTimeout:          5,
+		GrpcPoolLeakThreshold:    60,
+		GrpcCompressionMinSize:   1024,
+		GrpcPoolMessageQueueSize: 1,
+		MaxStreamMessageSize:     4 << 20,
+		ChunkTimeout:             10,
+		ChunkMaxTotal:            defaultChunkMaxTotal,
+		ChunkMaxBytes:            defaultChunkMaxBytes,
+		SendWorkers:              16,
+		SendQueueSize:            64,
+		NotifyWorkers:            8,
+		NotifyQueueSize:          256,
+		FlapThreshold:            5,
+		FlapWindow:               60,
+		FlapCooldown:             300,
+		StreamIdleTimeout:        600,
+		StreamStatsRetention:     3600,
+		HeartbeatInterval:        5,
+		StreamWindowSize:         256,
+		AsyncSendWorkers:         8,
+		AsyncSendQueueSize:       1024,
+		GrpcHealth:               true,
+		RelayRetransmitMult:      1,
+		BootstrapTimeout:         120,
+		IdempotencyTTL:           300,
+		GossipReplayWindow:       30,
+		IdempotencyMaxKeys:       65536,
+		OutboxRetryInterval:      5,
+		JoinRetryInterval:        500,
+		JoinRetryMaxInterval:     10000,
+		JoinDeadline:             60,
+		WatchdogThreshold:        10000,
+		PeerCacheMaxAge:          3600,
+		JournalRetention:         60,
+		JournalMaxBytes:          64 << 20,
+		TraceBufferSize:          1024,
+		SloObjective:             0.999,
+		SloWindow:                300,
+		SloMinRequests:           20,
+		KafkaBatchSize:           100,
+		KafkaBatchTimeout:        1000,
+		KafkaQueueSize:           4096,
+	}
+	return c
+}
+
+// NewConfigWAN create configuration for clusters spanning datacenters, based on
+// memberlist's DefaultWANConfig with higher timeouts, the overrides are applied in order
+func NewConfigWAN(overrides ...func(c *Config)) *Config {
+	c := NewConfig()
+	c.PushPullInterval = 60
+	c.GossipInterval = 500
+	c.GossipNodes = 4
+	c.GossipToTheDeadTime = 60
+	c.GossipCompression = true
+	c.TCPTimeout = 30
+	c.ProbeTimeout = 3000
+	c.ProbeInterval = 5
+	c.IndirectChecks = 3
+	c.SuspicionMult = 6
+	c.RPCTimeout = 10000
+	c.ChunkTimeout = 30
+	for _, override := range overrides {
+		override(c)
+	}
+	return c
+}
+
+// NewConfigLAN create configuration for clusters in one datacenter, based on memberlist's
+// DefaultLANConfig, the overrides are applied in order
+func NewConfigLAN(overrides ...func(c *Config)) *Config {
+	c := NewConfig()
+	c.PushPullInterval = 30
+	c.GossipInterval = 200
+	c.GossipNodes = 3
+	c.GossipToTheDeadTime = 30
+	c.TCPTimeout = 10
+	c.ProbeTimeout = 500
+	c.ProbeInterval = 1
+	c.IndirectChecks = 3
+	c.SuspicionMult = 4
+	c.RetransmitMult = 4
+	c.RPCTimeout = 5000
+	for _, override := range overrides {
+		override(c)
+	}
+	return c
+}
+
+// NewConfigLocal create configuration for development clusters on one host, based on memberlist's
+// DefaultLocalConfig with small pools and fast failure detection, the overrides are applied in order
+func NewConfigLocal(overrides ...func(c *Config)) *Config {
+	c := NewConfig()
+	c.Addr = "127.0.0.1"
+	c.PushPullInterval = 15
+	c.GossipInterval = 100
+	c.GossipToTheDeadTime = 15
+	c.GossipCompression = false
+	c.TCPTimeout = 1
+	c.ProbeTimeout = 200
+	c.ProbeInterval = 1
+	c.IndirectChecks = 1
+	c.SuspicionMult = 3
+	c.RetransmitMult = 2
+	c.RPCTimeout = 2000
+	c.GrpcPoolSize = 1
+	c.GrpcDialTimeout = 1
+	c.SendWorkers = 4
+	c.NotifyWorkers = 2
+	c.AsyncSendWorkers = 2
+	c.HeartbeatInterval = 1
+	c.JoinRetryMaxInterval = 1000
+	c.JoinDeadline = 10
+	for _, override := range overrides {
+		override(c)
 	}
 	return c
 }
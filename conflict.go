@@ -0,0 +1,94 @@
+package nakamacluster
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/doublemo/nakama-cluster/sd"
+)
+
+const (
+	DUPLICATE_ID_REJECT = "reject" // the newer registration is rejected
+	DUPLICATE_ID_EVICT  = "evict"  // the newer registration evicts the older node
+	DUPLICATE_ID_EPOCH  = "epoch"  // like evict, and calls from a stale epoch are fenced
+)
+
+var ErrDuplicateNodeId = errors.New("duplicate node id")
+
+// conflictHandler resolve duplicate ids found in sd for the local node
+type conflictHandler struct {
+	policy   string
+	local    func() *Meta
+	delegate func() ConflictDelegate
+	stop     func()
+	reassert func(meta *Meta) error
+}
+
+// check notify the delegate of a duplicate id and step down or reassert the local registration
+func (c *conflictHandler) check(metas []*Meta) error {
+	local := c.local()
+	other, ok := findDuplicate(local, metas)
+	if !ok {
+		return nil
+	}
+
+	if fn := c.delegate(); fn != nil {
+		fn.NotifyConflict(local, other)
+	}
+
+	if conflictLoser(c.policy, local, other) {
+		c.stop()
+		return fmt.Errorf("%w: %s is registered by %s", ErrDuplicateNodeId, local.Id, other.Addr)
+	}
+	return c.reassert(local)
+}
+
+// ConflictDelegate is an optional extension of Delegate and ServerDelegate
+// that is notified when another node registered the id of the local node
+type ConflictDelegate interface {
+	// NotifyConflict Receive duplicate node id notifications
+	NotifyConflict(local, other *Meta)
+}
+
+// findDuplicate returns the registration of another node using the id of local
+func findDuplicate(local *Meta, metas []*Meta) (*Meta, bool) {
+	for _, meta := range metas {
+		if meta.Id == local.Id && meta.Epoch != local.Epoch {
+			return meta, true
+		}
+	}
+	return nil, false
+}
+
+// conflictLoser reports whether local has to step down for other under the policy
+func conflictLoser(policy string, local, other *Meta) bool {
+	if policy == DUPLICATE_ID_REJECT || policy == "" {
+		return local.Epoch > other.Epoch
+	}
+	return local.Epoch < other.Epoch
+}
+
+// checkDuplicateOnStart returns ErrDuplicateNodeId when the id is
+// already registered in sd and the policy rejects the newcomer
+func checkDuplicateOnStart(sdclient sd.Client, prefix, policy string, local *Meta) error {
+	if policy != DUPLICATE_ID_REJECT && policy != "" {
+		return nil
+	}
+
+	values, err := sdclient.GetEntries(prefix)
+	if err != nil {
+		return nil
+	}
+
+	metas := make([]*Meta, 0, len(values))
+	for _, value := range values {
+		if meta := NewNodeMetaFromJSON([]byte(value)); meta != nil {
+			metas = append(metas, meta)
+		}
+	}
+
+	if other, ok := findDuplicate(local, metas); ok {
+		return fmt.Errorf("%w: %s is registered by %s", ErrDuplicateNodeId, local.Id, other.Addr)
+	}
+	return nil
+}
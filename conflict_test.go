@@ -0,0 +1,110 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+// deregisterClient sd client reporting the services it deregistered
+type deregisterClient struct {
+	sd.Client
+	deregistered chan sd.Service
+}
+
+func (c *deregisterClient) Deregister(s sd.Service) error {
+	err := c.Client.Deregister(s)
+	c.deregistered <- s
+	return err
+}
+
+// conflictNode watcher of a node registering meta and its conflict handler
+type conflictNode struct {
+	meta      *Meta
+	watcher   *Watcher
+	client    *deregisterClient
+	conflicts *conflictHandler
+}
+
+func newConflictNode(ctx context.Context, t *testing.T, store *sd.MemoryStore, policy string, epoch int64) *conflictNode {
+	node := &conflictNode{
+		meta:   &Meta{Id: "node1", Name: "svc", Addr: "127.0.0.1", Epoch: epoch},
+		client: &deregisterClient{Client: store.NewClient(ctx), deregistered: make(chan sd.Service, 1)},
+	}
+	node.watcher = NewWatcher(ctx, zap.NewNop(), node.client, "/nodes/", node.meta)
+	select {
+	case <-node.watcher.Registered():
+	case <-ctx.Done():
+		t.Fatal("node not registered")
+	}
+
+	node.conflicts = &conflictHandler{
+		policy:   policy,
+		local:    func() *Meta { return node.meta },
+		delegate: func() ConflictDelegate { return nil },
+		stop:     node.watcher.Stop,
+		reassert: node.watcher.Update,
+	}
+	return node
+}
+
+func (node *conflictNode) check(t *testing.T) error {
+	metas, err := node.watcher.GetEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node.conflicts.check(metas)
+}
+
+func TestConflictLoserKeepsWinnerRegistration(t *testing.T) {
+	for _, policy := range []string{DUPLICATE_ID_REJECT, DUPLICATE_ID_EVICT, DUPLICATE_ID_EPOCH} {
+		t.Run(policy, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			store := sd.NewMemoryStore()
+			older := newConflictNode(ctx, t, store, policy, 1)
+			newer := newConflictNode(ctx, t, store, policy, 2)
+
+			winner, loser := older, newer
+			if policy != DUPLICATE_ID_REJECT {
+				winner, loser = newer, older
+			}
+
+			if err := winner.check(t); err != nil {
+				t.Fatalf("winner stepped down %v", err)
+			}
+
+			if err := loser.check(t); !errors.Is(err, ErrDuplicateNodeId) {
+				t.Fatalf("loser kept running %v", err)
+			}
+
+			select {
+			case s := <-loser.client.deregistered:
+				if !s.KeepKey {
+					t.Fatal("loser deleted the registration of the winner")
+				}
+			case <-ctx.Done():
+				t.Fatal("loser not deregistered")
+			}
+
+			if epoch, ok := winner.watcher.registeredEpoch("node1"); !ok || epoch != winner.meta.Epoch {
+				t.Fatalf("registered epoch %d, want %d", epoch, winner.meta.Epoch)
+			}
+
+			winner.watcher.Stop()
+			select {
+			case s := <-winner.client.deregistered:
+				if s.KeepKey {
+					t.Fatal("winner kept its registration once stopped")
+				}
+			case <-ctx.Done():
+				t.Fatal("winner not deregistered")
+			}
+		})
+	}
+}
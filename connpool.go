@@ -0,0 +1,287 @@
+package nakamacluster
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// grpc settings of the connections between nodes
+const (
+	// DefaultDialTimeout time a connection may take to become ready
+	DefaultDialTimeout = 5 * time.Second
+
+	// grpcBackoffMaxDelay maximum delay between the reconnects of a connection
+	grpcBackoffMaxDelay = 3 * time.Second
+
+	// grpcKeepAliveTime idle time after which a connection is pinged
+	grpcKeepAliveTime = 10 * time.Second
+
+	// grpcKeepAliveTimeout time the keepalive ping waits for its ack before closing the connection
+	grpcKeepAliveTimeout = 3 * time.Second
+
+	// grpcInitialWindowSize flow control window of every stream
+	grpcInitialWindowSize = 1 << 30
+
+	// grpcInitialConnWindowSize flow control window of every connection
+	grpcInitialConnWindowSize = 1 << 30
+
+	// grpcMaxSendMsgSize maximum size of a sent message
+	grpcMaxSendMsgSize = 4 << 30
+
+	// grpcMaxRecvMsgSize maximum size of a received message
+	grpcMaxRecvMsgSize = 4 << 30
+)
+
+// ErrPoolClosed the connections to the node were closed
+var ErrPoolClosed = errors.New("connection pool is closed")
+
+// connPool fixed set of HTTP/2 connections to a node, calls are spread over them round robin
+// and a connection is only dialed the first time its turn comes
+type connPool struct {
+	node        string
+	addr        string
+	dialTimeout time.Duration
+	leakAfter   time.Duration
+	dialOptions []grpc.DialOption
+	next        uint32
+	sync.Mutex
+	conns  []*grpc.ClientConn
+	held   map[*poolConn]struct{}
+	closed bool
+}
+
+// poolConn connection handed out by connPool, Close gives it back without closing it
+type poolConn struct {
+	cc      *grpc.ClientConn
+	p       *connPool
+	since   time.Time
+	callers []uintptr
+
+	// reported is guarded by the pool
+	reported bool
+	once     sync.Once
+}
+
+// Value returns the grpc connection
+func (c *poolConn) Value() *grpc.ClientConn {
+	return c.cc
+}
+
+// Close give the connection back to the pool, it is safe to call more than once
+func (c *poolConn) Close() error {
+	c.once.Do(func() {
+		c.p.Lock()
+		delete(c.p.held, c)
+		c.p.Unlock()
+	})
+	return nil
+}
+
+// newConnPool create the pool of size connections to the node, call sites of the held connections
+// are only recorded when leakAfter is set. opts are applied after the default dial options
+func newConnPool(node, addr string, size int, dialTimeout, leakAfter time.Duration, tlsConfig *tls.Config, compression callCompression, opts ...grpc.DialOption) *connPool {
+	if size < 1 {
+		size = 1
+	}
+
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	return &connPool{
+		node:        node,
+		addr:        addr,
+		dialTimeout: dialTimeout,
+		leakAfter:   leakAfter,
+		dialOptions: append(grpcDialOptions(creds, dialTimeout, compression), opts...),
+		conns:       make([]*grpc.ClientConn, size),
+		held:        make(map[*poolConn]struct{}),
+	}
+}
+
+// Get returns the next connection once it is ready, connections in transient failure fail fast
+// with codes.Unavailable and connecting ones are waited for until the dial timeout or ctx ends
+func (p *connPool) Get(ctx context.Context) (*poolConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cc, err := p.conn(int(atomic.AddUint32(&p.next, 1) % uint32(len(p.conns))))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.ready(ctx, cc); err != nil {
+		return nil, err
+	}
+
+	c := &poolConn{cc: cc, p: p, since: time.Now()}
+	if p.leakAfter > 0 {
+		callers := make([]uintptr, poolCallerDepth)
+		c.callers = callers[:runtime.Callers(2, callers)]
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	p.held[c] = struct{}{}
+	return c, nil
+}
+
+// conn returns the connection of the slot, dialing it when it was never dialed
+func (p *connPool) conn(i int) (*grpc.ClientConn, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	if cc := p.conns[i]; cc != nil {
+		return cc, nil
+	}
+
+	// dialing does not block, the connection is established by ready
+	cc, err := grpc.Dial(p.addr, p.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	p.conns[i] = cc
+	return cc, nil
+}
+
+// ready wait for the connection to become ready
+func (p *connPool) ready(ctx context.Context, cc *grpc.ClientConn) error {
+	state := cc.GetState()
+	if state == connectivity.Ready {
+		return nil
+	}
+
+	if p.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.dialTimeout)
+		defer cancel()
+	}
+
+	for {
+		switch state {
+		case connectivity.Ready:
+			return nil
+
+		case connectivity.Shutdown:
+			return ErrPoolClosed
+
+		case connectivity.TransientFailure:
+			return status.Errorf(codes.Unavailable, "connection to %s is unavailable", p.addr)
+
+		case connectivity.Idle:
+			cc.Connect()
+		}
+
+		if !cc.WaitForStateChange(ctx, state) {
+			return status.Errorf(codes.Unavailable, "connect to %s: %v", p.addr, ctx.Err())
+		}
+		state = cc.GetState()
+	}
+}
+
+// Close close every connection, the calls in flight on them are canceled
+func (p *connPool) Close() error {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return nil
+	}
+
+	p.closed = true
+	conns := p.conns
+	p.conns = make([]*grpc.ClientConn, len(conns))
+	p.Unlock()
+
+	var firstErr error
+	for _, cc := range conns {
+		if cc == nil {
+			continue
+		}
+
+		if err := cc.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// grpcDialOptions options of the connections to other nodes
+func grpcDialOptions(creds credentials.TransportCredentials, dialTimeout time.Duration, compression callCompression) []grpc.DialOption {
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.Config{BaseDelay: time.Second, Multiplier: 1.6, Jitter: 0.2, MaxDelay: grpcBackoffMaxDelay},
+			MinConnectTimeout: dialTimeout,
+		}),
+		grpc.WithInitialWindowSize(grpcInitialWindowSize),
+		grpc.WithInitialConnWindowSize(grpcInitialConnWindowSize),
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(grpcMaxSendMsgSize)),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(grpcMaxRecvMsgSize)),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                grpcKeepAliveTime,
+			Timeout:             grpcKeepAliveTimeout,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithChainUnaryInterceptor(errorUnaryClientInterceptor, compression.unaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(compression.streamClientInterceptor),
+	}
+}
+
+// newPeerTLS returns the tls config of the connections to other nodes verifying their
+// certificates with the ca, nil when no ca is configured
+func newPeerTLS(c Config) (*tls.Config, error) {
+	if c.GrpcX509Ca == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(c.GrpcX509Ca)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %s", c.GrpcX509Ca)
+	}
+
+	tlsConfig := &tls.Config{RootCAs: roots, ServerName: c.GrpcServerName, MinVersion: tls.VersionTLS12}
+	if len(c.GrpcX509Key) > 0 && len(c.GrpcX509Pem) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.GrpcX509Pem, c.GrpcX509Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,149 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConnPoolRoundRobin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(echoServerDelegate{})
+
+	p := newConnPool("node1", server.GetMeta().Addr, 3, time.Second, 0, nil, callCompression{})
+	seen := make(map[*grpc.ClientConn]int)
+	for i := 0; i < 6; i++ {
+		conn, err := p.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := api.NewApiServerClient(conn.Value()).Call(ctx, &api.Envelope{Cid: "echo"}); err != nil {
+			t.Fatal(err)
+		}
+		seen[conn.Value()]++
+		conn.Close()
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("calls spread over %d connections", len(seen))
+	}
+
+	if stats := p.Stats(); stats != (PoolStats{Connections: 3, Idle: 3}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	conn, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, err := p.Get(ctx); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnPoolUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := newConnPool("node1", addr, 1, time.Second, 0, nil, callCompression{})
+	defer p.Close()
+
+	start := time.Now()
+	if _, err := p.Get(context.Background()); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected unavailable, got %v", err)
+	}
+
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("dial not bounded by the timeout %v", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.Get(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+func TestPeerServiceOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{
+		Connections: 1,
+		Timeout:     time.Second,
+		Services: map[string]PeerServiceOptions{
+			"analytics": {Connections: 8, StreamTTL: time.Minute},
+		},
+	})
+
+	analytics := NewNodeMeta("node1", "analytics", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, nil)
+	relay := NewNodeMeta("node2", "match-relay", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, nil)
+	if n := len(peer.makeGrpcPool(analytics).conns); n != 8 {
+		t.Fatalf("analytics pool of %d connections", n)
+	}
+
+	if n := len(peer.makeGrpcPool(relay).conns); n != 1 {
+		t.Fatalf("default pool of %d connections", n)
+	}
+
+	o := peer.serviceOptions("analytics")
+	if o.Timeout != time.Second || o.StreamTTL != time.Minute || peer.serviceOptions("match-relay").StreamTTL != 0 {
+		t.Fatalf("unexpected service options %+v", o)
+	}
+}
+
+func TestPeerDialer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(echoServerDelegate{})
+
+	// the dialer stands in for a proxy, the node is only reachable through it
+	dialed := make(chan string, 4)
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{
+		Connections: 1,
+		Dialer: func(ctx context.Context, addr string) (net.Conn, error) {
+			dialed <- addr
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", server.GetMeta().Addr)
+		},
+	})
+
+	node := server.GetMeta()
+	node.Addr = "proxied.invalid:7350"
+	peer.Sync(node)
+	if reply, err := peer.Send(ctx, node, &api.Envelope{Cid: "a", Payload: &api.Envelope_Bytes{Bytes: []byte("a")}}); err != nil || string(reply.GetBytes()) != "a" {
+		t.Fatalf("unexpected reply %v %v", reply, err)
+	}
+
+	if addr := <-dialed; addr != "proxied.invalid:7350" {
+		t.Fatalf("dialer called with %s", addr)
+	}
+}
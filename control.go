@@ -0,0 +1,614 @@
+package nakamacluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	CONTROL_CID_PREFIX      = "__control."
+	CONTROL_CID_MAINTENANCE = CONTROL_CID_PREFIX + "maintenance" // toggle maintenance, replies the local meta
+	CONTROL_CID_DRAIN       = CONTROL_CID_PREFIX + "drain"       // drain the node, replies the local meta
+	CONTROL_CID_QUARANTINE  = CONTROL_CID_PREFIX + "quarantine"  // quarantine a peer of the node
+	CONTROL_CID_RESYNC      = CONTROL_CID_PREFIX + "resync"      // read the nodes from sd again, replies the local meta
+	CONTROL_CID_LOG_LEVEL   = CONTROL_CID_PREFIX + "log_level"   // set the log level, replies the level
+	CONTROL_CID_GOROUTINES  = CONTROL_CID_PREFIX + "goroutines"  // replies the stacks of every goroutine
+	CONTROL_CID_TRACES      = CONTROL_CID_PREFIX + "traces"      // replies the recent envelopes as a json array
+	CONTROL_CID_TOPOLOGY    = CONTROL_CID_PREFIX + "topology"    // replies the cluster graph as json or dot
+	CONTROL_CID_FLAG        = CONTROL_CID_PREFIX + "flag"        // set or delete a cluster flag, replies the flag as json
+	CONTROL_CID_CORDON      = CONTROL_CID_PREFIX + "cordon"      // cordon or uncordon a node cluster-wide, replies the cordon list as json
+	CONTROL_CID_SLO         = CONTROL_CID_PREFIX + "slo"         // replies the success ratio, latency and error budget of the routes as json
+	CONTROL_CID_REFRESH     = CONTROL_CID_PREFIX + "refresh"     // read the nodes from sd and apply the differences now, replies the changes as json
+	CONTROL_CID_STREAMS     = CONTROL_CID_PREFIX + "streams"     // replies the traffic of the stream client ids as json, the busiest first
+
+	CONTROL_VAR_NODE      = "__control_node"      // id of the node the control envelope is for
+	CONTROL_VAR_TIME      = "__control_time"      // unix time in milliseconds the envelope was signed at
+	CONTROL_VAR_NONCE     = "__control_nonce"     // hex random nonce, an envelope is only run once per node
+	CONTROL_VAR_SIGNATURE = "__control_signature" // hex hmac-sha256 of the envelope
+	CONTROL_VAR_ENABLED   = "enabled"             // "true" or "false" for toggles like maintenance
+	CONTROL_VAR_PEER      = "peer"                // id of the peer to quarantine or the traces are filtered by
+	CONTROL_VAR_DURATION  = "duration"            // duration of the quarantine like 10m
+	CONTROL_VAR_LEVEL     = "level"               // log level like debug or info
+	CONTROL_VAR_TTL       = "ttl"                 // duration after which a log level reverts like 10m
+	CONTROL_VAR_DIRECTION = "direction"           // "in" or "out" direction of the traces
+	CONTROL_VAR_CID       = "cid"                 // cid prefix of the traces
+	CONTROL_VAR_SINCE     = "since"               // age of the oldest traces like 10m
+	CONTROL_VAR_LIMIT     = "limit"               // maximum number of the newest traces
+	CONTROL_VAR_FORMAT    = "format"              // "json" or "dot" format of the topology, default json
+	CONTROL_VAR_KEY       = "key"                 // key of the flag
+	CONTROL_VAR_VALUE     = "value"               // value of the flag, the flag is deleted without it
+	CONTROL_VAR_REASON    = "reason"              // reason of the cordon
+	CONTROL_VAR_CLIENT    = "client"              // client id prefix of the stream stats
+
+	// CONTROL_NODE_ALL node var of control envelopes for every node, only log levels may be set with it
+	CONTROL_NODE_ALL = "*"
+
+	// controlMaxSkew signed control envelopes older or newer than it are rejected
+	controlMaxSkew = 30 * time.Second
+
+	// controlUnverified prefix of the callers of control envelopes whose id is not verified
+	controlUnverified = "unverified:"
+
+	// controlQuarantineDuration duration of quarantines without a duration var
+	controlQuarantineDuration = 5 * time.Minute
+)
+
+var (
+	// ErrControlDisabled the node has no control key and rejects control envelopes
+	ErrControlDisabled = errors.New("control disabled")
+
+	// ErrLogLevelNotControllable the node was not created WithLogLevel
+	ErrLogLevelNotControllable = errors.New("log level not controllable")
+
+	// ErrControlUnauthorized the control envelope is not signed with the key of the node,
+	// is for another node, is too old or was already run
+	ErrControlUnauthorized = errors.New("control unauthorized")
+)
+
+// NewControlEnvelope create control envelope for the node signed with the control key
+func NewControlEnvelope(key []byte, cid, node string, vars map[string]string) *api.Envelope {
+	in := &api.Envelope{Cid: cid, Vars: make(map[string]string, len(vars)+4)}
+	for k, v := range vars {
+		in.Vars[k] = v
+	}
+
+	in.Vars[CONTROL_VAR_NODE] = node
+	in.Vars[CONTROL_VAR_TIME] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	in.Vars[CONTROL_VAR_NONCE] = controlNonce()
+	in.Vars[CONTROL_VAR_SIGNATURE] = signControl(key, in)
+	return in
+}
+
+// controlNonce returns a random nonce of a control envelope
+func controlNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// isControlCid reports whether the cid is handled by the control plane instead of the delegate
+func isControlCid(cid string) bool {
+	return strings.HasPrefix(cid, CONTROL_CID_PREFIX)
+}
+
+// signControl returns the signature of the cid and the vars of the envelope but the signature
+func signControl(key []byte, in *api.Envelope) string {
+	keys := make([]string, 0, len(in.Vars))
+	for k := range in.Vars {
+		if k != CONTROL_VAR_SIGNATURE {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(in.Cid))
+	for _, k := range keys {
+		mac.Write([]byte{0})
+		mac.Write([]byte(k))
+		mac.Write([]byte{0})
+		mac.Write([]byte(in.Vars[k]))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyControl check the control envelope is signed with the key, for the node and recent,
+// replays within the skew are rejected by the controlNonces of the handler
+func verifyControl(key []byte, in *api.Envelope, node string, now time.Time) error {
+	if len(key) < 1 {
+		return ErrControlDisabled
+	}
+
+	if target := in.Vars[CONTROL_VAR_NODE]; target != node && (target != CONTROL_NODE_ALL || in.Cid != CONTROL_CID_LOG_LEVEL) {
+		return ErrControlUnauthorized
+	}
+
+	ms, err := strconv.ParseInt(in.Vars[CONTROL_VAR_TIME], 10, 64)
+	if err != nil || in.Vars[CONTROL_VAR_NONCE] == "" {
+		return ErrControlUnauthorized
+	}
+
+	if d := now.Sub(time.UnixMilli(ms)); d > controlMaxSkew || d < -controlMaxSkew {
+		return ErrControlUnauthorized
+	}
+
+	if !hmac.Equal([]byte(signControl(key, in)), []byte(in.Vars[CONTROL_VAR_SIGNATURE])) {
+		return ErrControlUnauthorized
+	}
+	return nil
+}
+
+// controlNonces nonces of the control envelopes run by the node, an envelope is accepted
+// for controlMaxSkew on both sides of its time so nonces are kept for twice as long
+type controlNonces struct {
+	seen   map[string]time.Time
+	pruned time.Time
+	sync.Mutex
+}
+
+// add record the nonce, it returns false when the nonce was seen within the window
+func (n *controlNonces) add(nonce string, now time.Time) bool {
+	n.Lock()
+	defer n.Unlock()
+	if n.seen == nil {
+		n.seen = make(map[string]time.Time)
+	}
+
+	if t, ok := n.seen[nonce]; ok && now.Sub(t) <= 2*controlMaxSkew {
+		return false
+	}
+
+	if now.Sub(n.pruned) > controlMaxSkew {
+		for k, t := range n.seen {
+			if now.Sub(t) > 2*controlMaxSkew {
+				delete(n.seen, k)
+			}
+		}
+		n.pruned = now
+	}
+
+	n.seen[nonce] = now
+	return true
+}
+
+// controlCaller returns the id of the node calling with ctx for the control logs, the id the
+// caller announced is marked unverified unless the connection came from an address of the node
+func controlCaller(ctx context.Context) string {
+	info, ok := FromContext(ctx)
+	if !ok {
+		return controlUnverified
+	}
+
+	if info.Verified {
+		return info.NodeId
+	}
+	return controlUnverified + info.NodeId
+}
+
+// controlHandler serves the control envelopes of the local node, every command is audit logged
+type controlHandler struct {
+	key     []byte
+	level   *zap.AtomicLevel
+	local   func() *Meta
+	update  func(status MetaStatus, vars map[string]string) error
+	peers   Peer
+	resync  func()
+	traces  *TraceBuffer
+	flags   *Flags
+	cordons *CordonList
+	slo     *SloTracker
+	audit   *AuditLog
+	nonces  controlNonces
+	logger  *zap.Logger
+
+	// level before the temporary log level changes and the timer reverting to it
+	levelBase  zapcore.Level
+	levelTimer *time.Timer
+	levelMu    sync.Mutex
+}
+
+// handle verify and run the control envelope
+func (c *controlHandler) handle(caller string, in *api.Envelope) (*api.Envelope, error) {
+	now := time.Now()
+	err := verifyControl(c.key, in, c.local().Id, now)
+	if err == nil && !c.nonces.add(in.Vars[CONTROL_VAR_NONCE], now) {
+		err = ErrControlUnauthorized
+	}
+
+	if err != nil {
+		c.logger.Warn("Rejected control command", zap.String("cid", in.Cid), zap.String("caller", caller), zap.Error(err))
+		if errors.Is(err, ErrControlDisabled) {
+			return nil, api.NewError(api.Error_UNIMPLEMENTED, err.Error())
+		}
+		return nil, api.NewError(api.Error_PERMISSION_DENIED, err.Error())
+	}
+
+	out, err := c.run(in)
+	args := controlArgs(in)
+	fields := []zap.Field{zap.String("cid", in.Cid), zap.String("caller", caller), zap.Any("vars", args)}
+	if err != nil {
+		c.logger.Warn("Control command failed", append(fields, zap.Error(err))...)
+		args["error"] = err.Error()
+		c.audit.Record(AUDIT_CONTROL, caller, in.Cid, args)
+		return nil, err
+	}
+
+	c.audit.Record(AUDIT_CONTROL, caller, in.Cid, args)
+
+	c.logger.Info("Control command", fields...)
+	return out, nil
+}
+
+func (c *controlHandler) run(in *api.Envelope) (*api.Envelope, error) {
+	out := &api.Envelope{Cid: in.Cid}
+	switch in.Cid {
+	case CONTROL_CID_MAINTENANCE:
+		on, err := strconv.ParseBool(in.Vars[CONTROL_VAR_ENABLED])
+		if err != nil {
+			return nil, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid %s var", CONTROL_VAR_ENABLED)
+		}
+
+		if err := setMaintenance(c.local(), on, c.update); err != nil {
+			return nil, api.NewError(api.Error_FAILED_PRECONDITION, err.Error())
+		}
+
+	case CONTROL_CID_DRAIN:
+		if err := c.update(META_STATUS_DRAINING, c.local().Vars); err != nil {
+			return nil, api.NewError(api.Error_FAILED_PRECONDITION, err.Error())
+		}
+
+	case CONTROL_CID_QUARANTINE:
+		d := controlQuarantineDuration
+		if v, ok := in.Vars[CONTROL_VAR_DURATION]; ok {
+			var err error
+			if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+				return nil, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid %s var", CONTROL_VAR_DURATION)
+			}
+		}
+
+		if err := c.peers.Quarantine(in.Vars[CONTROL_VAR_PEER], d); err != nil {
+			return nil, api.NewError(api.Error_NOT_FOUND, err.Error())
+		}
+		return out, nil
+
+	case CONTROL_CID_RESYNC:
+		c.resync()
+
+	case CONTROL_CID_LOG_LEVEL:
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(in.Vars[CONTROL_VAR_LEVEL])); err != nil {
+			return nil, api.NewError(api.Error_INVALID_ARGUMENT, err.Error())
+		}
+
+		var ttl time.Duration
+		if v, ok := in.Vars[CONTROL_VAR_TTL]; ok {
+			var err error
+			if ttl, err = time.ParseDuration(v); err != nil || ttl < 0 {
+				return nil, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid %s var", CONTROL_VAR_TTL)
+			}
+		}
+
+		if err := c.setLevel(level, ttl); err != nil {
+			return nil, api.NewError(api.Error_UNIMPLEMENTED, err.Error())
+		}
+		out.Vars = map[string]string{CONTROL_VAR_LEVEL: level.String()}
+		return out, nil
+
+	case CONTROL_CID_GOROUTINES:
+		var b bytes.Buffer
+		if err := pprof.Lookup("goroutine").WriteTo(&b, 2); err != nil {
+			return nil, api.NewError(api.Error_INTERNAL, err.Error())
+		}
+		out.Payload = &api.Envelope_Bytes{Bytes: b.Bytes()}
+		return out, nil
+
+	case CONTROL_CID_TRACES:
+		if c.traces == nil {
+			return nil, api.NewError(api.Error_UNIMPLEMENTED, "tracing not enabled")
+		}
+
+		q, err := controlTraceQuery(in.Vars)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := json.Marshal(c.traces.Query(q))
+		if err != nil {
+			return nil, api.NewError(api.Error_INTERNAL, err.Error())
+		}
+		out.Payload = &api.Envelope_Bytes{Bytes: b}
+		return out, nil
+
+	case CONTROL_CID_TOPOLOGY:
+		t := NewTopology(c.local(), c.peers)
+		switch in.Vars[CONTROL_VAR_FORMAT] {
+		case "", "json":
+			b, err := json.Marshal(t)
+			if err != nil {
+				return nil, api.NewError(api.Error_INTERNAL, err.Error())
+			}
+			out.Payload = &api.Envelope_Bytes{Bytes: b}
+
+		case "dot":
+			out.Payload = &api.Envelope_Bytes{Bytes: []byte(t.DOT())}
+
+		default:
+			return nil, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid %s var", CONTROL_VAR_FORMAT)
+		}
+		return out, nil
+
+	case CONTROL_CID_FLAG:
+		if c.flags == nil {
+			return nil, api.NewError(api.Error_UNIMPLEMENTED, "flags not enabled")
+		}
+
+		key := in.Vars[CONTROL_VAR_KEY]
+		if key == "" {
+			return nil, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid %s var", CONTROL_VAR_KEY)
+		}
+
+		value, ok := in.Vars[CONTROL_VAR_VALUE]
+		flag, err := c.flags.set(key, value, !ok)
+		if err != nil {
+			return nil, api.NewError(api.Error_UNAVAILABLE, err.Error())
+		}
+
+		b, err := json.Marshal(flag)
+		if err != nil {
+			return nil, api.NewError(api.Error_INTERNAL, err.Error())
+		}
+		out.Payload = &api.Envelope_Bytes{Bytes: b}
+		return out, nil
+
+	case CONTROL_CID_SLO:
+		if c.slo == nil {
+			return nil, api.NewError(api.Error_UNIMPLEMENTED, "slo tracking not enabled")
+		}
+
+		b, err := json.Marshal(c.slo.Routes())
+		if err != nil {
+			return nil, api.NewError(api.Error_INTERNAL, err.Error())
+		}
+		out.Payload = &api.Envelope_Bytes{Bytes: b}
+		return out, nil
+
+	case CONTROL_CID_STREAMS:
+		stats := c.peers.StreamStats(in.Vars[CONTROL_VAR_CLIENT])
+		if v := in.Vars[CONTROL_VAR_LIMIT]; v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 0 {
+				return nil, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid %s var", CONTROL_VAR_LIMIT)
+			}
+
+			if limit < len(stats) {
+				stats = stats[:limit]
+			}
+		}
+
+		b, err := json.Marshal(stats)
+		if err != nil {
+			return nil, api.NewError(api.Error_INTERNAL, err.Error())
+		}
+		out.Payload = &api.Envelope_Bytes{Bytes: b}
+		return out, nil
+
+	case CONTROL_CID_REFRESH:
+		report, err := c.peers.Refresh(context.Background())
+		if err != nil {
+			return nil, api.NewError(api.Error_UNAVAILABLE, err.Error())
+		}
+
+		b, err := json.Marshal(report)
+		if err != nil {
+			return nil, api.NewError(api.Error_INTERNAL, err.Error())
+		}
+		out.Payload = &api.Envelope_Bytes{Bytes: b}
+		return out, nil
+
+	case CONTROL_CID_CORDON:
+		if c.cordons == nil {
+			return nil, api.NewError(api.Error_UNIMPLEMENTED, ErrCordonUnsupported.Error())
+		}
+
+		on, err := strconv.ParseBool(in.Vars[CONTROL_VAR_ENABLED])
+		if err != nil || in.Vars[CONTROL_VAR_PEER] == "" {
+			return nil, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid %s or %s var", CONTROL_VAR_PEER, CONTROL_VAR_ENABLED)
+		}
+
+		if on {
+			err = c.cordons.Cordon(in.Vars[CONTROL_VAR_PEER], in.Vars[CONTROL_VAR_REASON])
+		} else {
+			err = c.cordons.Uncordon(in.Vars[CONTROL_VAR_PEER])
+		}
+
+		if errors.Is(err, ErrCordonUnsupported) {
+			return nil, api.NewError(api.Error_UNIMPLEMENTED, err.Error())
+		}
+
+		if err != nil {
+			return nil, api.NewError(api.Error_UNAVAILABLE, err.Error())
+		}
+
+		cordons, err := c.cordons.List()
+		if err != nil {
+			return nil, api.NewError(api.Error_UNAVAILABLE, err.Error())
+		}
+
+		b, err := json.Marshal(cordons)
+		if err != nil {
+			return nil, api.NewError(api.Error_INTERNAL, err.Error())
+		}
+		out.Payload = &api.Envelope_Bytes{Bytes: b}
+		return out, nil
+
+	default:
+		return nil, api.Errorf(api.Error_UNIMPLEMENTED, "unknown control %s", in.Cid)
+	}
+
+	b, err := c.local().Marshal()
+	if err != nil {
+		return nil, api.NewError(api.Error_INTERNAL, err.Error())
+	}
+	out.Payload = &api.Envelope_Bytes{Bytes: b}
+	return out, nil
+}
+
+// setLevel set the log level, a positive ttl reverts it to the level before the first
+// temporary change once it expires and a level without ttl is kept
+func (c *controlHandler) setLevel(level zapcore.Level, ttl time.Duration) error {
+	if c.level == nil {
+		return ErrLogLevelNotControllable
+	}
+
+	c.levelMu.Lock()
+	defer c.levelMu.Unlock()
+	if c.levelTimer != nil {
+		c.levelTimer.Stop()
+		c.levelTimer = nil
+	} else {
+		c.levelBase = c.level.Level()
+	}
+
+	c.level.SetLevel(level)
+	if ttl <= 0 {
+		return nil
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(ttl, func() {
+		c.levelMu.Lock()
+		defer c.levelMu.Unlock()
+		if c.levelTimer != t {
+			return
+		}
+
+		c.levelTimer = nil
+		c.level.SetLevel(c.levelBase)
+		c.logger.Info("Log level reverted", zap.Stringer("level", c.levelBase))
+	})
+	c.levelTimer = t
+	return nil
+}
+
+// broadcastLevel set the log level like setLevel and send it to every service node,
+// it returns the signed envelope for the nodes reached through gossip
+func (c *controlHandler) broadcastLevel(level zapcore.Level, ttl time.Duration) (*api.Envelope, error) {
+	if len(c.key) < 1 {
+		return nil, ErrControlDisabled
+	}
+
+	if err := c.setLevel(level, ttl); err != nil {
+		return nil, err
+	}
+
+	vars := map[string]string{CONTROL_VAR_LEVEL: level.String()}
+	if ttl > 0 {
+		vars[CONTROL_VAR_TTL] = ttl.String()
+	}
+
+	in := NewControlEnvelope(c.key, CONTROL_CID_LOG_LEVEL, CONTROL_NODE_ALL, vars)
+	c.broadcast(in)
+	return in, nil
+}
+
+// broadcast send the control envelope to every service node over grpc without waiting
+// for the replies, nakama nodes are reached through gossip
+func (c *controlHandler) broadcast(in *api.Envelope) {
+	local := c.local().Id
+	for _, node := range c.peers.All() {
+		if node.Id == local || node.Type == NODE_TYPE_NAKAMA {
+			continue
+		}
+
+		node := node
+		err := c.peers.SendAsync(context.Background(), node, proto.Clone(in).(*api.Envelope), func(out *api.Envelope, err error) {
+			if err != nil {
+				c.logger.Warn("Failed send control command", zap.String("cid", in.Cid), zap.String("node", node.Id), zap.Error(err))
+			}
+		})
+
+		if err != nil {
+			c.logger.Warn("Failed send control command", zap.String("cid", in.Cid), zap.String("node", node.Id), zap.Error(err))
+		}
+	}
+}
+
+// controlArgs returns the vars of the control envelope without the signature and the nonce
+func controlArgs(in *api.Envelope) map[string]string {
+	args := make(map[string]string, len(in.Vars))
+	for k, v := range in.Vars {
+		if k != CONTROL_VAR_SIGNATURE && k != CONTROL_VAR_NONCE {
+			args[k] = v
+		}
+	}
+	return args
+}
+
+// setMaintenance move the node in or out of META_STATUS_MAINTENANCE keeping its vars,
+// leaving maintenance does nothing when the node is not in maintenance
+func setMaintenance(meta *Meta, on bool, update func(status MetaStatus, vars map[string]string) error) error {
+	if on {
+		return update(META_STATUS_MAINTENANCE, meta.Vars)
+	}
+
+	if meta.Status != META_STATUS_MAINTENANCE {
+		return nil
+	}
+	return update(META_STATUS_READYED, meta.Vars)
+}
+
+// sdDrain returns the meta of the local node drained in sd by an operator, like nkcluster drain,
+// when the local node did not take the drain yet
+func sdDrain(local *Meta, metas []*Meta) (*Meta, bool) {
+	for _, meta := range metas {
+		if meta.Id != local.Id || meta.Epoch != local.Epoch || meta.Status != META_STATUS_DRAINING {
+			continue
+		}
+
+		if local.Status == META_STATUS_DRAINING || meta.Version < local.Version || local.Status.CheckTransition(META_STATUS_DRAINING) != nil {
+			return nil, false
+		}
+		return meta, true
+	}
+	return nil, false
+}
+
+// controlTraceQuery returns the trace query of the vars of a traces control envelope
+func controlTraceQuery(vars map[string]string) (TraceQuery, error) {
+	q := TraceQuery{Node: vars[CONTROL_VAR_PEER], Direction: vars[CONTROL_VAR_DIRECTION], Cid: vars[CONTROL_VAR_CID]}
+	if v, ok := vars[CONTROL_VAR_SINCE]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return q, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid %s var", CONTROL_VAR_SINCE)
+		}
+		q.Since = time.Now().Add(-d).UnixMilli()
+	}
+
+	if v, ok := vars[CONTROL_VAR_LIMIT]; ok {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return q, api.Errorf(api.Error_INVALID_ARGUMENT, "invalid %s var", CONTROL_VAR_LIMIT)
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
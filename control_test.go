@@ -0,0 +1,230 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestVerifyControl(t *testing.T) {
+	key := []byte("secret")
+	in := NewControlEnvelope(key, CONTROL_CID_MAINTENANCE, "node1", map[string]string{CONTROL_VAR_ENABLED: "true"})
+	now := time.Now()
+	if err := verifyControl(key, in, "node1", now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyControl(nil, in, "node1", now); !errors.Is(err, ErrControlDisabled) {
+		t.Fatalf("expected ErrControlDisabled, got %v", err)
+	}
+
+	if err := verifyControl([]byte("other"), in, "node1", now); !errors.Is(err, ErrControlUnauthorized) {
+		t.Fatalf("expected wrong key rejected, got %v", err)
+	}
+
+	if err := verifyControl(key, in, "node2", now); !errors.Is(err, ErrControlUnauthorized) {
+		t.Fatalf("expected other node rejected, got %v", err)
+	}
+
+	if err := verifyControl(key, in, "node1", now.Add(time.Minute)); !errors.Is(err, ErrControlUnauthorized) {
+		t.Fatalf("expected replay rejected, got %v", err)
+	}
+
+	in.Vars[CONTROL_VAR_ENABLED] = "false"
+	if err := verifyControl(key, in, "node1", now); !errors.Is(err, ErrControlUnauthorized) {
+		t.Fatalf("expected tampered vars rejected, got %v", err)
+	}
+
+	in = NewControlEnvelope(key, CONTROL_CID_MAINTENANCE, "node1", nil)
+	delete(in.Vars, CONTROL_VAR_NONCE)
+	in.Vars[CONTROL_VAR_SIGNATURE] = signControl(key, in)
+	if err := verifyControl(key, in, "node1", now); !errors.Is(err, ErrControlUnauthorized) {
+		t.Fatalf("expected envelope without nonce rejected, got %v", err)
+	}
+}
+
+func TestServerMaintenanceControl(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.ControlKey = "secret"
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", "svc", map[string]string{"k": "v"}, *config)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(ctx, net.JoinHostPort(config.Addr, strconv.Itoa(config.Port)), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := api.NewApiServerClient(conn)
+	in := NewControlEnvelope([]byte("wrong"), CONTROL_CID_MAINTENANCE, "node1", map[string]string{CONTROL_VAR_ENABLED: "true"})
+	if _, err := client.Call(ctx, in); !api.IsCode(err, api.Error_PERMISSION_DENIED) {
+		t.Fatalf("expected PERMISSION_DENIED, got %v", err)
+	}
+
+	in = NewControlEnvelope([]byte(config.ControlKey), CONTROL_CID_MAINTENANCE, "node1", map[string]string{CONTROL_VAR_ENABLED: "true"})
+	out, err := client.Call(ctx, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta := NewNodeMetaFromJSON(out.GetBytes()); meta == nil || meta.Status != META_STATUS_MAINTENANCE || meta.Vars["k"] != "v" {
+		t.Fatalf("unexpected meta %v", meta)
+	}
+
+	if server.GetMeta().Status.Routable() {
+		t.Fatal("node in maintenance is routable")
+	}
+
+	if err := server.SetMaintenance(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := server.GetMeta().Status; status != META_STATUS_READYED {
+		t.Fatalf("unexpected status after maintenance %s", status)
+	}
+}
+
+func TestControlCommands(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := []byte("secret")
+	local := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	peer.Sync(local, NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{}))
+
+	level := zap.NewAtomicLevel()
+	resynced := false
+	c := &controlHandler{
+		key:   key,
+		level: &level,
+		local: func() *Meta { return local },
+		update: func(status MetaStatus, vars map[string]string) error {
+			local.Status = status
+			return nil
+		},
+		peers:  peer,
+		resync: func() { resynced = true },
+		logger: zap.NewNop(),
+	}
+
+	run := func(cid string, vars map[string]string) (*api.Envelope, error) {
+		return c.handle("cli", NewControlEnvelope(key, cid, "node1", vars))
+	}
+
+	if out, err := run(CONTROL_CID_LOG_LEVEL, map[string]string{CONTROL_VAR_LEVEL: "debug"}); err != nil || out.Vars[CONTROL_VAR_LEVEL] != "debug" || level.Level() != zap.DebugLevel {
+		t.Fatalf("log level not set %v %v", out, err)
+	}
+
+	if out, err := run(CONTROL_CID_GOROUTINES, nil); err != nil || len(out.GetBytes()) < 1 {
+		t.Fatalf("no goroutines dumped %v", err)
+	}
+
+	if _, err := run(CONTROL_CID_RESYNC, nil); err != nil || !resynced {
+		t.Fatalf("resync not triggered %v", err)
+	}
+
+	if _, err := run(CONTROL_CID_QUARANTINE, map[string]string{CONTROL_VAR_PEER: "node2", CONTROL_VAR_DURATION: "1m"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8; i++ {
+		if node, ok := peer.GetWithHashRing("svc", strconv.Itoa(i)); !ok || node.Id != "node1" {
+			t.Fatalf("quarantined peer still owns keys, got %v", node)
+		}
+	}
+
+	if _, err := run(CONTROL_CID_QUARANTINE, map[string]string{CONTROL_VAR_PEER: "missing"}); !api.IsCode(err, api.Error_NOT_FOUND) {
+		t.Fatalf("expected NOT_FOUND, got %v", err)
+	}
+
+	drain := NewControlEnvelope(key, CONTROL_CID_DRAIN, "node1", nil)
+	if _, err := c.handle("cli", drain); err != nil || local.Status != META_STATUS_DRAINING {
+		t.Fatalf("node not drained %v", err)
+	}
+
+	// a captured envelope is only run once within its validity
+	if _, err := c.handle("cli", drain); !api.IsCode(err, api.Error_PERMISSION_DENIED) {
+		t.Fatalf("expected replayed drain rejected, got %v", err)
+	}
+
+	if _, err := run(CONTROL_CID_FLAG, map[string]string{CONTROL_VAR_KEY: "matchmaker", CONTROL_VAR_VALUE: "v2"}); !api.IsCode(err, api.Error_UNIMPLEMENTED) {
+		t.Fatalf("expected UNIMPLEMENTED without flags, got %v", err)
+	}
+
+	if _, err := run(CONTROL_CID_PREFIX+"unknown", nil); !api.IsCode(err, api.Error_UNIMPLEMENTED) {
+		t.Fatalf("expected UNIMPLEMENTED, got %v", err)
+	}
+}
+
+func TestControlLogLevelTTL(t *testing.T) {
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	local := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	c := &controlHandler{key: []byte("secret"), level: &level, local: func() *Meta { return local }, logger: zap.NewNop()}
+
+	if err := c.setLevel(zap.DebugLevel, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.setLevel(zap.WarnLevel, 50*time.Millisecond); err != nil || level.Level() != zap.WarnLevel {
+		t.Fatalf("level not changed %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for level.Level() != zap.InfoLevel {
+		if time.Now().After(deadline) {
+			t.Fatalf("level not reverted, got %s", level.Level())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	in := NewControlEnvelope(c.key, CONTROL_CID_LOG_LEVEL, CONTROL_NODE_ALL, map[string]string{CONTROL_VAR_LEVEL: "error"})
+	if _, err := c.handle("node2", in); err != nil || level.Level() != zap.ErrorLevel {
+		t.Fatalf("broadcast level not applied %v", err)
+	}
+
+	in = NewControlEnvelope(c.key, CONTROL_CID_DRAIN, CONTROL_NODE_ALL, nil)
+	if _, err := c.handle("node2", in); !api.IsCode(err, api.Error_PERMISSION_DENIED) {
+		t.Fatalf("expected drain of every node rejected, got %v", err)
+	}
+
+	if err := (&controlHandler{}).setLevel(zap.DebugLevel, 0); !errors.Is(err, ErrLogLevelNotControllable) {
+		t.Fatalf("expected ErrLogLevelNotControllable, got %v", err)
+	}
+}
+
+func TestSdDrain(t *testing.T) {
+	local := &Meta{Id: "node1", Epoch: 2, Version: 3, Status: META_STATUS_READYED}
+	drained := func(epoch int64, version uint64) []*Meta {
+		return []*Meta{{Id: "node2", Status: META_STATUS_DRAINING}, {Id: "node1", Epoch: epoch, Version: version, Status: META_STATUS_DRAINING}}
+	}
+
+	if meta, ok := sdDrain(local, drained(2, 3)); !ok || meta.Version != 3 {
+		t.Fatal("expected the drain of the colliding version")
+	}
+
+	if _, ok := sdDrain(local, drained(2, 2)); ok {
+		t.Fatal("unexpected drain older than the local meta")
+	}
+
+	if _, ok := sdDrain(local, drained(1, 9)); ok {
+		t.Fatal("unexpected drain of a previous incarnation")
+	}
+
+	local.Status = META_STATUS_STOPED
+	if _, ok := sdDrain(local, drained(2, 4)); ok {
+		t.Fatal("unexpected drain of a stopped node")
+	}
+}
@@ -0,0 +1,195 @@
+package nakamacluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+// ErrCordonUnsupported the sd client can not read, watch or write the cordon list
+var ErrCordonUnsupported = errors.New("cordon list unsupported by sd client")
+
+// Cordon entry of the cordon list, a cordoned node stays in the cluster but no peer
+// routes to it until it is uncordoned
+type Cordon struct {
+	Node   string `json:"node"`
+	Reason string `json:"reason,omitempty"`
+	At     int64  `json:"at"`
+}
+
+// CordonList operator managed list of the nodes excluded from routing, stored in sd next to
+// the services so every peer applies it and it outlives the nodes writing it
+type CordonList struct {
+	ctx    context.Context
+	client sd.Client
+	prefix string
+	peers  Peer
+	logger *zap.Logger
+}
+
+// cordonPrefix returns the sd prefix of the cordon list of the services prefix, it is a
+// sibling of the services so reading them does not return the cordons
+func cordonPrefix(prefix string) string {
+	return strings.TrimSuffix(prefix, "/") + ".cordon/"
+}
+
+// Cordon exclude the node from the routing of every peer
+func (c *CordonList) Cordon(id, reason string) error {
+	w, ok := c.client.(sd.KeyWriter)
+	if !ok {
+		return ErrCordonUnsupported
+	}
+
+	b, err := json.Marshal(Cordon{Node: id, Reason: reason, At: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	return w.PutKey(c.prefix+id, string(b))
+}
+
+// Uncordon route to the node again
+func (c *CordonList) Uncordon(id string) error {
+	w, ok := c.client.(sd.KeyWriter)
+	if !ok {
+		return ErrCordonUnsupported
+	}
+	return w.DeleteKey(c.prefix + id)
+}
+
+// List returns the cordoned nodes by id
+func (c *CordonList) List() (map[string]Cordon, error) {
+	r, ok := c.client.(sd.KeyWatcher)
+	if !ok {
+		return nil, ErrCordonUnsupported
+	}
+
+	keys, err := r.GetKeys(c.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	cordons := make(map[string]Cordon, len(keys))
+	for key, value := range keys {
+		var cordon Cordon
+		if err := json.Unmarshal([]byte(value), &cordon); err != nil {
+			c.logger.Warn("Failed parse cordon", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		cordons[strings.TrimPrefix(key, c.prefix)] = cordon
+	}
+	return cordons, nil
+}
+
+// ListCordons returns the cordon list of the services prefix without a node, for tools
+// like nkcluster resolving owners as the peers do
+func ListCordons(client sd.Client, prefix string) (map[string]Cordon, error) {
+	c := &CordonList{client: client, prefix: cordonPrefix(prefix), logger: zap.NewNop()}
+	return c.List()
+}
+
+// watch apply the list to the peers on every change until ctx is done
+func (c *CordonList) watch() {
+	w, ok := c.client.(sd.KeyWatcher)
+	if !ok {
+		c.logger.Warn("Cordon list disabled", zap.Error(ErrCordonUnsupported))
+		return
+	}
+
+	ch := make(chan sd.KeyEvent, 1)
+	go w.WatchKeys(c.ctx, c.prefix, ch)
+	c.apply()
+	for {
+		select {
+		case <-ch:
+			c.apply()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// apply read the list again in full and pass it to the peers
+func (c *CordonList) apply() {
+	cordons, err := c.List()
+	if err != nil {
+		c.logger.Warn("Failed read cordon list", zap.Error(err))
+		return
+	}
+
+	ids := make(map[string]bool, len(cordons))
+	for id := range cordons {
+		ids[id] = true
+	}
+
+	if p, ok := c.peers.(*LocalPeer); ok {
+		p.setCordons(ids)
+	}
+}
+
+// newCordonList create the cordon list of the services prefix and apply it until ctx is done
+func newCordonList(ctx context.Context, logger *zap.Logger, client sd.Client, prefix string, peers Peer) *CordonList {
+	c := &CordonList{
+		ctx:    ctx,
+		client: client,
+		prefix: cordonPrefix(prefix),
+		peers:  peers,
+		logger: logger,
+	}
+
+	go c.watch()
+	return c
+}
+
+// Cordoned reports whether the node is on the cordon list
+func (peer *LocalPeer) Cordoned(id string) bool {
+	cordons, _ := peer.cordons.Load().(map[string]bool)
+	return cordons[id]
+}
+
+// routable reports whether the node takes traffic, its status is routable and it is
+// neither quarantined nor cordoned
+func (peer *LocalPeer) routable(node *Meta, now time.Time) bool {
+	return node.Status.Routable() && !peer.flaps.quarantined(node.Id, now) && !peer.Cordoned(node.Id)
+}
+
+// setCordons replace the cordon list and move the nodes whose cordon changed in or out of the rings,
+// an update event is published for each of them
+func (peer *LocalPeer) setCordons(ids map[string]bool) {
+	peer.Lock()
+	defer peer.Unlock()
+	prev, _ := peer.cordons.Load().(map[string]bool)
+	peer.cordons.Store(ids)
+
+	v := peer.view().clone()
+	now := peer.clock.Now()
+	changed := make([]*Meta, 0)
+	for id, node := range v.nodes {
+		if prev[id] == ids[id] {
+			continue
+		}
+
+		changed = append(changed, node)
+		if ids[id] {
+			peer.removeFromRing(v.rings, node)
+			peer.logger.Warn("Cordoned node", zap.String("node", id))
+		} else if peer.routable(node, now) {
+			peer.addToRing(v.rings, node)
+			peer.logger.Info("Uncordoned node", zap.String("node", id))
+		}
+	}
+
+	if len(changed) < 1 {
+		return
+	}
+
+	// the routability of the nodes changed, selection outside the rings like shards follows it
+	peer.storeView(v)
+	for _, node := range changed {
+		peer.options.Events.Publish(Event{Type: EVENT_NODE_UPDATE, Node: node.Clone()})
+	}
+}
@@ -0,0 +1,90 @@
+package nakamacluster
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestCordonList(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := sd.NewMemoryStore().NewClient(ctx)
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	local := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	peer.Sync(local, NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{}))
+
+	key := []byte("secret")
+	cordons := newCordonList(ctx, zap.NewNop(), client, "/nakama-cluster/services/", peer)
+	c := &controlHandler{key: key, local: func() *Meta { return local }, peers: peer, cordons: cordons, logger: zap.NewNop()}
+	run := func(vars map[string]string) (*api.Envelope, error) {
+		return c.handle("cli", NewControlEnvelope(key, CONTROL_CID_CORDON, "node1", vars))
+	}
+
+	wait := func(cordoned bool) {
+		for peer.Cordoned("node2") != cordoned {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("cordon of node2 not applied, expected %v", cordoned)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	out, err := run(map[string]string{CONTROL_VAR_PEER: "node2", CONTROL_VAR_ENABLED: "true", CONTROL_VAR_REASON: "disk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list map[string]Cordon
+	if err := json.Unmarshal(out.GetBytes(), &list); err != nil || list["node2"].Reason != "disk" {
+		t.Fatalf("unexpected cordon list %s %v", out.GetBytes(), err)
+	}
+
+	if list, err := ListCordons(client, "/nakama-cluster/services/"); err != nil || list["node2"].Reason != "disk" {
+		t.Fatalf("unexpected listed cordons %v %v", list, err)
+	}
+
+	wait(true)
+	for i := 0; i < 8; i++ {
+		if node, ok := peer.GetWithHashRing("svc", strconv.Itoa(i)); !ok || node.Id != "node1" {
+			t.Fatalf("cordoned peer still owns keys, got %v", node)
+		}
+	}
+
+	if table := peer.RoutingTable(); len(table.Services) != 1 || len(table.Services[0].Endpoints) != 1 {
+		t.Fatalf("cordoned peer in the routing table %v", table.Services)
+	}
+
+	// the cordons are not read as services
+	if entries, err := client.GetEntries("/nakama-cluster/services/"); err != nil || len(entries) != 0 {
+		t.Fatalf("cordon read as service %v %v", entries, err)
+	}
+
+	if _, err := run(map[string]string{CONTROL_VAR_PEER: "node2", CONTROL_VAR_ENABLED: "false"}); err != nil {
+		t.Fatal(err)
+	}
+
+	wait(false)
+	owners := make(map[string]bool)
+	for i := 0; i < 64; i++ {
+		if node, ok := peer.GetWithHashRing("svc", strconv.Itoa(i)); ok {
+			owners[node.Id] = true
+		}
+	}
+
+	if !owners["node2"] {
+		t.Fatal("uncordoned peer owns no keys")
+	}
+
+	if _, err := run(map[string]string{CONTROL_VAR_ENABLED: "true"}); !api.IsCode(err, api.Error_INVALID_ARGUMENT) {
+		t.Fatalf("expected INVALID_ARGUMENT, got %v", err)
+	}
+}
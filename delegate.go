@@ -53,34 +53,150 @@ func (s *Client) NodeMeta(limit int) []byte {
 // NotifyMsg is called when a user-data message is received.
 // Care should be taken that this method does not block, since doing
 // so would block the entire UDP packet receive loop. Additionally, the byte
-// slice may be modified after the call returns, so it should be copied if needed
+// slice may be modified after the call returns, so it should be copied if needed.
+// The frame is handled on the notify worker of the sending node, so messages of
+// a node keep their order and a slow delegate does not stall gossip.
 func (s *Client) NotifyMsg(msg []byte) {
-	var frame api.Frame
-	if err := proto.Unmarshal(msg, &frame); err != nil {
+	msg, err := s.signer.verify(msg)
+	if err != nil {
+		s.logger.Warn("NotifyMsg rejected", zap.Error(err))
+		s.metrics.GossipUnverified(gossipVerifyReason(err))
+		return
+	}
+
+	frame := api.AcquireFrame()
+	if err := proto.Unmarshal(msg, frame); err != nil {
+		api.ReleaseFrame(frame)
+		s.logger.Warn("NotifyMsg parse failed", zap.Error(err))
+		return
+	}
+
+	if s.notifyPool == nil {
+		s.handleFrame(frame)
+		api.ReleaseFrame(frame)
+		return
+	}
+
+	ok := s.notifyPool.TrySubmit(frame.Node, func() {
+		s.handleFrame(frame)
+		api.ReleaseFrame(frame)
+	})
+
+	if !ok {
+		s.logger.Warn("NotifyMsg queue full, message dropped", zap.String("node", frame.Node))
+		s.metrics.GossipDropped("inbound")
+		api.ReleaseFrame(frame)
+	}
+}
+
+// handleMsg parse and handle a reassembled message on the current goroutine
+func (s *Client) handleMsg(msg []byte) {
+	frame := api.AcquireFrame()
+	defer api.ReleaseFrame(frame)
+	if err := proto.Unmarshal(msg, frame); err != nil {
 		s.logger.Warn("NotifyMsg parse failed", zap.Error(err))
 		return
 	}
+	s.handleFrame(frame)
+}
 
-	if frame.Direct == api.Frame_Broadcast && !s.messageCursor.Fire(frame.Node, frame.SeqID) {
+func (s *Client) handleFrame(frame *api.Frame) {
+	if chunk := frame.GetChunk(); chunk != nil {
+		payload, ok, err := s.chunks.Add(frame.Node, chunk)
+		if err != nil {
+			s.logger.Warn("NotifyMsg chunk failed", zap.Error(err), zap.String("node", frame.Node))
+			return
+		}
+
+		if ok {
+			s.handleMsg(payload)
+		}
 		return
 	}
 
+	if frame.Direct == api.Frame_Broadcast {
+		if frame.Node == s.GetLocalNode().Name || !s.messageCursor.Fire(frame.Node, frame.SeqID) {
+			return
+		}
+
+		// expired envelopes are dropped below and not relayed
+		if frame.Hops > 1 && !Expired(frame.GetEnvelope(), time.Duration(s.config.ExpirySkewTolerance)*time.Millisecond) {
+			s.relayBroadcast(frame)
+		}
+
+		if !sendToTarget(frame.GetEnvelope(), s.GetLocalNode().Name) {
+			return
+		}
+
+		if in := frame.GetEnvelope(); in != nil {
+			delete(in.Vars, SEND_VAR_TO)
+		}
+	}
+
 	if frame.Direct == api.Frame_Reply {
-		s.recvReplyMessage(&frame)
+		s.recvReplyMessage(frame)
 		return
 	}
 
+	if Expired(frame.GetEnvelope(), time.Duration(s.config.ExpirySkewTolerance)*time.Millisecond) {
+		s.metrics.ExpiredDropped()
+		if frame.Direct == api.Frame_Send {
+			s.sendReplyMessage(frame, nil, api.NewError(api.Error_TIMEOUT, "message expired"))
+		}
+		return
+	}
+
+	if err := checkEnvelopeVersion(frame.GetEnvelope()); err != nil {
+		s.logger.Warn("NotifyMsg rejected", zap.Error(err), zap.String("node", frame.Node))
+		if frame.Direct == api.Frame_Send {
+			s.sendReplyMessage(frame, nil, api.NewError(api.Error_FAILED_PRECONDITION, err.Error()))
+		}
+		return
+	}
+
+	if isControlCid(frame.GetEnvelope().GetCid()) {
+		reply, err := s.control.handle(frame.Node, frame.GetEnvelope())
+		if frame.Direct == api.Frame_Send {
+			s.sendReplyMessage(frame, reply, err)
+		}
+		return
+	}
+
+	if isSessionCid(frame.GetEnvelope().GetCid()) {
+		s.sessions.handle(frame.Node, frame.GetEnvelope())
+		return
+	}
+
+	if isFlagsCid(frame.GetEnvelope().GetCid()) {
+		s.flags.handle(frame.Node, frame.GetEnvelope())
+		return
+	}
+
+	s.traces.Record(TRACE_IN, TRACE_GOSSIP, frame.Node, frame.GetEnvelope())
+	if !s.overload.Admit(frame.GetEnvelope().GetCid()) {
+		if frame.Direct == api.Frame_Send {
+			s.sendReplyMessage(frame, nil, api.NewError(api.Error_RESOURCE_EXHAUSTED, ErrOverloaded.Error()))
+		}
+		return
+	}
+
+	if frame.Direct == api.Frame_Broadcast {
+		s.notifyBroadcast(frame.Node, frame.GetEnvelope())
+	}
+
 	fn, ok := s.delegate.Load().(Delegate)
 	if !ok || fn == nil {
 		return
 	}
 
-	reply, err := fn.NotifyMsg(frame.Node, frame.GetEnvelope())
+	start := time.Now()
+	reply, err := s.notifyDelegate(fn, frame.Node, frame.GetEnvelope())
+	s.overload.Observe(time.Since(start))
 	if (reply == nil && err == nil) || frame.Direct == api.Frame_Broadcast {
 		return
 	}
 
-	s.sendReplyMessage(&frame, reply, err)
+	s.sendReplyMessage(frame, reply, err)
 }
 
 // GetBroadcasts is called when user data messages can be broadcast.
@@ -90,30 +206,15 @@ func (s *Client) NotifyMsg(msg []byte) {
 // the limit. Care should be taken that this method does not block,
 // since doing so would block the entire UDP packet receive loop.
 func (s *Client) GetBroadcasts(overhead, limit int) [][]byte {
-	return s.messageQueue.GetBroadcasts(overhead, limit)
-}
-
-// LocalState is used for a TCP Push/Pull. This is sent to
-// the remote side in addition to the membership information. ALogger
-// data can be sent here. See MergeRemoteState as well. The `join`
-// boolean indicates this is for a join instead of a push/pull.
-func (s *Client) LocalState(join bool) []byte {
-	fn, ok := s.delegate.Load().(Delegate)
-	if ok && fn != nil {
-		return fn.LocalState(join)
+	broadcasts := s.messageQueue.GetBroadcasts(overhead, limit)
+	for _, broadcast := range broadcasts {
+		limit -= overhead + len(broadcast)
 	}
-	return nil
-}
 
-// MergeRemoteState is invoked after a TCP Push/Pull. This is the
-// state received from the remote side and is the result of the
-// remote side's LocalState call. The 'join'
-// boolean indicates this is for a join instead of a push/pull.
-func (s *Client) MergeRemoteState(buf []byte, join bool) {
-	fn, ok := s.delegate.Load().(Delegate)
-	if ok && fn != nil {
-		fn.MergeRemoteState(buf, join)
+	if limit <= overhead {
+		return broadcasts
 	}
+	return append(broadcasts, s.relayQueue.GetBroadcasts(overhead, limit)...)
 }
 
 // AckPayload is invoked when an ack is being sent; the returned bytes will be appended to the ack
@@ -128,11 +229,13 @@ func (s *Client) NotifyPingComplete(other *memberlist.Node, rtt time.Duration, p
 // NotifyJoin is invoked when a node is detected to have joined.
 // The Node argument must not be modified.
 func (s *Client) NotifyJoin(node *memberlist.Node) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
 	s.Lock()
 	s.nodes[node.Name] = node
 	s.Unlock()
 
-	if fn, ok := s.delegate.Load().(Delegate); ok && fn != nil {
+	if fn, ok := s.delegate.Load().(Delegate); ok && fn != nil && !observerNode(node) {
 		fn.NotifyJoin(NewNodeMetaFromJSON(node.Meta))
 	}
 }
@@ -140,11 +243,14 @@ func (s *Client) NotifyJoin(node *memberlist.Node) {
 // NotifyLeave is invoked when a node is detected to have left.
 // The Node argument must not be modified.
 func (s *Client) NotifyLeave(node *memberlist.Node) {
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
 	s.Lock()
 	delete(s.nodes, node.Name)
 	s.Unlock()
+	s.sessions.dropNode(node.Name)
 
-	if fn, ok := s.delegate.Load().(Delegate); ok && fn != nil {
+	if fn, ok := s.delegate.Load().(Delegate); ok && fn != nil && !observerNode(node) {
 		fn.NotifyLeave(NewNodeMetaFromJSON(node.Meta))
 	}
 }
@@ -153,17 +259,105 @@ func (s *Client) NotifyLeave(node *memberlist.Node) {
 // updated, usually involving the meta data. The Node argument
 // must not be modified.
 func (s *Client) NotifyUpdate(node *memberlist.Node) {
+	meta := NewNodeMetaFromJSON(node.Meta)
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
 	s.Lock()
+	if prev, ok := s.nodes[node.Name]; ok && meta != nil {
+		// updates delivered out of order must not overwrite newer vars
+		if prevMeta := NewNodeMetaFromJSON(prev.Meta); prevMeta != nil && prevMeta.Newer(meta) {
+			s.Unlock()
+			return
+		}
+	}
 	s.nodes[node.Name] = node
 	s.Unlock()
 
-	if fn, ok := s.delegate.Load().(Delegate); ok && fn != nil {
+	if meta != nil {
+		s.peers.Merge(meta)
+	}
+
+	if fn, ok := s.delegate.Load().(Delegate); ok && fn != nil && !observerNode(node) {
 		fn.NotifyUpdate(NewNodeMetaFromJSON(node.Meta))
 	}
 }
 
+// notifyEvent call the delegate for the nakama nodes joining, leaving or updated in sd,
+// it replaces the memberlist notifications when gossip is disabled
+func (s *Client) notifyEvent(e Event) {
+	if e.Node == nil || e.Node.Name != NAKAMA {
+		return
+	}
+
+	if e.Type == EVENT_NODE_LEAVE {
+		s.sessions.dropNode(e.Node.Id)
+	}
+
+	s.notifyMu.Lock()
+	defer s.notifyMu.Unlock()
+	switch e.Type {
+	case EVENT_NODE_JOIN, EVENT_NODE_UPDATE:
+		s.announced[e.Node.Id] = e.Node
+	case EVENT_NODE_LEAVE:
+		delete(s.announced, e.Node.Id)
+	}
+
+	fn, ok := s.delegate.Load().(Delegate)
+	if !ok || fn == nil {
+		return
+	}
+
+	switch e.Type {
+	case EVENT_NODE_JOIN:
+		fn.NotifyJoin(e.Node)
+	case EVENT_NODE_LEAVE:
+		fn.NotifyLeave(e.Node)
+	case EVENT_NODE_UPDATE:
+		fn.NotifyUpdate(e.Node)
+	}
+}
+
+// joinedNodes returns the nakama nodes the delegate was told about so far sorted by id, the
+// members of the gossip or, without gossip, the nodes announced from sd. s.notifyMu must be held
+func (s *Client) joinedNodes() []*Meta {
+	var nodes []*Meta
+	if s.memberlist == nil {
+		for _, node := range s.announced {
+			nodes = append(nodes, node.Clone())
+		}
+	} else {
+		s.Lock()
+		for _, node := range s.nodes {
+			if meta := NewNodeMetaFromJSON(node.Meta); meta != nil && !observerNode(node) {
+				nodes = append(nodes, meta)
+			}
+		}
+		s.Unlock()
+	}
+	return sortedNodes(nodes)
+}
+
 // NotifyAlive implements the memberlist.AliveDelegate interface.
 func (s *Client) NotifyAlive(node *memberlist.Node) error {
+	if meta := NewNodeMetaFromJSON(node.Meta); meta != nil {
+		if err := CheckProtocolVersion(meta.ProtocolVersion); err != nil {
+			return err
+		}
+
+		if err := CheckCluster(s.config.ClusterName, meta); err != nil {
+			s.logger.Error("Rejected node of another cluster", zap.String("ID", meta.Id), zap.Error(err))
+			return err
+		}
+
+		if err := CheckNodeType(meta); err != nil {
+			return err
+		}
+
+		if err := s.varSchema.Check(meta.Vars); err != nil {
+			return err
+		}
+	}
+
 	if fn, ok := s.delegate.Load().(Delegate); ok && fn != nil {
 		return fn.NotifyAlive(NewNodeMetaFromJSON(node.Meta))
 	}
@@ -171,6 +365,43 @@ func (s *Client) NotifyAlive(node *memberlist.Node) error {
 	return nil
 }
 
+// NotifyMerge implements the memberlist.MergeDelegate interface, joining the
+// gossip of another cluster fails instead of merging both clusters
+func (s *Client) NotifyMerge(peers []*memberlist.Node) error {
+	for _, node := range peers {
+		if meta := NewNodeMetaFromJSON(node.Meta); meta != nil {
+			if err := CheckCluster(s.config.ClusterName, meta); err != nil {
+				s.logger.Error("Rejected merge with another cluster", zap.String("ID", meta.Id), zap.Error(err))
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// relayBroadcast queue the broadcast frame again with one hop less,
+// the origin node and sequence are kept so receivers drop duplicates
+func (s *Client) relayBroadcast(frame *api.Frame) {
+	relay := api.AcquireFrame()
+	relay.Id = frame.Id
+	relay.Node = frame.Node
+	relay.SeqID = frame.SeqID
+	relay.Direct = frame.Direct
+	relay.Envelope = proto.Clone(frame.Envelope).(*api.Envelope)
+	relay.Hops = frame.Hops - 1
+	for _, broadcast := range s.newBroadcasts(relay) {
+		s.relayQueue.QueueBroadcast(broadcast)
+	}
+}
+
+// NotifyConflict implements the memberlist.ConflictDelegate interface.
+func (s *Client) NotifyConflict(existing, other *memberlist.Node) {
+	s.logger.Warn("Node name conflict", zap.String("name", existing.Name), zap.String("existing", existing.Address()), zap.String("other", other.Address()))
+	if fn, ok := s.delegate.Load().(ConflictDelegate); ok && fn != nil {
+		fn.NotifyConflict(NewNodeMetaFromJSON(existing.Meta), NewNodeMetaFromJSON(other.Meta))
+	}
+}
+
 func (s *Client) recvReplyMessage(frame *api.Frame) {
 	m, ok := s.messageWaitQueue.Load(frame.Id)
 	if !ok {
@@ -190,25 +421,23 @@ func (s *Client) recvReplyMessage(frame *api.Frame) {
 }
 
 func (s *Client) sendReplyMessage(frame *api.Frame, reply *api.Envelope, err error) {
-	replyFrame := api.Frame{
-		Id:     frame.Id,
-		Node:   s.GetLocalNode().Name,
-		SeqID:  s.messageSeq.NextID(frame.Node),
-		Direct: api.Frame_Reply,
-	}
+	replyFrame := api.AcquireFrame()
+	defer api.ReleaseFrame(replyFrame)
+	replyFrame.Id = frame.Id
+	replyFrame.Node = s.GetLocalNode().Name
+	replyFrame.SeqID = s.messageSeq.NextID(frame.Node)
+	replyFrame.Direct = api.Frame_Reply
 
 	if err != nil {
 		replyFrame.Envelope = &api.Envelope{Payload: &api.Envelope_Error{
-			Error: &api.Error{
-				Code:    500,
-				Message: err.Error(),
-			},
+			Error: api.AsError(err),
 		}}
 	} else {
 		replyFrame.Envelope = reply
 	}
+	stampEnvelopeVersion(replyFrame.Envelope)
 
-	bytes, _ := proto.Marshal(&replyFrame)
+	bytes, _ := proto.Marshal(replyFrame)
 	s.Lock()
 	node, ok := s.nodes[frame.Node]
 	s.Unlock()
@@ -217,7 +446,7 @@ func (s *Client) sendReplyMessage(frame *api.Frame, reply *api.Envelope, err err
 		return
 	}
 
-	if err := s.memberlist.SendReliable(node, bytes); err != nil {
+	if err := s.memberlist.SendReliable(node, s.signer.sign(bytes)); err != nil {
 		s.logger.Warn("Failed send message to node", zap.Error(err), zap.String("node", frame.Node))
 	}
 }
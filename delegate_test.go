@@ -0,0 +1,51 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestDelegateJoinBackfill(t *testing.T) {
+	for _, gossipDisabled := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		store := sd.NewMemoryStore()
+		newClient := func(id string) *Client {
+			config := testConfig(t)
+			config.JoinRetryInterval = 10
+			config.GossipDisabled = gossipDisabled
+			return NewClient(ctx, zap.NewNop(), store.NewClient(ctx), id, map[string]string{}, *config)
+		}
+
+		first := newClient("nakama1")
+		early := &joinDelegate{joins: make(chan *Meta, 8)}
+		first.OnDelegate(early)
+		if err := first.WaitReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		second := newClient("nakama2")
+		for joined := false; !joined; {
+			select {
+			case node := <-early.joins:
+				joined = node.Id == "nakama2"
+			case <-ctx.Done():
+				t.Fatalf("join of nakama2 not notified, gossip disabled %v", gossipDisabled)
+			}
+		}
+
+		// the joins are replayed before OnDelegate returns
+		late := &joinDelegate{joins: make(chan *Meta, 8)}
+		first.OnDelegate(late)
+		if !late.hasJoined("nakama2") || (!gossipDisabled && !late.hasJoined("nakama1")) {
+			t.Fatalf("joins not replayed, gossip disabled %v", gossipDisabled)
+		}
+
+		second.Stop()
+		first.Stop()
+		cancel()
+	}
+}
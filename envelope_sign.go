@@ -0,0 +1,124 @@
+package nakamacluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	errEnvelopeUnsigned  = errors.New("envelope not signed")
+	errEnvelopeSignature = errors.New("envelope signature mismatch")
+	errEnvelopeStale     = errors.New("envelope outside the replay window")
+	errEnvelopeReplayed  = errors.New("envelope replayed")
+)
+
+// envelopeSignVars names of the vars carrying the time, the nonce and the signature of an envelope
+type envelopeSignVars struct {
+	time, nonce, signature string
+}
+
+// signEnvelope stamp the time and a random nonce in the vars of the envelope and sign its cid,
+// vars and payload with a hmac of the key
+func signEnvelope(key []byte, in *api.Envelope, names envelopeSignVars, now time.Time) {
+	nonce := make([]byte, gossipNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	if in.Vars == nil {
+		in.Vars = make(map[string]string, 3)
+	}
+	in.Vars[names.time] = strconv.FormatInt(now.UnixMilli(), 10)
+	in.Vars[names.nonce] = hex.EncodeToString(nonce)
+	in.Vars[names.signature] = envelopeMac(key, in, names.signature)
+}
+
+// envelopeMac returns the hmac of the cid, the vars but the signature and the payload of the envelope
+func envelopeMac(key []byte, in *api.Envelope, signature string) string {
+	keys := make([]string, 0, len(in.Vars))
+	for k := range in.Vars {
+		if k != signature {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(in.Cid))
+	for _, k := range keys {
+		mac.Write([]byte{0})
+		mac.Write([]byte(k))
+		mac.Write([]byte{0})
+		mac.Write([]byte(in.Vars[k]))
+	}
+
+	// the payload alone, the version and the expiry may be stamped after signing
+	payload, _ := proto.MarshalOptions{Deterministic: true}.Marshal(&api.Envelope{Payload: in.Payload})
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// envelopeVerifier checks the envelopes signed by signEnvelope, envelopes outside the window
+// or carrying a nonce seen within it are rejected
+type envelopeVerifier struct {
+	names  envelopeSignVars
+	window time.Duration
+	seen   map[string]time.Time
+	pruned time.Time
+	sync.Mutex
+}
+
+func newEnvelopeVerifier(names envelopeSignVars, window time.Duration) *envelopeVerifier {
+	return &envelopeVerifier{names: names, window: window, seen: make(map[string]time.Time)}
+}
+
+// verify check the envelope is signed with the key, recent and not replayed
+func (v *envelopeVerifier) verify(key []byte, in *api.Envelope, now time.Time) error {
+	signature, nonce := in.Vars[v.names.signature], in.Vars[v.names.nonce]
+	if signature == "" || nonce == "" {
+		return errEnvelopeUnsigned
+	}
+
+	if !hmac.Equal([]byte(envelopeMac(key, in, v.names.signature)), []byte(signature)) {
+		return errEnvelopeSignature
+	}
+
+	ms, err := strconv.ParseInt(in.Vars[v.names.time], 10, 64)
+	if err != nil {
+		return errEnvelopeStale
+	}
+
+	if d := now.Sub(time.UnixMilli(ms)); d > v.window || d < -v.window {
+		return errEnvelopeStale
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if _, ok := v.seen[nonce]; ok {
+		return errEnvelopeReplayed
+	}
+
+	// nonces older than the window are rejected by their time and are forgotten
+	if now.Sub(v.pruned) > v.window {
+		for k, t := range v.seen {
+			if now.Sub(t) > 2*v.window {
+				delete(v.seen, k)
+			}
+		}
+		v.pruned = now
+	}
+
+	v.seen[nonce] = now
+	return nil
+}
@@ -0,0 +1,150 @@
+package nakamacluster
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// EventType cluster event type
+type EventType int
+
+const (
+	EVENT_NODE_JOIN        EventType = iota + 1 // node joined the cluster view
+	EVENT_NODE_LEAVE                            // node left the cluster view
+	EVENT_NODE_UPDATE                           // node meta changed
+	EVENT_NODE_QUARANTINED                      // node flapped and gets no traffic until its cool-down ends
+	EVENT_NODE_RELEASED                         // node cool-down ended
+	EVENT_RESYNC_REQUIRED                       // sd watch lost changes and the view was read again in full, Node is the local node
+	EVENT_CLUSTER_JOINED                        // local node registered in sd and joined the gossip after the startup retries, Node is the local node
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EVENT_NODE_JOIN:
+		return "join"
+	case EVENT_NODE_LEAVE:
+		return "leave"
+	case EVENT_NODE_UPDATE:
+		return "update"
+	case EVENT_NODE_QUARANTINED:
+		return "quarantined"
+	case EVENT_NODE_RELEASED:
+		return "released"
+	case EVENT_RESYNC_REQUIRED:
+		return "resync_required"
+	case EVENT_CLUSTER_JOINED:
+		return "cluster_joined"
+	}
+	return "unknown"
+}
+
+// Event cluster event
+type Event struct {
+	Type EventType `json:"type"`
+	Node *Meta     `json:"node"`
+	Time time.Time `json:"time"`
+}
+
+// EventBus deliver cluster events to subscribers in order on a dispatcher goroutine,
+// events are dropped when the queue is full
+type EventBus struct {
+	ctx         context.Context
+	queue       chan Event
+	subscribers map[uint64]func(Event)
+	nextId      uint64
+	sync.RWMutex
+}
+
+// Subscribe call f for every event until the returned function is called
+func (b *EventBus) Subscribe(f func(e Event)) func() {
+	b.Lock()
+	b.nextId++
+	id := b.nextId
+	b.subscribers[id] = f
+	b.Unlock()
+
+	return func() {
+		b.Lock()
+		delete(b.subscribers, id)
+		b.Unlock()
+	}
+}
+
+// Publish queue the event without blocking, it reports false when the event was dropped
+func (b *EventBus) Publish(e Event) bool {
+	if b == nil {
+		return false
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	select {
+	case b.queue <- e:
+	default:
+		return false
+	}
+	return true
+}
+
+func (b *EventBus) dispatch() {
+	for {
+		select {
+		case e := <-b.queue:
+			// subscribers are called without the lock so they may subscribe or unsubscribe
+			b.RLock()
+			subscribers := make([]func(Event), 0, len(b.subscribers))
+			for _, f := range b.subscribers {
+				subscribers = append(subscribers, f)
+			}
+			b.RUnlock()
+
+			for _, f := range subscribers {
+				f(e)
+			}
+
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// NewEventBus create event bus, it is stopped when ctx is done
+func NewEventBus(ctx context.Context, queueSize int) *EventBus {
+	if queueSize < 1 {
+		queueSize = 1024
+	}
+
+	b := &EventBus{
+		ctx:         ctx,
+		queue:       make(chan Event, queueSize),
+		subscribers: make(map[uint64]func(Event)),
+	}
+	go b.dispatch()
+	return b
+}
+
+// diffNodes returns the events turning the old nodes into the new nodes
+func diffNodes(old, new map[string]*Meta) []Event {
+	now := time.Now()
+	events := make([]Event, 0)
+	for id, node := range new {
+		prev, ok := old[id]
+		switch {
+		case !ok:
+			events = append(events, Event{Type: EVENT_NODE_JOIN, Node: node.Clone(), Time: now})
+		case !reflect.DeepEqual(prev, node):
+			events = append(events, Event{Type: EVENT_NODE_UPDATE, Node: node.Clone(), Time: now})
+		}
+	}
+
+	for id, node := range old {
+		if _, ok := new[id]; !ok {
+			events = append(events, Event{Type: EVENT_NODE_LEAVE, Node: node.Clone(), Time: now})
+		}
+	}
+	return events
+}
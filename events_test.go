@@ -0,0 +1,36 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventBusUnsubscribeFromCallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bus := NewEventBus(ctx, 8)
+	once := make(chan Event, 2)
+	var unsubscribe func()
+	unsubscribe = bus.Subscribe(func(e Event) {
+		once <- e
+		unsubscribe()
+	})
+
+	all := make(chan Event, 2)
+	bus.Subscribe(func(e Event) { all <- e })
+	bus.Publish(Event{Type: EVENT_NODE_JOIN})
+	bus.Publish(Event{Type: EVENT_NODE_LEAVE})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-all:
+		case <-ctx.Done():
+			t.Fatal("event bus blocked by a subscriber unsubscribing itself")
+		}
+	}
+
+	if len(once) != 1 {
+		t.Fatalf("unsubscribed subscriber got %d events", len(once))
+	}
+}
@@ -0,0 +1,21 @@
+package nakamacluster
+
+import (
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+)
+
+// SetExpiry set the envelope to expire after ttl, receivers discard it once expired
+func SetExpiry(in *api.Envelope, ttl time.Duration) *api.Envelope {
+	in.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+	return in
+}
+
+// Expired reports whether the envelope expired, tolerance allows for clock skew between nodes
+func Expired(in *api.Envelope, tolerance time.Duration) bool {
+	if in == nil || in.ExpiresAt == 0 {
+		return false
+	}
+	return time.Now().Add(-tolerance).UnixMilli() > in.ExpiresAt
+}
@@ -0,0 +1,110 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// expiryDelegate delegate reporting the messages it handled
+type expiryDelegate struct {
+	stateDelegate
+	messages chan *api.Envelope
+}
+
+func (d *expiryDelegate) MergeRemoteState(buf []byte, join bool) {}
+
+func (d *expiryDelegate) NotifyMsg(node string, msg *api.Envelope) (*api.Envelope, error) {
+	d.messages <- msg
+	return nil, nil
+}
+
+func TestExpiredDroppedOnGossip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.JoinRetryInterval = 10
+	client := NewClient(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", map[string]string{}, *config)
+	defer client.Stop()
+	delegate := &expiryDelegate{messages: make(chan *api.Envelope, 4)}
+	client.OnDelegate(delegate)
+	<-client.wathcer.Registered()
+
+	expired := func() *api.Envelope {
+		in := &api.Envelope{Cid: "expired"}
+		in.ExpiresAt = time.Now().Add(-time.Minute).UnixMilli()
+		return in
+	}
+
+	// an expired broadcast is neither handled nor relayed
+	client.handleFrame(&api.Frame{Id: "1", Node: "node2", SeqID: 1, Direct: api.Frame_Broadcast, Hops: 3, Envelope: expired()})
+	if n := client.relayQueue.NumQueued(); n != 0 {
+		t.Fatalf("expired broadcast relayed %d", n)
+	}
+
+	client.handleFrame(&api.Frame{Id: "2", Node: "node2", SeqID: 2, Direct: api.Frame_Broadcast, Hops: 3, Envelope: SetExpiry(&api.Envelope{Cid: "fresh"}, time.Minute)})
+	if n := client.relayQueue.NumQueued(); n == 0 {
+		t.Fatal("fresh broadcast not relayed")
+	}
+
+	// an expired send is not handled
+	client.handleFrame(&api.Frame{Id: "3", Node: "node2", Direct: api.Frame_Send, Envelope: expired()})
+	select {
+	case in := <-delegate.messages:
+		if in.Cid != "fresh" {
+			t.Fatalf("expired message handled %v", in)
+		}
+	case <-ctx.Done():
+		t.Fatal("fresh broadcast not handled")
+	}
+
+	select {
+	case in := <-delegate.messages:
+		t.Fatalf("expired message handled %v", in)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestExpiredDroppedOnCall(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(echoServerDelegate{})
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	in := &api.Envelope{Cid: "expired"}
+	in.ExpiresAt = time.Now().Add(-time.Minute).UnixMilli()
+	if _, err := peer.Send(ctx, node, in); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expired call not dropped %v", err)
+	}
+
+	if _, err := peer.Send(ctx, node, SetExpiry(&api.Envelope{Cid: "fresh"}, time.Minute)); err != nil {
+		t.Fatalf("fresh call failed %v", err)
+	}
+	// an expired stream request is ended with the error instead of leaving the caller waiting
+	in = &api.Envelope{Cid: "expired"}
+	in.ExpiresAt = time.Now().Add(-time.Minute).UnixMilli()
+	ch, err := peer.SendStreamRequest(ctx, "client1", node, in, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, ok := <-ch; !ok || out.GetError().GetCode() != api.Error_TIMEOUT {
+		t.Fatalf("expired stream request not answered %v", out)
+	}
+
+	if _, ok := <-ch; ok {
+		t.Fatal("expired stream request not ended")
+	}
+}
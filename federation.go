@@ -0,0 +1,281 @@
+package nakamacluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// FEDERATION_CID_PREFIX cids reserved for the federation bridge
+	FEDERATION_CID_PREFIX = "__federation."
+
+	federationCidEnvelope = FEDERATION_CID_PREFIX + "envelope"
+	federationCidMembers  = FEDERATION_CID_PREFIX + "members"
+	federationVarCluster  = "federation_cluster"
+	federationVarCid      = "federation_cid"
+
+	// federationMaxSkew maximum age of a signed federation request
+	federationMaxSkew = time.Minute
+)
+
+// federationSignVars vars carrying the signature of the requests between gateways
+var federationSignVars = envelopeSignVars{time: "federation_time", nonce: "federation_nonce", signature: "federation_signature"}
+
+var (
+	ErrFederationUnknownCluster = errors.New("unknown federated cluster")
+	ErrFederationFiltered       = errors.New("envelope is not exported to federated clusters")
+	ErrFederationUnauthorized   = errors.New("federation request not signed by the cluster gateway")
+)
+
+type FederationOptions struct {
+	// Cluster name of the local cluster announced to remote gateways
+	Cluster string
+
+	// Remotes gRPC address of the gateway of every remote cluster by cluster name
+	Remotes map[string]string
+
+	// Keys secret shared with the gateway of every remote cluster by cluster name, the requests
+	// between gateways are signed with it and the requests of a cluster without key are rejected
+	Keys map[string]string
+
+	// Export reports whether the envelope may leave the cluster, nil exports everything
+	Export func(in *api.Envelope) bool
+
+	// Selector label selector of the local nodes included in the membership summary
+	Selector string
+
+	// SyncInterval interval for pushing the membership summary to remote gateways
+	SyncInterval time.Duration
+}
+
+// Federation bridge between gateway nodes of separate clusters, it exchanges
+// selected envelopes and a filtered membership summary without merging the gossip domains
+type Federation struct {
+	ctx      context.Context
+	peers    Peer
+	remotes  *LocalPeer
+	selector Selector
+	options  FederationOptions
+	members  map[string][]*Meta
+	verifier *envelopeVerifier
+	handler  atomic.Value
+	logger   *zap.Logger
+	sync.RWMutex
+}
+
+// OnEnvelope handle envelopes received from remote clusters
+func (f *Federation) OnEnvelope(handler func(cluster string, in *api.Envelope) (*api.Envelope, error)) {
+	f.handler.Store(handler)
+}
+
+// Send send the envelope to the gateway of the remote cluster
+func (f *Federation) Send(ctx context.Context, cluster string, in *api.Envelope) (*api.Envelope, error) {
+	if f.options.Export != nil && !f.options.Export(in) {
+		return nil, ErrFederationFiltered
+	}
+
+	node, ok := f.remotes.Get(cluster)
+	if !ok {
+		return nil, ErrFederationUnknownCluster
+	}
+
+	request := proto.Clone(in).(*api.Envelope)
+	if request.Vars == nil {
+		request.Vars = make(map[string]string)
+	}
+	request.Vars[federationVarCluster] = f.options.Cluster
+	request.Vars[federationVarCid] = in.Cid
+	request.Cid = federationCidEnvelope
+	f.sign(cluster, request)
+	return f.remotes.Send(ctx, node, request)
+}
+
+// sign sign the request to the gateway of the remote cluster with the key shared with it
+func (f *Federation) sign(cluster string, in *api.Envelope) {
+	if key := f.options.Keys[cluster]; key != "" {
+		signEnvelope([]byte(key), in, federationSignVars, time.Now())
+	}
+}
+
+// authenticate check the request was signed by the gateway of the cluster it claims to come from
+func (f *Federation) authenticate(cluster string, in *api.Envelope) error {
+	if _, ok := f.options.Remotes[cluster]; !ok {
+		return ErrFederationUnknownCluster
+	}
+
+	key := f.options.Keys[cluster]
+	if key == "" {
+		return ErrFederationUnauthorized
+	}
+
+	if err := f.verifier.verify([]byte(key), in, time.Now()); err != nil {
+		f.logger.Warn("Rejected federation request", zap.String("cluster", cluster), zap.String("cid", in.Cid), zap.Error(err))
+		return ErrFederationUnauthorized
+	}
+	return nil
+}
+
+// Broadcast send the envelope to the gateways of every remote cluster
+func (f *Federation) Broadcast(ctx context.Context, in *api.Envelope) error {
+	var errs []string
+	for _, node := range f.remotes.All() {
+		if _, err := f.Send(ctx, node.Id, in); err != nil {
+			errs = append(errs, node.Id+": "+err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Members returns the last membership summary received from the remote cluster
+func (f *Federation) Members(cluster string) []*Meta {
+	f.RLock()
+	defer f.RUnlock()
+	members := make([]*Meta, len(f.members[cluster]))
+	for i, member := range f.members[cluster] {
+		members[i] = member.Clone()
+	}
+	return members
+}
+
+// Clusters returns the names of the remote clusters
+func (f *Federation) Clusters() []string {
+	clusters := make([]string, 0, len(f.options.Remotes))
+	for cluster := range f.options.Remotes {
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// Handle serve a federation request received by the gateway,
+// it reports false when the cid is not reserved for the federation
+func (f *Federation) Handle(ctx context.Context, in *api.Envelope) (*api.Envelope, bool, error) {
+	if !strings.HasPrefix(in.Cid, FEDERATION_CID_PREFIX) {
+		return nil, false, nil
+	}
+
+	cluster := in.Vars[federationVarCluster]
+	if err := f.authenticate(cluster, in); err != nil {
+		return nil, true, err
+	}
+
+	switch in.Cid {
+	case federationCidMembers:
+		var members []*Meta
+		if err := json.Unmarshal(in.GetBytes(), &members); err != nil {
+			return nil, true, err
+		}
+
+		f.Lock()
+		f.members[cluster] = members
+		f.Unlock()
+		return &api.Envelope{Cid: in.Cid}, true, nil
+
+	case federationCidEnvelope:
+		handler, ok := f.handler.Load().(func(cluster string, in *api.Envelope) (*api.Envelope, error))
+		if !ok || handler == nil {
+			return nil, true, api.NewError(api.Error_UNIMPLEMENTED, "federation handler not set")
+		}
+
+		request := proto.Clone(in).(*api.Envelope)
+		request.Cid = in.Vars[federationVarCid]
+		delete(request.Vars, federationVarCluster)
+		delete(request.Vars, federationVarCid)
+		delete(request.Vars, federationSignVars.time)
+		delete(request.Vars, federationSignVars.nonce)
+		delete(request.Vars, federationSignVars.signature)
+		out, err := handler(cluster, request)
+		return out, true, err
+	}
+	return nil, true, api.Errorf(api.Error_UNIMPLEMENTED, "unknown federation cid %s", in.Cid)
+}
+
+func (f *Federation) syncMembers() {
+	members := make([]*Meta, 0)
+	for _, node := range f.peers.All() {
+		if f.selector.Matches(node.Labels) {
+			members = append(members, node)
+		}
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		f.logger.Warn("Failed marshal federation members", zap.Error(err))
+		return
+	}
+
+	for _, node := range f.remotes.All() {
+		ctx, cancel := context.WithTimeout(f.ctx, f.options.SyncInterval)
+		in := &api.Envelope{
+			Cid:     federationCidMembers,
+			Payload: &api.Envelope_Bytes{Bytes: b},
+			Vars:    map[string]string{federationVarCluster: f.options.Cluster},
+		}
+		f.sign(node.Id, in)
+		_, err := f.remotes.Send(ctx, node, in)
+		cancel()
+
+		if err != nil {
+			f.logger.Warn("Failed sync federation members", zap.Error(err), zap.String("cluster", node.Id))
+		}
+	}
+}
+
+func (f *Federation) syncLoop() {
+	t := time.NewTicker(f.options.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			f.syncMembers()
+
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+// NewFederation create federation bridge for the gateway, peers is the local cluster view
+func NewFederation(ctx context.Context, logger *zap.Logger, peers Peer, options FederationOptions) (*Federation, error) {
+	selector, err := ParseSelector(options.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = 10 * time.Second
+	}
+
+	f := &Federation{
+		ctx:      ctx,
+		peers:    peers,
+		selector: selector,
+		options:  options,
+		members:  make(map[string][]*Meta),
+		verifier: newEnvelopeVerifier(federationSignVars, federationMaxSkew),
+		logger:   logger,
+		remotes: NewPeer(ctx, logger, PeerOptions{
+			Connections: 2,
+		}),
+	}
+
+	remotes := make([]*Meta, 0, len(options.Remotes))
+	for cluster, addr := range options.Remotes {
+		remotes = append(remotes, &Meta{Id: cluster, Name: "federation", Addr: addr, Type: NODE_TYPE_MICROSERVICES, Status: META_STATUS_READYED, ProtocolVersion: ProtocolVersion})
+	}
+	f.remotes.Sync(remotes...)
+	go f.syncLoop()
+	return f, nil
+}
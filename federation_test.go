@@ -0,0 +1,92 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFederation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the gateway of cluster b serves federation requests without a server delegate
+	config := testConfig(t)
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "gateway-b", "gateway", map[string]string{}, *config)
+	defer server.Stop()
+
+	local := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MessageQueueSize: 8})
+	gatewayB, err := NewFederation(ctx, zap.NewNop(), local, FederationOptions{
+		Cluster: "b",
+		Remotes: map[string]string{"a": "127.0.0.1:1", "c": "127.0.0.1:2"},
+		Keys:    map[string]string{"a": "secret-a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gatewayB.OnEnvelope(func(cluster string, in *api.Envelope) (*api.Envelope, error) {
+		if _, ok := in.Vars[federationSignVars.signature]; ok {
+			t.Error("signature passed to the handler")
+		}
+		return &api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Bytes{Bytes: []byte(cluster)}}, nil
+	})
+	server.OnFederation(gatewayB)
+
+	newGateway := func(cluster, key string) *Federation {
+		f, err := NewFederation(ctx, zap.NewNop(), local, FederationOptions{
+			Cluster:      cluster,
+			Remotes:      map[string]string{"b": server.GetMeta().Addr},
+			Keys:         map[string]string{"b": key},
+			SyncInterval: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	out, err := newGateway("a", "secret-a").Send(ctx, "b", &api.Envelope{Cid: "chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Cid != "chat" || string(out.GetBytes()) != "a" {
+		t.Fatalf("unexpected reply %v", out)
+	}
+
+	// a gateway claiming another cluster, a cluster without key and a forged request are rejected
+	for _, gateway := range []*Federation{newGateway("a", "guess"), newGateway("c", "secret-a")} {
+		if _, err := gateway.Send(ctx, "b", &api.Envelope{Cid: "chat"}); err == nil {
+			t.Fatal("unauthenticated gateway accepted")
+		}
+	}
+
+	forged := &api.Envelope{Cid: federationCidEnvelope, Vars: map[string]string{federationVarCluster: "a", federationVarCid: "chat"}}
+	if _, ok, err := gatewayB.Handle(ctx, forged); !ok || !errors.Is(err, ErrFederationUnauthorized) {
+		t.Fatalf("expected ErrFederationUnauthorized for an unsigned request, got %v", err)
+	}
+
+	// a signed request is accepted once and its payload may not change
+	signed := proto.Clone(forged).(*api.Envelope)
+	signEnvelope([]byte("secret-a"), signed, federationSignVars, time.Now())
+	tampered := proto.Clone(signed).(*api.Envelope)
+	tampered.Payload = &api.Envelope_Bytes{Bytes: []byte("changed")}
+	if _, _, err := gatewayB.Handle(ctx, tampered); !errors.Is(err, ErrFederationUnauthorized) {
+		t.Fatalf("expected ErrFederationUnauthorized for a changed payload, got %v", err)
+	}
+
+	if _, _, err := gatewayB.Handle(ctx, signed); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := gatewayB.Handle(ctx, signed); !errors.Is(err, ErrFederationUnauthorized) {
+		t.Fatalf("expected ErrFederationUnauthorized for a replayed request, got %v", err)
+	}
+}
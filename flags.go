@@ -0,0 +1,206 @@
+package nakamacluster
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+const (
+	// FLAGS_CID_PREFIX cids reserved for cluster flags
+	FLAGS_CID_PREFIX = "__flags."
+
+	flagsCidSet = FLAGS_CID_PREFIX + "set"
+
+	// flagsState name of the gossip state extension exchanging every flag on push/pull
+	flagsState = "__flags"
+)
+
+// Flag cluster-wide config value, flags with a higher version replace older ones,
+// a deleted flag is kept as a tombstone so older versions do not come back
+type Flag struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Version   uint64 `json:"version"`
+	Node      string `json:"node"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// Bool returns the value parsed as a bool, false when it is not one
+func (f Flag) Bool() bool {
+	b, _ := strconv.ParseBool(f.Value)
+	return b
+}
+
+// newer reports whether the flag replaces other, ties are broken by node name
+func (f *Flag) newer(other *Flag) bool {
+	if f.Version != other.Version {
+		return f.Version > other.Version
+	}
+	return f.Node > other.Node
+}
+
+// Flags config values set on any node and replicated to every node through gossip,
+// broadcasts spread a change within seconds and the push/pull state repairs missed ones
+type Flags struct {
+	client   *Client
+	flags    map[string]*Flag
+	onChange atomic.Value
+	audit    *AuditLog
+	sync.Mutex
+}
+
+// OnChange is invoked when a flag is set or deleted on the local node or by another node
+func (s *Flags) OnChange(f func(flag Flag)) {
+	s.onChange.Store(f)
+}
+
+// Get returns the flag, false when it was never set or deleted
+func (s *Flags) Get(key string) (Flag, bool) {
+	s.Lock()
+	defer s.Unlock()
+	flag, ok := s.flags[key]
+	if !ok || flag.Deleted {
+		return Flag{}, false
+	}
+	return *flag, true
+}
+
+// Bool returns the flag parsed as a bool, the default when it is not set
+func (s *Flags) Bool(key string, def bool) bool {
+	flag, ok := s.Get(key)
+	if !ok {
+		return def
+	}
+
+	b, err := strconv.ParseBool(flag.Value)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// All returns the flags that are set by key
+func (s *Flags) All() map[string]Flag {
+	s.Lock()
+	defer s.Unlock()
+	flags := make(map[string]Flag, len(s.flags))
+	for key, flag := range s.flags {
+		if !flag.Deleted {
+			flags[key] = *flag
+		}
+	}
+	return flags
+}
+
+// Set change the value of the flag on every node
+func (s *Flags) Set(key, value string) (Flag, error) {
+	return s.set(key, value, false)
+}
+
+// Delete remove the flag from every node
+func (s *Flags) Delete(key string) error {
+	_, err := s.set(key, "", true)
+	return err
+}
+
+func (s *Flags) set(key, value string, deleted bool) (Flag, error) {
+	s.Lock()
+	flag := &Flag{Key: key, Value: value, Version: 1, Node: s.client.GetLocalNode().Name, Deleted: deleted, UpdatedAt: time.Now().Unix()}
+	if current, ok := s.flags[key]; ok {
+		flag.Version = current.Version + 1
+	}
+	s.flags[key] = flag
+	s.Unlock()
+
+	s.notify(*flag)
+	b, err := json.Marshal(flag)
+	if err != nil {
+		return Flag{}, err
+	}
+
+	err = s.client.Broadcast(NewMessage(&api.Envelope{Cid: flagsCidSet, Payload: &api.Envelope_Bytes{Bytes: b}}))
+	return *flag, err
+}
+
+// handle merge a flag received from another node
+func (s *Flags) handle(node string, in *api.Envelope) {
+	var flag Flag
+	if err := json.Unmarshal(in.GetBytes(), &flag); err != nil {
+		s.client.logger.Warn("Failed parse flag", zap.Error(err), zap.String("node", node))
+		return
+	}
+	s.merge(&flag)
+}
+
+// merge keep the flag when it is newer than the local one and notify the change
+func (s *Flags) merge(flag *Flag) {
+	s.Lock()
+	if current, ok := s.flags[flag.Key]; ok && !flag.newer(current) {
+		s.Unlock()
+		return
+	}
+	s.flags[flag.Key] = flag
+	s.Unlock()
+
+	s.notify(*flag)
+}
+
+func (s *Flags) notify(flag Flag) {
+	s.audit.Record(AUDIT_FLAG, flag.Node, flag.Key, map[string]string{"value": flag.Value, "version": strconv.FormatUint(flag.Version, 10), "deleted": strconv.FormatBool(flag.Deleted)})
+	if f, ok := s.onChange.Load().(func(flag Flag)); ok && f != nil {
+		f(flag)
+	}
+}
+
+// encode returns every flag and tombstone for the push/pull state
+func (s *Flags) encode(join bool) []byte {
+	s.Lock()
+	flags := make([]*Flag, 0, len(s.flags))
+	for _, flag := range s.flags {
+		flags = append(flags, flag)
+	}
+	b, err := json.Marshal(flags)
+	s.Unlock()
+
+	if err != nil {
+		s.client.logger.Warn("Failed marshal flags", zap.Error(err))
+		return nil
+	}
+	return b
+}
+
+// mergeState merge the flags of the push/pull state of another node
+func (s *Flags) mergeState(buf []byte, join bool) {
+	var flags []*Flag
+	if err := json.Unmarshal(buf, &flags); err != nil {
+		s.client.logger.Warn("Failed parse flags state", zap.Error(err))
+		return
+	}
+
+	for _, flag := range flags {
+		s.merge(flag)
+	}
+}
+
+func isFlagsCid(cid string) bool {
+	return strings.HasPrefix(cid, FLAGS_CID_PREFIX)
+}
+
+// NewFlags create flags replicated through the client
+func NewFlags(client *Client) *Flags {
+	s := &Flags{
+		client: client,
+		flags:  make(map[string]*Flag),
+	}
+
+	client.RegisterState(flagsState, GossipState{Encode: s.encode, Merge: s.mergeState})
+	return s
+}
@@ -0,0 +1,83 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestFlags(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newClient := func(id string) *Client {
+		config := testConfig(t)
+		config.JoinRetryInterval = 10
+		return NewClient(ctx, zap.NewNop(), store.NewClient(ctx), id, map[string]string{}, *config)
+	}
+
+	node1 := newClient("node1")
+	defer node1.Stop()
+	<-node1.wathcer.Registered()
+	node2 := newClient("node2")
+	defer node2.Stop()
+	for node1.memberlist.NumMembers() < 2 || node2.memberlist.NumMembers() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("nodes did not join the gossip")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	changes := make(chan Flag, 4)
+	node2.Flags().OnChange(func(flag Flag) { changes <- flag })
+	if _, err := node1.Flags().Set("cross_region", "false"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case flag := <-changes:
+		if flag.Key != "cross_region" || flag.Version != 1 || flag.Node != "node1" || flag.Bool() {
+			t.Fatalf("unexpected flag %+v", flag)
+		}
+	case <-ctx.Done():
+		t.Fatal("flag not replicated")
+	}
+
+	if node2.Flags().Bool("cross_region", true) {
+		t.Fatal("flag not set on the other node")
+	}
+
+	if err := node2.Flags().Delete("cross_region"); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, ok := node1.Flags().Get("cross_region"); !ok {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("flag deletion not replicated")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// an older version of the push/pull state does not bring the deleted flag back
+	stale := NewFlags(node2)
+	stale.merge(&Flag{Key: "cross_region", Value: "true", Version: 1, Node: "node1"})
+	node1.Flags().mergeState(stale.encode(false), false)
+	if _, ok := node1.Flags().Get("cross_region"); ok {
+		t.Fatal("stale flag merged")
+	}
+
+	node1.Flags().merge(&Flag{Key: "matchmaker", Value: "v2", Version: 1, Node: "node1"})
+	node2.Flags().mergeState(node1.Flags().encode(false), false)
+	if flag, ok := node2.Flags().Get("matchmaker"); !ok || flag.Value != "v2" {
+		t.Fatalf("flag missed by the push/pull state %+v", flag)
+	}
+}
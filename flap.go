@@ -0,0 +1,107 @@
+package nakamacluster
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNodeQuarantined the node flapped and is not dialed until its cool-down ends
+var ErrNodeQuarantined = errors.New("node quarantined")
+
+// flapDetector counts the joins and leaves of every node, a node with more than
+// threshold of them within window is quarantined for cooldown
+type flapDetector struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	history   map[string][]time.Time
+	until     map[string]time.Time
+	sync.Mutex
+}
+
+// newFlapDetector create flap detector, flaps are not detected when threshold is not
+// positive but nodes can still be quarantined with hold
+func newFlapDetector(threshold int, window, cooldown time.Duration) *flapDetector {
+	if window <= 0 || cooldown <= 0 {
+		threshold = 0
+	}
+
+	return &flapDetector{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		history:   make(map[string][]time.Time),
+		until:     make(map[string]time.Time),
+	}
+}
+
+// record a join or leave of the node, it reports true when the node got quarantined by it
+func (d *flapDetector) record(id string, now time.Time) bool {
+	if d == nil || d.threshold < 1 {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if now.Before(d.until[id]) {
+		return false
+	}
+
+	history := d.history[id][:0]
+	for _, t := range d.history[id] {
+		if now.Sub(t) < d.window {
+			history = append(history, t)
+		}
+	}
+
+	history = append(history, now)
+	if len(history) <= d.threshold {
+		d.history[id] = history
+		return false
+	}
+
+	delete(d.history, id)
+	d.until[id] = now.Add(d.cooldown)
+	return true
+}
+
+// hold quarantine the node until the time, an existing later quarantine is kept
+func (d *flapDetector) hold(id string, until time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if until.After(d.until[id]) {
+		d.until[id] = until
+	}
+}
+
+// quarantined reports whether the node is in its cool-down
+func (d *flapDetector) quarantined(id string, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	until, ok := d.until[id]
+	if ok && !now.Before(until) {
+		delete(d.until, id)
+		return false
+	}
+	return ok
+}
+
+// forget drop the history of nodes that stayed quiet for the window
+func (d *flapDetector) forget(now time.Time) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	for id, history := range d.history {
+		if len(history) < 1 || now.Sub(history[len(history)-1]) >= d.window {
+			delete(d.history, id)
+		}
+	}
+}
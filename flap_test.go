@@ -0,0 +1,61 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+func TestFlapQuarantine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := NewEventBus(ctx, 16)
+	quarantined := make(chan *Meta, 1)
+	released := make(chan *Meta, 1)
+	events.Subscribe(func(e Event) {
+		switch e.Type {
+		case EVENT_NODE_QUARANTINED:
+			quarantined <- e.Node
+		case EVENT_NODE_RELEASED:
+			released <- e.Node
+		}
+	})
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Events: events, FlapThreshold: 2, FlapWindow: time.Minute, FlapCooldown: 200 * time.Millisecond})
+	node := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	peer.Sync(node)
+	peer.Sync()
+	peer.Sync(node)
+
+	select {
+	case m := <-quarantined:
+		if m.Id != "node1" {
+			t.Fatalf("quarantined %s", m.Id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("node not quarantined")
+	}
+
+	if _, ok := peer.GetWithHashRing("svc", "a"); ok {
+		t.Fatal("quarantined node still in the ring")
+	}
+
+	if _, err := peer.Send(ctx, node, &api.Envelope{}); !errors.Is(err, ErrNodeQuarantined) {
+		t.Fatalf("expected quarantined error, got %v", err)
+	}
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("node not released")
+	}
+
+	if m, ok := peer.GetWithHashRing("svc", "a"); !ok || m.Id != "node1" {
+		t.Fatalf("released node not in the ring, got %v", m)
+	}
+}
@@ -0,0 +1,130 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+// joinDelegate delegate reporting the nodes joining, it keeps no gossip state
+// as its callbacks run on the join and memberlist goroutines
+type joinDelegate struct {
+	joins  chan *Meta
+	joined map[string]bool
+	sync.Mutex
+}
+
+func (d *joinDelegate) LocalState(join bool) []byte            { return nil }
+func (d *joinDelegate) MergeRemoteState(buf []byte, join bool) {}
+func (d *joinDelegate) NotifyLeave(node *Meta)                 {}
+func (d *joinDelegate) NotifyUpdate(node *Meta)                {}
+func (d *joinDelegate) NotifyAlive(node *Meta) error           { return nil }
+func (d *joinDelegate) NotifyMsg(node string, msg *api.Envelope) (*api.Envelope, error) {
+	return nil, nil
+}
+
+// NotifyJoin record the node and report it on joins, a full channel drops the report
+// instead of blocking the notifications of the client
+func (d *joinDelegate) NotifyJoin(node *Meta) {
+	d.Lock()
+	if d.joined == nil {
+		d.joined = make(map[string]bool)
+	}
+	d.joined[node.Id] = true
+	d.Unlock()
+
+	select {
+	case d.joins <- node:
+	default:
+	}
+}
+
+// hasJoined reports whether the join of the node was notified
+func (d *joinDelegate) hasJoined(id string) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.joined[id]
+}
+
+func TestGossipDisabled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newClient := func(id string) *Client {
+		config := testConfig(t)
+		config.GossipDisabled = true
+		return NewClient(ctx, zap.NewNop(), store.NewClient(ctx), id, map[string]string{}, *config)
+	}
+
+	first := newClient("nakama1")
+	defer first.Stop()
+	delegate := &joinDelegate{joins: make(chan *Meta, 4)}
+	first.OnDelegate(delegate)
+
+	second := newClient("nakama2")
+	defer second.Stop()
+	for joined := false; !joined; {
+		select {
+		case node := <-delegate.joins:
+			joined = node.Id == "nakama2"
+		case <-ctx.Done():
+			t.Fatal("join of nakama2 not notified")
+		}
+	}
+
+	if err := first.Broadcast(NewMessage(&api.Envelope{Cid: "chat"})); !errors.Is(err, ErrGossipDisabled) {
+		t.Fatalf("unexpected broadcast error %v", err)
+	}
+
+	if node := first.GetLocalNode(); node.Name != "nakama1" {
+		t.Fatalf("unexpected local node %+v", node)
+	}
+
+	if err := second.UpdateLabels(map[string]string{"zone": "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if node, ok := first.peers.Get("nakama2"); ok && node.Labels["zone"] == "a" {
+			break
+		}
+
+		if ctx.Err() != nil {
+			t.Fatal("labels not written to sd")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpdateLabelsWrittenToSd(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	store := sd.NewMemoryStore()
+	client := NewClient(ctx, zap.NewNop(), store.NewClient(ctx), "nakama1", map[string]string{}, *config)
+	defer client.Stop()
+	if err := client.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.UpdateLabels(map[string]string{"zone": "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := store.NewClient(ctx).GetEntries(config.Prefix)
+	if err != nil || len(values) != 1 {
+		t.Fatalf("unexpected sd entries %v %v", values, err)
+	}
+
+	if meta := NewNodeMetaFromJSON([]byte(values[0])); meta == nil || meta.Labels["zone"] != "a" {
+		t.Fatalf("labels not written to sd %s", values[0])
+	}
+}
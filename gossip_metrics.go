@@ -0,0 +1,108 @@
+package nakamacluster
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+	"github.com/uber-go/tally/v4"
+)
+
+// gossipMetricsLabel label memberlist adds to its metrics, it names the client they belong to
+const gossipMetricsLabel = "cluster_node"
+
+var (
+	gossipSink     = &gossipMetricsSink{}
+	gossipSinkOnce sync.Once
+)
+
+// gossipMetricsSink receives the metrics memberlist emits through the global go-metrics
+// instance and reports them to the scope of the client named by the cluster_node label
+type gossipMetricsSink struct {
+	scopes sync.Map
+}
+
+// registerGossipMetrics install the sink as the global go-metrics sink and report the
+// memberlist metrics labeled with node to the scope, it returns the memberlist labels
+func registerGossipMetrics(node string, scope tally.Scope) []gometrics.Label {
+	gossipSinkOnce.Do(func() {
+		conf := gometrics.DefaultConfig("")
+		conf.EnableHostname = false
+		conf.EnableRuntimeMetrics = false
+		gometrics.NewGlobal(conf, gossipSink)
+	})
+
+	gossipSink.scopes.Store(node, scope)
+	return []gometrics.Label{{Name: gossipMetricsLabel, Value: node}}
+}
+
+func unregisterGossipMetrics(node string) {
+	gossipSink.scopes.Delete(node)
+}
+
+func (s *gossipMetricsSink) scope(key []string, labels []gometrics.Label) (tally.Scope, string, bool) {
+	tags := make(map[string]string, len(labels))
+	var scope tally.Scope
+	for _, label := range labels {
+		if label.Name != gossipMetricsLabel {
+			tags[label.Name] = label.Value
+			continue
+		}
+
+		if v, ok := s.scopes.Load(label.Value); ok {
+			scope = v.(tally.Scope)
+		}
+	}
+
+	if scope == nil {
+		return nil, "", false
+	}
+
+	if len(tags) > 0 {
+		scope = scope.Tagged(tags)
+	}
+	return scope, strings.Join(key, "_"), true
+}
+
+func (s *gossipMetricsSink) SetGauge(key []string, val float32) {}
+
+func (s *gossipMetricsSink) SetGaugeWithLabels(key []string, val float32, labels []gometrics.Label) {
+	if scope, name, ok := s.scope(key, labels); ok {
+		scope.Gauge(name).Update(float64(val))
+	}
+}
+
+func (s *gossipMetricsSink) EmitKey(key []string, val float32) {}
+
+func (s *gossipMetricsSink) IncrCounter(key []string, val float32) {}
+
+func (s *gossipMetricsSink) IncrCounterWithLabels(key []string, val float32, labels []gometrics.Label) {
+	if scope, name, ok := s.scope(key, labels); ok {
+		scope.Counter(name).Inc(int64(val))
+	}
+}
+
+func (s *gossipMetricsSink) AddSample(key []string, val float32) {}
+
+// AddSampleWithLabels memberlist only samples durations, in milliseconds
+func (s *gossipMetricsSink) AddSampleWithLabels(key []string, val float32, labels []gometrics.Label) {
+	if scope, name, ok := s.scope(key, labels); ok {
+		scope.Timer(name).Record(time.Duration(float64(val) * float64(time.Millisecond)))
+	}
+}
+
+// reportGossip report the gossip queues and the health of memberlist until the client is done
+func (s *Client) reportGossip(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.metrics.Gossip(s.messageQueue.NumQueued(), s.relayQueue.NumQueued(), s.memberlist.GetHealthScore(), s.memberlist.NumMembers())
+
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package nakamacluster
+
+import (
+	"testing"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+	"github.com/uber-go/tally/v4"
+)
+
+func TestGossipMetricsSink(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	labels := registerGossipMetrics("node1", scope)
+	defer unregisterGossipMetrics("node1")
+
+	gometrics.IncrCounterWithLabels([]string{"memberlist", "degraded", "probe"}, 1, labels)
+	gometrics.MeasureSinceWithLabels([]string{"memberlist", "pushPullNode"}, time.Now().Add(-time.Second), labels)
+	gometrics.IncrCounterWithLabels([]string{"memberlist", "degraded", "probe"}, 1, []gometrics.Label{{Name: gossipMetricsLabel, Value: "node2"}})
+
+	snapshot := scope.Snapshot()
+	counter, ok := snapshot.Counters()["memberlist_degraded_probe+"]
+	if !ok || counter.Value() != 1 {
+		t.Fatalf("probe counter %v", snapshot.Counters())
+	}
+
+	timer, ok := snapshot.Timers()["memberlist_pushPullNode+"]
+	if !ok || len(timer.Values()) != 1 || timer.Values()[0] < time.Second {
+		t.Fatalf("push pull timer %v", snapshot.Timers())
+	}
+}
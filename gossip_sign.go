@@ -0,0 +1,137 @@
+package nakamacluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrGossipUnsigned  = errors.New("gossip message not signed")
+	ErrGossipSignature = errors.New("gossip message signature mismatch")
+	ErrGossipStale     = errors.New("gossip message outside the replay window")
+	ErrGossipReplayed  = errors.New("gossip message replayed")
+)
+
+// gossipSignMagic prefix of the signed user messages, a protobuf frame never starts with a zero byte
+var gossipSignMagic = []byte("\x00nksg")
+
+const (
+	gossipNonceSize  = 16
+	gossipHeaderSize = 8 + gossipNonceSize + sha256.Size
+)
+
+// gossipSigner signs the user messages sent through gossip with a hmac over a timestamp,
+// a random nonce and the message. Messages outside the replay window or carrying a nonce
+// seen within it are rejected
+type gossipSigner struct {
+	key    []byte
+	window time.Duration
+	clock  clock
+	seen   map[[gossipNonceSize]byte]time.Time
+	pruned time.Time
+	sync.Mutex
+}
+
+// newGossipSigner create the signer of the key, nil when the key is empty
+func newGossipSigner(key string, window time.Duration) *gossipSigner {
+	if key == "" {
+		return nil
+	}
+
+	if window <= 0 {
+		window = 30 * time.Second
+	}
+	return &gossipSigner{key: []byte(key), window: window, clock: realClock{}, seen: make(map[[gossipNonceSize]byte]time.Time)}
+}
+
+func (g *gossipSigner) mac(header, msg []byte) []byte {
+	h := hmac.New(sha256.New, g.key)
+	h.Write(header)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// sign returns the signed message, the message itself when g is nil
+func (g *gossipSigner) sign(msg []byte) []byte {
+	if g == nil {
+		return msg
+	}
+
+	b := make([]byte, len(gossipSignMagic)+gossipHeaderSize+len(msg))
+	n := copy(b, gossipSignMagic)
+	header := b[n : n+8+gossipNonceSize]
+	binary.BigEndian.PutUint64(header, uint64(g.clock.Now().UnixNano()))
+	if _, err := rand.Read(header[8:]); err != nil {
+		panic(err)
+	}
+
+	copy(b[n+8+gossipNonceSize:], g.mac(header, msg))
+	copy(b[n+gossipHeaderSize:], msg)
+	return b
+}
+
+// verify returns the message of the signed msg. A nil g accepts every message and strips
+// the signature of signed ones so nodes can enable signing one after another
+func (g *gossipSigner) verify(msg []byte) ([]byte, error) {
+	signed := bytes.HasPrefix(msg, gossipSignMagic) && len(msg) >= len(gossipSignMagic)+gossipHeaderSize
+	switch {
+	case g == nil && signed:
+		return msg[len(gossipSignMagic)+gossipHeaderSize:], nil
+	case g == nil:
+		return msg, nil
+	case !signed:
+		return nil, ErrGossipUnsigned
+	}
+
+	msg = msg[len(gossipSignMagic):]
+	header, sum, payload := msg[:8+gossipNonceSize], msg[8+gossipNonceSize:gossipHeaderSize], msg[gossipHeaderSize:]
+	if !hmac.Equal(sum, g.mac(header, payload)) {
+		return nil, ErrGossipSignature
+	}
+
+	now := g.clock.Now()
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(header)))
+	if d := now.Sub(sent); d > g.window || d < -g.window {
+		return nil, ErrGossipStale
+	}
+
+	var nonce [gossipNonceSize]byte
+	copy(nonce[:], header[8:])
+	g.Lock()
+	defer g.Unlock()
+	if _, ok := g.seen[nonce]; ok {
+		return nil, ErrGossipReplayed
+	}
+
+	// nonces older than the window are rejected by their timestamp and are forgotten
+	if now.Sub(g.pruned) > g.window {
+		for k, t := range g.seen {
+			if now.Sub(t) > 2*g.window {
+				delete(g.seen, k)
+			}
+		}
+		g.pruned = now
+	}
+
+	g.seen[nonce] = now
+	return payload, nil
+}
+
+// gossipVerifyReason metric tag of the verify error
+func gossipVerifyReason(err error) string {
+	switch {
+	case errors.Is(err, ErrGossipUnsigned):
+		return "unsigned"
+	case errors.Is(err, ErrGossipStale):
+		return "stale"
+	case errors.Is(err, ErrGossipReplayed):
+		return "replayed"
+	}
+	return "signature"
+}
@@ -0,0 +1,94 @@
+package nakamacluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestGossipSigner(t *testing.T) {
+	clock := newVirtualClock()
+	signer := newGossipSigner("secret", 10*time.Second)
+	signer.clock = clock
+	msg := []byte("frame")
+
+	signed := signer.sign(msg)
+	if b, err := signer.verify(signed); err != nil || !bytes.Equal(b, msg) {
+		t.Fatalf("unexpected verify %q %v", b, err)
+	}
+
+	if _, err := signer.verify(signed); !errors.Is(err, ErrGossipReplayed) {
+		t.Fatalf("expected ErrGossipReplayed, got %v", err)
+	}
+
+	tampered := signer.sign(msg)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := signer.verify(tampered); !errors.Is(err, ErrGossipSignature) {
+		t.Fatalf("expected ErrGossipSignature, got %v", err)
+	}
+
+	if _, err := newGossipSigner("other", time.Second).verify(signer.sign(msg)); !errors.Is(err, ErrGossipSignature) {
+		t.Fatalf("message of another key accepted %v", err)
+	}
+
+	if _, err := signer.verify(msg); !errors.Is(err, ErrGossipUnsigned) {
+		t.Fatalf("expected ErrGossipUnsigned, got %v", err)
+	}
+
+	late := signer.sign(msg)
+	clock.Advance(11 * time.Second)
+	if _, err := signer.verify(late); !errors.Is(err, ErrGossipStale) {
+		t.Fatalf("expected ErrGossipStale, got %v", err)
+	}
+
+	// nodes without a key accept signed messages while signing is rolled out
+	var none *gossipSigner
+	if b, err := none.verify(signer.sign(msg)); err != nil || !bytes.Equal(b, msg) || !bytes.Equal(none.sign(msg), msg) {
+		t.Fatalf("unexpected unsigned node %q %v", b, err)
+	}
+}
+
+func TestGossipSigning(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newClient := func(id string) *Client {
+		config := testConfig(t)
+		config.JoinRetryInterval = 10
+		config.GossipSigningKey = "secret"
+		return NewClient(ctx, zap.NewNop(), store.NewClient(ctx), id, map[string]string{}, *config)
+	}
+
+	node1 := newClient("node1")
+	defer node1.Stop()
+	<-node1.wathcer.Registered()
+	node2 := newClient("node2")
+	defer node2.Stop()
+	for node1.memberlist.NumMembers() < 2 || node2.memberlist.NumMembers() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("nodes did not join the gossip")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	changes := make(chan Flag, 4)
+	node2.Flags().OnChange(func(flag Flag) { changes <- flag })
+	if _, err := node1.Flags().Set("signed", "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case flag := <-changes:
+		if flag.Key != "signed" || !flag.Bool() {
+			t.Fatalf("unexpected flag %+v", flag)
+		}
+	case <-ctx.Done():
+		t.Fatal("signed broadcast not received")
+	}
+}
@@ -0,0 +1,114 @@
+package nakamacluster
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrStateRegistered a gossip state extension is already registered under the name
+var ErrStateRegistered = errors.New("gossip state already registered")
+
+// gossipStateMagic prefix of the push/pull state carrying extensions, states without
+// it are the plain state of the delegate sent when no extension is registered
+var gossipStateMagic = []byte("\x00nkgs")
+
+// GossipState a named state extension exchanged on the memberlist push/pull
+type GossipState struct {
+	// Encode returns the local state, join reports whether it is sent for a join
+	Encode func(join bool) []byte
+
+	// Merge merges the state of the remote node encoded by its Encode
+	Merge func(buf []byte, join bool)
+}
+
+// RegisterState register the state extension under the name, the states of every extension
+// and of the delegate are exchanged together and each is merged by the extension of the same
+// name on the remote node
+func (s *Client) RegisterState(name string, state GossipState) error {
+	if _, loaded := s.states.LoadOrStore(name, state); loaded {
+		return ErrStateRegistered
+	}
+	return nil
+}
+
+// UnregisterState stop exchanging the state extension
+func (s *Client) UnregisterState(name string) {
+	s.states.Delete(name)
+}
+
+// LocalState is used for a TCP Push/Pull. This is sent to
+// the remote side in addition to the membership information. ALogger
+// data can be sent here. See MergeRemoteState as well. The `join`
+// boolean indicates this is for a join instead of a push/pull.
+// The state is signed like the gossip messages when a signing key is set.
+func (s *Client) LocalState(join bool) []byte {
+	return s.signer.sign(s.localState(join))
+}
+
+func (s *Client) localState(join bool) []byte {
+	var local []byte
+	if fn, ok := s.delegate.Load().(Delegate); ok && fn != nil {
+		local = fn.LocalState(join)
+	}
+
+	state := &api.GossipState{Delegate: local}
+	s.states.Range(func(key, value any) bool {
+		if encode := value.(GossipState).Encode; encode != nil {
+			if state.Extensions == nil {
+				state.Extensions = make(map[string][]byte)
+			}
+			state.Extensions[key.(string)] = encode(join)
+		}
+		return true
+	})
+
+	if len(state.Extensions) < 1 {
+		return local
+	}
+
+	b, err := proto.Marshal(state)
+	if err != nil {
+		s.logger.Warn("Failed marshal gossip state", zap.Error(err))
+		return local
+	}
+	return append(append(make([]byte, 0, len(gossipStateMagic)+len(b)), gossipStateMagic...), b...)
+}
+
+// MergeRemoteState is invoked after a TCP Push/Pull. This is the
+// state received from the remote side and is the result of the
+// remote side's LocalState call. The 'join'
+// boolean indicates this is for a join instead of a push/pull.
+// Unsigned or stale states are dropped when a signing key is set.
+func (s *Client) MergeRemoteState(buf []byte, join bool) {
+	buf, err := s.signer.verify(buf)
+	if err != nil {
+		s.logger.Warn("MergeRemoteState rejected", zap.Error(err))
+		s.metrics.GossipUnverified(gossipVerifyReason(err))
+		return
+	}
+
+	state := &api.GossipState{Delegate: buf}
+	if bytes.HasPrefix(buf, gossipStateMagic) {
+		state.Delegate = nil
+		if err := proto.Unmarshal(buf[len(gossipStateMagic):], state); err != nil {
+			s.logger.Warn("Failed unmarshal gossip state", zap.Error(err))
+			return
+		}
+	}
+
+	for name, b := range state.Extensions {
+		if m, ok := s.states.Load(name); ok {
+			if merge := m.(GossipState).Merge; merge != nil {
+				merge(b, join)
+			}
+		}
+	}
+
+	if fn, ok := s.delegate.Load().(Delegate); ok && fn != nil {
+		fn.MergeRemoteState(state.Delegate, join)
+	}
+}
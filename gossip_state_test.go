@@ -0,0 +1,101 @@
+package nakamacluster
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+// stateDelegate delegate keeping the push/pull state
+type stateDelegate struct {
+	local  []byte
+	remote []byte
+}
+
+func (d *stateDelegate) LocalState(join bool) []byte            { return d.local }
+func (d *stateDelegate) MergeRemoteState(buf []byte, join bool) { d.remote = buf }
+func (d *stateDelegate) NotifyJoin(node *Meta)                  {}
+func (d *stateDelegate) NotifyLeave(node *Meta)                 {}
+func (d *stateDelegate) NotifyUpdate(node *Meta)                {}
+func (d *stateDelegate) NotifyAlive(node *Meta) error           { return nil }
+func (d *stateDelegate) NotifyMsg(node string, msg *api.Envelope) (*api.Envelope, error) {
+	return nil, nil
+}
+
+func TestGossipStateExtensions(t *testing.T) {
+	sender, receiver := &Client{logger: zap.NewNop()}, &Client{logger: zap.NewNop()}
+	sender.OnDelegate(&stateDelegate{local: []byte("delegate")})
+	delegate := &stateDelegate{}
+	receiver.OnDelegate(delegate)
+
+	if b := sender.LocalState(false); !bytes.Equal(b, []byte("delegate")) {
+		t.Fatalf("state without extensions should be the delegate state, got %q", b)
+	}
+
+	if err := sender.RegisterState("sessions", GossipState{Encode: func(join bool) []byte { return []byte("s1") }}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sender.RegisterState("sessions", GossipState{}); !errors.Is(err, ErrStateRegistered) {
+		t.Fatalf("expected ErrStateRegistered, got %v", err)
+	}
+
+	sender.RegisterState("matches", GossipState{Encode: func(join bool) []byte { return []byte("m1") }})
+	merged := make(map[string]string)
+	receiver.RegisterState("sessions", GossipState{Merge: func(buf []byte, join bool) { merged["sessions"] = string(buf) }})
+	receiver.MergeRemoteState(sender.LocalState(true), true)
+	if len(merged) != 1 || merged["sessions"] != "s1" {
+		t.Fatalf("unexpected merged extensions %v", merged)
+	}
+
+	if string(delegate.remote) != "delegate" {
+		t.Fatalf("unexpected delegate state %q", delegate.remote)
+	}
+
+	sender.UnregisterState("sessions")
+	sender.UnregisterState("matches")
+	receiver.MergeRemoteState(sender.LocalState(false), false)
+	if string(delegate.remote) != "delegate" {
+		t.Fatalf("unexpected delegate state %q", delegate.remote)
+	}
+}
+
+func TestGossipStateSigned(t *testing.T) {
+	clock := newVirtualClock()
+	newClient := func(key string) (*Client, *stateDelegate) {
+		c := &Client{logger: zap.NewNop(), metrics: NewMetrics(nil), signer: newGossipSigner(key, 10*time.Second)}
+		if c.signer != nil {
+			c.signer.clock = clock
+		}
+
+		delegate := &stateDelegate{local: []byte(key)}
+		c.OnDelegate(delegate)
+		return c, delegate
+	}
+
+	sender, _ := newClient("secret")
+	receiver, delegate := newClient("secret")
+	receiver.MergeRemoteState(sender.LocalState(false), false)
+	if string(delegate.remote) != "secret" {
+		t.Fatalf("signed state not merged %q", delegate.remote)
+	}
+
+	// a state pushed by a node without the key or outside the window is dropped
+	unsigned, _ := newClient("")
+	delegate.remote = nil
+	receiver.MergeRemoteState(unsigned.LocalState(false), false)
+	if delegate.remote != nil {
+		t.Fatalf("unsigned state merged %q", delegate.remote)
+	}
+
+	stale := sender.LocalState(false)
+	clock.Advance(11 * time.Second)
+	receiver.MergeRemoteState(stale, false)
+	if delegate.remote != nil {
+		t.Fatalf("stale state merged %q", delegate.remote)
+	}
+}
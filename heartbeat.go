@@ -0,0 +1,234 @@
+package nakamacluster
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+const (
+	HEARTBEAT_CID_PREFIX = "__heartbeat."
+	HEARTBEAT_CID_PING   = HEARTBEAT_CID_PREFIX + "ping"
+
+	// HEARTBEAT_VAR_TIME var of the ping reply holding the unix time in nanoseconds of the node
+	HEARTBEAT_VAR_TIME = "time"
+
+	// heartbeatDegradedFailures consecutive failed pings after which a link is reported degraded
+	heartbeatDegradedFailures = 3
+
+	// heartbeatRTTWeight weight of a new sample in the smoothed rtt and clock offset
+	heartbeatRTTWeight = 0.2
+
+	// heartbeatClockMaxRTT pings slower than this factor of the smoothed rtt are too
+	// asymmetric to estimate the clock offset and are skipped
+	heartbeatClockMaxRTT = 2
+)
+
+// PeerLink health of the grpc link to a node measured by the heartbeat
+type PeerLink struct {
+	// RTT smoothed round trip time of the pings
+	RTT time.Duration
+
+	// LastRTT round trip time of the last successful ping
+	LastRTT time.Duration
+
+	// Failures consecutive failed pings
+	Failures int
+
+	// LastSeen time of the last successful ping
+	LastSeen time.Time
+
+	// ClockOffset smoothed offset of the clock of the node to the local clock, the local time
+	// plus the offset is the time of the node
+	ClockOffset time.Duration
+}
+
+// Degraded reports whether the last pings of the link failed
+func (l PeerLink) Degraded() bool {
+	return l.Failures >= heartbeatDegradedFailures
+}
+
+type peerLink struct {
+	link    PeerLink
+	clocked bool
+	sync.Mutex
+}
+
+// Link returns the heartbeat state of the link to the node, false when the node was not pinged yet
+func (peer *LocalPeer) Link(id string) (PeerLink, bool) {
+	m, ok := peer.links.Load(id)
+	if !ok {
+		return PeerLink{}, false
+	}
+
+	l := m.(*peerLink)
+	l.Lock()
+	defer l.Unlock()
+	return l.link, true
+}
+
+// RTT returns the smoothed round trip time to the node, false when no ping succeeded yet
+func (peer *LocalPeer) RTT(id string) (time.Duration, bool) {
+	link, ok := peer.Link(id)
+	if !ok || link.LastSeen.IsZero() {
+		return 0, false
+	}
+	return link.RTT, true
+}
+
+// ClockOffset returns the estimated offset of the clock of the node to the local clock, the time of
+// the node is the local time plus the offset. False when no ping reply carried the time of the node
+func (peer *LocalPeer) ClockOffset(id string) (time.Duration, bool) {
+	m, ok := peer.links.Load(id)
+	if !ok {
+		return 0, false
+	}
+
+	l := m.(*peerLink)
+	l.Lock()
+	defer l.Unlock()
+	return l.link.ClockOffset, l.clocked
+}
+
+// heartbeatLoop ping the connected nodes until the peer is done
+func (peer *LocalPeer) heartbeatLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			peer.heartbeat(interval)
+
+		case <-peer.ctx.Done():
+			return
+		}
+	}
+}
+
+// heartbeat ping every node with an open connection pool, nodes never called are not dialed
+func (peer *LocalPeer) heartbeat(timeout time.Duration) {
+	var wg sync.WaitGroup
+	peer.grpcPool.Range(func(key, value any) bool {
+		id := key.(string)
+		if _, ok := peer.view().nodes[id]; !ok {
+			return true
+		}
+
+		wg.Add(1)
+		go func(p *connPool) {
+			defer wg.Done()
+			rtt, offset, clocked, err := peer.ping(p, timeout)
+			peer.recordPing(id, rtt, err)
+			if clocked {
+				peer.recordClockOffset(id, rtt, offset)
+			}
+		}(value.(*connPool))
+		return true
+	})
+	wg.Wait()
+}
+
+// ping call the heartbeat cid on a connection of the pool and returns the round trip time, the clock
+// offset is estimated when the reply carries the time of the node, taken halfway through the round trip
+func (peer *LocalPeer) ping(p *connPool, timeout time.Duration) (rtt, offset time.Duration, clocked bool, err error) {
+	ctx, cancel := context.WithTimeout(peer.ctx, timeout)
+	defer cancel()
+
+	conn, err := p.Get(ctx)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	defer conn.Close()
+	in := &api.Envelope{Cid: HEARTBEAT_CID_PING}
+	stampEnvelopeVersion(in)
+	start := time.Now()
+	out, err := api.NewApiServerClient(conn.Value()).Call(peer.outgoingContext(ctx), in)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	rtt = time.Since(start)
+	remote, err := strconv.ParseInt(out.GetVars()[HEARTBEAT_VAR_TIME], 10, 64)
+	if err != nil {
+		return rtt, 0, false, nil
+	}
+	return rtt, time.Unix(0, remote).Sub(start.Add(rtt / 2)), true, nil
+}
+
+// heartbeatReply returns the reply of a ping carrying the time of the local node
+func heartbeatReply(in *api.Envelope) *api.Envelope {
+	return &api.Envelope{Cid: in.Cid, Vars: map[string]string{HEARTBEAT_VAR_TIME: strconv.FormatInt(time.Now().UnixNano(), 10)}}
+}
+
+// recordPing update the link of the node with the result of a ping
+func (peer *LocalPeer) recordPing(id string, rtt time.Duration, err error) {
+	m, _ := peer.links.LoadOrStore(id, &peerLink{})
+	l := m.(*peerLink)
+	l.Lock()
+	if err != nil {
+		l.link.Failures++
+	} else {
+		if l.link.LastSeen.IsZero() {
+			l.link.RTT = rtt
+		} else {
+			l.link.RTT += time.Duration(heartbeatRTTWeight * float64(rtt-l.link.RTT))
+		}
+		l.link.LastRTT = rtt
+		l.link.Failures = 0
+		l.link.LastSeen = time.Now()
+	}
+	failures := l.link.Failures
+	l.Unlock()
+
+	if err == nil {
+		if peer.options.Metrics != nil {
+			peer.options.Metrics.PeerRTT(id, rtt)
+		}
+		return
+	}
+
+	if peer.options.Metrics != nil {
+		peer.options.Metrics.HeartbeatFailed(id)
+	}
+
+	if failures != heartbeatDegradedFailures {
+		return
+	}
+
+	peer.logger.Warn("Peer link degraded", zap.String("node", id), zap.Int("failures", failures), zap.Error(err))
+	if peer.options.HeartbeatQuarantine > 0 {
+		peer.Quarantine(id, peer.options.HeartbeatQuarantine)
+	}
+}
+
+// recordClockOffset update the clock offset of the node with the offset measured by a ping
+func (peer *LocalPeer) recordClockOffset(id string, rtt, offset time.Duration) {
+	m, _ := peer.links.LoadOrStore(id, &peerLink{})
+	l := m.(*peerLink)
+	l.Lock()
+	defer l.Unlock()
+	if !l.clocked {
+		l.link.ClockOffset = offset
+		l.clocked = true
+		return
+	}
+
+	if l.link.RTT > 0 && rtt > heartbeatClockMaxRTT*l.link.RTT {
+		return
+	}
+	l.link.ClockOffset += time.Duration(heartbeatRTTWeight * float64(offset-l.link.ClockOffset))
+}
+
+// heartbeatQuarantine returns the quarantine of nodes with a degraded link, nodes are only
+// quarantined without gossip and for the time their link took to degrade
+func heartbeatQuarantine(c Config) time.Duration {
+	if !c.GossipDisabled {
+		return 0
+	}
+	return time.Duration(c.HeartbeatInterval) * time.Second * heartbeatDegradedFailures
+}
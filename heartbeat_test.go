@@ -0,0 +1,131 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+func TestPeerHeartbeat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(echoServerDelegate{})
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, HeartbeatInterval: 20 * time.Millisecond})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := peer.Link(node.Id); ok {
+		t.Fatal("node pinged before it was connected")
+	}
+
+	if _, err := peer.Send(ctx, node, &api.Envelope{Cid: "echo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if rtt, ok := peer.RTT(node.Id); ok {
+			if rtt <= 0 {
+				t.Fatalf("unexpected rtt %v", rtt)
+			}
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("no heartbeat rtt recorded")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// both ends share the clock, the estimate is only off by the asymmetry of the round trip
+	if offset, ok := peer.ClockOffset(node.Id); !ok || offset < -100*time.Millisecond || offset > 100*time.Millisecond {
+		t.Fatalf("unexpected clock offset %v %v", offset, ok)
+	}
+
+	peer.Delete(node.Id)
+	if _, ok := peer.Link(node.Id); ok {
+		t.Fatal("link kept after the node left")
+	}
+}
+
+func TestPeerLinkDegraded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	peer.recordPing("node1", 10*time.Millisecond, nil)
+	peer.recordPing("node1", 20*time.Millisecond, nil)
+	link, _ := peer.Link("node1")
+	if link.RTT != 12*time.Millisecond || link.LastRTT != 20*time.Millisecond {
+		t.Fatalf("unexpected rtt %+v", link)
+	}
+
+	for i := 0; i < heartbeatDegradedFailures; i++ {
+		peer.recordPing("node1", 0, errors.New("unavailable"))
+	}
+
+	if link, _ = peer.Link("node1"); !link.Degraded() {
+		t.Fatalf("link not degraded %+v", link)
+	}
+
+	if rtt, ok := peer.RTT("node1"); !ok || rtt != 12*time.Millisecond {
+		t.Fatalf("rtt lost after failures %v", rtt)
+	}
+
+	peer.recordPing("node1", 10*time.Millisecond, nil)
+	if link, _ = peer.Link("node1"); link.Degraded() {
+		t.Fatalf("link degraded after a successful ping %+v", link)
+	}
+}
+
+func TestClockOffset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	if _, ok := peer.ClockOffset("node1"); ok {
+		t.Fatal("clock offset of an unknown node")
+	}
+
+	peer.recordPing("node1", 10*time.Millisecond, nil)
+	peer.recordClockOffset("node1", 10*time.Millisecond, time.Second)
+	peer.recordClockOffset("node1", 10*time.Millisecond, 2*time.Second)
+	if offset, ok := peer.ClockOffset("node1"); !ok || offset != 1200*time.Millisecond {
+		t.Fatalf("unexpected clock offset %v", offset)
+	}
+
+	peer.recordClockOffset("node1", 50*time.Millisecond, time.Minute)
+	if offset, _ := peer.ClockOffset("node1"); offset != 1200*time.Millisecond {
+		t.Fatalf("slow ping changed the clock offset %v", offset)
+	}
+}
+
+func TestHeartbeatQuarantine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{HeartbeatQuarantine: time.Minute})
+	peer.Sync(NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, nil))
+	for i := 0; i < heartbeatDegradedFailures; i++ {
+		if _, ok := peer.GetWithHashRing("svc", "a"); !ok {
+			t.Fatalf("node quarantined after %d failures", i)
+		}
+		peer.recordPing("node1", 0, errors.New("unavailable"))
+	}
+
+	if _, ok := peer.GetWithHashRing("svc", "a"); ok {
+		t.Fatal("degraded node not quarantined")
+	}
+
+	if heartbeatQuarantine(*NewConfig()) != 0 {
+		t.Fatal("nodes quarantined with gossip")
+	}
+}
@@ -0,0 +1,168 @@
+package nakamacluster
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/gofrs/uuid"
+	"google.golang.org/protobuf/proto"
+)
+
+// SetIdempotencyKey set a new idempotency key on the envelope unless it has one, retries of the
+// envelope reuse the key so the receiving server executes the call once
+func SetIdempotencyKey(in *api.Envelope) *api.Envelope {
+	if in.IdempotencyKey == "" {
+		in.IdempotencyKey = uuid.Must(uuid.NewV4()).String()
+	}
+	return in
+}
+
+// idempotencyKeyOf returns the cache key of the envelope, empty when it has no idempotency key
+func idempotencyKeyOf(in *api.Envelope) string {
+	if in.IdempotencyKey == "" {
+		return ""
+	}
+	return in.Cid + "/" + in.IdempotencyKey
+}
+
+// idempotencyCall call of a key, duplicates arriving while it runs wait for it
+type idempotencyCall struct {
+	done    chan struct{}
+	out     *api.Envelope
+	err     error
+	expires time.Time
+}
+
+// idempotencyKey key of the eviction queue
+type idempotencyKey struct {
+	key  string
+	call *idempotencyCall
+}
+
+// IdempotencyCache remembers the replies of the calls carrying an idempotency key for ttl,
+// failed calls are forgotten once they return so a retry executes them again
+type IdempotencyCache struct {
+	ttl     time.Duration
+	maxKeys int
+	calls   map[string]*idempotencyCall
+	queue   []idempotencyKey
+	metrics *Metrics
+	sync.Mutex
+}
+
+// NewIdempotencyCache create idempotency cache keeping the replies for ttl and at most maxKeys of them,
+// 0 is unlimited. A cache with a ttl of 0 is nil and executes every call
+func NewIdempotencyCache(ctx context.Context, ttl time.Duration, maxKeys int, metrics *Metrics) *IdempotencyCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	if metrics == nil {
+		metrics = NewMetrics(nil)
+	}
+
+	c := &IdempotencyCache{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		calls:   make(map[string]*idempotencyCall),
+		queue:   make([]idempotencyKey, 0),
+		metrics: metrics,
+	}
+	go c.evictLoop(ctx)
+	return c
+}
+
+// Do run fn once for the key within the ttl, duplicates get a copy of its reply or the
+// error of ctx when it ends before the reply
+func (c *IdempotencyCache) Do(ctx context.Context, key string, fn func() (*api.Envelope, error)) (*api.Envelope, error) {
+	if c == nil || key == "" {
+		return fn()
+	}
+
+	c.Lock()
+	if call, ok := c.calls[key]; ok && time.Now().Before(call.expires) {
+		c.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		c.metrics.IdempotentReplayed()
+		if call.out == nil {
+			return nil, call.err
+		}
+		return proto.Clone(call.out).(*api.Envelope), call.err
+	}
+
+	call := &idempotencyCall{done: make(chan struct{}), expires: time.Now().Add(c.ttl)}
+	c.calls[key] = call
+	c.queue = append(c.queue, idempotencyKey{key: key, call: call})
+	c.evict(time.Now())
+	c.Unlock()
+
+	out, err := fn()
+	if out != nil {
+		call.out = proto.Clone(out).(*api.Envelope)
+	}
+	call.err = err
+	close(call.done)
+
+	if err != nil {
+		c.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.Unlock()
+	}
+	return out, err
+}
+
+// Len returns the number of remembered keys
+func (c *IdempotencyCache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return len(c.calls)
+}
+
+// evict forget the expired keys and the oldest keys above maxKeys, keys expire in the order they were added
+func (c *IdempotencyCache) evict(now time.Time) {
+	i := 0
+	for ; i < len(c.queue); i++ {
+		q := c.queue[i]
+		if now.Before(q.call.expires) && (c.maxKeys < 1 || len(c.calls) <= c.maxKeys) {
+			break
+		}
+
+		// the key was forgotten or reused by a newer call when it is not the queued one
+		if c.calls[q.key] == q.call {
+			delete(c.calls, q.key)
+		}
+	}
+
+	if i > 0 {
+		c.queue = append(c.queue[:0:0], c.queue[i:]...)
+	}
+}
+
+func (c *IdempotencyCache) evictLoop(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			c.Lock()
+			c.evict(now)
+			c.Unlock()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
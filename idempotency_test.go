@@ -0,0 +1,142 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+// countingServerDelegate counts the calls it executes
+type countingServerDelegate struct {
+	echoServerDelegate
+	calls int64
+}
+
+func (d *countingServerDelegate) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+	n := atomic.AddInt64(&d.calls, 1)
+	return &api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Bytes{Bytes: []byte{byte(n)}}}, nil
+}
+
+func TestIdempotencyCacheDo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewIdempotencyCache(ctx, time.Minute, 2, nil)
+	calls := int64(0)
+	release := make(chan struct{})
+	call := func() (*api.Envelope, error) {
+		<-release
+		return &api.Envelope{Cid: "reply", Vars: map[string]string{"n": string(rune('0' + atomic.AddInt64(&calls, 1)))}}, nil
+	}
+
+	var wg sync.WaitGroup
+	replies := make([]*api.Envelope, 4)
+	for i := range replies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replies[i], _ = c.Do(ctx, "a", call)
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("call executed %d times", calls)
+	}
+
+	for _, reply := range replies {
+		if reply.Vars["n"] != "1" {
+			t.Fatalf("unexpected reply %v", reply)
+		}
+	}
+
+	if replies[0] == replies[1] {
+		t.Fatal("duplicates share the reply")
+	}
+
+	// failed calls are executed again
+	failures := 0
+	fail := func() (*api.Envelope, error) {
+		failures++
+		return nil, errors.New("failed")
+	}
+	c.Do(ctx, "b", fail)
+	c.Do(ctx, "b", fail)
+	if failures != 2 {
+		t.Fatalf("failed call executed %d times", failures)
+	}
+
+	// the oldest keys are forgotten above the maximum
+	c.Do(ctx, "c", call)
+	c.Do(ctx, "d", call)
+	if c.Len() != 2 {
+		t.Fatalf("%d keys remembered", c.Len())
+	}
+
+	if c.Do(ctx, "a", call); calls != 4 {
+		t.Fatalf("evicted key not executed again, %d calls", calls)
+	}
+
+	// duplicates stop waiting when their context ends
+	block := make(chan struct{})
+	defer close(block)
+	go c.Do(ctx, "e", func() (*api.Envelope, error) {
+		<-block
+		return &api.Envelope{}, nil
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer waitCancel()
+	if _, err := c.Do(waitCtx, "e", call); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	c.Lock()
+	c.evict(time.Now().Add(2 * time.Minute))
+	c.Unlock()
+	if c.Len() != 0 {
+		t.Fatalf("%d keys left after ttl", c.Len())
+	}
+}
+
+func TestIdempotentServerCall(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	delegate := &countingServerDelegate{}
+	server.OnDelegate(delegate)
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	in := SetIdempotencyKey(&api.Envelope{Cid: "economy.grant"})
+	for i := 0; i < 3; i++ {
+		out, err := peer.Send(ctx, node, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b := out.GetBytes(); len(b) != 1 || b[0] != 1 {
+			t.Fatalf("retry %d got reply %v", i, out)
+		}
+	}
+
+	if _, err := peer.Send(ctx, node, &api.Envelope{Cid: "economy.grant"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt64(&delegate.calls); n != 2 {
+		t.Fatalf("delegate executed %d calls", n)
+	}
+}
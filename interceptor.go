@@ -0,0 +1,39 @@
+package nakamacluster
+
+import (
+	"context"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// errorUnaryServerInterceptor convert envelopes carrying an api.Error payload
+// into gRPC status errors, the api.Error is attached as status detail
+func errorUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if out, ok := resp.(*api.Envelope); ok {
+		if e := out.GetError(); e != nil && e.GetCode() != api.Error_OK {
+			return nil, e
+		}
+	}
+	return resp, nil
+}
+
+// errorUnaryClientInterceptor convert gRPC status errors into api.Error,
+// which still works with status.FromError
+func errorUnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err == nil {
+		return nil
+	}
+
+	if s, ok := status.FromError(err); ok {
+		return api.FromStatus(s)
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package nakamacluster
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// joinRetry retries the startup steps joining the cluster, the delay between the attempts
+// doubles from interval up to maxInterval until deadline has passed. A zero joinRetry tries once
+type joinRetry struct {
+	interval    time.Duration
+	maxInterval time.Duration
+	deadline    time.Duration
+}
+
+func newJoinRetry(c Config) joinRetry {
+	r := joinRetry{
+		interval:    time.Duration(c.JoinRetryInterval) * time.Millisecond,
+		maxInterval: time.Duration(c.JoinRetryMaxInterval) * time.Millisecond,
+		deadline:    time.Duration(c.JoinDeadline) * time.Second,
+	}
+
+	if r.interval <= 0 {
+		r.interval = 500 * time.Millisecond
+	}
+
+	if r.maxInterval < r.interval {
+		r.maxInterval = r.interval
+	}
+	return r
+}
+
+// do call fn until it succeeds, the deadline passes or ctx is done, the last error is returned
+func (r joinRetry) do(ctx context.Context, logger *zap.Logger, step string, fn func() error) error {
+	deadline := time.Now().Add(r.deadline)
+	delay := r.interval
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || r.deadline <= 0 {
+			return err
+		}
+
+		remain := time.Until(deadline)
+		if remain <= 0 {
+			return err
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if wait > remain {
+			wait = remain
+		}
+
+		logger.Warn("Failed to join cluster, retrying", zap.String("step", step), zap.Int("attempt", attempt), zap.Duration("delay", wait), zap.Error(err))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		if delay *= 2; delay > r.maxInterval {
+			delay = r.maxInterval
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+// unavailableClient sd client failing reads the first times and registrations until it is up
+type unavailableClient struct {
+	sd.Client
+	reads int32
+	up    int32
+}
+
+func (c *unavailableClient) GetEntries(prefix string) ([]string, error) {
+	if atomic.AddInt32(&c.reads, -1) >= 0 {
+		return nil, errors.New("unavailable")
+	}
+	return c.Client.GetEntries(prefix)
+}
+
+func (c *unavailableClient) Register(s sd.Service) error {
+	if atomic.LoadInt32(&c.up) == 0 {
+		return errors.New("unavailable")
+	}
+	return c.Client.Register(s)
+}
+
+func TestJoinRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := joinRetry{interval: time.Millisecond, maxInterval: 4 * time.Millisecond, deadline: time.Second}
+	attempts := 0
+	err := r.do(ctx, zap.NewNop(), "test", func() error {
+		if attempts++; attempts < 4 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	if err != nil || attempts != 4 {
+		t.Fatalf("%d attempts, err %v", attempts, err)
+	}
+
+	r.deadline = 20 * time.Millisecond
+	start := time.Now()
+	if err := r.do(ctx, zap.NewNop(), "test", func() error { return errors.New("unavailable") }); err == nil {
+		t.Fatal("retry succeeded after the deadline")
+	}
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("retry gave up after %v", d)
+	}
+
+	attempts = 0
+	joinRetry{}.do(ctx, zap.NewNop(), "test", func() error {
+		attempts++
+		return errors.New("unavailable")
+	})
+	if attempts != 1 {
+		t.Fatalf("zero retry made %d attempts", attempts)
+	}
+}
+
+func TestServerJoinRetry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.JoinRetryInterval = 10
+	config.JoinRetryMaxInterval = 20
+	store := sd.NewMemoryStore()
+	client := &unavailableClient{Client: store.NewClient(ctx), reads: 2}
+	server := NewServer(ctx, zap.NewNop(), client, "node1", "svc", map[string]string{}, *config)
+	defer server.Stop()
+
+	if n := atomic.LoadInt32(&client.reads); n >= 0 {
+		t.Fatalf("server started after %d failed reads", 2-n)
+	}
+
+	joined := make(chan Event, 1)
+	server.Events().Subscribe(func(e Event) {
+		if e.Type == EVENT_CLUSTER_JOINED {
+			joined <- e
+		}
+	})
+
+	time.Sleep(30 * time.Millisecond)
+	atomic.StoreInt32(&client.up, 1)
+	select {
+	case e := <-joined:
+		if e.Node == nil || e.Node.Id != "node1" {
+			t.Fatalf("unexpected joined event %+v", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("joined event not published")
+	}
+
+	entries, err := store.NewClient(ctx).GetEntries(config.Prefix)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("node not registered %v %v", entries, err)
+	}
+}
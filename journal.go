@@ -0,0 +1,232 @@
+package nakamacluster
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// JOURNAL_CID_PREFIX cids reserved for journal replay
+	JOURNAL_CID_PREFIX = "__journal."
+
+	journalCidReplay = JOURNAL_CID_PREFIX + "replay"
+	journalVarNode   = "journal_node"
+	journalVarSince  = "journal_since"
+	journalVarNext   = "journal_next"
+
+	// journalReplayBatchSize maximum bytes of envelopes in a replay reply
+	journalReplayBatchSize = 2 << 20
+
+	// journalMaxSkew maximum age of a signed replay request
+	journalMaxSkew = time.Minute
+)
+
+// journalSignVars vars carrying the signature of the replay requests
+var journalSignVars = envelopeSignVars{time: "journal_time", nonce: "journal_nonce", signature: "journal_signature"}
+
+// JournalEntry outbound envelope recorded by the journal
+type JournalEntry struct {
+	Seq      uint64
+	Time     int64
+	Node     string
+	Envelope []byte
+}
+
+// JournalStorage append-only storage of journal entries
+type JournalStorage interface {
+	// Append store the entry, entries are appended in Seq order
+	Append(entry JournalEntry) error
+
+	// Range call f for the entries sent to node at or after since in Seq order until f returns false
+	Range(node string, since int64, f func(entry JournalEntry) bool) error
+
+	// Trim remove the entries older than before and the oldest entries above maxBytes, 0 is unlimited
+	Trim(before int64, maxBytes int) error
+}
+
+// MemoryJournalStorage in-memory journal storage
+type MemoryJournalStorage struct {
+	entries []JournalEntry
+	size    int
+	sync.RWMutex
+}
+
+func (s *MemoryJournalStorage) Append(entry JournalEntry) error {
+	s.Lock()
+	s.entries = append(s.entries, entry)
+	s.size += len(entry.Envelope)
+	s.Unlock()
+	return nil
+}
+
+func (s *MemoryJournalStorage) Range(node string, since int64, f func(entry JournalEntry) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	for _, entry := range s.entries {
+		if entry.Time < since || entry.Node != node {
+			continue
+		}
+
+		if !f(entry) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryJournalStorage) Trim(before int64, maxBytes int) error {
+	s.Lock()
+	defer s.Unlock()
+	i := 0
+	for ; i < len(s.entries); i++ {
+		if s.entries[i].Time >= before && (maxBytes < 1 || s.size <= maxBytes) {
+			break
+		}
+		s.size -= len(s.entries[i].Envelope)
+	}
+
+	if i > 0 {
+		s.entries = append(s.entries[:0:0], s.entries[i:]...)
+	}
+	return nil
+}
+
+// NewMemoryJournalStorage create in-memory journal storage
+func NewMemoryJournalStorage() *MemoryJournalStorage {
+	return &MemoryJournalStorage{entries: make([]JournalEntry, 0)}
+}
+
+// Journal append-only journal of outbound cluster messages with time and size retention,
+// the envelopes sent to a node are replayed to it when it asks with a request signed by key
+type Journal struct {
+	ctx       context.Context
+	storage   JournalStorage
+	retention time.Duration
+	maxBytes  int
+	seq       uint64
+	key       []byte
+	verifier  *envelopeVerifier
+}
+
+// Record append the envelope sent to the node
+func (j *Journal) Record(node string, in *api.Envelope) error {
+	if j == nil {
+		return nil
+	}
+
+	b, err := proto.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	return j.storage.Append(JournalEntry{
+		Seq:      atomic.AddUint64(&j.seq, 1),
+		Time:     time.Now().UnixNano(),
+		Node:     node,
+		Envelope: b,
+	})
+}
+
+// Replay call f for the envelopes sent to node since the time until f returns false
+func (j *Journal) Replay(node string, since time.Time, f func(t time.Time, in *api.Envelope) bool) error {
+	var err error
+	rangeErr := j.storage.Range(node, since.UnixNano(), func(entry JournalEntry) bool {
+		var in api.Envelope
+		if err = proto.Unmarshal(entry.Envelope, &in); err != nil {
+			return false
+		}
+		return f(time.Unix(0, entry.Time), &in)
+	})
+
+	if rangeErr != nil {
+		return rangeErr
+	}
+	return err
+}
+
+// newJournalReplay returns the replay request of the envelopes sent to node since the time,
+// signed with the journal key of the cluster
+func newJournalReplay(key []byte, node, since string) *api.Envelope {
+	in := &api.Envelope{
+		Cid:  journalCidReplay,
+		Vars: map[string]string{journalVarNode: node, journalVarSince: since},
+	}
+
+	if len(key) > 0 {
+		signEnvelope(key, in, journalSignVars, time.Now())
+	}
+	return in
+}
+
+// handleReplay serve a replay request with the envelopes sent to the requesting node, the node
+// named by the request is trusted only once the request is signed with the journal key
+func (j *Journal) handleReplay(in *api.Envelope) (*api.Envelope, error) {
+	if len(j.key) < 1 {
+		return nil, api.NewError(api.Error_PERMISSION_DENIED, "journal replay needs a journal key")
+	}
+
+	if err := j.verifier.verify(j.key, in, time.Now()); err != nil {
+		return nil, api.Errorf(api.Error_UNAUTHENTICATED, "journal replay rejected: %v", err)
+	}
+
+	since, err := strconv.ParseInt(in.Vars[journalVarSince], 10, 64)
+	if err != nil {
+		return nil, api.NewError(api.Error_INVALID_ARGUMENT, "invalid journal since")
+	}
+
+	batch := &api.Batch{Envelopes: make([]*api.Envelope, 0)}
+	out := &api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Batch{Batch: batch}}
+	size := 0
+	err = j.Replay(in.Vars[journalVarNode], time.Unix(0, since), func(t time.Time, envelope *api.Envelope) bool {
+		size += proto.Size(envelope)
+		if size > journalReplayBatchSize && len(batch.Envelopes) > 0 {
+			out.Vars = map[string]string{journalVarNext: strconv.FormatInt(t.UnixNano(), 10)}
+			return false
+		}
+
+		batch.Envelopes = append(batch.Envelopes, envelope)
+		return true
+	})
+	return out, err
+}
+
+func (j *Journal) trimLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			before := int64(0)
+			if j.retention > 0 {
+				before = now.Add(-j.retention).UnixNano()
+			}
+			j.storage.Trim(before, j.maxBytes)
+
+		case <-j.ctx.Done():
+			return
+		}
+	}
+}
+
+// NewJournal create journal, entries older than retention or above maxBytes are trimmed
+func NewJournal(ctx context.Context, storage JournalStorage, retention time.Duration, maxBytes int) *Journal {
+	if storage == nil {
+		storage = NewMemoryJournalStorage()
+	}
+
+	j := &Journal{
+		ctx:       ctx,
+		storage:   storage,
+		retention: retention,
+		maxBytes:  maxBytes,
+		verifier:  newEnvelopeVerifier(journalSignVars, journalMaxSkew),
+	}
+	go j.trimLoop()
+	return j
+}
@@ -0,0 +1,114 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestJournalReplayRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	journal := NewJournal(ctx, nil, time.Minute, 0)
+	journal.Record("node1", &api.Envelope{Cid: "a"})
+	journal.Record("node2", &api.Envelope{Cid: "b"})
+	since := "0"
+
+	if _, err := journal.handleReplay(newJournalReplay([]byte("secret"), "node1", since)); !api.IsCode(err, api.Error_PERMISSION_DENIED) {
+		t.Fatalf("expected replay refused without journal key, got %v", err)
+	}
+
+	journal.key = []byte("secret")
+	for _, in := range []*api.Envelope{newJournalReplay(nil, "node1", since), newJournalReplay([]byte("guess"), "node1", since)} {
+		if _, err := journal.handleReplay(in); !api.IsCode(err, api.Error_UNAUTHENTICATED) {
+			t.Fatalf("expected unsigned replay rejected, got %v", err)
+		}
+	}
+
+	in := newJournalReplay([]byte("secret"), "node1", since)
+	out, err := journal.handleReplay(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if envelopes := out.GetBatch().GetEnvelopes(); len(envelopes) != 1 || envelopes[0].Cid != "a" {
+		t.Fatalf("unexpected replay %v", envelopes)
+	}
+
+	if _, err := journal.handleReplay(in); !api.IsCode(err, api.Error_UNAUTHENTICATED) {
+		t.Fatalf("expected replayed request rejected, got %v", err)
+	}
+
+	// the requesting node is signed, another node's envelopes cannot be asked for
+	spoofed := newJournalReplay([]byte("secret"), "node1", since)
+	spoofed.Vars[journalVarNode] = "node2"
+	if _, err := journal.handleReplay(spoofed); !api.IsCode(err, api.Error_UNAUTHENTICATED) {
+		t.Fatalf("expected changed node rejected, got %v", err)
+	}
+}
+
+// callDelegate server delegate reporting the calls
+type callDelegate struct {
+	echoServerDelegate
+	calls chan *api.Envelope
+}
+
+func (d callDelegate) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+	d.calls <- in
+	return in, nil
+}
+
+func TestServerReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newServer := func(id string, options ...Option) *Server {
+		config := testConfig(t)
+		config.JournalKey = "secret"
+		server := NewServer(ctx, zap.NewNop(), store.NewClient(ctx), id, "svc", map[string]string{}, *config, options...)
+		if err := server.WaitReady(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return server
+	}
+
+	sender := newServer("node1", WithJournal(NewMemoryJournalStorage()))
+	defer sender.Stop()
+	sender.OnDelegate(echoServerDelegate{})
+	receiver := newServer("node2")
+	defer receiver.Stop()
+	delegate := callDelegate{calls: make(chan *api.Envelope, 4)}
+	receiver.OnDelegate(delegate)
+
+	since := time.Now()
+	for {
+		if _, ok := sender.peers.Get("node2"); ok {
+			break
+		}
+
+		if ctx.Err() != nil {
+			t.Fatal("node2 not known to node1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := sender.peers.Send(ctx, receiver.GetMeta(), &api.Envelope{Cid: "chat"}); err != nil {
+		t.Fatal(err)
+	}
+	<-delegate.calls
+
+	n, err := receiver.Replay(ctx, since)
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected replay %d %v", n, err)
+	}
+
+	if in := <-delegate.calls; in.Cid != "chat" {
+		t.Fatalf("unexpected replayed envelope %v", in)
+	}
+}
@@ -0,0 +1,226 @@
+package nakamacluster
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// KafkaMessage message written to a kafka topic
+type KafkaMessage struct {
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+	Time    time.Time
+}
+
+// KafkaWriter producer used by the kafka sink, adapt the kafka client of your choice to it
+type KafkaWriter interface {
+	// WriteMessages write the batch, it returns once the batch is delivered or failed
+	WriteMessages(ctx context.Context, msgs ...KafkaMessage) error
+}
+
+type KafkaSinkOptions struct {
+	// EventsTopic topic of cluster events, empty disables events
+	EventsTopic string
+
+	// EnvelopesTopic topic of the envelopes sent to peers, empty disables envelopes
+	EnvelopesTopic string
+
+	// Routes cid patterns of the envelopes published, matched with path.Match
+	Routes []string
+
+	// BatchSize maximum number of messages written at once
+	BatchSize int
+
+	// BatchTimeout maximum time a message waits for its batch to fill
+	BatchTimeout time.Duration
+
+	// QueueSize number of messages waiting to be written, messages are dropped when it is full
+	QueueSize int
+
+	// StopTimeout time given to write the queued messages once the sink stops
+	StopTimeout time.Duration
+}
+
+// KafkaSink publish cluster events and selected envelopes to kafka in batches
+type KafkaSink struct {
+	ctx     context.Context
+	writer  KafkaWriter
+	options KafkaSinkOptions
+	queue   chan KafkaMessage
+	metrics *Metrics
+	logger  *zap.Logger
+	done    chan struct{}
+}
+
+// PublishEvent queue the cluster event
+func (k *KafkaSink) PublishEvent(e Event) {
+	if k == nil || k.options.EventsTopic == "" {
+		return
+	}
+
+	value, err := json.Marshal(e)
+	if err != nil {
+		k.logger.Warn("Failed marshal event", zap.Error(err))
+		return
+	}
+
+	k.publish(KafkaMessage{
+		Topic:   k.options.EventsTopic,
+		Key:     []byte(e.Node.Id),
+		Value:   value,
+		Headers: map[string]string{"type": e.Type.String()},
+		Time:    e.Time,
+	})
+}
+
+// PublishEnvelope queue the envelope sent to node when its cid matches a route
+func (k *KafkaSink) PublishEnvelope(node string, in *api.Envelope) {
+	if k == nil || k.options.EnvelopesTopic == "" || !k.match(in.Cid) {
+		return
+	}
+
+	value, err := proto.Marshal(in)
+	if err != nil {
+		k.logger.Warn("Failed marshal envelope", zap.Error(err))
+		return
+	}
+
+	headers := map[string]string{"cid": in.Cid, "node": node}
+	if j := in.GetJson(); j != nil {
+		headers["content-type"] = j.MediaType()
+	}
+
+	if t := in.AnyType(); t != "" {
+		headers["type"] = string(t)
+	}
+
+	k.publish(KafkaMessage{
+		Topic:   k.options.EnvelopesTopic,
+		Key:     []byte(in.Cid),
+		Value:   value,
+		Headers: headers,
+		Time:    time.Now(),
+	})
+}
+
+func (k *KafkaSink) match(cid string) bool {
+	for _, route := range k.options.Routes {
+		if ok, _ := path.Match(route, cid); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *KafkaSink) publish(msg KafkaMessage) {
+	select {
+	case k.queue <- msg:
+	default:
+		k.metrics.KafkaDropped(1)
+	}
+}
+
+func (k *KafkaSink) flush(ctx context.Context, batch []KafkaMessage) {
+	start := time.Now()
+	if err := k.writer.WriteMessages(ctx, batch...); err != nil {
+		k.logger.Warn("Failed write messages to kafka", zap.Error(err), zap.Int("size", len(batch)))
+		k.metrics.KafkaFailed(len(batch))
+		return
+	}
+	k.metrics.KafkaPublished(len(batch), time.Since(start))
+}
+
+func (k *KafkaSink) loop() {
+	defer close(k.done)
+	batch := make([]KafkaMessage, 0, k.options.BatchSize)
+	t := time.NewTicker(k.options.BatchTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case msg := <-k.queue:
+			batch = append(batch, msg)
+			if len(batch) < k.options.BatchSize {
+				continue
+			}
+
+		case <-t.C:
+			if len(batch) < 1 {
+				continue
+			}
+
+		case <-k.ctx.Done():
+			k.drain(batch)
+			return
+		}
+
+		k.flush(k.ctx, batch)
+		batch = make([]KafkaMessage, 0, k.options.BatchSize)
+	}
+}
+
+// drain write the pending batch and the queued messages within the StopTimeout
+func (k *KafkaSink) drain(batch []KafkaMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.options.StopTimeout)
+	defer cancel()
+	for {
+		select {
+		case msg := <-k.queue:
+			batch = append(batch, msg)
+			if len(batch) < k.options.BatchSize {
+				continue
+			}
+
+		default:
+			if len(batch) > 0 {
+				k.flush(ctx, batch)
+			}
+			return
+		}
+
+		k.flush(ctx, batch)
+		batch = make([]KafkaMessage, 0, k.options.BatchSize)
+	}
+}
+
+// NewKafkaSink create kafka sink, it is stopped when ctx is done
+func NewKafkaSink(ctx context.Context, logger *zap.Logger, writer KafkaWriter, options KafkaSinkOptions, metrics *Metrics) *KafkaSink {
+	if options.BatchSize < 1 {
+		options.BatchSize = 100
+	}
+
+	if options.BatchTimeout <= 0 {
+		options.BatchTimeout = time.Second
+	}
+
+	if options.QueueSize < 1 {
+		options.QueueSize = 4096
+	}
+
+	if options.StopTimeout <= 0 {
+		options.StopTimeout = 5 * time.Second
+	}
+
+	if metrics == nil {
+		metrics = NewMetrics(nil)
+	}
+
+	k := &KafkaSink{
+		ctx:     ctx,
+		writer:  writer,
+		options: options,
+		queue:   make(chan KafkaMessage, options.QueueSize),
+		metrics: metrics,
+		logger:  logger,
+		done:    make(chan struct{}),
+	}
+	go k.loop()
+	return k
+}
@@ -0,0 +1,69 @@
+package nakamacluster
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+// memoryKafkaWriter kafka writer keeping the messages, it fails once ctx is done
+type memoryKafkaWriter struct {
+	msgs []KafkaMessage
+	sync.Mutex
+}
+
+func (w *memoryKafkaWriter) WriteMessages(ctx context.Context, msgs ...KafkaMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	w.Lock()
+	w.msgs = append(w.msgs, msgs...)
+	w.Unlock()
+	return nil
+}
+
+func TestKafkaSinkFlushOnStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &memoryKafkaWriter{}
+	sink := NewKafkaSink(ctx, zap.NewNop(), writer, KafkaSinkOptions{
+		EventsTopic:    "events",
+		EnvelopesTopic: "envelopes",
+		Routes:         []string{"chat.*"},
+		BatchSize:      2,
+		BatchTimeout:   time.Hour,
+	}, nil)
+
+	sink.PublishEvent(Event{Type: EVENT_NODE_JOIN, Node: &Meta{Id: "node1"}})
+	sink.PublishEnvelope("node1", &api.Envelope{Cid: "chat.send"})
+	sink.PublishEnvelope("node1", &api.Envelope{Cid: "match.join"})
+	sink.PublishEnvelope("node1", &api.Envelope{Cid: "chat.leave"})
+
+	// the first two messages fill a batch, the third waits for the batch timeout
+	for {
+		writer.Lock()
+		n := len(writer.msgs)
+		writer.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-sink.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink not stopped")
+	}
+
+	writer.Lock()
+	defer writer.Unlock()
+	if len(writer.msgs) != 3 || string(writer.msgs[2].Key) != "chat.leave" {
+		t.Fatalf("pending batch not flushed on stop %v", writer.msgs)
+	}
+}
@@ -0,0 +1,127 @@
+package nakamacluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Hook lifecycle hook of Client and Server
+type Hook func(ctx context.Context) error
+
+type lifecycleStage int
+
+const (
+	stageStart lifecycleStage = iota
+	stageStop
+	stageJoin
+	stageLeave
+)
+
+func (stage lifecycleStage) String() string {
+	switch stage {
+	case stageStart:
+		return "start"
+	case stageStop:
+		return "stop"
+	case stageJoin:
+		return "join"
+	case stageLeave:
+		return "leave"
+	}
+	return "unknown"
+}
+
+// lifecycle runs the hooks of every stage. Start and join hooks run in
+// registration order and stop at the first error, leave and stop hooks run in
+// reverse registration order, all of them run and the first error is returned
+type lifecycle struct {
+	hooks   [4][]Hook
+	joined  bool
+	stopped bool
+	logger  *zap.Logger
+	sync.Mutex
+}
+
+func newLifecycle(logger *zap.Logger, o *options) *lifecycle {
+	l := &lifecycle{logger: logger}
+	l.hooks[stageStart] = o.onStart
+	l.hooks[stageStop] = o.onStop
+	l.hooks[stageJoin] = o.onJoin
+	l.hooks[stageLeave] = o.onLeave
+	return l
+}
+
+func (l *lifecycle) run(ctx context.Context, stage lifecycleStage) error {
+	hooks := l.hooks[stage]
+	if stage == stageStart || stage == stageJoin {
+		for i, hook := range hooks {
+			if err := hook(ctx); err != nil {
+				return fmt.Errorf("%s hook %d: %w", stage, i, err)
+			}
+		}
+		return nil
+	}
+
+	var first error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i](ctx); err != nil {
+			err = fmt.Errorf("%s hook %d: %w", stage, i, err)
+			if first == nil {
+				first = err
+			} else {
+				l.logger.Warn("Lifecycle hook failed", zap.Error(err))
+			}
+		}
+	}
+	return first
+}
+
+// sync run the join hooks once the local node shows up in the sd entries and
+// the leave hooks once it is gone
+func (l *lifecycle) sync(ctx context.Context, local string, metas []*Meta) {
+	found := false
+	for _, meta := range metas {
+		if meta.Id == local {
+			found = true
+			break
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.stopped || found == l.joined {
+		return
+	}
+
+	l.joined = found
+	stage := stageLeave
+	if found {
+		stage = stageJoin
+	}
+
+	if err := l.run(ctx, stage); err != nil {
+		l.logger.Warn("Lifecycle hook failed", zap.Error(err))
+	}
+}
+
+// stop run the leave hooks when the node is still part of the cluster,
+// cancel the node and run the stop hooks
+func (l *lifecycle) stop(ctx context.Context, cancel func()) error {
+	l.Lock()
+	defer l.Unlock()
+	l.stopped = true
+	var err error
+	if l.joined {
+		l.joined = false
+		err = l.run(ctx, stageLeave)
+	}
+
+	cancel()
+	if e := l.run(ctx, stageStop); err == nil {
+		err = e
+	}
+	return err
+}
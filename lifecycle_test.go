@@ -0,0 +1,76 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestLifecycleOrder(t *testing.T) {
+	var calls []string
+	hook := func(name string, err error) Hook {
+		return func(ctx context.Context) error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+
+	errLeave := errors.New("leave")
+	o := newOptions(
+		WithOnStart(hook("start1", nil)),
+		WithOnStart(hook("start2", nil)),
+		WithOnJoinCluster(hook("join1", nil)),
+		WithOnJoinCluster(hook("join2", nil)),
+		WithOnLeaveCluster(hook("leave1", nil)),
+		WithOnLeaveCluster(hook("leave2", errLeave)),
+		WithOnStop(hook("stop1", nil)),
+		WithOnStop(hook("stop2", nil)),
+	)
+	l := newLifecycle(zap.NewNop(), o)
+	ctx := context.Background()
+	if err := l.run(ctx, stageStart); err != nil {
+		t.Fatal(err)
+	}
+
+	l.sync(ctx, "node1", []*Meta{{Id: "node2"}})
+	l.sync(ctx, "node1", []*Meta{{Id: "node1"}, {Id: "node2"}})
+	l.sync(ctx, "node1", []*Meta{{Id: "node1"}})
+
+	cancelled := false
+	err := l.stop(ctx, func() {
+		calls = append(calls, "cancel")
+		cancelled = true
+	})
+	if !errors.Is(err, errLeave) || !cancelled {
+		t.Fatalf("stop error %v cancelled %v", err, cancelled)
+	}
+
+	l.sync(ctx, "node1", []*Meta{{Id: "node1"}})
+	expected := []string{"start1", "start2", "join1", "join2", "leave2", "leave1", "cancel", "stop2", "stop1"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("calls %v expected %v", calls, expected)
+	}
+}
+
+func TestLifecycleStartError(t *testing.T) {
+	errStart := errors.New("start")
+	called := false
+	l := newLifecycle(zap.NewNop(), newOptions(
+		WithOnStart(func(ctx context.Context) error { return errStart }),
+		WithOnStart(func(ctx context.Context) error {
+			called = true
+			return nil
+		}),
+	))
+
+	if err := l.run(context.Background(), stageStart); !errors.Is(err, errStart) {
+		t.Fatalf("expected start error, got %v", err)
+	}
+
+	if called {
+		t.Fatal("hook after the failed hook was called")
+	}
+}
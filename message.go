@@ -14,6 +14,7 @@ type Message struct {
 	ctxCancelFn context.CancelFunc
 	to          []string
 	payload     *api.Envelope
+	hops        int
 	replyChan   chan *api.Envelope
 	errChan     chan error
 }
@@ -2,8 +2,11 @@ package nakamacluster
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"time"
 
 	sockaddr "github.com/hashicorp/go-sockaddr"
 )
@@ -13,19 +16,88 @@ import (
 type MetaStatus int
 
 const (
-	META_STATUS_WAIT_READY MetaStatus = iota // waiting for ready
-	META_STATUS_READYED                      // node ready
-	META_STATUS_STOPED                       // node down
+	META_STATUS_WAIT_READY    MetaStatus = iota // waiting for ready
+	META_STATUS_READYED                         // node ready
+	META_STATUS_STOPED                          // node down
+	META_STATUS_SUSPECT                         // node may be down, no new traffic until it recovers
+	META_STATUS_DRAINING                        // node alive and finishing its work, no new traffic
+	META_STATUS_QUARANTINED                     // node alive and isolated by an operator or a flap detector
+	META_STATUS_BOOTSTRAPPING                   // node waiting for the bootstrap quorum, no traffic until it is met
+	META_STATUS_MAINTENANCE                     // node alive, gossiping and answering control envelopes, no traffic for debugging
 )
 
+// ErrInvalidStatusTransition the node can not move from its status to the new one
+var ErrInvalidStatusTransition = errors.New("invalid status transition")
+
+// metaStatusTransitions legal transitions between statuses, staying in the same status is always legal
+var metaStatusTransitions = map[MetaStatus][]MetaStatus{
+	META_STATUS_WAIT_READY:    {META_STATUS_READYED, META_STATUS_SUSPECT, META_STATUS_DRAINING, META_STATUS_QUARANTINED, META_STATUS_MAINTENANCE, META_STATUS_STOPED},
+	META_STATUS_READYED:       {META_STATUS_SUSPECT, META_STATUS_DRAINING, META_STATUS_QUARANTINED, META_STATUS_MAINTENANCE, META_STATUS_STOPED},
+	META_STATUS_SUSPECT:       {META_STATUS_READYED, META_STATUS_DRAINING, META_STATUS_QUARANTINED, META_STATUS_MAINTENANCE, META_STATUS_STOPED},
+	META_STATUS_DRAINING:      {META_STATUS_READYED, META_STATUS_STOPED},
+	META_STATUS_QUARANTINED:   {META_STATUS_READYED, META_STATUS_DRAINING, META_STATUS_STOPED},
+	META_STATUS_BOOTSTRAPPING: {META_STATUS_READYED, META_STATUS_WAIT_READY, META_STATUS_DRAINING, META_STATUS_STOPED},
+	META_STATUS_MAINTENANCE:   {META_STATUS_READYED, META_STATUS_DRAINING, META_STATUS_STOPED},
+	META_STATUS_STOPED:        {META_STATUS_WAIT_READY},
+}
+
+func (s MetaStatus) String() string {
+	switch s {
+	case META_STATUS_WAIT_READY:
+		return "wait_ready"
+	case META_STATUS_READYED:
+		return "ready"
+	case META_STATUS_STOPED:
+		return "stopped"
+	case META_STATUS_SUSPECT:
+		return "suspect"
+	case META_STATUS_DRAINING:
+		return "draining"
+	case META_STATUS_QUARANTINED:
+		return "quarantined"
+	case META_STATUS_BOOTSTRAPPING:
+		return "bootstrapping"
+	case META_STATUS_MAINTENANCE:
+		return "maintenance"
+	}
+	return "unknown(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Routable reports whether nodes in the status receive new traffic, nodes waiting
+// for ready are routable so services work before they report ready
+func (s MetaStatus) Routable() bool {
+	return s == META_STATUS_WAIT_READY || s == META_STATUS_READYED
+}
+
+// CheckTransition returns ErrInvalidStatusTransition when the status can not move to next
+func (s MetaStatus) CheckTransition(next MetaStatus) error {
+	if s == next {
+		return nil
+	}
+
+	for _, status := range metaStatusTransitions[s] {
+		if status == next {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w from %s to %s", ErrInvalidStatusTransition, s, next)
+}
+
 // NodeMeta Node parameters
 type Meta struct {
-	Id     string            `json:"id"`
-	Name   string            `json:"name"`
-	Addr   string            `json:"addr"`
-	Type   NodeType          `json:"type"`
-	Status MetaStatus        `json:"status"`
-	Vars   map[string]string `json:"vars"`
+	Id              string            `json:"id"`
+	Name            string            `json:"name"`
+	Addr            string            `json:"addr"`
+	Type            NodeType          `json:"type"`
+	TypeName        string            `json:"type_name,omitempty"`
+	Status          MetaStatus        `json:"status"`
+	Vars            map[string]string `json:"vars"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	Cluster         string            `json:"cluster,omitempty"`
+	Epoch           int64             `json:"epoch,omitempty"`
+	Version         uint64            `json:"version,omitempty"`
+	ProtocolVersion uint32            `json:"protocol_version"`
 }
 
 // Marshal create JSON
@@ -33,11 +105,35 @@ func (n *Meta) Marshal() ([]byte, error) {
 	return json.Marshal(n)
 }
 
-// Clone copy
+// Clone copy of the node, its vars and labels included
 func (n Meta) Clone() *Meta {
+	n.Vars = cloneStringMap(n.Vars)
+	n.Labels = cloneStringMap(n.Labels)
 	return &n
 }
 
+// cloneStringMap returns a copy of m, nil when m is nil
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// Newer reports whether n is a later update of the node than other, a later
+// epoch is a restart of the node and within an epoch the version orders updates
+func (n *Meta) Newer(other *Meta) bool {
+	if n.Epoch != other.Epoch {
+		return n.Epoch > other.Epoch
+	}
+	return n.Version > other.Version
+}
+
 // NewNodeMetaFromJSON Created via json stream NodeMeta
 func NewNodeMetaFromJSON(b []byte) *Meta {
 	var m Meta
@@ -50,20 +146,52 @@ func NewNodeMetaFromJSON(b []byte) *Meta {
 // NewNodeMeta Create node meta information
 func NewNodeMeta(id, name, addr string, nodeType NodeType, vars map[string]string) *Meta {
 	return &Meta{
-		Id:     id,
-		Name:   name,
-		Addr:   addr,
-		Type:   nodeType,
-		Vars:   vars,
-		Status: META_STATUS_WAIT_READY,
+		Id:              id,
+		Name:            name,
+		Addr:            addr,
+		Type:            nodeType,
+		TypeName:        nodeType.String(),
+		Vars:            vars,
+		Status:          META_STATUS_WAIT_READY,
+		ProtocolVersion: ProtocolVersion,
+		Epoch:           time.Now().UnixNano(),
+	}
+}
+
+// advertiseAddr returns the ip and port announced to memberlist, the advertise
+// address is resolved when it is a dns name and defaults to the bind address
+func advertiseAddr(c Config) (string, int, error) {
+	port := c.Port
+	if c.AdvertisePort > 0 {
+		port = c.AdvertisePort
+	}
+
+	host := c.AdvertiseAddr
+	if host == "" {
+		host = c.Addr
+	}
+
+	if host == "" || host == "0.0.0.0" {
+		ip, err := sockaddr.GetPrivateIP()
+		return ip, port, err
 	}
+
+	ip, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return "", 0, err
+	}
+	return ip.String(), port, nil
 }
 
 // NewNodeMetaFromConfig Create node meta through configuration file
 func NewNodeMetaFromConfig(id, name string, t NodeType, vars map[string]string, c Config) *Meta {
 	addr := ""
 	ip, err := net.ResolveIPAddr("ip", c.Addr)
-	if err == nil && c.Addr != "" && c.Addr != "0.0.0.0" {
+	if c.DNSName != "" {
+		addr = c.DNSName
+	} else if c.AdvertiseAddr != "" {
+		addr = c.AdvertiseAddr
+	} else if err == nil && c.Addr != "" && c.Addr != "0.0.0.0" {
 		addr = ip.String()
 	} else {
 		addr, err = sockaddr.GetPrivateIP()
@@ -72,6 +200,28 @@ func NewNodeMetaFromConfig(id, name string, t NodeType, vars map[string]string,
 		}
 	}
 
-	vars["domain"] = c.Domain
-	return NewNodeMeta(id, name, fmt.Sprintf("%s:%d", addr, c.Port), t, vars)
+	vars[VAR_DOMAIN] = c.Domain
+	if host := hostId(c); host != "" {
+		vars[VAR_HOST] = host
+	}
+
+	if c.GrpcUnixSocket != "" {
+		vars[VAR_UNIX_SOCKET] = c.GrpcUnixSocket
+	}
+
+	port := c.Port
+	if c.AdvertisePort > 0 {
+		port = c.AdvertisePort
+	}
+
+	meta := NewNodeMeta(id, name, net.JoinHostPort(addr, strconv.Itoa(port)), t, vars)
+	meta.Namespace = c.Namespace
+	meta.Cluster = c.ClusterName
+	if len(c.Labels) > 0 {
+		meta.Labels = make(map[string]string, len(c.Labels))
+		for k, v := range c.Labels {
+			meta.Labels[k] = v
+		}
+	}
+	return meta
 }
@@ -1,10 +1,13 @@
 package nakamacluster
 
 import (
+	"context"
+	"errors"
 	"net"
 	"testing"
 
 	sockaddr "github.com/hashicorp/go-sockaddr"
+	"go.uber.org/zap"
 )
 
 func TestMeta(t *testing.T) {
@@ -22,3 +25,73 @@ func TestMeta(t *testing.T) {
 
 	t.Log(addr)
 }
+
+func TestMetaStatusTransition(t *testing.T) {
+	if err := META_STATUS_READYED.CheckTransition(META_STATUS_DRAINING); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := META_STATUS_DRAINING.CheckTransition(META_STATUS_SUSPECT); !errors.Is(err, ErrInvalidStatusTransition) {
+		t.Fatalf("expected invalid transition, got %v", err)
+	}
+
+	if err := META_STATUS_STOPED.CheckTransition(META_STATUS_STOPED); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerSkipsUnroutableNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	node1 := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	node2 := NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{})
+	node2.Status = META_STATUS_DRAINING
+	peer.Sync(node1, node2)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if node, ok := peer.GetWithHashRing("svc", key); !ok || node.Id != "node1" {
+			t.Fatalf("key %s routed to %v", key, node)
+		}
+	}
+
+	peer.Update("node1", META_STATUS_QUARANTINED)
+	if node, ok := peer.GetWithHashRing("svc", "a"); ok {
+		t.Fatalf("routed to quarantined node %s", node.Id)
+	}
+
+	peer.Update("node2", META_STATUS_READYED)
+	if node, ok := peer.GetWithHashRing("svc", "a"); !ok || node.Id != "node2" {
+		t.Fatalf("expected node2, got %v", node)
+	}
+}
+
+func TestMetaNewer(t *testing.T) {
+	node := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	update := node.Clone()
+	update.Version++
+	if !update.Newer(node) || node.Newer(update) {
+		t.Fatal("later version not newer")
+	}
+
+	restarted := node.Clone()
+	restarted.Epoch++
+	if !restarted.Newer(update) {
+		t.Fatal("later epoch not newer than a later version")
+	}
+
+	if node.Newer(node.Clone()) {
+		t.Fatal("equal meta newer")
+	}
+}
+
+func TestMetaCloneMaps(t *testing.T) {
+	meta := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{"k": "v"})
+	meta.Labels = map[string]string{"zone": "a"}
+	clone := meta.Clone()
+	clone.Vars["k"] = "v2"
+	clone.Labels["zone"] = "b"
+	if meta.Vars["k"] != "v" || meta.Labels["zone"] != "a" {
+		t.Fatalf("clone shares the maps of the node %+v", meta)
+	}
+}
@@ -0,0 +1,231 @@
+package nakamacluster
+
+import (
+	"time"
+
+	"github.com/uber-go/tally/v4"
+)
+
+// Metrics cluster metrics reported through the tally scope
+type Metrics struct {
+	scope tally.Scope
+}
+
+// WorkerPoolUtilization report the number of busy workers and queued jobs of the pool
+func (m *Metrics) WorkerPoolUtilization(name string, busy, queued, size int) {
+	scope := m.scope.Tagged(map[string]string{"pool": name})
+	scope.Gauge("worker_pool_busy").Update(float64(busy))
+	scope.Gauge("worker_pool_queued").Update(float64(queued))
+	scope.Gauge("worker_pool_size").Update(float64(size))
+}
+
+// WorkerPoolRejected report a job rejected because the queue of the pool was full
+func (m *Metrics) WorkerPoolRejected(name string) {
+	m.scope.Tagged(map[string]string{"pool": name}).Counter("worker_pool_rejected").Inc(1)
+}
+
+// StreamStall report the number of streams waiting for flow control credits
+func (m *Metrics) StreamStall(stalled int64) {
+	m.scope.Gauge("stream_stalled").Update(float64(stalled))
+}
+
+// StreamStallDuration report how long a stream waited for flow control credits
+func (m *Metrics) StreamStallDuration(d time.Duration) {
+	m.scope.Counter("stream_stalls").Inc(1)
+	m.scope.Timer("stream_stall_latency").Record(d)
+}
+
+// streamBatchBuckets buckets of the stream batch size histogram, 1 to 128 envelopes
+var streamBatchBuckets = tally.MustMakeExponentialValueBuckets(1, 2, 8)
+
+// StreamBatch report the number of envelopes coalesced in a stream write
+func (m *Metrics) StreamBatch(n int) {
+	m.scope.Histogram("stream_batch_size", streamBatchBuckets).RecordValue(float64(n))
+}
+
+// KafkaPublished report a batch delivered to kafka
+func (m *Metrics) KafkaPublished(n int, d time.Duration) {
+	m.scope.Counter("kafka_published").Inc(int64(n))
+	m.scope.Timer("kafka_write_latency").Record(d)
+}
+
+// KafkaFailed report messages that could not be delivered to kafka
+func (m *Metrics) KafkaFailed(n int) {
+	m.scope.Counter("kafka_failed").Inc(int64(n))
+}
+
+// KafkaDropped report messages dropped because the kafka queue was full
+func (m *Metrics) KafkaDropped(n int) {
+	m.scope.Counter("kafka_dropped").Inc(int64(n))
+}
+
+// DelegatePanic report a panic of the delegate callback recovered by the cluster
+func (m *Metrics) DelegatePanic(callback string) {
+	m.scope.Tagged(map[string]string{"callback": callback}).Counter("delegate_panics").Inc(1)
+}
+
+// delegateLatencyBuckets buckets of the delegate latency histogram, 1ms to about 65s
+var delegateLatencyBuckets = tally.MustMakeExponentialDurationBuckets(time.Millisecond, 2, 17)
+
+// DelegateLatency report the time a delegate callback ran
+func (m *Metrics) DelegateLatency(callback string, d time.Duration) {
+	m.scope.Tagged(map[string]string{"callback": callback}).Histogram("delegate_latency", delegateLatencyBuckets).RecordDuration(d)
+}
+
+// DelegateStuck report a delegate callback still running past the watchdog threshold
+func (m *Metrics) DelegateStuck(callback string) {
+	m.scope.Tagged(map[string]string{"callback": callback}).Counter("delegate_stuck").Inc(1)
+}
+
+// ExpiredDropped report an envelope discarded because it expired
+func (m *Metrics) ExpiredDropped() {
+	m.scope.Counter("expired_dropped").Inc(1)
+}
+
+// StreamUnauthenticated report a stream rejected or closed by its authentication, reason is rejected or expired
+func (m *Metrics) StreamUnauthenticated(reason string) {
+	m.scope.Tagged(map[string]string{"reason": reason}).Counter("stream_unauthenticated").Inc(1)
+}
+
+// StreamRedirected report a stream redirected to the successor of the draining node
+func (m *Metrics) StreamRedirected() {
+	m.scope.Counter("stream_redirected").Inc(1)
+}
+
+// StreamTraffic report the messages and bytes of the peer streams to the service, direction is in or out
+func (m *Metrics) StreamTraffic(service, direction string, messages, bytes int) {
+	scope := m.scope.Tagged(map[string]string{"service": service, "direction": direction})
+	scope.Counter("stream_messages").Inc(int64(messages))
+	scope.Counter("stream_bytes").Inc(int64(bytes))
+}
+
+// StreamError report a failed send or receive on a peer stream to the service
+func (m *Metrics) StreamError(service string) {
+	m.scope.Tagged(map[string]string{"service": service}).Counter("stream_errors").Inc(1)
+}
+
+// StickyStreamRepinned report a sticky stream of the service moved to the new owner of its key
+func (m *Metrics) StickyStreamRepinned(name string) {
+	m.scope.Tagged(map[string]string{"service": name}).Counter("sticky_stream_repinned").Inc(1)
+}
+
+// IdempotentReplayed report a duplicate call answered with the reply of the call of its idempotency key
+func (m *Metrics) IdempotentReplayed() {
+	m.scope.Counter("idempotent_replayed").Inc(1)
+}
+
+// EgressThrottled report how long a send waited for the egress byte rate limit
+func (m *Metrics) EgressThrottled(d time.Duration) {
+	m.scope.Counter("egress_throttled").Inc(1)
+	m.scope.Timer("egress_throttle_latency").Record(d)
+}
+
+// Gossip report the gossip queue depths, the memberlist health score and the number of members
+func (m *Metrics) Gossip(broadcasts, relays, health, members int) {
+	m.scope.Gauge("gossip_broadcast_queue").Update(float64(broadcasts))
+	m.scope.Gauge("gossip_relay_queue").Update(float64(relays))
+	m.scope.Gauge("gossip_health_score").Update(float64(health))
+	m.scope.Gauge("gossip_members").Update(float64(members))
+}
+
+// GossipDropped report a gossip message dropped because the inbound or outbound queue was full
+func (m *Metrics) GossipDropped(direction string) {
+	m.scope.Tagged(map[string]string{"direction": direction}).Counter("gossip_dropped").Inc(1)
+}
+
+// GossipUnverified report a gossip message dropped because its signature was missing, wrong, stale or replayed
+func (m *Metrics) GossipUnverified(reason string) {
+	m.scope.Tagged(map[string]string{"reason": reason}).Counter("gossip_unverified").Inc(1)
+}
+
+// AuditDropped report an audit record dropped because the queue was full
+func (m *Metrics) AuditDropped() {
+	m.scope.Counter("audit_dropped").Inc(1)
+}
+
+// AuditFailed report an audit record the sink failed to append
+func (m *Metrics) AuditFailed() {
+	m.scope.Counter("audit_failed").Inc(1)
+}
+
+// PeerRTT report the round trip time of a heartbeat ping to the node
+func (m *Metrics) PeerRTT(node string, d time.Duration) {
+	m.scope.Tagged(map[string]string{"node": node}).Timer("peer_rtt").Record(d)
+}
+
+// HeartbeatFailed report a heartbeat ping to the node that failed
+func (m *Metrics) HeartbeatFailed(node string) {
+	m.scope.Tagged(map[string]string{"node": node}).Counter("heartbeat_failed").Inc(1)
+}
+
+// PeerPool report the connections of the pool to the node
+func (m *Metrics) PeerPool(node string, stats PoolStats) {
+	scope := m.scope.Tagged(map[string]string{"node": node})
+	scope.Gauge("peer_pool_connections").Update(float64(stats.Connections))
+	scope.Gauge("peer_pool_active").Update(float64(stats.Active))
+	scope.Gauge("peer_pool_idle").Update(float64(stats.Idle))
+	scope.Gauge("peer_pool_in_use").Update(float64(stats.InUse))
+}
+
+// PeerPoolLeaked report a connection to the node held beyond the leak threshold
+func (m *Metrics) PeerPoolLeaked(node string) {
+	m.scope.Tagged(map[string]string{"node": node}).Counter("peer_pool_leaked").Inc(1)
+}
+
+// OutboxPending report the number of outbox envelopes not acknowledged yet
+func (m *Metrics) OutboxPending(pending int) {
+	m.scope.Gauge("outbox_pending").Update(float64(pending))
+}
+
+// OutboxDropped report an outbox envelope dropped because it was not delivered within its ttl
+func (m *Metrics) OutboxDropped() {
+	m.scope.Counter("outbox_dropped").Inc(1)
+}
+
+// OverloadShed report an envelope of the priority shed because the node is overloaded
+func (m *Metrics) OverloadShed(priority string) {
+	m.scope.Tagged(map[string]string{"priority": priority}).Counter("overload_shed").Inc(1)
+}
+
+// SloRequest report a request of the route, failed and slow requests spend its error budget
+func (m *Metrics) SloRequest(route string, failed, slow bool, d time.Duration) {
+	result := "ok"
+	switch {
+	case failed:
+		result = "error"
+	case slow:
+		result = "slow"
+	}
+
+	scope := m.scope.Tagged(map[string]string{"route": route})
+	scope.Tagged(map[string]string{"result": result}).Counter("slo_requests").Inc(1)
+	scope.Timer("slo_latency").Record(d)
+}
+
+// SloBudget report the share of the error budget of the route left
+func (m *Metrics) SloBudget(route string, remaining float64) {
+	m.scope.Tagged(map[string]string{"route": route}).Gauge("slo_budget_remaining").Update(remaining)
+}
+
+// SloTripped report the breaker of the route tripped on its exhausted error budget
+func (m *Metrics) SloTripped(route string) {
+	m.scope.Tagged(map[string]string{"route": route}).Counter("slo_tripped").Inc(1)
+}
+
+// SloRejected report a request rejected by the breaker of the route
+func (m *Metrics) SloRejected(route string) {
+	m.scope.Tagged(map[string]string{"route": route}).Counter("slo_rejected").Inc(1)
+}
+
+// OverloadPressure report the pressure of the node in percent
+func (m *Metrics) OverloadPressure(pressure int) {
+	m.scope.Gauge("overload_pressure").Update(float64(pressure))
+}
+
+// NewMetrics create metrics, a nil scope disables reporting
+func NewMetrics(scope tally.Scope) *Metrics {
+	if scope == nil {
+		scope = tally.NoopScope
+	}
+	return &Metrics{scope: scope.SubScope("cluster")}
+}
@@ -1,9 +1,101 @@
 package nakamacluster
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+var (
+	ErrInvalidNodeType    = errors.New("invalid node type")
+	ErrNodeTypeRegistered = errors.New("node type already registered")
+)
+
 // node type
 type NodeType int
 
 const (
 	NODE_TYPE_NAKAMA        NodeType = iota + 1 // nakama main service
 	NODE_TYPE_MICROSERVICES                     // microservice
+	NODE_TYPE_OBSERVER                          // gossip only client created WithObserver
 )
+
+var nodeTypes = struct {
+	names map[NodeType]string
+	ids   map[string]NodeType
+	sync.RWMutex
+}{
+	names: map[NodeType]string{
+		NODE_TYPE_NAKAMA:        "nakama",
+		NODE_TYPE_MICROSERVICES: "microservices",
+		NODE_TYPE_OBSERVER:      "observer",
+	},
+	ids: map[string]NodeType{
+		"nakama":        NODE_TYPE_NAKAMA,
+		"microservices": NODE_TYPE_MICROSERVICES,
+		"observer":      NODE_TYPE_OBSERVER,
+	},
+}
+
+// RegisterNodeType register a custom node class, it must be called on every
+// node of the cluster before Client or Server is created
+func RegisterNodeType(id NodeType, name string) error {
+	if id < 1 || name == "" {
+		return ErrInvalidNodeType
+	}
+
+	nodeTypes.Lock()
+	defer nodeTypes.Unlock()
+	if n, ok := nodeTypes.names[id]; ok {
+		return fmt.Errorf("%w: %d is %s", ErrNodeTypeRegistered, id, n)
+	}
+
+	if t, ok := nodeTypes.ids[name]; ok {
+		return fmt.Errorf("%w: %s is %d", ErrNodeTypeRegistered, name, t)
+	}
+
+	nodeTypes.names[id] = name
+	nodeTypes.ids[name] = id
+	return nil
+}
+
+// NodeTypeByName returns the registered node type of the name
+func NodeTypeByName(name string) (NodeType, bool) {
+	nodeTypes.RLock()
+	defer nodeTypes.RUnlock()
+	t, ok := nodeTypes.ids[name]
+	return t, ok
+}
+
+// Registered reports whether the node type is registered
+func (t NodeType) Registered() bool {
+	nodeTypes.RLock()
+	defer nodeTypes.RUnlock()
+	_, ok := nodeTypes.names[t]
+	return ok
+}
+
+func (t NodeType) String() string {
+	nodeTypes.RLock()
+	defer nodeTypes.RUnlock()
+	if name, ok := nodeTypes.names[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+// CheckNodeType validate the node type carried in meta against the registry
+func CheckNodeType(meta *Meta) error {
+	nodeTypes.RLock()
+	defer nodeTypes.RUnlock()
+	name, ok := nodeTypes.names[meta.Type]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrInvalidNodeType, meta.Type)
+	}
+
+	if meta.TypeName != "" && meta.TypeName != name {
+		return fmt.Errorf("%w: %d is %s, got %s", ErrInvalidNodeType, meta.Type, name, meta.TypeName)
+	}
+	return nil
+}
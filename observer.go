@@ -0,0 +1,25 @@
+package nakamacluster
+
+import "github.com/hashicorp/memberlist"
+
+// OBSERVER name of the clients created WithObserver
+const OBSERVER = "observer"
+
+// Observer reports whether the client was created WithObserver
+func (s *Client) Observer() bool {
+	return s.GetMeta().Type == NODE_TYPE_OBSERVER
+}
+
+// updateSd write the meta of the node to sd, observers are not registered in sd
+func (s *Client) updateSd(meta *Meta) error {
+	if meta.Type == NODE_TYPE_OBSERVER {
+		return nil
+	}
+	return s.wathcer.Update(meta)
+}
+
+// observerNode reports whether the gossip node is an observer
+func observerNode(node *memberlist.Node) bool {
+	meta := NewNodeMetaFromJSON(node.Meta)
+	return meta != nil && meta.Type == NODE_TYPE_OBSERVER
+}
@@ -0,0 +1,253 @@
+package nakamacluster
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+)
+
+// observerEventQueueSize events a watcher of the observer api may fall behind before its stream is ended
+const observerEventQueueSize = 256
+
+// observerApi serves the read-only Observer service of the cluster listener, it changes
+// nothing so dashboards and controllers need no control key
+type observerApi struct {
+	api.UnimplementedObserverServer
+	local  func() *Meta
+	peers  Peer
+	events *EventBus
+}
+
+func newObserverApi(local func() *Meta, peers Peer, events *EventBus) *observerApi {
+	return &observerApi{local: local, peers: peers, events: events}
+}
+
+// ListNodes returns the nodes of the view matching the name and the selector, sorted by id
+func (o *observerApi) ListNodes(ctx context.Context, in *api.ListNodesRequest) (*api.ListNodesResponse, error) {
+	var nodes []*Meta
+	switch {
+	case in.Selector != "":
+		matched, err := o.peers.Query(in.Selector)
+		if err != nil {
+			return nil, api.NewError(api.Error_INVALID_ARGUMENT, err.Error())
+		}
+
+		for _, node := range matched {
+			if in.Name == "" || node.Name == in.Name {
+				nodes = append(nodes, node)
+			}
+		}
+
+	case in.Name != "":
+		nodes = o.peers.GetByName(in.Name)
+
+	default:
+		nodes = o.peers.All()
+	}
+
+	out := &api.ListNodesResponse{Local: apiNode(o.local()), Nodes: make([]*api.Node, 0, len(nodes))}
+	for _, node := range sortedNodes(nodes) {
+		out.Nodes = append(out.Nodes, apiNode(node))
+	}
+	return out, nil
+}
+
+// WatchEvents stream the cluster events until the caller leaves, a watcher falling more than
+// observerEventQueueSize events behind is ended with RESOURCE_EXHAUSTED and must list the nodes again
+func (o *observerApi) WatchEvents(in *api.WatchEventsRequest, stream api.Observer_WatchEventsServer) error {
+	types := make(map[EventType]bool, len(in.Types))
+	for _, name := range in.Types {
+		t, ok := parseEventType(name)
+		if !ok {
+			return api.Errorf(api.Error_INVALID_ARGUMENT, "unknown event type %s", name)
+		}
+		types[t] = true
+	}
+
+	ch := make(chan Event, observerEventQueueSize)
+	overflow := make(chan struct{})
+	var once sync.Once
+	unsubscribe := o.events.Subscribe(func(e Event) {
+		if len(types) > 0 && !types[e.Type] {
+			return
+		}
+
+		select {
+		case ch <- e:
+		default:
+			once.Do(func() { close(overflow) })
+		}
+	})
+	defer unsubscribe()
+
+	// subscribed first so no change between the snapshot and the events is missed
+	if in.Snapshot {
+		now := time.Now()
+		for _, node := range sortedNodes(o.peers.All()) {
+			if err := stream.Send(apiEvent(Event{Type: EVENT_NODE_JOIN, Node: node, Time: now})); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case e := <-ch:
+			if err := stream.Send(apiEvent(e)); err != nil {
+				return err
+			}
+
+		case <-overflow:
+			return api.NewError(api.Error_RESOURCE_EXHAUSTED, "watcher fell behind the cluster events")
+
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// GetRing returns the nodes of the ring of the name with their virtual nodes, and the owners of the keys
+func (o *observerApi) GetRing(ctx context.Context, in *api.GetRingRequest) (*api.Ring, error) {
+	if in.Name == "" {
+		return nil, api.NewError(api.Error_INVALID_ARGUMENT, "missing ring name")
+	}
+
+	var weights map[string]int
+	if p, ok := o.peers.(*LocalPeer); ok {
+		if weights, ok = p.ringWeights(in.Name); !ok {
+			return nil, api.Errorf(api.Error_NOT_FOUND, "ring %s not found", in.Name)
+		}
+	} else {
+		weights = make(map[string]int)
+		for _, node := range o.peers.GetByName(in.Name) {
+			weights[node.Id] = nodeWeight(node)
+		}
+	}
+
+	out := &api.Ring{Name: in.Name, Members: make([]*api.RingMember, 0, len(weights)), Owners: make(map[string]string, len(in.Keys))}
+	for id, weight := range weights {
+		if node, ok := o.peers.Get(id); ok {
+			out.Members = append(out.Members, &api.RingMember{Node: apiNode(node), Weight: int32(weight)})
+		}
+	}
+	sort.Slice(out.Members, func(i, j int) bool { return out.Members[i].Node.Id < out.Members[j].Node.Id })
+
+	for _, key := range in.Keys {
+		if node, ok := o.peers.GetWithHashRing(in.Name, key); ok {
+			out.Owners[key] = node.Id
+		}
+	}
+	return out, nil
+}
+
+// GetStats returns the node counts of the view and the links of the local node to its peers
+func (o *observerApi) GetStats(ctx context.Context, in *api.GetStatsRequest) (*api.Stats, error) {
+	local := o.local()
+	nodes := sortedNodes(o.peers.All())
+	out := &api.Stats{
+		Local:    apiNode(local),
+		Nodes:    int32(len(nodes)),
+		Services: make(map[string]int32),
+		Statuses: make(map[string]int32),
+		Peers:    make([]*api.PeerStats, 0, len(nodes)),
+	}
+
+	p, _ := o.peers.(*LocalPeer)
+	for _, node := range nodes {
+		out.Services[node.Name]++
+		out.Statuses[node.Status.String()]++
+		if node.Id == local.Id {
+			continue
+		}
+
+		stats := &api.PeerStats{Id: node.Id, Cordoned: o.peers.Cordoned(node.Id)}
+		if link, ok := o.peers.Link(node.Id); ok {
+			stats.Rtt = int64(link.RTT)
+			stats.ClockOffset = int64(link.ClockOffset)
+			stats.Failures = int32(link.Failures)
+			if !link.LastSeen.IsZero() {
+				stats.LastSeen = link.LastSeen.UnixNano()
+			}
+		}
+
+		if p != nil {
+			stats.Quarantined = p.flaps.quarantined(node.Id, p.clock.Now())
+		}
+		out.Peers = append(out.Peers, stats)
+	}
+	return out, nil
+}
+
+// ListStreams returns the traffic of the streams of the client ids, the busiest first
+func (o *observerApi) ListStreams(ctx context.Context, in *api.ListStreamsRequest) (*api.ListStreamsResponse, error) {
+	if in.Limit < 0 {
+		return nil, api.NewError(api.Error_INVALID_ARGUMENT, "negative limit")
+	}
+
+	stats := o.peers.StreamStats(in.ClientId)
+	if in.Limit > 0 && int(in.Limit) < len(stats) {
+		stats = stats[:in.Limit]
+	}
+
+	out := &api.ListStreamsResponse{Streams: make([]*api.StreamStats, 0, len(stats))}
+	for _, s := range stats {
+		out.Streams = append(out.Streams, &api.StreamStats{
+			ClientId:     s.ClientId,
+			Node:         s.Node,
+			Service:      s.Service,
+			Open:         s.Open,
+			Opened:       s.Opened,
+			MessagesIn:   s.MessagesIn,
+			MessagesOut:  s.MessagesOut,
+			BytesIn:      s.BytesIn,
+			BytesOut:     s.BytesOut,
+			Errors:       s.Errors,
+			LastActivity: s.LastActivity.UnixNano(),
+		})
+	}
+	return out, nil
+}
+
+// parseEventType returns the event type of the name of EventType.String
+func parseEventType(name string) (EventType, bool) {
+	for t := EVENT_NODE_JOIN; t <= EVENT_CLUSTER_JOINED; t++ {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// sortedNodes sort the nodes by id in place
+func sortedNodes(nodes []*Meta) []*Meta {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return nodes
+}
+
+func apiNode(node *Meta) *api.Node {
+	if node == nil {
+		return nil
+	}
+
+	return &api.Node{
+		Id:              node.Id,
+		Name:            node.Name,
+		Addr:            node.Addr,
+		Type:            node.Type.String(),
+		Status:          node.Status.String(),
+		Vars:            node.Vars,
+		Labels:          node.Labels,
+		Namespace:       node.Namespace,
+		Cluster:         node.Cluster,
+		Epoch:           node.Epoch,
+		Version:         node.Version,
+		ProtocolVersion: node.ProtocolVersion,
+	}
+}
+
+func apiEvent(e Event) *api.ClusterEvent {
+	return &api.ClusterEvent{Type: e.Type.String(), Node: apiNode(e.Node), Time: e.Time.UnixNano()}
+}
@@ -0,0 +1,127 @@
+package nakamacluster
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestObserverApi(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.GrpcObserver = true
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", "svc", map[string]string{}, *config)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(ctx, net.JoinHostPort(config.Addr, strconv.Itoa(config.Port)), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the sd sync of the registration would replace the nodes synced by hand
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	server.peers.Sync(&Meta{Id: "node2", Name: "svc", Addr: "127.0.0.1:1", Vars: map[string]string{VAR_WEIGHT: "2"}})
+	observer := api.NewObserverClient(conn)
+	watch, err := observer.WatchEvents(ctx, &api.WatchEventsRequest{Types: []string{"join"}, Snapshot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot is sent once the stream is subscribed, the later join follows it
+	for _, id := range []string{"node2", "node3"} {
+		e, err := watch.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Type != "join" || e.Time == 0 || e.Node.Id != id {
+			t.Fatalf("unexpected event %v", e)
+		}
+
+		if id == "node2" {
+			server.peers.Sync(
+				&Meta{Id: "node2", Name: "svc", Addr: "127.0.0.1:1", Vars: map[string]string{VAR_WEIGHT: "2"}},
+				&Meta{Id: "node3", Name: "match", Addr: "127.0.0.1:2", Status: META_STATUS_DRAINING},
+			)
+		}
+	}
+
+	nodes, err := observer.ListNodes(ctx, &api.ListNodesRequest{Name: "svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nodes.Local.Id != "node1" || len(nodes.Nodes) != 1 || nodes.Nodes[0].Id != "node2" || nodes.Nodes[0].Vars[VAR_WEIGHT] != "2" {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+
+	if _, err := observer.ListNodes(ctx, &api.ListNodesRequest{Selector: "=="}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+
+	ring, err := observer.GetRing(ctx, &api.GetRingRequest{Name: "svc", Keys: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ring.Members) != 1 || ring.Members[0].Node.Id != "node2" || ring.Members[0].Weight <= 0 || ring.Owners["a"] != "node2" || ring.Owners["b"] != "node2" {
+		t.Fatalf("unexpected ring %v", ring)
+	}
+
+	if _, err := observer.GetRing(ctx, &api.GetRingRequest{Name: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	stats, err := observer.GetStats(ctx, &api.GetStatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Nodes != 2 || stats.Services["svc"] != 1 || stats.Services["match"] != 1 || stats.Statuses[META_STATUS_DRAINING.String()] != 1 || len(stats.Peers) != 2 {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	other, err := observer.WatchEvents(ctx, &api.WatchEventsRequest{Types: []string{"other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := other.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestObserverApiDisabled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", "svc", map[string]string{}, *config)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(ctx, net.JoinHostPort(config.Addr, strconv.Itoa(config.Port)), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := api.NewObserverClient(conn).ListNodes(ctx, &api.ListNodesRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestObserver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newClient := func(id string, opts ...Option) *Client {
+		config := testConfig(t)
+		config.JoinRetryInterval = 10
+		return NewClient(ctx, zap.NewNop(), store.NewClient(ctx), id, map[string]string{}, *config, opts...)
+	}
+
+	nakama := newClient("nakama1")
+	defer nakama.Stop()
+	delegate := &joinDelegate{joins: make(chan *Meta, 4)}
+	nakama.OnDelegate(delegate)
+
+	observer := newClient("observer1", WithObserver())
+	defer observer.Stop()
+	if !observer.Observer() || nakama.Observer() {
+		t.Fatal("unexpected observer mode")
+	}
+
+	for observer.memberlist.NumMembers() < 2 || nakama.memberlist.NumMembers() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("observer did not join the gossip")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := observer.peers.Get("nakama1"); !ok {
+		t.Fatal("observer misses the cluster view")
+	}
+
+	if err := observer.UpdateMeta(META_STATUS_READYED, map[string]string{"v": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := store.NewClient(ctx).GetEntries(nakama.config.Prefix)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("unexpected sd entries %v %v", entries, err)
+	}
+
+	if _, ok := nakama.peers.Get("observer1"); ok {
+		t.Fatal("observer routed to")
+	}
+
+	for len(delegate.joins) > 0 {
+		if node := <-delegate.joins; node.Id == "observer1" {
+			t.Fatal("observer reported to the delegate")
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package nakamacluster
+
+import (
+	"context"
+	"net"
+
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+type options struct {
+	metricsScope tally.Scope
+	nodeType     NodeType
+	observer     bool
+	snapshot     *Snapshot
+	journal      JournalStorage
+	outbox       OutboxStorage
+	kafka        KafkaWriter
+	audit        AuditSink
+	blobs        BlobStore
+	streamAuth   StreamAuthenticator
+	transport    Transport
+	dialer       func(ctx context.Context, addr string) (net.Conn, error)
+	dialOptions  []grpc.DialOption
+	throttle     *Throttle
+	rings        map[string]RingOptions
+	keyMappers   map[string]KeyMapper
+	strategies   map[string]Strategy
+	services     map[string]PeerServiceOptions
+	logLevel     *zap.AtomicLevel
+	onStart      []Hook
+	onStop       []Hook
+	onJoin       []Hook
+	onLeave      []Hook
+}
+
+// Option configures optional dependencies of Client and Server
+type Option func(o *options)
+
+// WithMetricsScope report metrics to the scope
+func WithMetricsScope(scope tally.Scope) Option {
+	return func(o *options) {
+		o.metricsScope = scope
+	}
+}
+
+// WithNodeType announce the server as a registered custom node type instead of NODE_TYPE_MICROSERVICES
+func WithNodeType(t NodeType) Option {
+	return func(o *options) {
+		o.nodeType = t
+	}
+}
+
+// WithObserver run the client as an observer for sidecars and tooling needing the cluster view,
+// it joins the gossip and watches sd but is not registered in sd, gets no traffic and is not
+// reported to the delegates of the other nodes, its join and leave hooks never run
+func WithObserver() Option {
+	return func(o *options) {
+		o.observer = true
+	}
+}
+
+// WithSnapshot seed the peers from the snapshot before sd is read,
+// startup continues with the snapshot when sd can not be reached
+func WithSnapshot(snapshot *Snapshot) Option {
+	return func(o *options) {
+		o.snapshot = snapshot
+	}
+}
+
+// WithJournal record outbound peer messages of a service node to the storage so peers can
+// replay them with requests signed by Config.JournalKey, nakama nodes ignore it
+func WithJournal(storage JournalStorage) Option {
+	return func(o *options) {
+		o.journal = storage
+	}
+}
+
+// WithOutbox persist the envelopes sent through the outbox to the storage until they are acknowledged
+func WithOutbox(storage OutboxStorage) Option {
+	return func(o *options) {
+		o.outbox = storage
+	}
+}
+
+// WithKafka publish cluster events and the envelopes matching Config.KafkaRoutes to kafka
+func WithKafka(writer KafkaWriter) Option {
+	return func(o *options) {
+		o.kafka = writer
+	}
+}
+
+// WithAuditSink append the audit trail of the node to the sink instead of the audit_log_file,
+// like a NewSdAuditSink or NewKafkaAuditSink
+func WithAuditSink(sink AuditSink) Option {
+	return func(o *options) {
+		o.audit = sink
+	}
+}
+
+// WithBlobStore accept blobs sent by peers with SendBlob into the store
+func WithBlobStore(store BlobStore) Option {
+	return func(o *options) {
+		o.blobs = store
+	}
+}
+
+// WithStreamAuthenticator authenticate the metadata of the streams opened on the server, the
+// session it builds is passed to the Delegate.Stream handler and closes the stream once expired
+func WithStreamAuthenticator(auth StreamAuthenticator) Option {
+	return func(o *options) {
+		o.streamAuth = auth
+	}
+}
+
+// WithTransport run the gossip of the client over the transport instead of the udp and tcp
+// transport of memberlist, e.g. a tcp only transport for networks filtering udp
+func WithTransport(transport Transport) Option {
+	return func(o *options) {
+		o.transport = transport
+	}
+}
+
+// WithDialer dial the grpc connections to the other nodes with dialer instead of plain tcp,
+// e.g. through a SOCKS5 or corporate proxy when nodes cannot reach each other directly
+func WithDialer(dialer func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(o *options) {
+		o.dialer = dialer
+	}
+}
+
+// WithDialOptions add grpc dial options to the connections to the other nodes, they are
+// applied after the default options and may override them
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(o *options) {
+		o.dialOptions = append(o.dialOptions, opts...)
+	}
+}
+
+// WithThrottle limit the egress bytes per second with the throttle instead of the one
+// built from EgressNodeRate and EgressRate, e.g. to override the limit of some nodes
+func WithThrottle(throttle *Throttle) Option {
+	return func(o *options) {
+		o.throttle = throttle
+	}
+}
+
+// WithRing build the hashring of the named service with the options instead of
+// the ring_hash and ring_virtual_nodes configuration
+func WithRing(name string, ring RingOptions) Option {
+	return func(o *options) {
+		if o.rings == nil {
+			o.rings = make(map[string]RingOptions)
+		}
+		o.rings[name] = ring
+	}
+}
+
+// WithKeyMapper map the keys of the named ring with the mapper before their hashring lookup,
+// e.g. to co-locate the keys of a user on one node
+func WithKeyMapper(name string, mapper KeyMapper) Option {
+	return func(o *options) {
+		if o.keyMappers == nil {
+			o.keyMappers = make(map[string]KeyMapper)
+		}
+		o.keyMappers[name] = mapper
+	}
+}
+
+// WithStrategy pick the nodes of the named service served by SendToName with the
+// strategy instead of the send_strategy configuration
+func WithStrategy(name string, strategy Strategy) Option {
+	return func(o *options) {
+		if o.strategies == nil {
+			o.strategies = make(map[string]Strategy)
+		}
+		o.strategies[name] = strategy
+	}
+}
+
+// WithServiceOptions connect to the nodes of the named service with the overrides of the
+// connection pool, queue sizes and timeouts of the configuration
+func WithServiceOptions(name string, service PeerServiceOptions) Option {
+	return func(o *options) {
+		if o.services == nil {
+			o.services = make(map[string]PeerServiceOptions)
+		}
+		o.services[name] = service
+	}
+}
+
+// WithLogLevel let control envelopes change the level of the logger built with it
+func WithLogLevel(level zap.AtomicLevel) Option {
+	return func(o *options) {
+		o.logLevel = &level
+	}
+}
+
+// WithOnStart run the hook while the node starts, before it is registered in sd,
+// a failing hook aborts the start
+func WithOnStart(hook Hook) Option {
+	return func(o *options) {
+		o.onStart = append(o.onStart, hook)
+	}
+}
+
+// WithOnStop run the hook after the node stopped, stop hooks run in reverse order
+func WithOnStop(hook Hook) Option {
+	return func(o *options) {
+		o.onStop = append(o.onStop, hook)
+	}
+}
+
+// WithOnJoinCluster run the hook once the node is registered in sd and visible to its peers
+func WithOnJoinCluster(hook Hook) Option {
+	return func(o *options) {
+		o.onJoin = append(o.onJoin, hook)
+	}
+}
+
+// WithOnLeaveCluster run the hook when the node is stopping or lost its sd registration,
+// leave hooks run in reverse order
+func WithOnLeaveCluster(hook Hook) Option {
+	return func(o *options) {
+		o.onLeave = append(o.onLeave, hook)
+	}
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,399 @@
+package nakamacluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// OUTBOX_VAR_ID var carrying the outbox id of the envelope, it is the same on every delivery
+// attempt so receivers can drop the duplicates of at-least-once delivery
+const OUTBOX_VAR_ID = "outbox_id"
+
+// ErrOutboxDisabled no outbox storage was configured
+var ErrOutboxDisabled = errors.New("outbox not enabled")
+
+// outboxFileExt extension of the entry files of FileOutboxStorage
+const outboxFileExt = ".outbox"
+
+// OutboxEntry envelope persisted by the outbox until it is acknowledged
+type OutboxEntry struct {
+	Id   string `json:"id"`
+	Time int64  `json:"time"`
+
+	// Node id of the node the envelope is sent to, empty when it is sent to any node of Service
+	Node    string `json:"node,omitempty"`
+	Service string `json:"service,omitempty"`
+
+	// Envelope the marshaled envelope
+	Envelope []byte `json:"envelope"`
+}
+
+// OutboxStorage durable storage of the outbox, back it with bbolt, pebble or any store
+// that survives a restart of the process
+type OutboxStorage interface {
+	// Put store the entry, it must be durable when Put returns
+	Put(entry OutboxEntry) error
+
+	// Delete remove the acknowledged entry, deleting an unknown id is not an error
+	Delete(id string) error
+
+	// Range call f for every stored entry until f returns false
+	Range(f func(entry OutboxEntry) bool) error
+}
+
+// MemoryOutboxStorage in-memory outbox storage, entries do not survive a restart
+type MemoryOutboxStorage struct {
+	entries map[string]OutboxEntry
+	sync.RWMutex
+}
+
+func (s *MemoryOutboxStorage) Put(entry OutboxEntry) error {
+	s.Lock()
+	s.entries[entry.Id] = entry
+	s.Unlock()
+	return nil
+}
+
+func (s *MemoryOutboxStorage) Delete(id string) error {
+	s.Lock()
+	delete(s.entries, id)
+	s.Unlock()
+	return nil
+}
+
+func (s *MemoryOutboxStorage) Range(f func(entry OutboxEntry) bool) error {
+	s.RLock()
+	defer s.RUnlock()
+	for _, entry := range s.entries {
+		if !f(entry) {
+			break
+		}
+	}
+	return nil
+}
+
+// NewMemoryOutboxStorage create in-memory outbox storage
+func NewMemoryOutboxStorage() *MemoryOutboxStorage {
+	return &MemoryOutboxStorage{entries: make(map[string]OutboxEntry)}
+}
+
+// FileOutboxStorage outbox storage keeping every entry in a file of the directory,
+// entries are synced to disk before Put returns
+type FileOutboxStorage struct {
+	dir string
+}
+
+func (s *FileOutboxStorage) Put(entry OutboxEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(entry.Id))
+}
+
+func (s *FileOutboxStorage) Delete(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileOutboxStorage) Range(f func(entry OutboxEntry) bool) error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), outboxFileExt) {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			return err
+		}
+
+		var entry OutboxEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return err
+		}
+
+		if !f(entry) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *FileOutboxStorage) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+outboxFileExt)
+}
+
+// NewFileOutboxStorage create outbox storage in the directory, it is created when missing
+func NewFileOutboxStorage(dir string) (*FileOutboxStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileOutboxStorage{dir: dir}, nil
+}
+
+// OutboxOptions delivery of the outbox
+type OutboxOptions struct {
+	// RetryInterval interval undelivered envelopes are sent again at, it also bounds every attempt
+	RetryInterval time.Duration
+
+	// TTL envelopes not delivered within it are dropped, 0 retries them forever
+	TTL time.Duration
+}
+
+// Outbox persists envelopes before they are sent and deletes them once the receiving node
+// acknowledged them, envelopes left in the storage by a previous process are sent on start.
+// Delivery is at-least-once, envelopes of a target are delivered in the order they were queued
+type Outbox struct {
+	ctx     context.Context
+	storage OutboxStorage
+	peers   Peer
+	options OutboxOptions
+	pending []OutboxEntry
+	wake    chan struct{}
+	metrics *Metrics
+	logger  *zap.Logger
+	sync.Mutex
+}
+
+// Send persist the envelope and send it to the node until the node acknowledges it
+func (o *Outbox) Send(node *Meta, in *api.Envelope) error {
+	if o == nil {
+		return ErrOutboxDisabled
+	}
+
+	if node == nil {
+		return ErrNodeNotFound
+	}
+	return o.put(node.Id, "", in)
+}
+
+// SendToName persist the envelope and send it to a node of the service until one acknowledges it
+func (o *Outbox) SendToName(name string, in *api.Envelope) error {
+	return o.put("", name, in)
+}
+
+// Pending returns the number of envelopes not acknowledged yet
+func (o *Outbox) Pending() int {
+	if o == nil {
+		return 0
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	return len(o.pending)
+}
+
+func (o *Outbox) put(node, service string, in *api.Envelope) error {
+	if o == nil {
+		return ErrOutboxDisabled
+	}
+
+	entry := OutboxEntry{
+		Id:      uuid.Must(uuid.NewV4()).String(),
+		Time:    time.Now().UnixNano(),
+		Node:    node,
+		Service: service,
+	}
+
+	in = proto.Clone(in).(*api.Envelope)
+	if in.Vars == nil {
+		in.Vars = make(map[string]string)
+	}
+	in.Vars[OUTBOX_VAR_ID] = entry.Id
+	if in.IdempotencyKey == "" {
+		in.IdempotencyKey = entry.Id
+	}
+
+	var err error
+	if entry.Envelope, err = proto.Marshal(in); err != nil {
+		return err
+	}
+
+	if err := o.storage.Put(entry); err != nil {
+		return err
+	}
+
+	o.Lock()
+	o.pending = append(o.pending, entry)
+	o.metrics.OutboxPending(len(o.pending))
+	o.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// load queue the entries left in the storage in the order they were queued
+func (o *Outbox) load() error {
+	entries := make([]OutboxEntry, 0)
+	if err := o.storage.Range(func(entry OutboxEntry) bool {
+		entries = append(entries, entry)
+		return true
+	}); err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Time == entries[j].Time {
+			return entries[i].Id < entries[j].Id
+		}
+		return entries[i].Time < entries[j].Time
+	})
+
+	o.Lock()
+	o.pending = entries
+	o.metrics.OutboxPending(len(o.pending))
+	o.Unlock()
+	return nil
+}
+
+func (o *Outbox) run() {
+	t := time.NewTicker(o.options.RetryInterval)
+	defer t.Stop()
+	for {
+		o.deliver(time.Now())
+		select {
+		case <-t.C:
+		case <-o.wake:
+		case <-o.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver send the pending envelopes, the envelopes after a failed one to the same target
+// wait for the next attempt so they keep their order
+func (o *Outbox) deliver(now time.Time) {
+	o.Lock()
+	entries := append([]OutboxEntry(nil), o.pending...)
+	o.Unlock()
+
+	done := make(map[string]bool, len(entries))
+	blocked := make(map[string]bool)
+	for _, entry := range entries {
+		target := entry.Node + "/" + entry.Service
+		if blocked[target] {
+			continue
+		}
+
+		if o.options.TTL > 0 && now.Sub(time.Unix(0, entry.Time)) > o.options.TTL {
+			o.logger.Warn("Outbox envelope expired", zap.String("id", entry.Id), zap.String("node", entry.Node), zap.String("service", entry.Service))
+			o.metrics.OutboxDropped()
+		} else if err := o.send(entry); err != nil {
+			o.logger.Debug("Failed deliver outbox envelope", zap.Error(err), zap.String("id", entry.Id))
+			blocked[target] = true
+			continue
+		}
+
+		if err := o.storage.Delete(entry.Id); err != nil {
+			o.logger.Warn("Failed delete outbox envelope", zap.Error(err), zap.String("id", entry.Id))
+		}
+		done[entry.Id] = true
+	}
+
+	if len(done) < 1 {
+		return
+	}
+
+	o.Lock()
+	pending := o.pending[:0]
+	for _, entry := range o.pending {
+		if !done[entry.Id] {
+			pending = append(pending, entry)
+		}
+	}
+	o.pending = pending
+	o.metrics.OutboxPending(len(o.pending))
+	o.Unlock()
+}
+
+func (o *Outbox) send(entry OutboxEntry) error {
+	in := &api.Envelope{}
+	if err := proto.Unmarshal(entry.Envelope, in); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(o.ctx, o.options.RetryInterval)
+	defer cancel()
+	if entry.Node == "" {
+		_, _, err := o.peers.SendToName(ctx, entry.Service, in)
+		return err
+	}
+
+	node, ok := o.peers.Get(entry.Node)
+	if !ok {
+		return ErrNodeNotFound
+	}
+
+	_, err := o.peers.Send(ctx, node, in)
+	return err
+}
+
+// NewOutbox create outbox sending the envelopes of the storage to the peers until ctx is done
+func NewOutbox(ctx context.Context, logger *zap.Logger, storage OutboxStorage, peers Peer, options OutboxOptions, metrics *Metrics) *Outbox {
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = 5 * time.Second
+	}
+
+	if metrics == nil {
+		metrics = NewMetrics(nil)
+	}
+
+	o := &Outbox{
+		ctx:     ctx,
+		storage: storage,
+		peers:   peers,
+		options: options,
+		pending: make([]OutboxEntry, 0),
+		wake:    make(chan struct{}, 1),
+		metrics: metrics,
+		logger:  logger,
+	}
+
+	if err := o.load(); err != nil {
+		logger.Warn("Failed load outbox", zap.Error(err))
+	}
+	go o.run()
+	return o
+}
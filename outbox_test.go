@@ -0,0 +1,130 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+// flakyServerDelegate fails the first calls and records the outbox ids of the others
+type flakyServerDelegate struct {
+	echoServerDelegate
+	fail int
+	ids  []string
+	sync.Mutex
+}
+
+func (d *flakyServerDelegate) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.fail > 0 {
+		d.fail--
+		return nil, errors.New("unavailable")
+	}
+
+	d.ids = append(d.ids, in.Vars[OUTBOX_VAR_ID])
+	return in, nil
+}
+
+func (d *flakyServerDelegate) received() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.ids...)
+}
+
+func TestOutboxDeliversAcrossRestart(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	delegate := &flakyServerDelegate{fail: 1}
+	server.OnDelegate(delegate)
+
+	storage, err := NewFileOutboxStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first process queues the envelopes while the node is unknown to it
+	options := OutboxOptions{RetryInterval: 50 * time.Millisecond}
+	firstCtx, firstCancel := context.WithCancel(ctx)
+	first := NewOutbox(firstCtx, zap.NewNop(), storage, NewPeer(firstCtx, zap.NewNop(), PeerOptions{Connections: 1}), options, nil)
+	node := server.GetMeta()
+	for _, cid := range []string{"economy.1", "economy.2"} {
+		if err := first.Send(node, &api.Envelope{Cid: cid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	firstCancel()
+
+	if n := first.Pending(); n != 2 {
+		t.Fatalf("pending %d", n)
+	}
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1})
+	peer.Sync(node)
+	second := NewOutbox(ctx, zap.NewNop(), storage, peer, options, nil)
+	for second.Pending() > 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("outbox not delivered, pending %d", second.Pending())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ids := delegate.received()
+	if len(ids) != 2 || ids[0] == "" || ids[0] == ids[1] {
+		t.Fatalf("unexpected deliveries %v", ids)
+	}
+
+	left := 0
+	storage.Range(func(entry OutboxEntry) bool {
+		left++
+		return true
+	})
+
+	if left != 0 {
+		t.Fatalf("%d acknowledged entries left in storage", left)
+	}
+}
+
+func TestOutboxTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storage := NewMemoryOutboxStorage()
+	o := NewOutbox(ctx, zap.NewNop(), storage, NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1}), OutboxOptions{RetryInterval: time.Hour, TTL: time.Minute}, nil)
+	if err := o.SendToName("svc", &api.Envelope{Cid: "economy"}); err != nil {
+		t.Fatal(err)
+	}
+
+	o.deliver(time.Now())
+	if o.Pending() != 1 {
+		t.Fatal("envelope dropped before its ttl")
+	}
+
+	o.deliver(time.Now().Add(2 * time.Minute))
+	stored := 0
+	storage.Range(func(entry OutboxEntry) bool {
+		stored++
+		return true
+	})
+
+	if o.Pending() != 0 || stored != 0 {
+		t.Fatal("expired envelope not dropped")
+	}
+
+	if err := o.Send(nil, &api.Envelope{Cid: "economy"}); !errors.Is(err, ErrNodeNotFound) || o.Pending() != 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var disabled *Outbox
+	if err := disabled.SendToName("svc", &api.Envelope{}); !errors.Is(err, ErrOutboxDisabled) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority class of the envelopes the overload controller sheds by
+type Priority int
+
+const (
+	PRIORITY_LOW      Priority = iota // shed first
+	PRIORITY_NORMAL                   // shed when the node is saturated
+	PRIORITY_REALTIME                 // never shed
+	PRIORITY_CONTROL                  // reserved cids, never shed
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PRIORITY_LOW:
+		return "low"
+	case PRIORITY_NORMAL:
+		return "normal"
+	case PRIORITY_REALTIME:
+		return "realtime"
+	case PRIORITY_CONTROL:
+		return "control"
+	}
+	return "unknown"
+}
+
+// ErrOverloaded the envelope was shed because the node is overloaded
+var ErrOverloaded = errors.New("node overloaded")
+
+// overloadInterval interval the pressure of the node is measured at
+const overloadInterval = 100 * time.Millisecond
+
+// overloadLatencyWeight weight of the latency of an interval in the moving average, intervals
+// without inbound envelopes decay it so shedding stops once the node has recovered
+const overloadLatencyWeight = 0.3
+
+// OverloadOptions priorities of the envelopes and the pressures they are shed at
+type OverloadOptions struct {
+	// ShedRoutes cid patterns of the low priority envelopes, matched with path.Match
+	ShedRoutes []string
+
+	// RealtimeRoutes cid patterns of the envelopes never shed, matched with path.Match
+	RealtimeRoutes []string
+
+	// ShedLow pressure in percent from which low priority envelopes are shed, 0 never sheds them
+	ShedLow int
+
+	// ShedNormal pressure in percent from which normal envelopes are shed, 0 never sheds them
+	ShedNormal int
+
+	// Latency handling latency of inbound envelopes counted as a pressure of 100, 0 ignores latency
+	Latency time.Duration
+}
+
+// overloadQueue queue the pressure is measured on
+type overloadQueue struct {
+	name  string
+	depth func() (queued, capacity int)
+}
+
+// OverloadController measures the pressure of the node from the fill of its queues and the
+// handling latency of inbound envelopes, and sheds envelopes by priority once it rises.
+// Control envelopes and realtime routes are never shed
+type OverloadController struct {
+	options      OverloadOptions
+	threshold    int
+	queues       []overloadQueue
+	latency      float64 // guarded by the mutex
+	latencySum   int64
+	latencyCount int64
+	pressure     int64
+	metrics      *Metrics
+	sync.Mutex
+}
+
+// NewOverloadController create overload controller measuring the pressure until ctx is done,
+// it returns nil when no priority is shed
+func NewOverloadController(ctx context.Context, options OverloadOptions, metrics *Metrics) *OverloadController {
+	if options.ShedLow < 1 && options.ShedNormal < 1 {
+		return nil
+	}
+
+	if metrics == nil {
+		metrics = NewMetrics(nil)
+	}
+
+	o := &OverloadController{options: options, threshold: options.ShedLow, metrics: metrics}
+	if o.threshold < 1 || (options.ShedNormal > 0 && options.ShedNormal < o.threshold) {
+		o.threshold = options.ShedNormal
+	}
+	go o.measureLoop(ctx)
+	return o
+}
+
+// newOverloadController create the overload controller of the config measuring the queues of the
+// peers, nil when it sheds nothing
+func newOverloadController(ctx context.Context, config Config, peers Peer, metrics *Metrics) *OverloadController {
+	o := NewOverloadController(ctx, OverloadOptions{
+		ShedRoutes:     config.ShedRoutes,
+		RealtimeRoutes: config.RealtimeRoutes,
+		ShedLow:        config.OverloadShedLow,
+		ShedNormal:     config.OverloadShedNormal,
+		Latency:        time.Duration(config.OverloadLatency) * time.Millisecond,
+	}, metrics)
+
+	if p, ok := peers.(*LocalPeer); ok {
+		o.Watch("peer_async", poolDepth(p.asyncPool))
+	}
+	return o
+}
+
+// poolDepth returns the depth function of the worker pool
+func poolDepth(p interface {
+	Queued() int
+	Capacity() int
+}) func() (int, int) {
+	return func() (int, int) { return p.Queued(), p.Capacity() }
+}
+
+// Watch add the queue to the pressure measurement, depth returns its queued items and capacity
+func (o *OverloadController) Watch(name string, depth func() (queued, capacity int)) {
+	if o == nil {
+		return
+	}
+
+	o.Lock()
+	o.queues = append(o.queues, overloadQueue{name: name, depth: depth})
+	o.Unlock()
+}
+
+// Observe add the handling latency of an inbound envelope to the measurement
+func (o *OverloadController) Observe(d time.Duration) {
+	if o == nil || o.options.Latency <= 0 {
+		return
+	}
+
+	atomic.AddInt64(&o.latencySum, int64(d))
+	atomic.AddInt64(&o.latencyCount, 1)
+}
+
+// Pressure returns the last measured pressure in percent, the fill of the fullest queue or
+// the average latency relative to the target when it is higher
+func (o *OverloadController) Pressure() int {
+	if o == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&o.pressure))
+}
+
+// Priority returns the priority of the cid
+func (o *OverloadController) Priority(cid string) Priority {
+	if strings.HasPrefix(cid, "__") {
+		return PRIORITY_CONTROL
+	}
+
+	if o == nil {
+		return PRIORITY_NORMAL
+	}
+
+	for _, route := range o.options.RealtimeRoutes {
+		if ok, _ := path.Match(route, cid); ok {
+			return PRIORITY_REALTIME
+		}
+	}
+
+	for _, route := range o.options.ShedRoutes {
+		if ok, _ := path.Match(route, cid); ok {
+			return PRIORITY_LOW
+		}
+	}
+	return PRIORITY_NORMAL
+}
+
+// Admit reports whether the envelope of the cid is handled, shed envelopes are counted
+func (o *OverloadController) Admit(cid string) bool {
+	if o == nil {
+		return true
+	}
+
+	pressure := o.Pressure()
+	if pressure < o.threshold {
+		return true
+	}
+
+	priority := o.Priority(cid)
+	normal := o.options.ShedNormal > 0 && pressure >= o.options.ShedNormal
+	switch {
+	case priority == PRIORITY_LOW && (normal || (o.options.ShedLow > 0 && pressure >= o.options.ShedLow)):
+	case priority == PRIORITY_NORMAL && normal:
+	default:
+		return true
+	}
+
+	o.metrics.OverloadShed(priority.String())
+	return false
+}
+
+func (o *OverloadController) measureLoop(ctx context.Context) {
+	t := time.NewTicker(overloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			o.measure()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// measure update the pressure from the queues and the latency
+func (o *OverloadController) measure() {
+	pressure := 0
+	o.Lock()
+	defer o.Unlock()
+	for _, q := range o.queues {
+		queued, capacity := q.depth()
+		if capacity < 1 {
+			continue
+		}
+
+		if p := queued * 100 / capacity; p > pressure {
+			pressure = p
+		}
+	}
+
+	if o.options.Latency > 0 {
+		sum, count := atomic.SwapInt64(&o.latencySum, 0), atomic.SwapInt64(&o.latencyCount, 0)
+		avg := 0.0
+		if count > 0 {
+			avg = float64(sum) / float64(count)
+		}
+
+		if o.latency == 0 {
+			o.latency = avg
+		} else {
+			o.latency = o.latency*(1-overloadLatencyWeight) + avg*overloadLatencyWeight
+		}
+
+		if p := int(o.latency * 100 / float64(o.options.Latency)); p > pressure {
+			pressure = p
+		}
+	}
+
+	atomic.StoreInt64(&o.pressure, int64(pressure))
+	o.metrics.OverloadPressure(pressure)
+}
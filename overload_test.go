@@ -0,0 +1,127 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOverloadAdmit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if o := NewOverloadController(ctx, OverloadOptions{}, nil); o != nil || !o.Admit("any") {
+		t.Fatal("controller without thresholds must admit everything")
+	}
+
+	scope := tally.NewTestScope("", nil)
+	o := NewOverloadController(ctx, OverloadOptions{
+		ShedRoutes:     []string{"stats.*"},
+		RealtimeRoutes: []string{"match.*"},
+		ShedLow:        50,
+		ShedNormal:     90,
+	}, NewMetrics(scope))
+
+	queued := 0
+	o.Watch("test", func() (int, int) { return queued, 100 })
+	cases := []struct {
+		queued   int
+		admitted map[string]bool
+	}{
+		{10, map[string]bool{"stats.a": true, "chat": true, "match.a": true, "__control.x": true}},
+		{60, map[string]bool{"stats.a": false, "chat": true, "match.a": true, "__control.x": true}},
+		{95, map[string]bool{"stats.a": false, "chat": false, "match.a": true, "__control.x": true}},
+	}
+
+	for _, c := range cases {
+		queued = c.queued
+		o.measure()
+		if o.Pressure() != c.queued {
+			t.Fatalf("pressure %d, want %d", o.Pressure(), c.queued)
+		}
+
+		for cid, want := range c.admitted {
+			if got := o.Admit(cid); got != want {
+				t.Fatalf("pressure %d admit %s = %v, want %v", c.queued, cid, got, want)
+			}
+		}
+	}
+
+	snapshot := scope.Snapshot()
+	if counter, ok := snapshot.Counters()["cluster.overload_shed+priority=low"]; !ok || counter.Value() != 2 {
+		t.Fatalf("low shed count %v", snapshot.Counters())
+	}
+
+	if counter, ok := snapshot.Counters()["cluster.overload_shed+priority=normal"]; !ok || counter.Value() != 1 {
+		t.Fatalf("normal shed count %v", snapshot.Counters())
+	}
+
+	if gauge, ok := snapshot.Gauges()["cluster.overload_pressure+"]; !ok || gauge.Value() != 95 {
+		t.Fatalf("pressure gauge %v", snapshot.Gauges())
+	}
+}
+
+func TestOverloadLatency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	o := NewOverloadController(ctx, OverloadOptions{ShedNormal: 100, Latency: 10 * time.Millisecond}, nil)
+	o.Observe(20 * time.Millisecond)
+	o.Observe(30 * time.Millisecond)
+	o.measure()
+	if o.Pressure() != 250 || o.Admit("chat") {
+		t.Fatalf("pressure %d must shed", o.Pressure())
+	}
+
+	// without inbound envelopes the latency decays until the node recovers
+	for i := 0; i < 10; i++ {
+		o.measure()
+	}
+
+	if o.Pressure() >= 100 || !o.Admit("chat") {
+		t.Fatalf("pressure %d did not decay", o.Pressure())
+	}
+}
+
+func TestOverloadServerCall(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, func(c *Config) {
+		c.OverloadShedNormal = 80
+		c.RealtimeRoutes = []string{"match.*"}
+	})
+	server.OnDelegate(echoServerDelegate{})
+
+	server.overload.Watch("test", func() (int, int) { return 9, 10 })
+	server.overload.measure()
+	if _, err := server.Call(ctx, &api.Envelope{Cid: "chat"}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("normal envelope not shed %v", err)
+	}
+
+	if _, err := server.Call(ctx, &api.Envelope{Cid: "match.join"}); err != nil {
+		t.Fatalf("realtime envelope shed %v", err)
+	}
+
+	// a shed stream request is ended with the error instead of leaving the caller waiting
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1})
+	peer.Sync(server.GetMeta())
+	ch, err := peer.SendStreamRequest(ctx, "client1", server.GetMeta(), &api.Envelope{Cid: "chat"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out, ok := <-ch; !ok || out.GetError().GetCode() != api.Error_RESOURCE_EXHAUSTED {
+		t.Fatalf("shed stream request not answered %v", out)
+	}
+
+	if _, ok := <-ch; ok {
+		t.Fatal("shed stream request not ended")
+	}
+}
@@ -0,0 +1,68 @@
+package nakamacluster
+
+import (
+	"context"
+	"runtime/debug"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+// delegate callbacks guarded against panics
+const (
+	DELEGATE_CALL       = "call"
+	DELEGATE_STREAM     = "stream"
+	DELEGATE_NOTIFY_MSG = "notify_msg"
+)
+
+// recoverDelegate turn a panic of the delegate callback into an INTERNAL error in err, the
+// stack is logged and the panic counted so a bad handler does not crash the node
+func recoverDelegate(logger *zap.Logger, metrics *Metrics, callback, cid string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	logger.Error("Delegate panic recovered",
+		zap.String("callback", callback),
+		zap.String("cid", cid),
+		zap.Any("panic", r),
+		zap.ByteString("stack", debug.Stack()))
+	metrics.DelegatePanic(callback)
+	*err = api.Errorf(api.Error_INTERNAL, "%s %s panicked: %v", callback, cid, r)
+}
+
+// callDelegate run the Call of the delegate, a panic is returned as INTERNAL error
+func (s *Server) callDelegate(ctx context.Context, fn ServerDelegate, in *api.Envelope) (out *api.Envelope, err error) {
+	ctx, done := s.watchdog.watch(ctx, DELEGATE_CALL, in.Cid)
+	defer done()
+	defer recoverDelegate(s.logger, s.metrics, DELEGATE_CALL, in.Cid, &err)
+	return fn.Call(ctx, in)
+}
+
+// streamDelegate run the Stream of the delegate, a panic is replied to the client as INTERNAL
+// error and keeps the stream open
+func (s *Server) streamDelegate(ctx context.Context, fn ServerDelegate, reply func(out *api.Envelope) bool, in *api.Envelope) error {
+	ctx, done := s.watchdog.watch(ctx, DELEGATE_STREAM, in.Cid)
+	defer done()
+
+	var panicked error
+	err := func() (err error) {
+		defer recoverDelegate(s.logger, s.metrics, DELEGATE_STREAM, in.Cid, &panicked)
+		return fn.Stream(ctx, reply, in)
+	}()
+
+	if panicked != nil {
+		reply(&api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Error{Error: api.AsError(panicked)}})
+		return nil
+	}
+	return err
+}
+
+// notifyDelegate run the NotifyMsg of the delegate, a panic is returned as INTERNAL error
+func (s *Client) notifyDelegate(fn Delegate, node string, in *api.Envelope) (out *api.Envelope, err error) {
+	_, done := s.watchdog.watch(s.ctx, DELEGATE_NOTIFY_MSG, in.GetCid())
+	defer done()
+	defer recoverDelegate(s.logger, s.metrics, DELEGATE_NOTIFY_MSG, in.GetCid(), &err)
+	return fn.NotifyMsg(node, in)
+}
@@ -0,0 +1,76 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+// panicServerDelegate panics on the panic cid and echoes every other envelope
+type panicServerDelegate struct {
+	echoServerDelegate
+}
+
+func (panicServerDelegate) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+	if in.Cid == "panic" {
+		panic("bad handler")
+	}
+	return in, nil
+}
+
+func (panicServerDelegate) Stream(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error {
+	if in.Cid == "panic" {
+		var m map[string]string
+		m["x"] = "nil map"
+	}
+	client(in)
+	return nil
+}
+
+func TestDelegatePanicRecovered(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	scope := tally.NewTestScope("", nil)
+	server := newTestServer(t, nil, WithMetricsScope(scope))
+	server.OnDelegate(panicServerDelegate{})
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	if _, err := peer.Send(ctx, node, &api.Envelope{Cid: "panic"}); !api.IsCode(err, api.Error_INTERNAL) {
+		t.Fatalf("unexpected call error %v", err)
+	}
+
+	if _, err := peer.Send(ctx, node, &api.Envelope{Cid: "echo"}); err != nil {
+		t.Fatalf("server not serving after panic %v", err)
+	}
+
+	for _, cid := range []string{"panic", "echo"} {
+		ch, err := peer.SendStreamRequest(ctx, "client1", node, &api.Envelope{Cid: cid}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case out := <-ch:
+			if got := out.GetError().GetCode(); (cid == "panic") != (got == api.Error_INTERNAL) {
+				t.Fatalf("%s stream reply %v", cid, out)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no %s stream reply", cid)
+		}
+	}
+
+	counters := scope.Snapshot().Counters()
+	for _, key := range []string{"cluster.delegate_panics+callback=call", "cluster.delegate_panics+callback=stream"} {
+		if counter, ok := counters[key]; !ok || counter.Value() != 1 {
+			t.Fatalf("%s not counted %v", key, counters)
+		}
+	}
+}
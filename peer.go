@@ -2,14 +2,20 @@ package nakamacluster
 
 import (
 	"context"
-	"strconv"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/doublemo/nakama-cluster/api"
-	"github.com/serialx/hashring"
-	"github.com/shimingyah/pool"
+	"github.com/gofrs/uuid"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
 )
 
 type Peer interface {
@@ -17,59 +23,249 @@ type Peer interface {
 	GetByName(name string) []*Meta
 	All() []*Meta
 	AllToMap() map[string]*Meta
+	Range(fn func(node *Meta) bool)
 	Size() int
 	SizeByName(name string) int
 	Send(ctx context.Context, node *Meta, in *api.Envelope) (*api.Envelope, error)
+	SendAsync(ctx context.Context, node *Meta, in *api.Envelope, callback func(out *api.Envelope, err error)) error
+	SendToName(ctx context.Context, name string, in *api.Envelope, opts ...SendOption) (*api.Envelope, *Meta, error)
 	SendStream(ctx context.Context, clientId string, node *Meta, in *api.Envelope, md metadata.MD) (created bool, ch chan *api.Envelope, err error)
+	SendStreamRequest(ctx context.Context, clientId string, node *Meta, in *api.Envelope, md metadata.MD) (<-chan *api.Envelope, error)
 	GetWithHashRing(name, k string) (*Meta, bool)
+	Assign(name string, keys []string) map[string][]string
+	Query(selector string) ([]*Meta, error)
+	Snapshot() *Snapshot
+	RoutingTable() *RoutingTable
+	Link(id string) (PeerLink, bool)
+	RTT(id string) (time.Duration, bool)
+	ClockOffset(id string) (time.Duration, bool)
 	Sync(nodes ...*Meta)
+	Refresh(ctx context.Context) (*RefreshReport, error)
 	Update(id string, status MetaStatus)
+	Merge(node *Meta) bool
+	Quarantine(id string, d time.Duration) error
+	Cordoned(id string) bool
+	OpenStickyStream(ctx context.Context, name, key string, md metadata.MD, onRepin func(from, to *Meta)) (*StickyStream, error)
+	StreamStats(prefix string) []StreamStats
 	Delete(id string)
 	Reset()
 }
 
 type PeerOptions struct {
-	// Maximum number of idle connections in the pool.
-	MaxIdle int
+	// Connections number of connections to every node the calls are spread over, default 1
+	Connections int
 
-	// Maximum number of connections allocated by the pool at a given time.
-	// When zero, there is no limit on the number of connections in the pool.
-	MaxActive int
+	// DialTimeout time a connection may take to become ready, default DefaultDialTimeout
+	DialTimeout time.Duration
 
-	// MaxConcurrentStreams limit on the number of concurrent streams to each single connection
-	MaxConcurrentStreams int
+	// TLS secures the connections to the nodes when set
+	TLS *tls.Config
 
-	// If Reuse is true and the pool is at the MaxActive limit, then Get() reuse
-	// the connection to return, If Reuse is false and the pool is at the MaxActive limit,
-	// create a one-time connection to return.
-	Reuse bool
+	// Dialer dials the connections to the nodes instead of plain tcp when set, like through
+	// a SOCKS5 or corporate proxy, addr is the address of the node
+	Dialer func(ctx context.Context, addr string) (net.Conn, error)
+
+	// DialOptions extra options of the connections to the nodes, applied after the defaults
+	DialOptions []grpc.DialOption
 
 	MessageQueueSize int
+
+	// MaxStreamMessageSize stream messages larger than it are sent in chunks
+	MaxStreamMessageSize int
+
+	// ChunkTimeout is the timeout for receiving every chunk of a large message
+	ChunkTimeout time.Duration
+
+	// ChunkMaxTotal and ChunkMaxBytes limit the chunks of a large message and the bytes of
+	// the incomplete messages of a node, 0 uses the defaults
+	ChunkMaxTotal int
+	ChunkMaxBytes int
+
+	// AsyncWorkers maximum number of concurrent SendAsync calls
+	AsyncWorkers int
+
+	// AsyncQueueSize number of SendAsync calls waiting for a worker
+	AsyncQueueSize int
+
+	// Timeout is applied to Send when the context has no deadline
+	Timeout time.Duration
+
+	// ResolveInterval interval for re-resolving node addresses registered as dns names
+	ResolveInterval time.Duration
+
+	// Namespace only nodes of the namespace are tracked
+	Namespace string
+
+	// Journal records the envelopes sent by Send when set
+	Journal *Journal
+
+	// Events receives node join, leave and update events when set
+	Events *EventBus
+
+	// Kafka publishes the envelopes sent by Send when set
+	Kafka *KafkaSink
+
+	// Traces records the envelopes sent by Send and over streams when set
+	Traces *TraceBuffer
+
+	// LocalMeta returns the local node announced to called peers
+	LocalMeta func() *Meta
+
+	// Source reads the authoritative list of nodes for Refresh, Client and Server read it from sd
+	Source func() ([]*Meta, error)
+
+	// Strategy picks the node of SendToName, default round robin, Strategies overrides it per service name
+	Strategy   Strategy
+	Strategies map[string]Strategy
+
+	// Throttle limits the bytes sent to every node when set
+	Throttle *Throttle
+
+	// StreamIdleTimeout closes streams without messages sent or received for it, 0 disables it
+	StreamIdleTimeout time.Duration
+
+	// StreamTTL closes streams older than it, 0 disables it
+	StreamTTL time.Duration
+
+	// StreamStatsRetention keeps the StreamStats of a client id without open streams for it,
+	// 0 forgets them once its last stream closed
+	StreamStatsRetention time.Duration
+
+	// HeartbeatInterval interval of the pings measuring the rtt to connected nodes, 0 disables them
+	HeartbeatInterval time.Duration
+
+	// HeartbeatQuarantine quarantines nodes whose link degraded for it, for clusters without
+	// gossip detecting dead nodes. 0 keeps routing to degraded nodes
+	HeartbeatQuarantine time.Duration
+
+	// PoolLeakThreshold logs the call sites holding a pooled connection longer than it, 0 disables it
+	PoolLeakThreshold time.Duration
+
+	// Compression name of the registered grpc compressor of the calls, empty sends them uncompressed.
+	// Requests smaller than CompressionMinSize bytes are not compressed, WithCallCompression
+	// overrides both per call
+	Compression        string
+	CompressionMinSize int
+
+	// StreamCoalesceLinger time the sends on a stream wait to be written together with the
+	// next ones, streams to nodes not unpacking batches and 0 write every send at once
+	StreamCoalesceLinger time.Duration
+
+	// Ring hash function and virtual nodes of the rings, Rings overrides it per service name
+	// and per var name of RingVars
+	Ring  RingOptions
+	Rings map[string]RingOptions
+
+	// RingVars names of the vars nodes are also placed on a ring per value of, like region or
+	// match_pool. The ring of a value is looked up with GetWithHashRing(RingName(var, value), k)
+	RingVars []string
+
+	// KeyMappers transform the keys of GetWithHashRing per ring name before the lookup
+	KeyMappers map[string]KeyMapper
+
+	// Services overrides the connection budgets, queue sizes and timeouts per service name
+	Services map[string]PeerServiceOptions
+
+	// FlapThreshold quarantines nodes joining or leaving more than it within FlapWindow
+	// for FlapCooldown, 0 disables flap detection
+	FlapThreshold int
+	FlapWindow    time.Duration
+	FlapCooldown  time.Duration
+
+	Metrics *Metrics
+}
+
+// PeerServiceOptions overrides of the PeerOptions for the nodes of a service, zero values
+// keep the value of the PeerOptions
+type PeerServiceOptions struct {
+	Connections          int
+	DialTimeout          time.Duration
+	MessageQueueSize     int
+	MaxStreamMessageSize int
+	Timeout              time.Duration
+	StreamIdleTimeout    time.Duration
+	StreamTTL            time.Duration
+	StreamCoalesceLinger time.Duration
+}
+
+// apply returns a copy of the options with the overrides of the service
+func (o PeerServiceOptions) apply(options PeerOptions) *PeerOptions {
+	if o.Connections > 0 {
+		options.Connections = o.Connections
+	}
+
+	if o.DialTimeout > 0 {
+		options.DialTimeout = o.DialTimeout
+	}
+
+	if o.MessageQueueSize > 0 {
+		options.MessageQueueSize = o.MessageQueueSize
+	}
+
+	if o.MaxStreamMessageSize > 0 {
+		options.MaxStreamMessageSize = o.MaxStreamMessageSize
+	}
+
+	if o.Timeout > 0 {
+		options.Timeout = o.Timeout
+	}
+
+	if o.StreamIdleTimeout > 0 {
+		options.StreamIdleTimeout = o.StreamIdleTimeout
+	}
+
+	if o.StreamTTL > 0 {
+		options.StreamTTL = o.StreamTTL
+	}
+
+	if o.StreamCoalesceLinger > 0 {
+		options.StreamCoalesceLinger = o.StreamCoalesceLinger
+	}
+	return &options
 }
 
+// streamContext parent context of the streams to a node, refs counts the open streams
 type streamContext struct {
 	ctx    context.Context
 	cancel context.CancelFunc
+	refs   int64
 }
 
 type LocalPeer struct {
 	ctx                context.Context
 	ctxCancelFn        context.CancelFunc
-	nodes              map[string]*Meta
-	nodesByName        map[string]int
-	rings              map[string]*hashring.HashRing
+	current            atomic.Value
+	viewChanged        chan struct{}
+	viewMu             sync.Mutex
 	grpcPool           sync.Map
 	grpcStreams        sync.Map
 	grpcStreamCancelFn sync.Map
+	streamsMu          sync.Mutex
+	streamOpens        sync.Map
+	resolved           sync.Map
+	resolveAt          map[string]time.Time
+	resolveMu          sync.Mutex
+	links              sync.Map
+	cordons            atomic.Value
+	chunks             *ChunkBuffer
+	flaps              *flapDetector
+	defaultRing        ringBuilder
+	ringBuilders       map[string]ringBuilder
+	services           map[string]*PeerOptions
+	asyncPool          *WorkerPool
+	streamsStalled     int64
+	streamStats        sync.Map
+	streamStatsMu      sync.Mutex
 	options            *PeerOptions
 	logger             *zap.Logger
-	sync.RWMutex
+	clock              clock
+
+	// serializes the writers of the view
+	sync.Mutex
 }
 
 func (peer *LocalPeer) Get(id string) (*Meta, bool) {
-	peer.RLock()
-	defer peer.RUnlock()
-	node, ok := peer.nodes[id]
+	node, ok := peer.view().nodes[id]
 	if !ok {
 		return nil, false
 	}
@@ -77,148 +273,429 @@ func (peer *LocalPeer) Get(id string) (*Meta, bool) {
 }
 
 func (peer *LocalPeer) GetByName(name string) []*Meta {
-	nodes := make([]*Meta, 0)
-	size := peer.SizeByName(name)
-	if size < 1 {
-		return nodes
-	}
-	var n string
-	peer.RLock()
-	for _, node := range peer.nodes {
-		n = node.Name
-		peer.RUnlock()
-		if n == name {
-			nodes = append(nodes, node.Clone())
-		}
-		peer.RLock()
+	byName := peer.view().byName[name]
+	nodes := make([]*Meta, len(byName))
+	for i, node := range byName {
+		nodes[i] = node.Clone()
 	}
-	peer.RUnlock()
 	return nodes
 }
 
 func (peer *LocalPeer) All() []*Meta {
-	len := peer.Size()
-	nodes := make([]*Meta, len)
-
-	i := 0
-	peer.RLock()
-	for _, v := range peer.nodes {
-		peer.RUnlock()
-		nodes[i] = v.Clone()
-		i++
-		peer.RLock()
-	}
-	peer.RUnlock()
+	v := peer.view()
+	nodes := make([]*Meta, 0, len(v.nodes))
+	for _, node := range v.nodes {
+		nodes = append(nodes, node.Clone())
+	}
 	return nodes
 }
 
 func (peer *LocalPeer) AllToMap() map[string]*Meta {
-	nodes := make(map[string]*Meta)
-	peer.RLock()
-	for k, v := range peer.nodes {
-		peer.RUnlock()
-		nodes[k] = v.Clone()
-		peer.RLock()
-	}
-	peer.RUnlock()
+	v := peer.view()
+	nodes := make(map[string]*Meta, len(v.nodes))
+	for k, node := range v.nodes {
+		nodes[k] = node.Clone()
+	}
 	return nodes
 }
 
+// Query returns the nodes whose labels match the label selector
+func (peer *LocalPeer) Query(selector string) ([]*Meta, error) {
+	s, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*Meta, 0)
+	for _, node := range peer.view().nodes {
+		if s.Matches(node.Labels) {
+			nodes = append(nodes, node.Clone())
+		}
+	}
+	return nodes, nil
+}
+
 func (peer *LocalPeer) Size() int {
-	peer.RLock()
-	defer peer.RUnlock()
-	return len(peer.nodes)
+	return len(peer.view().nodes)
 }
 
 func (peer *LocalPeer) SizeByName(name string) int {
-	peer.RLock()
-	defer peer.RUnlock()
-	return peer.nodesByName[name]
+	return len(peer.view().byName[name])
+}
+
+// Range calls fn for every node of the current view until fn returns false,
+// the nodes are shared with the view and must not be modified
+func (peer *LocalPeer) Range(fn func(node *Meta) bool) {
+	for _, node := range peer.view().nodes {
+		if !fn(node) {
+			return
+		}
+	}
 }
 
 func (peer *LocalPeer) Send(ctx context.Context, node *Meta, in *api.Envelope) (*api.Envelope, error) {
-	p, err := peer.makeGrpcPool(node.Id, node.Addr)
-	if err != nil {
-		return nil, err
+	if peer.flaps.quarantined(node.Id, peer.clock.Now()) {
+		return nil, ErrNodeQuarantined
 	}
 
-	conn, err := p.Get()
+	if timeout := peer.serviceOptions(node.Name).Timeout; timeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+
+	conn, err := peer.makeGrpcPool(node).Get(ctx)
 	if err != nil {
+		peer.resolveOnError(node, err)
 		return nil, err
 	}
 
 	defer conn.Close()
+
+	if err := downgradeEnvelope(in, node.ProtocolVersion); err != nil {
+		return nil, err
+	}
+
+	if err := peer.options.Journal.Record(node.Id, in); err != nil {
+		peer.logger.Warn("Failed record message to journal", zap.Error(err))
+	}
+	peer.options.Kafka.PublishEnvelope(node.Id, in)
+	peer.options.Traces.Record(TRACE_OUT, TRACE_GRPC, node.Id, in)
+	if err := peer.throttle(ctx, node.Id, proto.Size(in)); err != nil {
+		return nil, err
+	}
+
 	client := api.NewApiServerClient(conn.Value())
-	return client.Call(ctx, in)
+	out, err := client.Call(peer.outgoingContext(ctx), in)
+	peer.resolveOnError(node, err)
+	return out, err
+}
+
+// SendAsync send the envelope on the async worker pool and invoke the callback with the reply,
+// it returns ErrMessageQueueFull without blocking when the queue is full
+func (peer *LocalPeer) SendAsync(ctx context.Context, node *Meta, in *api.Envelope, callback func(out *api.Envelope, err error)) error {
+	ok := peer.asyncPool.TrySubmit(func() {
+		out, err := peer.Send(ctx, node, in)
+		if callback != nil {
+			callback(out, err)
+		}
+	})
+
+	if !ok {
+		return ErrMessageQueueFull
+	}
+	return nil
 }
 
 func (peer *LocalPeer) SendStream(ctx context.Context, clientId string, node *Meta, in *api.Envelope, md metadata.MD) (created bool, ch chan *api.Envelope, err error) {
 	stream, ok := peer.grpcStreams.Load(clientId)
 	if ok && stream != nil {
-		err = stream.(api.ApiServer_StreamClient).Send(in)
+		err = peer.sendStream(ctx, stream.(*peerStream), in)
 		return
 	}
 
-	p, err := peer.makeGrpcPool(node.Id, node.Addr)
+	ps, ch, err := peer.openStream(ctx, clientId, node, md, false)
 	if err != nil {
 		return false, nil, err
 	}
+	return true, ch, peer.sendStream(ctx, ps, in)
+}
 
-	conn, err := p.Get()
+// SendStreamRequest send the envelope on the stream of the client and returns the channel
+// receiving the replies carrying its id, the channel is closed after the STREAM_CID_END reply,
+// when ctx is done or when the stream ends. Streams opened by it drop messages that answer no request.
+func (peer *LocalPeer) SendStreamRequest(ctx context.Context, clientId string, node *Meta, in *api.Envelope, md metadata.MD) (<-chan *api.Envelope, error) {
+	ps, err := peer.requestStream(ctx, clientId, node, md)
 	if err != nil {
-		return false, nil, err
+		return nil, err
+	}
+
+	if in.Id == "" {
+		in.Id = uuid.Must(uuid.NewV4()).String()
+	}
+
+	id := in.Id
+	ch, done := ps.register(id, peer.serviceOptions(ps.service).MessageQueueSize)
+	if err := peer.sendStream(ctx, ps, in); err != nil {
+		ps.unregister(id)
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-ps.stream.Context().Done():
+		case <-done:
+			return
+		}
+		ps.unregister(id)
+	}()
+	return ch, nil
+}
+
+// streamOpen stream of a client being opened for stream requests, done is closed once it opened
+type streamOpen struct {
+	done chan struct{}
+	ps   *peerStream
+	err  error
+}
+
+// requestStream returns the stream of the client, concurrent requests of a client without
+// a stream wait for the first of them to open it instead of opening one each
+func (peer *LocalPeer) requestStream(ctx context.Context, clientId string, node *Meta, md metadata.MD) (*peerStream, error) {
+	if stream, ok := peer.grpcStreams.Load(clientId); ok && stream != nil {
+		return stream.(*peerStream), nil
+	}
+
+	open := &streamOpen{done: make(chan struct{})}
+	if v, loaded := peer.streamOpens.LoadOrStore(clientId, open); loaded {
+		open = v.(*streamOpen)
+		select {
+		case <-open.done:
+			return open.ps, open.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	defer func() {
+		peer.streamOpens.Delete(clientId)
+		close(open.done)
+	}()
+
+	// opened meanwhile by a request that finished before this one stored its open
+	if stream, ok := peer.grpcStreams.Load(clientId); ok && stream != nil {
+		open.ps = stream.(*peerStream)
+		return open.ps, nil
+	}
+
+	// the stream is shared by later requests, it must not end with the ctx of this one
+	open.ps, _, open.err = peer.openStream(peer.ctx, clientId, node, md, true)
+	return open.ps, open.err
+}
+
+// openStream open the stream of the client, replies to stream requests are dispatched
+// by envelope id and other messages are written to ch, or dropped when dropUnmatched
+func (peer *LocalPeer) openStream(ctx context.Context, clientId string, node *Meta, md metadata.MD, dropUnmatched bool) (*peerStream, chan *api.Envelope, error) {
+	if peer.flaps.quarantined(node.Id, peer.clock.Now()) {
+		return nil, nil, ErrNodeQuarantined
+	}
+
+	conn, err := peer.makeGrpcPool(node).Get(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	defer conn.Close()
 
 	client := api.NewApiServerClient(conn.Value())
-	ctxStream, ok := peer.grpcStreamCancelFn.Load(node.Id)
-	if ok {
-		ctxS := ctxStream.(*streamContext)
-		ctx = ctxS.ctx
-	} else {
+	peer.streamsMu.Lock()
+	ctxS, ok := peer.grpcStreamCancelFn.Load(node.Id)
+	if !ok {
 		ctxM, cancel := context.WithCancel(ctx)
-		ctx = ctxM
-		peer.grpcStreamCancelFn.Store(node.Id, &streamContext{ctx: ctxM, cancel: cancel})
+		ctxS = &streamContext{ctx: ctxM, cancel: cancel}
+		peer.grpcStreamCancelFn.Store(node.Id, ctxS)
+	}
+	sc := ctxS.(*streamContext)
+	atomic.AddInt64(&sc.refs, 1)
+	peer.streamsMu.Unlock()
+
+	ctx, cancel := context.WithCancel(sc.ctx)
+	ctx = peer.outgoingContext(metadata.NewOutgoingContext(ctx, md))
+	linger := peer.serviceOptions(node.Name).StreamCoalesceLinger
+	if linger > 0 {
+		ctx = withStreamBatch(ctx)
 	}
 
-	ctx = metadata.NewOutgoingContext(ctx, md)
 	s, err := client.Stream(ctx)
 	if err != nil {
-		return false, nil, err
+		cancel()
+		atomic.AddInt64(&sc.refs, -1)
+		return nil, nil, err
 	}
 
-	ch = make(chan *api.Envelope, peer.options.MessageQueueSize)
+	ps := newPeerStream(node.Id, s, cancel, &peer.streamsStalled, peer.options.Metrics)
+	ps.service = node.Name
+	ps.version = node.ProtocolVersion
+	ps.stats = peer.streamOpened(clientId, node)
+	ch := make(chan *api.Envelope, peer.serviceOptions(node.Name).MessageQueueSize)
 	go func() {
 		defer func() {
 			close(ch)
-			peer.grpcStreams.Delete(clientId)
+			ps.closePending()
+			ps.close()
+			atomic.AddInt64(&sc.refs, -1)
+			peer.streamClosed(clientId, ps.stats)
+			// the client may have opened a new stream after this one was reaped
+			if v, ok := peer.grpcStreams.Load(clientId); ok && v == ps {
+				peer.grpcStreams.Delete(clientId)
+			}
 		}()
 
-		out, err := s.Recv()
-		if err != nil {
-			peer.logger.Warn("recv message error", zap.Error(err))
-			return
+		// sends are coalesced once the server announced it unpacks them
+		if linger > 0 {
+			if header, err := s.Header(); err == nil && streamBatchAccepted(header) {
+				ps.coalesce(linger, peer.serviceOptions(node.Name).MaxStreamMessageSize)
+			}
 		}
 
-		select {
-		case ch <- out:
-		case <-ctx.Done():
-			s.CloseSend()
-			return
-		default:
+		receive := func(envelope *api.Envelope) bool {
+			if window := envelope.GetWindow(); window != nil {
+				ps.grant(window.Credits)
+				return true
+			}
+
+			// the stream is not reused once the node drains, the next send opens a new one
+			if envelope.Cid == STREAM_CID_REDIRECT {
+				if v, ok := peer.grpcStreams.Load(clientId); ok && v == ps {
+					peer.grpcStreams.Delete(clientId)
+				}
+				peer.logger.Info("Stream redirected", zap.String("node", node.Id), zap.String("successor", envelope.Vars[STREAM_VAR_NODE]))
+			}
+
+			if ok, err := ps.dispatch(envelope); ok {
+				if err != nil {
+					peer.logger.Warn("Failed dispatch stream reply", zap.Error(err), zap.String("id", envelope.Id))
+				}
+				return true
+			}
+
+			if dropUnmatched {
+				peer.logger.Debug("Dropped stream message without request", zap.String("cid", envelope.Cid))
+				return true
+			}
+
+			select {
+			case ch <- envelope:
+			case <-ctx.Done():
+				s.CloseSend()
+				return false
+			}
+			return true
+		}
+
+		for {
+			out, err := s.Recv()
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					ps.stats.failed()
+				}
+				peer.logger.Warn("recv message error", zap.Error(err))
+				return
+			}
+
+			ps.touch()
+
+			size := proto.Size(out)
+			envelope, ok, err := peer.chunks.AddEnvelope(clientId, out)
+			if err != nil {
+				ps.stats.failed()
+				peer.logger.Warn("recv chunk error", zap.Error(err))
+				continue
+			}
+
+			if !ok {
+				ps.stats.received(0, size)
+				continue
+			}
+
+			envelopes := unbatch(envelope)
+			messages := 0
+			for _, envelope := range envelopes {
+				if envelope.GetWindow() == nil {
+					messages++
+				}
+			}
+			ps.stats.received(messages, size)
+
+			for _, envelope := range envelopes {
+				if !receive(envelope) {
+					return
+				}
+			}
 		}
 	}()
 
 	// store the client
-	peer.grpcStreams.Store(clientId, s)
-	return true, ch, s.Send(in)
+	peer.grpcStreams.Store(clientId, ps)
+	return ps, ch, nil
+}
+
+func (peer *LocalPeer) sendStream(ctx context.Context, s *peerStream, in *api.Envelope) error {
+	if err := downgradeEnvelope(in, s.version); err != nil {
+		return err
+	}
+
+	// nodes older than chunk frames are sent whole messages
+	maxSize := peer.serviceOptions(s.service).MaxStreamMessageSize
+	if negotiateProtocol(s.version) < protocolVersionStreams {
+		maxSize = 0
+	}
+
+	peer.options.Traces.Record(TRACE_OUT, TRACE_STREAM, s.node, in)
+	envelopes, err := SplitEnvelope(in, maxSize)
+	if err != nil {
+		return err
+	}
+
+	if len(envelopes) > 1 {
+		defer func() {
+			for _, envelope := range envelopes {
+				api.ReleaseEnvelope(envelope)
+			}
+		}()
+	}
+
+	size := 0
+	for _, envelope := range envelopes {
+		n := proto.Size(envelope)
+		if err := peer.throttle(ctx, s.node, n); err != nil {
+			return err
+		}
+
+		if err := s.Send(ctx, envelope); err != nil {
+			s.stats.failed()
+			return err
+		}
+		size += n
+	}
+
+	s.stats.sent(size)
+	return nil
 }
 
+// throttle wait until n bytes may be sent to the node
+func (peer *LocalPeer) throttle(ctx context.Context, node string, n int) error {
+	d, err := peer.options.Throttle.Wait(ctx, node, n)
+	if d > 0 {
+		peer.options.Metrics.EgressThrottled(d)
+	}
+	return err
+}
+
+func (peer *LocalPeer) outgoingContext(ctx context.Context) context.Context {
+	var local *Meta
+	if peer.options.LocalMeta != nil {
+		local = peer.options.LocalMeta()
+	}
+	return outgoingCallerContext(ctx, local)
+}
+
+// GetWithHashRing returns the node of the ring of the name owning the key, the key is
+// passed through the key mapper of the name first
 func (peer *LocalPeer) GetWithHashRing(name, k string) (*Meta, bool) {
-	peer.RLock()
-	defer peer.RUnlock()
-	ring, ok := peer.rings[name]
+	if mapper, ok := peer.options.KeyMappers[name]; ok {
+		k = mapper(k)
+	}
+	return peer.ringOwner(name, k)
+}
+
+// ringOwner returns the node of the ring of the name owning the key as it is
+func (peer *LocalPeer) ringOwner(name, k string) (*Meta, bool) {
+	v := peer.view()
+	ring, ok := v.rings[name]
 	if !ok {
 		return nil, false
 	}
@@ -227,7 +704,7 @@ func (peer *LocalPeer) GetWithHashRing(name, k string) (*Meta, bool) {
 	if !ok {
 		return nil, false
 	}
-	node, ok := peer.nodes[id]
+	node, ok := v.nodes[id]
 	if !ok {
 		return nil, false
 	}
@@ -235,62 +712,162 @@ func (peer *LocalPeer) GetWithHashRing(name, k string) (*Meta, bool) {
 	return node, true
 }
 
+// Assign group the keys by the id of the node of the ring of the name owning them, like
+// GetWithHashRing for every key but from a single view so a topology change cannot split the batch.
+// The keys of a node keep their order, keys without an owner are left out
+func (peer *LocalPeer) Assign(name string, keys []string) map[string][]string {
+	assigned := make(map[string][]string)
+	v := peer.view()
+	ring, ok := v.rings[name]
+	if !ok {
+		return assigned
+	}
+
+	mapper := peer.options.KeyMappers[name]
+	for _, key := range keys {
+		k := key
+		if mapper != nil {
+			k = mapper(k)
+		}
+
+		if id, ok := ring.GetNode(k); ok {
+			if _, ok := v.nodes[id]; ok {
+				assigned[id] = append(assigned[id], key)
+			}
+		}
+	}
+	return assigned
+}
+
 func (peer *LocalPeer) Sync(nodes ...*Meta) {
-	nodeMap := make(map[string]bool, len(nodes))
-	newNodes := make(map[string]*Meta, len(nodes))
-	newRings := make(map[string]*hashring.HashRing)
-	newNodesByName := make(map[string]int)
-	var weight int
+	peer.sync(nodes)
+}
+
+// sync replace the view with the nodes and returns the events of the differences
+func (peer *LocalPeer) sync(nodes []*Meta) []Event {
+	// the view is read and replaced under the lock of Merge and Update so none of their
+	// changes lands between the two
+	peer.Lock()
+	v := newPeerView()
+	current := peer.view()
+	now := peer.clock.Now()
 	for _, node := range nodes {
-		newNodes[node.Id] = node
-		nodeMap[node.Id] = true
-		weight = 1
-		if v, ok := node.Vars["weight"]; ok {
-			weight, _ = strconv.Atoi(v)
-			if weight < 1 {
-				weight = 1
-			}
+		if node.Namespace != peer.options.Namespace {
+			continue
+		}
+
+		// a stale read must not undo a newer update of the node
+		if cur, ok := current.nodes[node.Id]; ok && cur.Newer(node) {
+			node = cur
 		}
 
-		if _, ok := newRings[node.Name]; !ok {
-			newRings[node.Name] = hashring.NewWithWeights(map[string]int{node.Id: weight})
-		} else {
-			newRings[node.Name] = newRings[node.Name].AddWeightedNode(node.Id, weight)
+		if prev, ok := v.nodes[node.Id]; ok {
+			v.delete(prev)
+			peer.removeFromRing(v.rings, prev)
 		}
-		newNodesByName[node.Name]++
+
+		v.nodes[node.Id] = node
+		v.byName[node.Name] = append(v.byName[node.Name], node)
+		if !peer.routable(node, now) {
+			continue
+		}
+		peer.addToRing(v.rings, node)
+	}
+
+	events := diffNodes(current.nodes, v.nodes)
+	quarantined := make([]*Meta, 0)
+	for _, e := range events {
+		if (e.Type != EVENT_NODE_JOIN && e.Type != EVENT_NODE_LEAVE) || !peer.flaps.record(e.Node.Id, now) {
+			continue
+		}
+
+		quarantined = append(quarantined, e.Node)
+		peer.removeFromRing(v.rings, e.Node)
+	}
+
+	peer.storeView(v)
+	peer.Unlock()
+
+	for _, e := range events {
+		if e.Type == EVENT_NODE_LEAVE {
+			peer.closeNode(e.Node.Id)
+		}
+		peer.options.Events.Publish(e)
+	}
+
+	for _, node := range quarantined {
+		peer.logger.Warn("Quarantined flapping node", zap.String("node", node.Id), zap.Duration("cooldown", peer.flaps.cooldown))
+		peer.quarantine(node, peer.flaps.cooldown)
 	}
+	peer.flaps.forget(now)
+	return events
+}
 
+// Quarantine stop routing to the node and close its connections for d, like a flapping node
+func (peer *LocalPeer) Quarantine(id string, d time.Duration) error {
 	peer.Lock()
-	for k := range peer.nodes {
+	node, ok := peer.view().nodes[id]
+	if !ok {
 		peer.Unlock()
-		if !nodeMap[k] {
-			if m, ok := peer.grpcPool.Load(k); ok && m != nil {
-				m.(pool.Pool).Close()
-				peer.grpcPool.Delete(k)
-			}
+		return fmt.Errorf("node %s %w", id, ErrNodeNotFound)
+	}
 
-			if m, ok := peer.grpcStreamCancelFn.Load(k); ok && m != nil {
-				m.(*streamContext).cancel()
-				peer.grpcStreamCancelFn.Delete(k)
-			}
+	peer.flaps.hold(id, peer.clock.Now().Add(d))
+	v := peer.view().clone()
+	peer.removeFromRing(v.rings, node)
+	peer.storeView(v)
+	peer.Unlock()
+
+	peer.logger.Warn("Quarantined node", zap.String("node", id), zap.Duration("duration", d))
+	peer.quarantine(node, d)
+	return nil
+}
+
+// quarantine close the connections of the quarantined node and add it back to
+// the rings once its cool-down ends
+func (peer *LocalPeer) quarantine(node *Meta, cooldown time.Duration) {
+	if m, ok := peer.grpcPool.LoadAndDelete(node.Id); ok {
+		m.(*connPool).Close()
+	}
+
+	if m, ok := peer.grpcStreamCancelFn.LoadAndDelete(node.Id); ok {
+		m.(*streamContext).cancel()
+	}
+
+	peer.options.Events.Publish(Event{Type: EVENT_NODE_QUARANTINED, Node: node.Clone()})
+	peer.clock.AfterFunc(cooldown, func() {
+		if peer.ctx.Err() == nil {
+			peer.release(node.Id)
 		}
-		peer.Lock()
+	})
+}
+
+func (peer *LocalPeer) release(id string) {
+	peer.Lock()
+	node, ok := peer.view().nodes[id]
+	if !ok || peer.flaps.quarantined(id, peer.clock.Now()) {
+		peer.Unlock()
+		return
+	}
+
+	if node.Status.Routable() && !peer.Cordoned(id) {
+		v := peer.view().clone()
+		peer.addToRing(v.rings, node)
+		peer.storeView(v)
 	}
-	peer.nodes = newNodes
-	peer.rings = newRings
-	peer.nodesByName = newNodesByName
 	peer.Unlock()
+
+	peer.logger.Info("Released quarantined node", zap.String("node", id))
+	peer.options.Events.Publish(Event{Type: EVENT_NODE_RELEASED, Node: node.Clone()})
 }
 
 func (peer *LocalPeer) Reset() {
 	peer.Lock()
-	peer.rings = make(map[string]*hashring.HashRing)
-	peer.nodes = make(map[string]*Meta)
-	peer.nodesByName = make(map[string]int)
+	peer.storeView(newPeerView())
 	peer.Unlock()
 	peer.grpcPool.Range(func(key, value any) bool {
 		if v, ok := peer.grpcPool.LoadAndDelete(key); ok && v != nil {
-			v.(pool.Pool).Close()
+			v.(*connPool).Close()
 		}
 		return true
 	})
@@ -305,76 +882,190 @@ func (peer *LocalPeer) Reset() {
 
 func (peer *LocalPeer) Delete(id string) {
 	peer.Lock()
-	if m, ok := peer.nodes[id]; ok {
-		peer.nodesByName[m.Name]--
-		if _, ok := peer.rings[m.Name]; ok {
-			peer.rings[m.Name] = peer.rings[m.Name].RemoveNode(m.Id)
-		}
-
-		if peer.nodesByName[m.Name] < 1 {
-			delete(peer.nodesByName, m.Name)
-			delete(peer.rings, m.Name)
-		}
-		delete(peer.nodes, m.Id)
+	if m, ok := peer.view().nodes[id]; ok {
+		v := peer.view().clone()
+		v.delete(m)
+		peer.removeFromRing(v.rings, m)
+		peer.storeView(v)
+		peer.options.Events.Publish(Event{Type: EVENT_NODE_LEAVE, Node: m.Clone()})
 	}
 	peer.Unlock()
+	peer.closeNode(id)
+}
 
-	if m, ok := peer.grpcPool.Load(id); ok {
-		m.(pool.Pool).Close()
-		peer.grpcPool.Delete(id)
+// closeNode close the connections and streams of the node and forget its state
+func (peer *LocalPeer) closeNode(id string) {
+	if m, ok := peer.grpcPool.LoadAndDelete(id); ok && m != nil {
+		m.(*connPool).Close()
+		peer.options.Metrics.PeerPool(id, PoolStats{})
 	}
 
-	if m, ok := peer.grpcStreamCancelFn.Load(id); ok {
+	if m, ok := peer.grpcStreamCancelFn.LoadAndDelete(id); ok && m != nil {
 		m.(*streamContext).cancel()
-		peer.grpcStreamCancelFn.Delete(id)
 	}
+	peer.resolved.Delete(id)
+	peer.resolveMu.Lock()
+	delete(peer.resolveAt, id)
+	peer.resolveMu.Unlock()
+	peer.links.Delete(id)
+	peer.options.Throttle.Delete(id)
 }
 
 func (peer *LocalPeer) Update(id string, status MetaStatus) {
 	peer.Lock()
 	defer peer.Unlock()
-	node, ok := peer.nodes[id]
+	node, ok := peer.view().nodes[id]
 	if !ok {
 		return
 	}
 
 	newNode := node.Clone()
 	newNode.Status = status
-	peer.nodes[id] = newNode
+	peer.replace(node, newNode)
+	if node.Status != status {
+		peer.options.Events.Publish(Event{Type: EVENT_NODE_UPDATE, Node: newNode.Clone()})
+	}
 }
 
-func (peer *LocalPeer) makeGrpcPool(id, addr string) (pool.Pool, error) {
-	p, ok := peer.grpcPool.Load(id)
-	if ok {
-		return p.(pool.Pool), nil
+// Merge replace the node in the view when it is newer than the known one,
+// unknown nodes are ignored. It reports whether the view changed
+func (peer *LocalPeer) Merge(node *Meta) bool {
+	peer.Lock()
+	defer peer.Unlock()
+	cur, ok := peer.view().nodes[node.Id]
+	if !ok || cur.Name != node.Name || !node.Newer(cur) {
+		return false
 	}
 
-	pool, err := pool.New(addr, pool.Options{
-		Dial:                 pool.Dial,
-		MaxIdle:              peer.options.MaxIdle,
-		MaxActive:            peer.options.MaxActive,
-		MaxConcurrentStreams: peer.options.MaxConcurrentStreams,
-		Reuse:                peer.options.Reuse,
-	})
+	newNode := node.Clone()
+	peer.replace(cur, newNode)
+	peer.options.Events.Publish(Event{Type: EVENT_NODE_UPDATE, Node: newNode.Clone()})
+	return true
+}
 
-	if err != nil {
-		return nil, err
+// replace swap node for newNode with the same id and name in a new view and move it in the
+// ring of its service when its routability or weight changed, the caller holds the lock
+func (peer *LocalPeer) replace(node, newNode *Meta) {
+	v := peer.view().clone()
+	v.set(newNode)
+	routable := peer.routable(newNode, peer.clock.Now())
+	switch {
+	case node.Status.Routable() == newNode.Status.Routable() && nodeWeight(node) == nodeWeight(newNode) && peer.sameRings(node, newNode):
+	case node.Status.Routable() == newNode.Status.Routable() && !routable:
+	case node.Status.Routable() == newNode.Status.Routable() && peer.sameRings(node, newNode):
+		// only the weight changed, updates gossiped by the node apply without a full sync
+		peer.updateRingWeight(v.rings, newNode)
+	default:
+		peer.removeFromRing(v.rings, node)
+
+		if routable {
+			peer.addToRing(v.rings, newNode)
+		}
+	}
+	peer.storeView(v)
+}
+
+func nodeWeight(node *Meta) int {
+	weight, err := node.TypedVars().GetInt(VAR_WEIGHT)
+	if err != nil || weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// serviceOptions returns the options of the nodes of the service
+func (peer *LocalPeer) serviceOptions(name string) *PeerOptions {
+	if o, ok := peer.services[name]; ok {
+		return o
+	}
+	return peer.options
+}
+
+// makeGrpcPool returns the connections to the node, they are dialed on first use
+func (peer *LocalPeer) makeGrpcPool(node *Meta) *connPool {
+	if p, ok := peer.grpcPool.Load(node.Id); ok {
+		return p.(*connPool)
 	}
 
-	peer.grpcPool.Store(id, pool)
-	return pool, nil
+	o := peer.serviceOptions(node.Name)
+	opts := o.DialOptions
+	var local *Meta
+	if peer.options.LocalMeta != nil {
+		local = peer.options.LocalMeta()
+	}
+
+	// nodes of the same host are called over their unix socket instead of loopback tcp,
+	// falling back to their address when the socket is not reachable from this node
+	if path, ok := colocatedSocket(local, node); ok {
+		peer.logger.Debug("Calling node over unix socket", zap.String("node", node.Id), zap.String("path", path))
+		opts = append([]grpc.DialOption{grpc.WithContextDialer(unixDialer(path, o.Dialer))}, opts...)
+	} else if o.Dialer != nil {
+		opts = append([]grpc.DialOption{grpc.WithContextDialer(o.Dialer)}, opts...)
+	}
+
+	p, _ := peer.grpcPool.LoadOrStore(node.Id, newConnPool(node.Id, node.Addr, o.Connections, o.DialTimeout, o.PoolLeakThreshold, o.TLS, callCompression{name: o.Compression, minSize: o.CompressionMinSize}, opts...))
+	return p.(*connPool)
 }
 
 func NewPeer(ctx context.Context, logger *zap.Logger, options PeerOptions) *LocalPeer {
 	ctx, cancel := context.WithCancel(ctx)
+	if options.Metrics == nil {
+		options.Metrics = NewMetrics(nil)
+	}
+
+	if options.Strategy == nil {
+		options.Strategy = NewRoundRobinStrategy()
+	}
+
 	s := &LocalPeer{
-		ctx:         ctx,
-		ctxCancelFn: cancel,
-		nodes:       make(map[string]*Meta),
-		nodesByName: make(map[string]int),
-		rings:       make(map[string]*hashring.HashRing),
-		logger:      logger,
-		options:     &options,
+		ctx:          ctx,
+		ctxCancelFn:  cancel,
+		chunks:       NewChunkBufferWithLimits(ctx, options.ChunkTimeout, options.ChunkMaxTotal, options.ChunkMaxBytes),
+		flaps:        newFlapDetector(options.FlapThreshold, options.FlapWindow, options.FlapCooldown),
+		defaultRing:  newRingBuilder(options.Ring),
+		ringBuilders: make(map[string]ringBuilder),
+		services:     make(map[string]*PeerOptions),
+		asyncPool:    NewWorkerPool(ctx, "peer_async", options.AsyncWorkers, options.AsyncQueueSize, options.Metrics),
+		logger:       logger,
+		options:      &options,
+		clock:        realClock{},
+	}
+
+	s.viewChanged = make(chan struct{})
+	s.current.Store(newPeerView())
+	if strategy, ok := options.Strategy.(linkAware); ok {
+		strategy.bindLinks(s)
 	}
+
+	for _, strategy := range options.Strategies {
+		if strategy, ok := strategy.(linkAware); ok {
+			strategy.bindLinks(s)
+		}
+	}
+
+	for name, ring := range options.Rings {
+		s.ringBuilders[name] = newRingBuilder(ring)
+	}
+
+	reap := options.StreamIdleTimeout > 0 || options.StreamTTL > 0 || options.StreamStatsRetention > 0
+	for name, service := range options.Services {
+		o := service.apply(options)
+		s.services[name] = o
+		reap = reap || o.StreamIdleTimeout > 0 || o.StreamTTL > 0
+	}
+
+	if options.ResolveInterval > 0 {
+		go s.resolveLoop(options.ResolveInterval)
+	}
+
+	if reap {
+		go s.reapLoop()
+	}
+
+	if options.HeartbeatInterval > 0 {
+		go s.heartbeatLoop(options.HeartbeatInterval)
+	}
+
+	go s.poolMonitorLoop(poolMonitorInterval)
 	return s
 }
@@ -0,0 +1,105 @@
+package nakamacluster
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// peerCacheDialTimeout timeout for verifying a cached node is still reachable
+const peerCacheDialTimeout = 500 * time.Millisecond
+
+// PeerCache persist the last-known nodes to disk, so peers can route
+// optimistically on startup before sd has been read
+type PeerCache struct {
+	name   string
+	maxAge time.Duration
+	logger *zap.Logger
+	sync.Mutex
+}
+
+// Load returns the cached nodes which are still reachable,
+// a cache older than maxAge is ignored
+func (c *PeerCache) Load() []*Meta {
+	if c == nil {
+		return nil
+	}
+
+	snapshot, err := ReadSnapshotFile(c.name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			c.logger.Warn("Failed read peer cache", zap.Error(err), zap.String("file", c.name))
+		}
+		return nil
+	}
+
+	if c.maxAge > 0 && time.Since(snapshot.CreatedAt) > c.maxAge {
+		c.logger.Debug("Peer cache expired", zap.String("file", c.name), zap.Time("created_at", snapshot.CreatedAt))
+		return nil
+	}
+
+	reachable := make([]bool, len(snapshot.Nodes))
+	var wg sync.WaitGroup
+	for i, node := range snapshot.Nodes {
+		if node == nil || node.Status == META_STATUS_STOPED {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", addr, peerCacheDialTimeout)
+			if err != nil {
+				return
+			}
+			conn.Close()
+			reachable[i] = true
+		}(i, node.Addr)
+	}
+	wg.Wait()
+
+	nodes := make([]*Meta, 0, len(snapshot.Nodes))
+	for i, node := range snapshot.Nodes {
+		if reachable[i] {
+			nodes = append(nodes, node)
+		}
+	}
+
+	c.logger.Debug("Loaded peer cache", zap.String("file", c.name), zap.Int("cached", len(snapshot.Nodes)), zap.Int("reachable", len(nodes)))
+	return nodes
+}
+
+// Save replace the cached nodes
+func (c *PeerCache) Save(nodes []*Meta) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if err := NewSnapshot(nodes...).WriteFile(c.name); err != nil {
+		c.logger.Warn("Failed write peer cache", zap.Error(err), zap.String("file", c.name))
+	}
+}
+
+// NewPeerCache create peer cache, it returns nil when name is empty
+func NewPeerCache(logger *zap.Logger, name string, maxAge time.Duration) *PeerCache {
+	if name == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		logger.Warn("Failed create peer cache directory", zap.Error(err), zap.String("file", name))
+	}
+
+	return &PeerCache{
+		name:   name,
+		maxAge: maxAge,
+		logger: logger,
+	}
+}
@@ -0,0 +1,100 @@
+package nakamacluster
+
+import (
+	"github.com/serialx/hashring"
+)
+
+// peerView immutable view of the cluster. Writers copy the view, change the copy and
+// swap it in, so readers never lock and always see nodes, name index and rings agree.
+type peerView struct {
+	nodes  map[string]*Meta
+	byName map[string][]*Meta
+	rings  map[string]*hashring.HashRing
+}
+
+func newPeerView() *peerView {
+	return &peerView{
+		nodes:  make(map[string]*Meta),
+		byName: make(map[string][]*Meta),
+		rings:  make(map[string]*hashring.HashRing),
+	}
+}
+
+// clone copy the maps of the view, nodes, name index slices and rings are never
+// changed in place and are shared with the copy
+func (v *peerView) clone() *peerView {
+	c := &peerView{
+		nodes:  make(map[string]*Meta, len(v.nodes)),
+		byName: make(map[string][]*Meta, len(v.byName)),
+		rings:  make(map[string]*hashring.HashRing, len(v.rings)),
+	}
+
+	for k, node := range v.nodes {
+		c.nodes[k] = node
+	}
+
+	for k, nodes := range v.byName {
+		c.byName[k] = nodes
+	}
+
+	for k, ring := range v.rings {
+		c.rings[k] = ring
+	}
+	return c
+}
+
+// set replace the node with the same id, the name of the node must not change
+func (v *peerView) set(node *Meta) {
+	v.nodes[node.Id] = node
+	nodes := make([]*Meta, len(v.byName[node.Name]))
+	copy(nodes, v.byName[node.Name])
+	for i := range nodes {
+		if nodes[i].Id == node.Id {
+			nodes[i] = node
+		}
+	}
+	v.byName[node.Name] = nodes
+}
+
+// delete remove the node from the nodes, the name index and the ring of its service
+func (v *peerView) delete(node *Meta) {
+	delete(v.nodes, node.Id)
+	nodes := make([]*Meta, 0, len(v.byName[node.Name]))
+	for _, n := range v.byName[node.Name] {
+		if n.Id != node.Id {
+			nodes = append(nodes, n)
+		}
+	}
+
+	if len(nodes) < 1 {
+		delete(v.byName, node.Name)
+		delete(v.rings, node.Name)
+		return
+	}
+
+	v.byName[node.Name] = nodes
+	if ring, ok := v.rings[node.Name]; ok {
+		v.rings[node.Name] = ring.RemoveNode(node.Id)
+	}
+}
+
+// view returns the current view of the cluster
+func (peer *LocalPeer) view() *peerView {
+	return peer.current.Load().(*peerView)
+}
+
+// storeView swap in the view and wake the waiters of viewChange
+func (peer *LocalPeer) storeView(v *peerView) {
+	peer.viewMu.Lock()
+	peer.current.Store(v)
+	close(peer.viewChanged)
+	peer.viewChanged = make(chan struct{})
+	peer.viewMu.Unlock()
+}
+
+// viewChange returns a channel closed when the next view is stored
+func (peer *LocalPeer) viewChange() <-chan struct{} {
+	peer.viewMu.Lock()
+	defer peer.viewMu.Unlock()
+	return peer.viewChanged
+}
@@ -0,0 +1,222 @@
+package nakamacluster
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPeerViewConcurrentReads(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	nodes := make([]*Meta, 4)
+	for i := range nodes {
+		nodes[i] = NewNodeMeta("node"+strconv.Itoa(i), "svc", "127.0.0.1:"+strconv.Itoa(i+1), NODE_TYPE_MICROSERVICES, map[string]string{})
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				v := peer.view()
+				n := 0
+				for _, m := range v.nodes {
+					if m.Name == "svc" {
+						n++
+					}
+				}
+
+				if n != len(v.byName["svc"]) {
+					t.Error("name index and nodes disagree")
+					return
+				}
+
+				if ring, ok := v.rings["svc"]; ok {
+					if id, ok := ring.GetNode("key"); ok && v.nodes[id] == nil {
+						t.Errorf("ring returned unknown node %s", id)
+						return
+					}
+				}
+
+				peer.GetByName("svc")
+				peer.GetWithHashRing("svc", "key")
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		peer.Sync(nodes[:i%len(nodes)+1]...)
+		peer.Update(nodes[0].Id, META_STATUS_DRAINING)
+		peer.Delete(nodes[len(nodes)-1].Id)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestPeerViewDeleteAndUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	node1 := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	node2 := NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{})
+	peer.Sync(node1, node2)
+	before := peer.view()
+
+	peer.Update("node1", META_STATUS_DRAINING)
+	if m, _ := peer.Get("node1"); m.Status != META_STATUS_DRAINING {
+		t.Fatalf("status not updated, got %s", m.Status)
+	}
+
+	if before.nodes["node1"].Status == META_STATUS_DRAINING {
+		t.Fatal("update changed the previous view")
+	}
+
+	for _, m := range peer.GetByName("svc") {
+		if m.Id == "node1" && m.Status != META_STATUS_DRAINING {
+			t.Fatal("name index not updated")
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if m, ok := peer.GetWithHashRing("svc", strconv.Itoa(i)); !ok || m.Id != "node2" {
+			t.Fatalf("draining node still in the ring, got %v", m)
+		}
+	}
+
+	peer.Delete("node2")
+	if peer.SizeByName("svc") != 1 || peer.Size() != 1 {
+		t.Fatalf("expected 1 node, got %d", peer.Size())
+	}
+
+	if _, ok := peer.GetWithHashRing("svc", "a"); ok {
+		t.Fatal("ring not empty")
+	}
+
+	if len(before.nodes) != 2 || len(before.byName["svc"]) != 2 {
+		t.Fatal("delete changed the previous view")
+	}
+
+	peer.Delete("node1")
+	if _, ok := peer.view().byName["svc"]; ok {
+		t.Fatal("empty name index not removed")
+	}
+}
+
+func TestPeerRange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	for i := 0; i < 3; i++ {
+		peer.Sync(append(peer.All(), NewNodeMeta("node"+strconv.Itoa(i), "svc", "127.0.0.1:"+strconv.Itoa(i+1), NODE_TYPE_MICROSERVICES, map[string]string{}))...)
+	}
+
+	seen := make(map[string]bool)
+	peer.Range(func(node *Meta) bool {
+		seen[node.Id] = true
+		return true
+	})
+
+	if len(seen) != 3 {
+		t.Fatalf("expected 3 nodes, got %v", seen)
+	}
+
+	n := 0
+	peer.Range(func(node *Meta) bool {
+		n++
+		return false
+	})
+
+	if n != 1 {
+		t.Fatalf("range did not stop, visited %d", n)
+	}
+}
+
+func BenchmarkPeerAll(b *testing.B) {
+	peer := benchPeer(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, node := range peer.All() {
+			_ = node.Status
+		}
+	}
+}
+
+func BenchmarkPeerRange(b *testing.B) {
+	peer := benchPeer(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		peer.Range(func(node *Meta) bool {
+			_ = node.Status
+			return true
+		})
+	}
+}
+
+func benchPeer(b *testing.B) Peer {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	nodes := make([]*Meta, 100)
+	for i := range nodes {
+		nodes[i] = NewNodeMeta("node"+strconv.Itoa(i), "svc", "127.0.0.1:"+strconv.Itoa(i+1), NODE_TYPE_MICROSERVICES, map[string]string{})
+	}
+	peer.Sync(nodes...)
+	return peer
+}
+
+func TestPeerMergeOrdersUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	node := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{"v": "1"})
+	peer.Sync(node)
+
+	newer := node.Clone()
+	newer.Vars = map[string]string{"v": "2"}
+	newer.Version = 2
+	if !peer.Merge(newer) {
+		t.Fatal("newer meta not merged")
+	}
+
+	older := node.Clone()
+	older.Vars = map[string]string{"v": "old"}
+	older.Version = 1
+	if peer.Merge(older) {
+		t.Fatal("older meta merged")
+	}
+
+	peer.Sync(older)
+	if m, _ := peer.Get("node1"); m.Vars["v"] != "2" {
+		t.Fatalf("stale sync overwrote newer vars, got %v", m.Vars)
+	}
+
+	if peer.Merge(NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{})) {
+		t.Fatal("unknown node merged")
+	}
+
+	drained := newer.Clone()
+	drained.Status = META_STATUS_DRAINING
+	drained.Version = 3
+	peer.Merge(drained)
+	if _, ok := peer.GetWithHashRing("svc", "a"); ok {
+		t.Fatal("merged draining node still in the ring")
+	}
+}
@@ -0,0 +1,132 @@
+package nakamacluster
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// poolMonitorInterval interval the connection pools are reported and checked for leaks
+const poolMonitorInterval = 10 * time.Second
+
+// poolCallerDepth number of frames recorded for the call site holding a connection
+const poolCallerDepth = 8
+
+// PoolStats connections of the pool to a node
+type PoolStats struct {
+	// Connections physical connections open to the node
+	Connections int
+
+	// Active physical connections held by at least one caller
+	Active int
+
+	// Idle physical connections held by no caller
+	Idle int
+
+	// InUse connections handed out by the pool and not closed yet,
+	// one physical connection is shared by any number of them
+	InUse int
+}
+
+// caller returns the call stack that took the connection
+func (c *poolConn) caller() string {
+	if len(c.callers) < 1 {
+		return "unknown"
+	}
+
+	sites := make([]string, 0, len(c.callers))
+	frames := runtime.CallersFrames(c.callers)
+	for {
+		frame, more := frames.Next()
+		sites = append(sites, fmt.Sprintf("%s %s:%d", frame.Function, frame.File, frame.Line))
+		if !more {
+			break
+		}
+	}
+	return strings.Join(sites, "; ")
+}
+
+// Stats returns the connections of the pool
+func (p *connPool) Stats() PoolStats {
+	p.Lock()
+	defer p.Unlock()
+
+	active := make(map[*grpc.ClientConn]struct{}, len(p.held))
+	for c := range p.held {
+		active[c.cc] = struct{}{}
+	}
+
+	stats := PoolStats{Active: len(active), InUse: len(p.held)}
+	for _, cc := range p.conns {
+		if cc != nil {
+			stats.Connections++
+		}
+	}
+	if stats.Idle = stats.Connections - stats.Active; stats.Idle < 0 {
+		stats.Idle = 0
+	}
+	return stats
+}
+
+// leaked returns the connections held longer than leakAfter not reported yet
+func (p *connPool) leaked(now time.Time) []*poolConn {
+	if p.leakAfter <= 0 {
+		return nil
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	leaks := make([]*poolConn, 0)
+	for c := range p.held {
+		if !c.reported && now.Sub(c.since) >= p.leakAfter {
+			c.reported = true
+			leaks = append(leaks, c)
+		}
+	}
+	return leaks
+}
+
+// PoolStats returns the connections of the pool to the node, false when no pool is open to it
+func (peer *LocalPeer) PoolStats(id string) (PoolStats, bool) {
+	p, ok := peer.grpcPool.Load(id)
+	if !ok {
+		return PoolStats{}, false
+	}
+	return p.(*connPool).Stats(), true
+}
+
+// poolMonitorLoop report the connection pools and log leaked connections until the peer is done
+func (peer *LocalPeer) poolMonitorLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			peer.monitorPools(now)
+
+		case <-peer.ctx.Done():
+			return
+		}
+	}
+}
+
+// monitorPools report the gauges of every pool and log the call sites holding connections
+// beyond the leak threshold, each held connection is logged once
+func (peer *LocalPeer) monitorPools(now time.Time) {
+	peer.grpcPool.Range(func(key, value any) bool {
+		p := value.(*connPool)
+		peer.options.Metrics.PeerPool(p.node, p.Stats())
+		for _, c := range p.leaked(now) {
+			peer.options.Metrics.PeerPoolLeaked(p.node)
+			peer.logger.Warn("Connection held beyond leak threshold",
+				zap.String("node", p.node),
+				zap.Duration("held", now.Sub(c.since)),
+				zap.String("caller", c.caller()))
+		}
+		return true
+	})
+}
@@ -0,0 +1,61 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+func TestPoolStatsAndLeaks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(echoServerDelegate{})
+
+	scope := tally.NewTestScope("", nil)
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 2, PoolLeakThreshold: time.Minute, Metrics: NewMetrics(scope)})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	if _, ok := peer.PoolStats(node.Id); ok {
+		t.Fatal("stats of a node never dialed")
+	}
+
+	conn, err := peer.makeGrpcPool(node).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, _ := peer.PoolStats(node.Id)
+	if stats != (PoolStats{Connections: 1, Active: 1, InUse: 1}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	peer.monitorPools(time.Now())
+	peer.monitorPools(time.Now().Add(2 * time.Minute))
+	peer.monitorPools(time.Now().Add(3 * time.Minute))
+	snapshot := scope.Snapshot()
+	if counter, ok := snapshot.Counters()["cluster.peer_pool_leaked+node=node1"]; !ok || counter.Value() != 1 {
+		t.Fatalf("leak not reported once %v", snapshot.Counters())
+	}
+
+	if gauge, ok := snapshot.Gauges()["cluster.peer_pool_in_use+node=node1"]; !ok || gauge.Value() != 1 {
+		t.Fatalf("in use gauge %v", snapshot.Gauges())
+	}
+
+	conn.Close()
+	conn.Close()
+	if stats, _ = peer.PoolStats(node.Id); stats != (PoolStats{Connections: 1, Idle: 1}) {
+		t.Fatalf("unexpected stats after close %+v", stats)
+	}
+
+	peer.Delete(node.Id)
+	snapshot = scope.Snapshot()
+	if gauge := snapshot.Gauges()["cluster.peer_pool_connections+node=node1"]; gauge == nil || gauge.Value() != 0 {
+		t.Fatalf("connections gauge not reset %v", snapshot.Gauges())
+	}
+}
@@ -0,0 +1,140 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	READY_STEP_SD       = "sd"       // the nodes were read from sd in full
+	READY_STEP_REGISTER = "register" // the local node is registered in sd
+	READY_STEP_GOSSIP   = "gossip"   // the local node joined the gossip, Client only
+)
+
+// ErrNotReady the node did not complete its startup
+var ErrNotReady = errors.New("node not ready")
+
+// ReadyError returned by WaitReady when the startup did not complete, Steps holds the
+// pending steps with the last error of each, nil when a step did not fail yet
+type ReadyError struct {
+	Steps map[string]error
+	Err   error
+}
+
+func (e *ReadyError) Error() string {
+	steps := make([]string, 0, len(e.Steps))
+	for step, err := range e.Steps {
+		if err == nil {
+			steps = append(steps, step+": pending")
+			continue
+		}
+		steps = append(steps, step+": "+err.Error())
+	}
+
+	sort.Strings(steps)
+	return fmt.Sprintf("%s: %v (%s)", ErrNotReady, e.Err, strings.Join(steps, ", "))
+}
+
+func (e *ReadyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ReadyError) Is(target error) bool {
+	return target == ErrNotReady
+}
+
+type readyStep struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+	last func() error
+}
+
+// readiness tracks the startup steps of the node, a failed step ends every wait
+type readiness struct {
+	steps    map[string]*readyStep
+	failed   chan struct{}
+	failErr  error
+	failOnce sync.Once
+	sync.Mutex
+}
+
+func newReadiness(steps ...string) *readiness {
+	r := &readiness{steps: make(map[string]*readyStep, len(steps)), failed: make(chan struct{})}
+	for _, step := range steps {
+		r.steps[step] = &readyStep{done: make(chan struct{})}
+	}
+	return r
+}
+
+// lastError set fn returning the last error of the step when none was reported
+func (r *readiness) lastError(step string, fn func() error) {
+	if s, ok := r.steps[step]; ok {
+		s.last = fn
+	}
+}
+
+// done mark the step completed
+func (r *readiness) done(step string) {
+	s, ok := r.steps[step]
+	if !ok {
+		return
+	}
+
+	r.Lock()
+	s.err = nil
+	r.Unlock()
+	s.once.Do(func() { close(s.done) })
+}
+
+// report record the last error of the step, it may still complete
+func (r *readiness) report(step string, err error) {
+	if s, ok := r.steps[step]; ok {
+		r.Lock()
+		s.err = err
+		r.Unlock()
+	}
+}
+
+// fail record the error the step gave up with
+func (r *readiness) fail(step string, err error) {
+	r.report(step, err)
+	r.failOnce.Do(func() {
+		r.failErr = fmt.Errorf("%s: %w", step, err)
+		close(r.failed)
+	})
+}
+
+// wait block until every step completed, a step failed or ctx is done
+func (r *readiness) wait(ctx context.Context) error {
+	for _, s := range r.steps {
+		select {
+		case <-s.done:
+		case <-r.failed:
+			return r.error(r.failErr)
+		case <-ctx.Done():
+			return r.error(ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (r *readiness) error(err error) *ReadyError {
+	e := &ReadyError{Steps: make(map[string]error), Err: err}
+	r.Lock()
+	defer r.Unlock()
+	for step, s := range r.steps {
+		select {
+		case <-s.done:
+		default:
+			if e.Steps[step] = s.err; s.err == nil && s.last != nil {
+				e.Steps[step] = s.last()
+			}
+		}
+	}
+	return e
+}
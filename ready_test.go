@@ -0,0 +1,64 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestWaitReady(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.JoinRetryInterval = 10
+	config.JoinRetryMaxInterval = 20
+	client := &unavailableClient{Client: sd.NewMemoryStore().NewClient(ctx)}
+	server := NewServer(ctx, zap.NewNop(), client, "node1", "svc", map[string]string{}, *config)
+	defer server.Stop()
+
+	wctx, wcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer wcancel()
+	err := server.WaitReady(wctx)
+	var e *ReadyError
+	if !errors.As(err, &e) || !errors.Is(err, ErrNotReady) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ReadyError, got %v", err)
+	}
+
+	if _, ok := e.Steps[READY_STEP_SD]; ok || len(e.Steps) != 1 || e.Steps[READY_STEP_REGISTER] == nil {
+		t.Fatalf("unexpected pending steps %v", e.Steps)
+	}
+
+	atomic.StoreInt32(&client.up, 1)
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a registration that gave up ends the wait at once
+	config.Port = freePort(t)
+	config.JoinDeadline = 0
+	failed := NewServer(ctx, zap.NewNop(), &unavailableClient{Client: sd.NewMemoryStore().NewClient(ctx)}, "node2", "svc", map[string]string{}, *config)
+	defer failed.Stop()
+	if err := failed.WaitReady(ctx); !errors.As(err, &e) || ctx.Err() != nil || e.Steps[READY_STEP_REGISTER] == nil {
+		t.Fatalf("expected failed registration, got %v", err)
+	}
+}
+
+func TestClientWaitReady(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.JoinRetryInterval = 10
+	node := NewClient(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", map[string]string{}, *config)
+	defer node.Stop()
+
+	if err := node.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,144 @@
+package nakamacluster
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+// redisBridgeVarSource marks envelopes published into the cluster by the redis bridge
+const redisBridgeVarSource = "redis_bridge"
+
+// RedisPubSub redis pub/sub client used by the bridge, adapt the redis client of your choice to it
+type RedisPubSub interface {
+	// Publish publish the payload to the channel
+	Publish(ctx context.Context, channel string, payload []byte) error
+
+	// PSubscribe call handler for every message of the channels matching pattern, it blocks until ctx is done
+	PSubscribe(ctx context.Context, pattern string, handler func(channel string, payload []byte)) error
+}
+
+type RedisBridgeOptions struct {
+	// OutboundPrefix cluster broadcasts are published to OutboundPrefix + cid
+	OutboundPrefix string
+
+	// InboundPrefix messages of the channels InboundPrefix + cid are broadcast to the cluster
+	InboundPrefix string
+
+	// Timeout timeout of a single publish
+	Timeout time.Duration
+
+	// QueueSize number of broadcasts waiting to be published, broadcasts are dropped when it is full
+	QueueSize int
+}
+
+// RedisBridge mirror the cluster broadcasts with a bytes payload to redis pub/sub channels and
+// redis messages to the cluster, run it on a single node of the cluster. The bridge is added to
+// the broadcast listeners of the client and removed when ctx is done
+type RedisBridge struct {
+	ctx     context.Context
+	client  *Client
+	redis   RedisPubSub
+	queue   chan *api.Envelope
+	options RedisBridgeOptions
+	logger  *zap.Logger
+}
+
+// outbound queue the broadcast without blocking the gossip receive loop, only bytes
+// payloads are published and the others are skipped
+func (b *RedisBridge) outbound(node string, in *api.Envelope) {
+	if _, ok := in.Vars[redisBridgeVarSource]; ok {
+		return
+	}
+
+	if _, ok := in.Payload.(*api.Envelope_Bytes); !ok {
+		b.logger.Warn("Redis bridge skipped a broadcast without bytes payload", zap.String("cid", in.Cid), zap.String("node", node))
+		return
+	}
+
+	select {
+	case b.queue <- &api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Bytes{Bytes: append([]byte(nil), in.GetBytes()...)}}:
+	default:
+		b.logger.Warn("Redis bridge queue full, message dropped", zap.String("cid", in.Cid))
+	}
+}
+
+func (b *RedisBridge) publish(unsubscribe func()) {
+	defer unsubscribe()
+	for {
+		select {
+		case in := <-b.queue:
+			ctx, cancel := context.WithTimeout(b.ctx, b.options.Timeout)
+			if err := b.redis.Publish(ctx, b.options.OutboundPrefix+in.Cid, in.GetBytes()); err != nil {
+				b.logger.Warn("Failed publish message to redis", zap.Error(err), zap.String("cid", in.Cid))
+			}
+			cancel()
+
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *RedisBridge) inbound(channel string, payload []byte) {
+	in := &api.Envelope{
+		Cid:     strings.TrimPrefix(channel, b.options.InboundPrefix),
+		Payload: &api.Envelope_Bytes{Bytes: payload},
+		Vars:    map[string]string{redisBridgeVarSource: channel},
+	}
+
+	if err := b.client.Broadcast(NewMessage(in)); err != nil {
+		b.logger.Warn("Failed broadcast redis message", zap.Error(err), zap.String("channel", channel))
+	}
+
+	if err := b.client.deliverLocal(in); err != nil {
+		b.logger.Warn("Failed deliver redis message", zap.Error(err), zap.String("channel", channel))
+	}
+}
+
+func (b *RedisBridge) subscribe() {
+	for {
+		err := b.redis.PSubscribe(b.ctx, b.options.InboundPrefix+"*", b.inbound)
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		b.logger.Warn("Redis subscription closed, resubscribing", zap.Error(err))
+	}
+}
+
+// NewRedisBridge create redis bridge for the client, it is stopped when ctx is done
+func NewRedisBridge(ctx context.Context, logger *zap.Logger, client *Client, redis RedisPubSub, options RedisBridgeOptions) *RedisBridge {
+	if options.OutboundPrefix == "" {
+		options.OutboundPrefix = "nakama-cluster:out:"
+	}
+
+	if options.InboundPrefix == "" {
+		options.InboundPrefix = "nakama-cluster:in:"
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+
+	if options.QueueSize < 1 {
+		options.QueueSize = 1024
+	}
+
+	b := &RedisBridge{
+		ctx:     ctx,
+		client:  client,
+		redis:   redis,
+		queue:   make(chan *api.Envelope, options.QueueSize),
+		options: options,
+		logger:  logger,
+	}
+	go b.publish(client.OnBroadcast(b.outbound))
+	go b.subscribe()
+	return b
+}
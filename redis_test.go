@@ -0,0 +1,73 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+// memoryRedis redis pub/sub reporting the published messages
+type memoryRedis struct {
+	published chan string
+}
+
+func (r *memoryRedis) Publish(ctx context.Context, channel string, payload []byte) error {
+	r.published <- channel + "=" + string(payload)
+	return nil
+}
+
+func (r *memoryRedis) PSubscribe(ctx context.Context, pattern string, handler func(channel string, payload []byte)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRedisBridgeOutbound(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &Client{logger: zap.NewNop()}
+	received := make(chan string, 4)
+	client.OnBroadcast(func(node string, in *api.Envelope) { received <- in.Cid })
+
+	bridgeCtx, stopBridge := context.WithCancel(ctx)
+	redis := &memoryRedis{published: make(chan string, 4)}
+	NewRedisBridge(bridgeCtx, zap.NewNop(), client, redis, RedisBridgeOptions{OutboundPrefix: "out:"})
+
+	// the bridge does not replace the other listeners and skips payloads that are not bytes
+	client.notifyBroadcast("node1", &api.Envelope{Cid: "chat", Payload: &api.Envelope_Json{Json: &api.Json{}}})
+	client.notifyBroadcast("node1", &api.Envelope{Cid: "chat", Payload: &api.Envelope_Bytes{Bytes: []byte("hi")}})
+	if len(received) != 2 {
+		t.Fatalf("expected both broadcasts delivered to the other listener, got %d", len(received))
+	}
+
+	select {
+	case msg := <-redis.published:
+		if msg != "out:chat=hi" {
+			t.Fatalf("unexpected published message %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast not published")
+	}
+
+	// the bridge stops listening once stopped
+	stopBridge()
+	for {
+		n := 0
+		client.onBroadcast.Range(func(key, value any) bool {
+			n++
+			return true
+		})
+
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(redis.published) != 0 {
+		t.Fatal("payload that is not bytes published")
+	}
+}
@@ -0,0 +1,64 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoPeerSource the peer has no Source to refresh from
+var ErrNoPeerSource = errors.New("peer has no source")
+
+// RefreshReport nodes changed by Refresh
+type RefreshReport struct {
+	Joined  []*Meta `json:"joined"`
+	Left    []*Meta `json:"left"`
+	Updated []*Meta `json:"updated"`
+}
+
+// Changed reports whether the refresh changed the view
+func (r *RefreshReport) Changed() bool {
+	return len(r.Joined)+len(r.Left)+len(r.Updated) > 0
+}
+
+// Refresh read the authoritative list of nodes from the Source and apply the differences
+// immediately, like after a suspected partition or an operator intervention
+func (peer *LocalPeer) Refresh(ctx context.Context) (*RefreshReport, error) {
+	if peer.options.Source == nil {
+		return nil, ErrNoPeerSource
+	}
+
+	type result struct {
+		nodes []*Meta
+		err   error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		nodes, err := peer.options.Source()
+		done <- result{nodes: nodes, err: err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	report := &RefreshReport{Joined: []*Meta{}, Left: []*Meta{}, Updated: []*Meta{}}
+	for _, e := range peer.sync(r.nodes) {
+		switch e.Type {
+		case EVENT_NODE_JOIN:
+			report.Joined = append(report.Joined, e.Node)
+		case EVENT_NODE_LEAVE:
+			report.Left = append(report.Left, e.Node)
+		case EVENT_NODE_UPDATE:
+			report.Updated = append(report.Updated, e.Node)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,57 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPeerRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	node1 := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	node2 := NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{})
+	node3 := NewNodeMeta("node3", "svc", "127.0.0.1:3", NODE_TYPE_MICROSERVICES, map[string]string{})
+	updated := node2.Clone()
+	updated.Version++
+	updated.Vars["zone"] = "b"
+
+	source := []*Meta{updated, node3}
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Source: func() ([]*Meta, error) { return source, nil }})
+	peer.Sync(node1, node2)
+
+	report, err := peer.Refresh(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Joined) != 1 || report.Joined[0].Id != "node3" || len(report.Left) != 1 || report.Left[0].Id != "node1" ||
+		len(report.Updated) != 1 || report.Updated[0].Vars["zone"] != "b" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	if _, ok := peer.Get("node1"); ok || peer.Size() != 2 {
+		t.Fatal("view not refreshed")
+	}
+
+	if report, err := peer.Refresh(ctx); err != nil || report.Changed() {
+		t.Fatalf("unexpected second refresh %+v %v", report, err)
+	}
+
+	if _, err := NewPeer(ctx, zap.NewNop(), PeerOptions{}).Refresh(ctx); !errors.Is(err, ErrNoPeerSource) {
+		t.Fatalf("expected ErrNoPeerSource, got %v", err)
+	}
+
+	// a source that does not answer is abandoned with the ctx
+	block := make(chan struct{})
+	defer close(block)
+	slow := NewPeer(ctx, zap.NewNop(), PeerOptions{Source: func() ([]*Meta, error) { <-block; return nil, nil }})
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	if _, err := slow.Refresh(cctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
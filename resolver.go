@@ -0,0 +1,110 @@
+package nakamacluster
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	resolveTimeout = 2 * time.Second // timeout of a single dns lookup
+
+	// resolveOnErrorInterval minimum interval between the lookups of a node address started by
+	// failures, above resolveTimeout so a node never has two lookups running
+	resolveOnErrorInterval = 5 * time.Second
+)
+
+// addrHost returns the host of the node address when it is a dns name
+func addrHost(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || net.ParseIP(host) != nil {
+		return "", false
+	}
+	return host, true
+}
+
+// resolve lookup the dns name of the node address and invalidates the grpc pool
+// of the node when the resolution changed, it reports whether it changed
+func (peer *LocalPeer) resolve(node *Meta) bool {
+	host, ok := addrHost(node.Addr)
+	if !ok {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(peer.ctx, resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		peer.logger.Warn("Failed resolve node address", zap.Error(err), zap.String("id", node.Id), zap.String("addr", node.Addr))
+		return false
+	}
+
+	sort.Strings(addrs)
+	resolved := strings.Join(addrs, ",")
+	last, loaded := peer.resolved.Load(node.Id)
+	peer.resolved.Store(node.Id, resolved)
+	if !loaded || last.(string) == resolved {
+		return false
+	}
+
+	peer.logger.Info("Node address resolution changed", zap.String("id", node.Id), zap.String("addr", node.Addr), zap.String("from", last.(string)), zap.String("to", resolved))
+	if m, ok := peer.grpcPool.LoadAndDelete(node.Id); ok && m != nil {
+		m.(*connPool).Close()
+	}
+	return true
+}
+
+// resolveOnError re-resolve the node address when err means the node could not be reached
+func (peer *LocalPeer) resolveOnError(node *Meta, err error) {
+	if err == nil {
+		return
+	}
+
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unavailable {
+		return
+	}
+
+	if _, ok := addrHost(node.Addr); ok && peer.allowResolve(node.Id) {
+		go peer.resolve(node)
+	}
+}
+
+// allowResolve reports whether a lookup of the node address may start, a burst of failures
+// to the node makes a single lookup every resolveOnErrorInterval
+func (peer *LocalPeer) allowResolve(id string) bool {
+	peer.resolveMu.Lock()
+	defer peer.resolveMu.Unlock()
+	now := peer.clock.Now()
+	if last, ok := peer.resolveAt[id]; ok && now.Sub(last) < resolveOnErrorInterval {
+		return false
+	}
+
+	if peer.resolveAt == nil {
+		peer.resolveAt = make(map[string]time.Time)
+	}
+	peer.resolveAt[id] = now
+	return true
+}
+
+func (peer *LocalPeer) resolveLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			peer.Range(func(node *Meta) bool {
+				peer.resolve(node)
+				return true
+			})
+
+		case <-peer.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestResolveOnError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MessageQueueSize: 8})
+	clock := newVirtualClock()
+	peer.clock = clock
+	resolves := func() int {
+		peer.resolveMu.Lock()
+		defer peer.resolveMu.Unlock()
+		return len(peer.resolveAt)
+	}
+
+	node := &Meta{Id: "node1", Addr: "localhost:7350"}
+	peer.resolveOnError(node, status.Error(codes.InvalidArgument, "bad request"))
+	peer.resolveOnError(&Meta{Id: "node2", Addr: "127.0.0.1:7350"}, status.Error(codes.Unavailable, "down"))
+	if n := resolves(); n != 0 {
+		t.Fatalf("unexpected lookups %d", n)
+	}
+
+	unavailable := status.Error(codes.Unavailable, "down")
+	peer.resolveOnError(node, unavailable)
+	if n := resolves(); n != 1 {
+		t.Fatalf("expected a lookup of node1, got %d", n)
+	}
+
+	// a burst of failures makes a single lookup per interval
+	clock.Advance(time.Second)
+	if peer.allowResolve(node.Id) {
+		t.Fatal("lookup allowed within the interval")
+	}
+
+	if !peer.allowResolve("node3") {
+		t.Fatal("lookup of another node not allowed")
+	}
+
+	clock.Advance(resolveOnErrorInterval)
+	if !peer.allowResolve(node.Id) {
+		t.Fatal("lookup not allowed after the interval")
+	}
+
+	peer.closeNode(node.Id)
+	peer.closeNode("node3")
+	if n := resolves(); n != 0 {
+		t.Fatalf("lookups of closed nodes not forgotten, got %d", n)
+	}
+}
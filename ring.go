@@ -0,0 +1,230 @@
+package nakamacluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/serialx/hashring"
+	"github.com/twmb/murmur3"
+)
+
+const (
+	RING_HASH_MD5     = "md5"     // md5 of serialx/hashring, the default
+	RING_HASH_XXHASH  = "xxhash"  // 64 bit xxhash
+	RING_HASH_MURMUR3 = "murmur3" // 64 bit murmur3
+)
+
+// RING_VAR_PREFIX prefix of the names of the rings keyed by a var instead of the service name
+const RING_VAR_PREFIX = "@"
+
+// RingName returns the name of the ring of the nodes whose var has the value, the var must be
+// one of PeerOptions.RingVars. Pass it to GetWithHashRing like a service name
+func RingName(name, value string) string {
+	return RING_VAR_PREFIX + name + "=" + value
+}
+
+// KeyMapper transforms a key before its ring lookup, keys mapped to the same value are owned by
+// the same node so related keys can be co-located
+type KeyMapper func(key string) string
+
+// PrefixKeyMapper returns a key mapper keeping the part of the key before the first sep, e.g.
+// the user id of user:inventory keys. Keys without sep are kept whole
+func PrefixKeyMapper(sep string) KeyMapper {
+	return func(key string) string {
+		if i := strings.Index(key, sep); i >= 0 {
+			return key[:i]
+		}
+		return key
+	}
+}
+
+// RangeKeyMapper returns a key mapper mapping numeric keys to ranges of size, keys of a range
+// are owned by the same node. Keys that are not unsigned integers are kept whole
+func RangeKeyMapper(size uint64) KeyMapper {
+	if size < 1 {
+		size = 1
+	}
+
+	return func(key string) string {
+		n, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return key
+		}
+		return "range:" + strconv.FormatUint(n/size, 10)
+	}
+}
+
+// RingOptions hash function and virtual node count of the hashring of a service
+type RingOptions struct {
+	// Hash is the hash function of the ring: md5, xxhash or murmur3, default md5
+	Hash string
+
+	// VirtualNodes is the number of ring points of every unit of node weight, default 1
+	VirtualNodes int
+}
+
+// uint64HashKey ring point of the 64 bit hash functions
+type uint64HashKey uint64
+
+func (k uint64HashKey) Less(other hashring.HashKey) bool {
+	return k < other.(uint64HashKey)
+}
+
+// ringHashFunc returns the hash function registered under the name, nil is the default of hashring
+func ringHashFunc(name string) (hashring.HashFunc, error) {
+	switch name {
+	case "", RING_HASH_MD5:
+		return nil, nil
+
+	case RING_HASH_XXHASH:
+		return func(b []byte) hashring.HashKey { return uint64HashKey(xxhash.Sum64(b)) }, nil
+
+	case RING_HASH_MURMUR3:
+		return func(b []byte) hashring.HashKey { return uint64HashKey(murmur3.Sum64(b)) }, nil
+	}
+	return nil, fmt.Errorf("unknown ring hash %q", name)
+}
+
+// CheckRingOptions returns an error when the hash function of the options is unknown
+func CheckRingOptions(o RingOptions) error {
+	_, err := ringHashFunc(o.Hash)
+	return err
+}
+
+// ringBuilder creates the rings of the services with their options
+type ringBuilder struct {
+	hash         hashring.HashFunc
+	virtualNodes int
+}
+
+func newRingBuilder(o RingOptions) ringBuilder {
+	hash, _ := ringHashFunc(o.Hash)
+	virtualNodes := o.VirtualNodes
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+	return ringBuilder{hash: hash, virtualNodes: virtualNodes}
+}
+
+func (b ringBuilder) new(node *Meta) *hashring.HashRing {
+	weights := map[string]int{node.Id: b.weight(node)}
+	if b.hash == nil {
+		return hashring.NewWithWeights(weights)
+	}
+	return hashring.NewWithHashAndWeights(weights, b.hash)
+}
+
+// add add the node to the ring of the name in rings
+func (b ringBuilder) add(rings map[string]*hashring.HashRing, name string, node *Meta) {
+	if ring, ok := rings[name]; ok {
+		rings[name] = ring.AddWeightedNode(node.Id, b.weight(node))
+		return
+	}
+	rings[name] = b.new(node)
+}
+
+// update change the weight of the node on the ring of the name in rings, nodes not on it are skipped
+func (b ringBuilder) update(rings map[string]*hashring.HashRing, name string, node *Meta) {
+	if ring, ok := rings[name]; ok {
+		rings[name] = ring.UpdateWeightedNode(node.Id, b.weight(node))
+	}
+}
+
+func (b ringBuilder) weight(node *Meta) int {
+	return nodeWeight(node) * b.virtualNodes
+}
+
+// ringBuilder returns the builder of the ring of the service
+func (peer *LocalPeer) ringBuilder(name string) ringBuilder {
+	if b, ok := peer.ringBuilders[name]; ok {
+		return b
+	}
+	return peer.defaultRing
+}
+
+// ringNames returns the rings of the node, the ring of its service and the ring of the value
+// of every var of PeerOptions.RingVars the node has
+func (peer *LocalPeer) ringNames(node *Meta) []string {
+	names := []string{node.Name}
+	for _, name := range peer.options.RingVars {
+		if value := node.Vars[name]; value != "" {
+			names = append(names, RingName(name, value))
+		}
+	}
+	return names
+}
+
+// addToRing add the node to the ring of its service and the rings of its vars in rings,
+// the rings of a var use the ring options of the var name
+func (peer *LocalPeer) addToRing(rings map[string]*hashring.HashRing, node *Meta) {
+	peer.ringBuilder(node.Name).add(rings, node.Name, node)
+	for _, name := range peer.options.RingVars {
+		if value := node.Vars[name]; value != "" {
+			peer.ringBuilder(name).add(rings, RingName(name, value), node)
+		}
+	}
+}
+
+// removeFromRing remove the node from the ring of its service and the rings of its vars in rings,
+// the rings of a var are dropped once they are empty
+func (peer *LocalPeer) removeFromRing(rings map[string]*hashring.HashRing, node *Meta) {
+	for i, name := range peer.ringNames(node) {
+		ring, ok := rings[name]
+		if !ok {
+			continue
+		}
+
+		if ring = ring.RemoveNode(node.Id); i > 0 && ring.Size() < 1 {
+			delete(rings, name)
+			continue
+		}
+		rings[name] = ring
+	}
+}
+
+// updateRingWeight change the weight of the node on the ring of its service and the rings of its vars
+// in rings without removing it, it is used when only the weight of a node changed
+func (peer *LocalPeer) updateRingWeight(rings map[string]*hashring.HashRing, node *Meta) {
+	peer.ringBuilder(node.Name).update(rings, node.Name, node)
+	for _, name := range peer.options.RingVars {
+		if value := node.Vars[name]; value != "" {
+			peer.ringBuilder(name).update(rings, RingName(name, value), node)
+		}
+	}
+}
+
+// sameRings reports whether both nodes are on the same rings
+func (peer *LocalPeer) sameRings(node, other *Meta) bool {
+	for _, name := range peer.options.RingVars {
+		if node.Vars[name] != other.Vars[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// ringWeights returns the virtual nodes of every node of the ring of the name by node id,
+// false when there is no such ring
+func (peer *LocalPeer) ringWeights(name string) (map[string]int, bool) {
+	v := peer.view()
+	if _, ok := v.rings[name]; !ok {
+		return nil, false
+	}
+
+	builder := peer.ringBuilder(name)
+	if strings.HasPrefix(name, RING_VAR_PREFIX) {
+		builder = peer.ringBuilder(strings.SplitN(strings.TrimPrefix(name, RING_VAR_PREFIX), "=", 2)[0])
+	}
+
+	weights := make(map[string]int)
+	for _, node := range v.nodes {
+		for _, n := range peer.ringNames(node) {
+			if n == name {
+				weights[node.Id] = builder.weight(node)
+			}
+		}
+	}
+	return weights, true
+}
@@ -0,0 +1,243 @@
+package nakamacluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRingHash(t *testing.T) {
+	for _, hash := range []string{RING_HASH_MD5, RING_HASH_XXHASH, RING_HASH_MURMUR3} {
+		ctx, cancel := context.WithCancel(context.Background())
+		peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Ring: RingOptions{Hash: hash, VirtualNodes: 16}})
+		nodes := make([]*Meta, 0)
+		for i := 0; i < 4; i++ {
+			id := "node" + strconv.Itoa(i)
+			nodes = append(nodes, NewNodeMeta(id, "svc", "127.0.0.1:"+strconv.Itoa(i+1), NODE_TYPE_MICROSERVICES, map[string]string{}))
+		}
+		peer.Sync(nodes...)
+
+		counts := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			node, ok := peer.GetWithHashRing("svc", "key"+strconv.Itoa(i))
+			if !ok {
+				t.Fatalf("%s: key not routed", hash)
+			}
+			counts[node.Id]++
+		}
+
+		if len(counts) != 4 {
+			t.Fatalf("%s: keys routed to %v", hash, counts)
+		}
+		cancel()
+	}
+
+	if err := CheckRingOptions(RingOptions{Hash: "crc"}); err == nil {
+		t.Fatal("expected unknown hash error")
+	}
+}
+
+func TestRingPerService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Rings: map[string]RingOptions{"chat": {Hash: RING_HASH_XXHASH, VirtualNodes: 8}}})
+	peer.Sync(
+		NewNodeMeta("node1", "chat", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{}),
+		NewNodeMeta("node2", "match", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{}),
+	)
+
+	if b := peer.ringBuilder("chat"); b.hash == nil || b.virtualNodes != 8 {
+		t.Fatalf("chat ring %+v", b)
+	}
+
+	if b := peer.ringBuilder("match"); b.hash != nil || b.virtualNodes != 1 {
+		t.Fatalf("match ring %+v", b)
+	}
+}
+
+func TestRingVars(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{RingVars: []string{"region"}})
+	peer.Sync(
+		NewNodeMeta("node1", "match", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{"region": "eu"}),
+		NewNodeMeta("node2", "chat", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{"region": "eu"}),
+		NewNodeMeta("node3", "match", "127.0.0.1:3", NODE_TYPE_MICROSERVICES, map[string]string{"region": "us"}),
+		NewNodeMeta("node4", "match", "127.0.0.1:4", NODE_TYPE_MICROSERVICES, map[string]string{}),
+	)
+
+	routed := func(ring string) map[string]bool {
+		ids := make(map[string]bool)
+		for i := 0; i < 200; i++ {
+			if node, ok := peer.GetWithHashRing(ring, "key"+strconv.Itoa(i)); ok {
+				ids[node.Id] = true
+			}
+		}
+		return ids
+	}
+
+	if ids := routed(RingName("region", "eu")); len(ids) != 2 || !ids["node1"] || !ids["node2"] {
+		t.Fatalf("eu ring routes to %v", ids)
+	}
+
+	if ids := routed("match"); len(ids) != 3 {
+		t.Fatalf("service ring routes to %v", ids)
+	}
+
+	// a node moving to another region moves between the rings
+	moved := NewNodeMeta("node3", "match", "127.0.0.1:3", NODE_TYPE_MICROSERVICES, map[string]string{"region": "eu"})
+	moved.Version = 1
+	peer.Merge(moved)
+	if ids := routed(RingName("region", "us")); len(ids) != 0 {
+		t.Fatalf("us ring routes to %v", ids)
+	}
+
+	if _, ok := peer.view().rings[RingName("region", "us")]; ok {
+		t.Fatal("empty us ring kept")
+	}
+
+	if ids := routed(RingName("region", "eu")); len(ids) != 3 {
+		t.Fatalf("eu ring routes to %v", ids)
+	}
+
+	peer.Quarantine("node1", time.Minute)
+	if ids := routed(RingName("region", "eu")); ids["node1"] {
+		t.Fatal("quarantined node routed")
+	}
+
+	peer.Delete("node2")
+	if ids := routed(RingName("region", "eu")); len(ids) != 1 || !ids["node3"] {
+		t.Fatalf("eu ring routes to %v after delete", ids)
+	}
+}
+
+func TestKeyMapper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{KeyMappers: map[string]KeyMapper{
+		"inventory":   PrefixKeyMapper(":"),
+		"leaderboard": RangeKeyMapper(100),
+	}})
+	nodes := make([]*Meta, 0)
+	for i := 0; i < 8; i++ {
+		id := "node" + strconv.Itoa(i)
+		nodes = append(nodes,
+			NewNodeMeta(id+"i", "inventory", "127.0.0.1:"+strconv.Itoa(i+1), NODE_TYPE_MICROSERVICES, map[string]string{}),
+			NewNodeMeta(id+"l", "leaderboard", "127.0.0.1:"+strconv.Itoa(i+100), NODE_TYPE_MICROSERVICES, map[string]string{}))
+	}
+	peer.Sync(nodes...)
+
+	for i := 0; i < 50; i++ {
+		user := "user" + strconv.Itoa(i)
+		owner, _ := peer.GetWithHashRing("inventory", user)
+		for _, key := range []string{user + ":items", user + ":wallet"} {
+			if node, _ := peer.GetWithHashRing("inventory", key); node.Id != owner.Id {
+				t.Fatalf("%s owned by %s, %s by %s", key, node.Id, user, owner.Id)
+			}
+		}
+
+		first, _ := peer.GetWithHashRing("leaderboard", strconv.Itoa(i*100))
+		last, _ := peer.GetWithHashRing("leaderboard", strconv.Itoa(i*100+99))
+		if first.Id != last.Id {
+			t.Fatalf("range %d split over %s and %s", i, first.Id, last.Id)
+		}
+	}
+
+	if RangeKeyMapper(100)("name") != "name" || PrefixKeyMapper(":")("name") != "name" {
+		t.Fatal("unmapped keys changed")
+	}
+}
+
+func TestAssign(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{KeyMappers: map[string]KeyMapper{"inventory": PrefixKeyMapper(":")}})
+	nodes := make([]*Meta, 0)
+	for i := 0; i < 4; i++ {
+		nodes = append(nodes, NewNodeMeta("node"+strconv.Itoa(i), "inventory", "127.0.0.1:"+strconv.Itoa(i+1), NODE_TYPE_MICROSERVICES, map[string]string{}))
+	}
+	peer.Sync(nodes...)
+
+	keys := make([]string, 0)
+	for i := 0; i < 200; i++ {
+		keys = append(keys, "user"+strconv.Itoa(i/2)+":"+strconv.Itoa(i%2))
+	}
+
+	assigned := peer.Assign("inventory", keys)
+	total := 0
+	for id, owned := range assigned {
+		total += len(owned)
+		for i, key := range owned {
+			if node, _ := peer.GetWithHashRing("inventory", key); node.Id != id {
+				t.Fatalf("%s assigned to %s, owned by %s", key, id, node.Id)
+			}
+
+			if i > 0 && indexOf(keys, owned[i-1]) > indexOf(keys, key) {
+				t.Fatalf("keys of %s out of order %v", id, owned)
+			}
+		}
+	}
+
+	if total != len(keys) || len(assigned) < 2 {
+		t.Fatalf("%d keys assigned to %d nodes", total, len(assigned))
+	}
+
+	if assigned := peer.Assign("chat", keys); len(assigned) != 0 {
+		t.Fatalf("keys of unknown ring assigned %v", assigned)
+	}
+}
+
+func indexOf(keys []string, key string) int {
+	for i, k := range keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestRingWeightUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{RingVars: []string{"region"}})
+	nodes := []*Meta{
+		NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{"region": "eu"}),
+		NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{"region": "eu"}),
+	}
+	peer.Sync(nodes...)
+
+	share := func(ring string) int {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if node, _ := peer.GetWithHashRing(ring, strconv.Itoa(i)); node.Id == "node2" {
+				n++
+			}
+		}
+		return n
+	}
+
+	update := nodes[1].Clone()
+	update.Vars = map[string]string{"region": "eu", VAR_WEIGHT: "9"}
+	update.Version++
+	if !peer.Merge(update) {
+		t.Fatal("update not merged")
+	}
+
+	for _, ring := range []string{"svc", RingName("region", "eu")} {
+		if n := share(ring); n < 800 {
+			t.Fatalf("node2 owns %d of 1000 keys of %s after its weight grew", n, ring)
+		}
+	}
+
+	if size := peer.view().rings["svc"].Size(); size != 2 {
+		t.Fatalf("ring has %d nodes", size)
+	}
+}
@@ -0,0 +1,99 @@
+package nakamacluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/heroiclabs/nakama-common/rtapi"
+	"google.golang.org/protobuf/proto"
+)
+
+// ROUTE_CID cid of envelopes sent by Route, the payload is an api.Message
+// holding the session ids of the node and the marshaled rtapi envelope
+const ROUTE_CID = "nakama.rtapi"
+
+// SessionRef session of a user on a nakama node
+type SessionRef struct {
+	Node      string
+	SessionId string
+}
+
+// RouteError failures of Route by node, the other nodes received the message
+type RouteError map[string]error
+
+func (e RouteError) Error() string {
+	nodes := make([]string, 0, len(e))
+	for node := range e {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	errs := make([]string, len(nodes))
+	for i, node := range nodes {
+		errs[i] = fmt.Sprintf("%s: %v", node, e[node])
+	}
+	return "route failed: " + strings.Join(errs, "; ")
+}
+
+// Route send the rtapi envelope to the sessions, targets are grouped by the node
+// owning them and every node is sent one envelope in parallel. Sessions of the
+// local node are delivered to the delegate. A RouteError reports the nodes that failed.
+func (s *Client) Route(ctx context.Context, rt *rtapi.Envelope, targets []SessionRef) error {
+	content, err := proto.Marshal(rt)
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string][]string)
+	for _, target := range targets {
+		groups[target.Node] = append(groups[target.Node], target.SessionId)
+	}
+
+	local := s.GetLocalNode().Name
+	errs := make(RouteError)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for node, sessions := range groups {
+		in := &api.Envelope{
+			Cid:     ROUTE_CID,
+			Payload: &api.Envelope_Message{Message: &api.Message{SessionID: sessions, Content: content}},
+		}
+
+		wg.Add(1)
+		go func(node string, in *api.Envelope) {
+			defer wg.Done()
+			var err error
+			if node == local {
+				err = s.deliverLocal(in)
+			} else {
+				err = s.sendDirect(ctx, node, in)
+			}
+
+			if err != nil {
+				mu.Lock()
+				errs[node] = err
+				mu.Unlock()
+			}
+		}(node, in)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s *Client) deliverLocal(in *api.Envelope) error {
+	fn, ok := s.delegate.Load().(Delegate)
+	if !ok || fn == nil {
+		return ErrMessageSendFailed
+	}
+
+	_, err := s.notifyDelegate(fn, s.GetLocalNode().Name, in)
+	return err
+}
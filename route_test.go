@@ -0,0 +1,93 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"github.com/heroiclabs/nakama-common/rtapi"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// routeDelegate delegate reporting the routed messages
+type routeDelegate struct {
+	stateDelegate
+	messages chan *api.Message
+}
+
+func (d *routeDelegate) MergeRemoteState(buf []byte, join bool) {}
+
+func (d *routeDelegate) NotifyMsg(node string, msg *api.Envelope) (*api.Envelope, error) {
+	if msg.Cid == ROUTE_CID {
+		d.messages <- msg.GetMessage()
+	}
+	return nil, nil
+}
+
+func TestRoute(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newClient := func(id string) (*Client, *routeDelegate) {
+		config := testConfig(t)
+		config.JoinRetryInterval = 10
+		client := NewClient(ctx, zap.NewNop(), store.NewClient(ctx), id, map[string]string{}, *config)
+		delegate := &routeDelegate{messages: make(chan *api.Message, 4)}
+		client.OnDelegate(delegate)
+		return client, delegate
+	}
+
+	node1, local := newClient("node1")
+	defer node1.Stop()
+	<-node1.wathcer.Registered()
+	node2, remote := newClient("node2")
+	defer node2.Stop()
+	for node1.memberlist.NumMembers() < 2 || node2.memberlist.NumMembers() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("nodes did not join the gossip")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rt := &rtapi.Envelope{Cid: "42"}
+	err := node1.Route(ctx, rt, []SessionRef{
+		{Node: "node1", SessionId: "s1"},
+		{Node: "node2", SessionId: "s2"},
+		{Node: "node2", SessionId: "s3"},
+		{Node: "node9", SessionId: "s4"},
+	})
+
+	// the unknown node fails alone and the other nodes get their sessions in one envelope
+	var routeErr RouteError
+	if !errors.As(err, &routeErr) || len(routeErr) != 1 || !errors.Is(routeErr["node9"], ErrNodeNotFound) {
+		t.Fatalf("unexpected route error %v", err)
+	}
+
+	for _, c := range []struct {
+		delegate *routeDelegate
+		sessions []string
+	}{{local, []string{"s1"}}, {remote, []string{"s2", "s3"}}} {
+		select {
+		case msg := <-c.delegate.messages:
+			sessions := append([]string(nil), msg.SessionID...)
+			sort.Strings(sessions)
+			if len(sessions) != len(c.sessions) || sessions[0] != c.sessions[0] || sessions[len(sessions)-1] != c.sessions[len(c.sessions)-1] {
+				t.Fatalf("unexpected sessions %v", msg.SessionID)
+			}
+
+			var out rtapi.Envelope
+			if err := proto.Unmarshal(msg.Content, &out); err != nil || out.Cid != rt.Cid {
+				t.Fatalf("unexpected content %v %v", out.Cid, err)
+			}
+
+		case <-ctx.Done():
+			t.Fatalf("sessions %v not routed", c.sessions)
+		}
+	}
+}
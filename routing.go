@@ -0,0 +1,255 @@
+package nakamacluster
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+)
+
+const (
+	// ROUTING_CID_PREFIX cids reserved for the routing table export
+	ROUTING_CID_PREFIX = "__routing."
+
+	// ROUTING_CID_TABLE Call returns the routing table, on a Stream the table is sent
+	// right away and again every time it changes until the stream closes
+	ROUTING_CID_TABLE = ROUTING_CID_PREFIX + "table"
+
+	// ROUTING_VAR_VERSION version of the table the caller has, a Call answers
+	// with an empty payload when the table did not change
+	ROUTING_VAR_VERSION = "routing_version"
+
+	// ROUTING_VAR_SELECTOR label selector of the endpoints exported to the caller
+	ROUTING_VAR_SELECTOR = "routing_selector"
+)
+
+// RoutingEndpoint node of a service that receives traffic
+type RoutingEndpoint struct {
+	Id     string            `json:"id"`
+	Addr   string            `json:"addr"`
+	Weight int               `json:"weight"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// RoutingService endpoints of a service sorted by id
+type RoutingService struct {
+	Name      string            `json:"name"`
+	Endpoints []RoutingEndpoint `json:"endpoints"`
+}
+
+// RoutingTable services and the endpoints routing sends them traffic, Version is a
+// hash of the content so peers with the same view export the same version
+type RoutingTable struct {
+	Version  string           `json:"version"`
+	Services []RoutingService `json:"services"`
+}
+
+// NewRoutingTable create the routing table of the nodes, nodes that are not routable are left out
+func NewRoutingTable(nodes ...*Meta) *RoutingTable {
+	services := make(map[string][]RoutingEndpoint)
+	for _, node := range nodes {
+		if !node.Status.Routable() {
+			continue
+		}
+
+		services[node.Name] = append(services[node.Name], RoutingEndpoint{
+			Id:     node.Id,
+			Addr:   node.Addr,
+			Weight: nodeWeight(node),
+			Labels: node.Labels,
+		})
+	}
+
+	t := &RoutingTable{Services: make([]RoutingService, 0, len(services))}
+	for name, endpoints := range services {
+		sort.Slice(endpoints, func(i, j int) bool {
+			return endpoints[i].Id < endpoints[j].Id
+		})
+		t.Services = append(t.Services, RoutingService{Name: name, Endpoints: endpoints})
+	}
+
+	sort.Slice(t.Services, func(i, j int) bool {
+		return t.Services[i].Name < t.Services[j].Name
+	})
+	t.Version = t.version()
+	return t
+}
+
+// Select returns the table of the endpoints whose labels match the selector
+func (t *RoutingTable) Select(s Selector) *RoutingTable {
+	selected := &RoutingTable{Services: make([]RoutingService, 0, len(t.Services))}
+	for _, service := range t.Services {
+		endpoints := make([]RoutingEndpoint, 0, len(service.Endpoints))
+		for _, endpoint := range service.Endpoints {
+			if s.Matches(endpoint.Labels) {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+
+		if len(endpoints) > 0 {
+			selected.Services = append(selected.Services, RoutingService{Name: service.Name, Endpoints: endpoints})
+		}
+	}
+	selected.Version = selected.version()
+	return selected
+}
+
+func (t *RoutingTable) version() string {
+	h := fnv.New64a()
+	for _, service := range t.Services {
+		h.Write([]byte(service.Name))
+		h.Write([]byte{0})
+		for _, endpoint := range service.Endpoints {
+			h.Write([]byte(endpoint.Id))
+			h.Write([]byte{0})
+			h.Write([]byte(endpoint.Addr))
+			h.Write([]byte{0})
+			h.Write([]byte(strconv.Itoa(endpoint.Weight)))
+			h.Write([]byte{0})
+			keys := make([]string, 0, len(endpoint.Labels))
+			for k := range endpoint.Labels {
+				keys = append(keys, k)
+			}
+
+			sort.Strings(keys)
+			for _, k := range keys {
+				h.Write([]byte(k + "=" + endpoint.Labels[k]))
+				h.Write([]byte{0})
+			}
+		}
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// RoutingTable export the routing table of the current view, quarantined and cordoned nodes are left out
+func (peer *LocalPeer) RoutingTable() *RoutingTable {
+	v := peer.view()
+	now := time.Now()
+	nodes := make([]*Meta, 0, len(v.nodes))
+	for id, node := range v.nodes {
+		if !peer.flaps.quarantined(id, now) && !peer.Cordoned(id) {
+			nodes = append(nodes, node)
+		}
+	}
+	return NewRoutingTable(nodes...)
+}
+
+// routingTable returns the table of the peers filtered by the selector of the request
+func (s *Server) routingTable(in *api.Envelope) (*RoutingTable, error) {
+	t := s.peers.RoutingTable()
+	if selector := in.Vars[ROUTING_VAR_SELECTOR]; selector != "" {
+		sel, err := ParseSelector(selector)
+		if err != nil {
+			return nil, api.NewError(api.Error_INVALID_ARGUMENT, err.Error())
+		}
+		t = t.Select(sel)
+	}
+	return t, nil
+}
+
+// handleRoutingTable answer a Call for the routing table
+func (s *Server) handleRoutingTable(in *api.Envelope) (*api.Envelope, error) {
+	t, err := s.routingTable(in)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &api.Envelope{Cid: in.Cid, Vars: map[string]string{ROUTING_VAR_VERSION: t.Version}}
+	if t.Version == in.Vars[ROUTING_VAR_VERSION] {
+		return out, nil
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+
+	out.Payload = &api.Envelope_Bytes{Bytes: b}
+	return out, nil
+}
+
+// watchRoutingTable send the routing table to the stream every time it changes
+// until ctx is done, changes made while a table is sent are coalesced
+func (s *Server) watchRoutingTable(ctx context.Context, in *api.Envelope, out chan<- *api.Envelope) {
+	changed := make(chan struct{}, 1)
+	unsubscribe := s.events.Subscribe(func(e Event) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	request := &api.Envelope{Cid: in.Cid, Vars: map[string]string{ROUTING_VAR_SELECTOR: in.Vars[ROUTING_VAR_SELECTOR]}}
+	version := in.Vars[ROUTING_VAR_VERSION]
+	for {
+		request.Vars[ROUTING_VAR_VERSION] = version
+		reply, err := s.handleRoutingTable(request)
+		if err != nil {
+			reply = &api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Error{Error: api.AsError(err)}}
+		}
+
+		if err != nil || reply.Payload != nil {
+			reply.Id = in.Id
+			select {
+			case out <- reply:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+
+		version = reply.Vars[ROUTING_VAR_VERSION]
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// WatchRoutingTable subscribe to the routing table of the node over the stream and call fn
+// with every new table until ctx is done or the stream fails, selector may be empty
+func WatchRoutingTable(ctx context.Context, client api.ApiServerClient, selector string, fn func(t *RoutingTable)) error {
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		return err
+	}
+
+	in := &api.Envelope{Cid: ROUTING_CID_TABLE, Vars: map[string]string{ROUTING_VAR_SELECTOR: selector}}
+	stampEnvelopeVersion(in)
+	if err := stream.Send(in); err != nil {
+		return err
+	}
+
+	for {
+		out, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		if out.Cid != ROUTING_CID_TABLE {
+			continue
+		}
+
+		if e := out.GetError(); e != nil {
+			return e
+		}
+
+		var t RoutingTable
+		if err := json.Unmarshal(out.GetBytes(), &t); err != nil {
+			return err
+		}
+		fn(&t)
+	}
+}
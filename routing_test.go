@@ -0,0 +1,120 @@
+package nakamacluster
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestNewRoutingTable(t *testing.T) {
+	node1 := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{"weight": "3"})
+	node2 := NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{})
+	node2.Labels = map[string]string{"zone": "a"}
+	node3 := NewNodeMeta("node3", "svc", "127.0.0.1:3", NODE_TYPE_MICROSERVICES, map[string]string{})
+	node3.Status = META_STATUS_DRAINING
+
+	table := NewRoutingTable(node2, node3, node1)
+	if len(table.Services) != 1 || len(table.Services[0].Endpoints) != 2 {
+		t.Fatalf("unexpected table %+v", table)
+	}
+
+	if e := table.Services[0].Endpoints[0]; e.Id != "node1" || e.Weight != 3 {
+		t.Fatalf("unexpected endpoint %+v", e)
+	}
+
+	if NewRoutingTable(node1, node2).Version != table.Version {
+		t.Fatal("version depends on the order of the nodes")
+	}
+
+	node2.Labels = map[string]string{"zone": "b"}
+	if NewRoutingTable(node1, node2).Version == table.Version {
+		t.Fatal("version not changed by the labels")
+	}
+
+	selector, err := ParseSelector("zone=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected := NewRoutingTable(node1, node2).Select(selector)
+	if len(selected.Services) != 1 || len(selected.Services[0].Endpoints) != 1 || selected.Services[0].Endpoints[0].Id != "node2" {
+		t.Fatalf("unexpected selected table %+v", selected)
+	}
+}
+
+func TestWatchRoutingTable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	config := testConfig(t)
+	server := NewServer(ctx, zap.NewNop(), store.NewClient(ctx), "node1", "svc", map[string]string{}, *config)
+	server.OnDelegate(echoServerDelegate{})
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(ctx, net.JoinHostPort(config.Addr, strconv.Itoa(config.Port)), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tables := make(chan *RoutingTable, 8)
+	go WatchRoutingTable(ctx, api.NewApiServerClient(conn), "", func(t *RoutingTable) {
+		tables <- t
+	})
+
+	next := func() *RoutingTable {
+		select {
+		case table := <-tables:
+			return table
+		case <-ctx.Done():
+			t.Fatal("routing table not received")
+		}
+		return nil
+	}
+
+	exported := func(table *RoutingTable) bool {
+		for _, service := range table.Services {
+			for _, endpoint := range service.Endpoints {
+				if endpoint.Id == "node2" {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	backendConfig := testConfig(t)
+	backend := NewServer(ctx, zap.NewNop(), store.NewClient(ctx), "node2", "backend", map[string]string{}, *backendConfig)
+	defer backend.Stop()
+
+	table := next()
+	for !exported(table) {
+		table = next()
+	}
+
+	if err := backend.UpdateMeta(META_STATUS_DRAINING, map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for exported(table) {
+		table = next()
+	}
+
+	out, err := api.NewApiServerClient(conn).Call(ctx, &api.Envelope{Cid: ROUTING_CID_TABLE, Vars: map[string]string{ROUTING_VAR_VERSION: table.Version}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Payload != nil || out.Vars[ROUTING_VAR_VERSION] != table.Version {
+		t.Fatalf("expected unchanged reply, got %v", out)
+	}
+}
@@ -68,7 +68,7 @@ func (s *Delegate) NotifyMsg(node string, msg *api.Envelope) (*api.Envelope, err
 // Call rpc call
 func (s *Delegate) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
 	s.logger.Info("Call", zap.String("CID", in.Cid))
-	return &api.Envelope{Cid: "22", Payload: &api.Envelope_Error{Error: &api.Error{Code: 500, Message: s.conn.GetLocalNode().Name}}}, nil
+	return &api.Envelope{Cid: "22", Payload: &api.Envelope_Error{Error: api.NewError(api.Error_INTERNAL, s.conn.GetLocalNode().Name)}}, nil
 }
 
 // Stream rpc stream
@@ -105,10 +105,10 @@ func main() {
 		log.Fatal("Failed to connect to etcd", zap.Error(err))
 	}
 
-	c := nakamacluster.NewConfig()
-	c.Port = 10000 + rand.Intn(10000)
-	c.RetransmitMult = 5
-	c.Prefix = "/nk/samples/"
+	c := nakamacluster.NewConfigLocal(func(c *nakamacluster.Config) {
+		c.Port = 10000 + rand.Intn(10000)
+		c.Prefix = "/nk/samples/"
+	})
 	serverId := fmt.Sprintf("node-%d", rand.Intn(10000))
 	vars := map[string]string{"weight": "1", "nakama-rpc": strconv.Itoa(c.Port)}
 	node := nakamacluster.NewNodeMetaFromConfig(serverId, "nakama", nakamacluster.NODE_TYPE_NAKAMA, vars, *c)
@@ -127,14 +127,13 @@ func main() {
 		SanitizeOptions: &prometheus.DefaultSanitizerOpts,
 	}, time.Duration(5)*time.Second)
 
-	_ = scope
-	s := nakamacluster.NewClient(ctx, log, client, serverId, make(map[string]string), *c)
+	s := nakamacluster.NewClient(ctx, log, client, serverId, make(map[string]string), *c, nakamacluster.WithMetricsScope(scope))
 	s.OnDelegate(&Delegate{logger: log, conn: s})
 
-	c2 := nakamacluster.NewConfig()
-	c2.Port = 10000 + rand.Intn(10000)
-	c2.RetransmitMult = 5
-	c2.Prefix = "/nk/samples/"
+	c2 := nakamacluster.NewConfigLocal(func(c *nakamacluster.Config) {
+		c.Port = 10000 + rand.Intn(10000)
+		c.Prefix = "/nk/samples/"
+	})
 	serverId2 := fmt.Sprintf("node-server-%d", rand.Intn(10000))
 	client2, err := sd.NewEtcdV3Client(ctx, []string{"127.0.0.1:12379", "127.0.0.1:22379", "127.0.0.1:32379"}, sd.EtcdClientOptions{})
 	if err != nil {
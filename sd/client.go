@@ -1,6 +1,9 @@
 package sd
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 var (
 	// ErrNoKey indicates a client method needs a key but receives none.
@@ -8,6 +11,9 @@ var (
 
 	// ErrNoValue indicates a client method needs a value but receives none.
 	ErrNoValue = errors.New("no value provided")
+
+	// ErrKeyWatchUnsupported indicates a client does not implement KeyWatcher.
+	ErrKeyWatchUnsupported = errors.New("key watch unsupported")
 )
 
 // Client is a wrapper around the etcd client.
@@ -32,9 +38,64 @@ type Client interface {
 	// Deregister a service with etcd.
 	Deregister(s Service) error
 
-	// Update a service with etcd.
+	// Update a service with etcd. Without a registered service the
+	// current lease of the key is kept.
 	Update(s Service) error
 
 	// LeaseID returns the lease id created for this service instance
 	LeaseID() int64
 }
+
+// ResyncNotifier is implemented by clients whose watches can lose changes,
+// e.g. when the revision a watch resumes from was compacted.
+type ResyncNotifier interface {
+	// OnResync sets the handler called when a watch lost changes, the
+	// entries must be read again in full and not patched.
+	OnResync(f func(err error))
+}
+
+// KeyEventType type of a change of a watched key
+type KeyEventType int
+
+const (
+	// KeyEventPut the key was created or its value changed
+	KeyEventPut KeyEventType = iota + 1
+
+	// KeyEventDelete the key was deleted or its lease expired
+	KeyEventDelete
+
+	// KeyEventResync the watch lost changes, the keys must be read again in full
+	KeyEventResync
+)
+
+// KeyEvent change of a key under a watched prefix
+type KeyEvent struct {
+	Type  KeyEventType
+	Key   string
+	Value string
+
+	// Revision of the store the change was made at, zero when the store has no revisions
+	Revision int64
+}
+
+// KeyWatcher is implemented by clients exposing the keys of arbitrary prefixes, so
+// applications reuse the sd session for their own coordination data.
+type KeyWatcher interface {
+	// GetKeys returns the values of the keys under the prefix by key.
+	GetKeys(prefix string) (map[string]string, error)
+
+	// WatchKeys sends every change of the keys under the prefix made after the
+	// watch started on ch. When changes were lost a KeyEventResync is sent and the
+	// keys should be read again with GetKeys. WatchKeys blocks until ctx is done.
+	WatchKeys(ctx context.Context, prefix string, ch chan<- KeyEvent)
+}
+
+// KeyWriter is implemented by clients writing arbitrary keys, the keys are not bound to
+// the lease of a registered service and outlive the client.
+type KeyWriter interface {
+	// PutKey sets the value of the key.
+	PutKey(key, value string) error
+
+	// DeleteKey deletes the key, deleting a missing key is not an error.
+	DeleteKey(key string) error
+}
@@ -3,13 +3,22 @@ package sd
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"math/rand"
+	"sync/atomic"
 	"time"
 
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/pkg/v3/transport"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"google.golang.org/grpc"
 )
 
+const (
+	watchMinBackoff = 500 * time.Millisecond
+	watchMaxBackoff = 30 * time.Second
+)
+
 type EtcdV3Client struct {
 	cli *clientv3.Client
 	ctx context.Context
@@ -29,6 +38,9 @@ type EtcdV3Client struct {
 	hbch <-chan *clientv3.LeaseKeepAliveResponse
 	// Lease interface instance, used to leverage Lease.Close()
 	leaser clientv3.Lease
+
+	// called when a watch lost changes
+	onResync atomic.Value
 }
 
 // ClientOptions defines options for the etcd client. All values are optional.
@@ -112,21 +124,227 @@ func (c *EtcdV3Client) GetEntries(key string) ([]string, error) {
 	return entries, nil
 }
 
-// WatchPrefix implements the etcd Client interface.
+// WatchPrefix implements the etcd Client interface. The watch resumes after the last
+// revision it saw when the connection drops, reconnects back off with jitter. When the
+// revision was compacted changes were lost, the resync handler is called and ch signaled
+// so the entries are read again in full. Before ch is signaled for a full read the
+// current revision is taken, the watch starts after it so no change is missed.
 func (c *EtcdV3Client) WatchPrefix(prefix string, ch chan struct{}) {
 	c.wctx, c.wcf = context.WithCancel(c.ctx)
-	c.watcher = clientv3.NewWatcher(c.cli)
+	wctx := c.wctx
+
+	var rev int64
+	backoff := watchMinBackoff
+	for {
+		var err error
+		if rev == 0 {
+			rev, err = c.revision(wctx, prefix)
+			if err == nil {
+				select {
+				case ch <- struct{}{}:
+				case <-wctx.Done():
+					return
+				}
+			}
+		}
+
+		if err == nil {
+			watcher := clientv3.NewWatcher(c.cli)
+			c.watcher = watcher
+			wch := watcher.Watch(clientv3.WithRequireLeader(wctx), prefix, clientv3.WithPrefix(), clientv3.WithProgressNotify(), clientv3.WithRev(rev+1))
+			err = c.watch(wctx, wch, ch, &rev, &backoff)
+			watcher.Close()
+		}
+
+		if wctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, rpctypes.ErrCompacted) {
+			rev = 0
+			c.resync(err)
+			continue
+		}
+
+		select {
+		case <-time.After(jitter(backoff)):
+		case <-wctx.Done():
+			return
+		}
 
-	wch := c.watcher.Watch(c.wctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(0))
-	ch <- struct{}{}
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+}
+
+// revision returns the current revision of the store
+func (c *EtcdV3Client) revision(ctx context.Context, prefix string) (int64, error) {
+	resp, err := c.kv.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// watch signal ch for every change until the watch ends, it tracks the last revision seen
+func (c *EtcdV3Client) watch(ctx context.Context, wch clientv3.WatchChan, ch chan struct{}, rev *int64, backoff *time.Duration) error {
 	for wr := range wch {
-		if wr.Canceled {
+		if err := wr.Err(); err != nil {
+			return err
+		}
+
+		*backoff = watchMinBackoff
+		if wr.Header.Revision > *rev {
+			*rev = wr.Header.Revision
+		}
+
+		if len(wr.Events) < 1 {
+			continue
+		}
+
+		select {
+		case ch <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// GetKeys implements the KeyWatcher interface.
+func (c *EtcdV3Client) GetKeys(prefix string) (map[string]string, error) {
+	resp, err := c.kv.Get(c.ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		keys[string(kv.Key)] = string(kv.Value)
+	}
+	return keys, nil
+}
+
+// WatchKeys implements the KeyWatcher interface. Like WatchPrefix the watch resumes after
+// the last revision it saw, a KeyEventResync is sent when the revision was compacted or
+// the watch broke before it saw one. The watch starts after the revision taken before the
+// resync is sent so no change is missed.
+func (c *EtcdV3Client) WatchKeys(ctx context.Context, prefix string, ch chan<- KeyEvent) {
+	var rev int64
+	backoff := watchMinBackoff
+	lost := false
+	for {
+		var err error
+		if lost {
+			if rev, err = c.revision(ctx, prefix); err == nil {
+				lost = false
+				select {
+				case ch <- KeyEvent{Type: KeyEventResync}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		if err == nil {
+			opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithProgressNotify()}
+			if rev > 0 {
+				opts = append(opts, clientv3.WithRev(rev+1))
+			}
+
+			watcher := clientv3.NewWatcher(c.cli)
+			err = c.watchKeys(ctx, watcher.Watch(clientv3.WithRequireLeader(ctx), prefix, opts...), ch, &rev, &backoff)
+			watcher.Close()
+		}
+
+		if ctx.Err() != nil {
 			return
 		}
-		ch <- struct{}{}
+
+		if errors.Is(err, rpctypes.ErrCompacted) {
+			rev = 0
+			lost = true
+			continue
+		}
+
+		lost = lost || rev == 0
+		select {
+		case <-time.After(jitter(backoff)):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
 	}
 }
 
+// watchKeys send the events of the watch on ch until the watch ends, it tracks the last revision seen
+func (c *EtcdV3Client) watchKeys(ctx context.Context, wch clientv3.WatchChan, ch chan<- KeyEvent, rev *int64, backoff *time.Duration) error {
+	for wr := range wch {
+		if err := wr.Err(); err != nil {
+			return err
+		}
+
+		*backoff = watchMinBackoff
+		if wr.Header.Revision > *rev {
+			*rev = wr.Header.Revision
+		}
+
+		for _, ev := range wr.Events {
+			e := KeyEvent{Type: KeyEventPut, Key: string(ev.Kv.Key), Value: string(ev.Kv.Value), Revision: ev.Kv.ModRevision}
+			if ev.Type == clientv3.EventTypeDelete {
+				e.Type = KeyEventDelete
+			}
+
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// PutKey implements the KeyWriter interface.
+func (c *EtcdV3Client) PutKey(key, value string) error {
+	if key == "" {
+		return ErrNoKey
+	}
+
+	_, err := c.kv.Put(c.ctx, key, value)
+	return err
+}
+
+// DeleteKey implements the KeyWriter interface.
+func (c *EtcdV3Client) DeleteKey(key string) error {
+	if key == "" {
+		return ErrNoKey
+	}
+
+	_, err := c.kv.Delete(c.ctx, key)
+	return err
+}
+
+// OnResync implements the ResyncNotifier interface.
+func (c *EtcdV3Client) OnResync(f func(err error)) {
+	c.onResync.Store(f)
+}
+
+func (c *EtcdV3Client) resync(err error) {
+	if f, ok := c.onResync.Load().(func(err error)); ok && f != nil {
+		f(err)
+	}
+}
+
+// jitter returns a random duration between half d and d
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func (c *EtcdV3Client) Register(s Service) error {
 	var err error
 
@@ -201,6 +419,9 @@ func (c *EtcdV3Client) Deregister(s Service) error {
 	if s.Key == "" {
 		return ErrNoKey
 	}
+	if s.KeepKey {
+		return nil
+	}
 	if _, err := c.cli.Delete(c.ctx, s.Key, clientv3.WithIgnoreLease()); err != nil {
 		return err
 	}
@@ -208,12 +429,19 @@ func (c *EtcdV3Client) Deregister(s Service) error {
 	return nil
 }
 
+// Update a service with etcd, a client that did not register a service
+// keeps the current lease of the key, which allows updating other services
 func (c *EtcdV3Client) Update(s Service) error {
 	if s.Key == "" {
 		return ErrNoKey
 	}
 
-	if _, err := c.cli.Put(c.ctx, s.Key, s.Value, clientv3.WithLease(c.leaseID)); err != nil {
+	opt := clientv3.WithLease(c.leaseID)
+	if c.leaseID == clientv3.NoLease {
+		opt = clientv3.WithIgnoreLease()
+	}
+
+	if _, err := c.cli.Put(c.ctx, s.Key, s.Value, opt); err != nil {
 		return err
 	}
 
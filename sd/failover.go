@@ -0,0 +1,443 @@
+package sd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoHealthyBackend indicates every backend of a failover client failed.
+	ErrNoHealthyBackend = errors.New("no healthy sd backend")
+
+	// ErrBackendFailover is the resync reason when the active backend changed.
+	ErrBackendFailover = errors.New("sd backend failover")
+)
+
+// FailoverOptions defines options for the failover client. All values are optional.
+type FailoverOptions struct {
+	// CheckInterval is the interval between health checks of the backends, default 3s.
+	CheckInterval time.Duration
+
+	// CheckTimeout is the time a health check may take before the backend
+	// is considered down, default 2s.
+	CheckTimeout time.Duration
+
+	// CheckPrefix is the prefix read by the health checks, it should hold
+	// no or few keys, default "/__sd_health".
+	CheckPrefix string
+
+	// OnFailover is called with the indexes of the backends when the active backend changes.
+	OnFailover func(from, to int)
+}
+
+// FailoverClient is a Client over a list of backends in priority order. Reads and
+// watches use the first healthy backend, services are registered with every backend
+// so a standby backend already knows them when it takes over, and they are registered
+// again when a backend recovers.
+type FailoverClient struct {
+	ctx      context.Context
+	backends []Client
+	healthy  []bool
+	active   int
+	services map[string]Service
+	watchers map[chan struct{}]struct{}
+	onResync func(err error)
+	options  FailoverOptions
+	sync.RWMutex
+}
+
+// NewFailoverClient returns Client that fails over between the backends, the
+// first backend is the primary. Health checks run until ctx is done.
+func NewFailoverClient(ctx context.Context, options FailoverOptions, backends ...Client) (*FailoverClient, error) {
+	if len(backends) < 1 {
+		return nil, ErrNoHealthyBackend
+	}
+
+	if options.CheckInterval <= 0 {
+		options.CheckInterval = 3 * time.Second
+	}
+
+	if options.CheckTimeout <= 0 {
+		options.CheckTimeout = 2 * time.Second
+	}
+
+	if options.CheckPrefix == "" {
+		options.CheckPrefix = "/__sd_health"
+	}
+
+	c := &FailoverClient{
+		ctx:      ctx,
+		backends: backends,
+		healthy:  make([]bool, len(backends)),
+		services: make(map[string]Service),
+		watchers: make(map[chan struct{}]struct{}),
+		options:  options,
+	}
+
+	for i := range c.healthy {
+		c.healthy[i] = true
+	}
+
+	go c.checkLoop()
+	return c, nil
+}
+
+// Active returns the index of the backend used for reads and watches.
+func (c *FailoverClient) Active() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.active
+}
+
+// GetEntries implements the sd Client interface. It reads the active backend and
+// fails over to the next healthy backend when the read fails.
+func (c *FailoverClient) GetEntries(prefix string) ([]string, error) {
+	var err error
+	for _, i := range c.candidates() {
+		var entries []string
+		entries, err = c.backends[i].GetEntries(prefix)
+		if err == nil {
+			return entries, nil
+		}
+		c.setHealthy(i, false)
+	}
+
+	if err == nil {
+		err = ErrNoHealthyBackend
+	}
+	return nil, err
+}
+
+// WatchPrefix implements the sd Client interface. Every backend is watched, a change
+// on any of them or a failover signals ch, so clients read the entries of the active
+// backend again.
+func (c *FailoverClient) WatchPrefix(prefix string, ch chan struct{}) {
+	notify := make(chan struct{}, 1)
+	c.Lock()
+	c.watchers[notify] = struct{}{}
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		delete(c.watchers, notify)
+		c.Unlock()
+	}()
+
+	for _, backend := range c.backends {
+		go c.watchBackend(backend, prefix, notify)
+	}
+
+	ch <- struct{}{}
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-notify:
+			select {
+			case ch <- struct{}{}:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// watchBackend watch the prefix on the backend, the watch is started again when
+// the backend ends it before ctx is done
+func (c *FailoverClient) watchBackend(backend Client, prefix string, notify chan struct{}) {
+	ch := make(chan struct{})
+	go func() {
+		for {
+			backend.WatchPrefix(prefix, ch)
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(c.options.CheckInterval):
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ch:
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// GetKeys implements the KeyWatcher interface. It reads the active backend and fails
+// over to the next healthy backend like GetEntries.
+func (c *FailoverClient) GetKeys(prefix string) (map[string]string, error) {
+	err := ErrKeyWatchUnsupported
+	for _, i := range c.candidates() {
+		w, ok := c.backends[i].(KeyWatcher)
+		if !ok {
+			continue
+		}
+
+		var keys map[string]string
+		if keys, err = w.GetKeys(prefix); err == nil {
+			return keys, nil
+		}
+		c.setHealthy(i, false)
+	}
+	return nil, err
+}
+
+// WatchKeys implements the KeyWatcher interface. Only the active backend is watched,
+// on a failover a KeyEventResync is sent and the new active backend is watched.
+func (c *FailoverClient) WatchKeys(ctx context.Context, prefix string, ch chan<- KeyEvent) {
+	notify := make(chan struct{}, 1)
+	c.Lock()
+	c.watchers[notify] = struct{}{}
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		delete(c.watchers, notify)
+		c.Unlock()
+	}()
+
+	for {
+		wctx, cancel := context.WithCancel(ctx)
+		if w, ok := c.backends[c.Active()].(KeyWatcher); ok {
+			go w.WatchKeys(wctx, prefix, ch)
+		}
+
+		select {
+		case <-notify:
+			cancel()
+		case <-ctx.Done():
+			cancel()
+			return
+		case <-c.ctx.Done():
+			cancel()
+			return
+		}
+
+		select {
+		case ch <- KeyEvent{Type: KeyEventResync}:
+		case <-ctx.Done():
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// PutKey implements the KeyWriter interface. Like services the key is written to every
+// backend, backends not writing keys are skipped.
+func (c *FailoverClient) PutKey(key, value string) error {
+	return c.each(func(backend Client) error {
+		w, ok := backend.(KeyWriter)
+		if !ok {
+			return nil
+		}
+		return w.PutKey(key, value)
+	})
+}
+
+// DeleteKey implements the KeyWriter interface, the key is deleted from every backend.
+func (c *FailoverClient) DeleteKey(key string) error {
+	return c.each(func(backend Client) error {
+		w, ok := backend.(KeyWriter)
+		if !ok {
+			return nil
+		}
+		return w.DeleteKey(key)
+	})
+}
+
+// Register implements the sd Client interface. The service is registered with every
+// backend, it fails only when no backend registered it.
+func (c *FailoverClient) Register(s Service) error {
+	if s.Key == "" {
+		return ErrNoKey
+	}
+
+	c.Lock()
+	c.services[s.Key] = s
+	c.Unlock()
+	return c.each(func(backend Client) error { return backend.Register(s) })
+}
+
+// Deregister implements the sd Client interface.
+func (c *FailoverClient) Deregister(s Service) error {
+	if s.Key == "" {
+		return ErrNoKey
+	}
+
+	c.Lock()
+	delete(c.services, s.Key)
+	c.Unlock()
+	return c.each(func(backend Client) error { return backend.Deregister(s) })
+}
+
+// Update implements the sd Client interface.
+func (c *FailoverClient) Update(s Service) error {
+	if s.Key == "" {
+		return ErrNoKey
+	}
+
+	c.Lock()
+	if registered, ok := c.services[s.Key]; ok {
+		s.TTL = registered.TTL
+		c.services[s.Key] = s
+	}
+	c.Unlock()
+	return c.each(func(backend Client) error { return backend.Update(s) })
+}
+
+// OnResync implements the ResyncNotifier interface. The handler is called when a
+// backend watch lost changes and when the active backend changed.
+func (c *FailoverClient) OnResync(f func(err error)) {
+	c.Lock()
+	c.onResync = f
+	c.Unlock()
+	for _, backend := range c.backends {
+		if n, ok := backend.(ResyncNotifier); ok {
+			n.OnResync(f)
+		}
+	}
+}
+
+// LeaseID implements the sd Client interface, it returns the lease of the active backend.
+func (c *FailoverClient) LeaseID() int64 {
+	return c.backends[c.Active()].LeaseID()
+}
+
+// each call fn for every healthy backend, it returns the last error when fn failed for all of them
+func (c *FailoverClient) each(fn func(backend Client) error) error {
+	var err error
+	ok := false
+	for _, i := range c.candidates() {
+		if e := fn(c.backends[i]); e != nil {
+			c.setHealthy(i, false)
+			err = e
+			continue
+		}
+		ok = true
+	}
+
+	if ok {
+		return nil
+	}
+
+	if err == nil {
+		err = ErrNoHealthyBackend
+	}
+	return err
+}
+
+// candidates returns the healthy backends in priority order, every backend when none is healthy
+func (c *FailoverClient) candidates() []int {
+	c.RLock()
+	defer c.RUnlock()
+	healthy := make([]int, 0, len(c.backends))
+	for i, ok := range c.healthy {
+		if ok {
+			healthy = append(healthy, i)
+		}
+	}
+
+	if len(healthy) > 0 {
+		return healthy
+	}
+
+	for i := range c.backends {
+		healthy = append(healthy, i)
+	}
+	return healthy
+}
+
+// setHealthy record the health of the backend and elect the first healthy backend
+func (c *FailoverClient) setHealthy(i int, healthy bool) {
+	c.Lock()
+	if c.healthy[i] == healthy {
+		c.Unlock()
+		return
+	}
+
+	c.healthy[i] = healthy
+	from := c.active
+	for j, ok := range c.healthy {
+		if ok {
+			c.active = j
+			break
+		}
+	}
+
+	to := c.active
+	if from != to {
+		for notify := range c.watchers {
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	onResync := c.onResync
+	services := make([]Service, 0, len(c.services))
+	if healthy {
+		for _, s := range c.services {
+			services = append(services, s)
+		}
+	}
+	c.Unlock()
+
+	for _, s := range services {
+		c.backends[i].Register(s)
+	}
+
+	if from == to {
+		return
+	}
+
+	if c.options.OnFailover != nil {
+		c.options.OnFailover(from, to)
+	}
+
+	if onResync != nil {
+		onResync(ErrBackendFailover)
+	}
+}
+
+func (c *FailoverClient) checkLoop() {
+	t := time.NewTicker(c.options.CheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for i := range c.backends {
+				c.setHealthy(i, c.check(i))
+			}
+
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// check reports whether the backend answers a read within the timeout
+func (c *FailoverClient) check(i int) bool {
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.backends[i].GetEntries(c.options.CheckPrefix)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(c.options.CheckTimeout):
+		return false
+	}
+}
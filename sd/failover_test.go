@@ -0,0 +1,187 @@
+package sd
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errBackendDown = errors.New("backend down")
+
+// flakyClient memory client that fails every call while down
+type flakyClient struct {
+	Client
+	down int32
+}
+
+func (c *flakyClient) setDown(down bool) {
+	v := int32(0)
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&c.down, v)
+}
+
+func (c *flakyClient) isDown() bool {
+	return atomic.LoadInt32(&c.down) == 1
+}
+
+func (c *flakyClient) GetEntries(prefix string) ([]string, error) {
+	if c.isDown() {
+		return nil, errBackendDown
+	}
+	return c.Client.GetEntries(prefix)
+}
+
+func (c *flakyClient) Register(s Service) error {
+	if c.isDown() {
+		return errBackendDown
+	}
+	return c.Client.Register(s)
+}
+
+func TestFailoverClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	primaryStore, standbyStore := NewMemoryStore(), NewMemoryStore()
+	primary := &flakyClient{Client: primaryStore.NewClient(ctx)}
+	standby := &flakyClient{Client: standbyStore.NewClient(ctx)}
+	failovers := make(chan int, 4)
+	resyncs := make(chan error, 4)
+	c, err := NewFailoverClient(ctx, FailoverOptions{CheckInterval: 20 * time.Millisecond, OnFailover: func(from, to int) { failovers <- to }}, primary, standby)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.OnResync(func(err error) { resyncs <- err })
+	if err := c.Register(Service{Key: "/nodes/node1", Value: "node1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []Client{primary, standby} {
+		if entries, _ := client.GetEntries("/nodes/"); len(entries) != 1 {
+			t.Fatalf("service not registered with every backend, got %v", entries)
+		}
+	}
+
+	watch := make(chan struct{}, 8)
+	go c.WatchPrefix("/nodes/", watch)
+	<-watch
+
+	primary.setDown(true)
+	primaryStore.NewClient(ctx).Deregister(Service{Key: "/nodes/node1"})
+	entries, err := c.GetEntries("/nodes/")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("read not served by the standby, got %v %v", entries, err)
+	}
+
+	select {
+	case to := <-failovers:
+		if to != 1 {
+			t.Fatalf("failed over to %d", to)
+		}
+	case <-ctx.Done():
+		t.Fatal("no failover")
+	}
+
+	if err := <-resyncs; !errors.Is(err, ErrBackendFailover) {
+		t.Fatalf("unexpected resync reason %v", err)
+	}
+
+	primary.setDown(false)
+	select {
+	case to := <-failovers:
+		if to != 0 {
+			t.Fatalf("failed back to %d", to)
+		}
+	case <-ctx.Done():
+		t.Fatal("no failback")
+	}
+
+	if entries, _ := primary.GetEntries("/nodes/"); len(entries) != 1 {
+		t.Fatalf("service not registered again with the recovered backend, got %v", entries)
+	}
+
+	primary.setDown(true)
+	standby.setDown(true)
+	if _, err := c.GetEntries("/nodes/"); err == nil {
+		t.Fatal("expected error when every backend is down")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < 500*time.Millisecond || d > time.Second {
+			t.Fatalf("jitter out of range %v", d)
+		}
+	}
+}
+
+func TestWatchKeys(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	primaryStore, standbyStore := NewMemoryStore(), NewMemoryStore()
+	c, err := NewFailoverClient(ctx, FailoverOptions{CheckInterval: time.Minute}, primaryStore.NewClient(ctx), standbyStore.NewClient(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(ch chan KeyEvent) KeyEvent {
+		select {
+		case e := <-ch:
+			return e
+		case <-ctx.Done():
+			t.Fatal("no key event")
+		}
+		return KeyEvent{}
+	}
+
+	events := make(chan KeyEvent)
+	go c.WatchKeys(ctx, "/app/", events)
+	time.Sleep(20 * time.Millisecond)
+
+	primary := primaryStore.NewClient(ctx)
+	primary.Update(Service{Key: "/nodes/node1", Value: "node1"})
+	primary.Update(Service{Key: "/app/lock", Value: "node1"})
+	if e := next(events); e.Type != KeyEventPut || e.Key != "/app/lock" || e.Value != "node1" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	primary.Deregister(Service{Key: "/app/lock"})
+	if e := next(events); e.Type != KeyEventDelete || e.Key != "/app/lock" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	c.setHealthy(0, false)
+	if e := next(events); e.Type != KeyEventResync {
+		t.Fatalf("failover not reported %+v", e)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	standbyStore.NewClient(ctx).Update(Service{Key: "/app/lock", Value: "node2"})
+	if e := next(events); e.Type != KeyEventPut || e.Value != "node2" {
+		t.Fatalf("standby not watched %+v", e)
+	}
+
+	if keys, err := c.GetKeys("/app/"); err != nil || keys["/app/lock"] != "node2" {
+		t.Fatalf("unexpected keys %v %v", keys, err)
+	}
+
+	// a reader too slow for the buffer is told to read the keys again
+	wctx, wcancel := context.WithCancel(ctx)
+	defer wcancel()
+	slow := make(chan KeyEvent)
+	go primary.(KeyWatcher).WatchKeys(wctx, "/app/", slow)
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i <= memoryKeyWatchBuffer+1; i++ {
+		primary.Update(Service{Key: "/app/lock", Value: "node1"})
+	}
+
+	if e := next(slow); e.Type != KeyEventResync {
+		t.Fatalf("lost changes not reported %+v", e)
+	}
+}
@@ -0,0 +1,266 @@
+package sd
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryStore is an in-process sd backend shared by every client created from it,
+// nodes running in the same process discover each other without etcd
+type MemoryStore struct {
+	sync.RWMutex
+	entries     map[string]string
+	watchers    map[chan struct{}]string
+	keyWatchers map[*memoryKeyWatch]struct{}
+	leaseID     int64
+}
+
+// memoryKeyWatch buffered watch of raw keys, a full buffer marks changes as lost
+type memoryKeyWatch struct {
+	prefix string
+	ch     chan KeyEvent
+	lost   int32
+}
+
+// memoryKeyWatchBuffer events a key watch buffers before changes are lost
+const memoryKeyWatchBuffer = 64
+
+type memoryClient struct {
+	ctx     context.Context
+	store   *MemoryStore
+	leaseID int64
+}
+
+// NewMemoryStore create an empty in-process sd backend
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:     make(map[string]string),
+		watchers:    make(map[chan struct{}]string),
+		keyWatchers: make(map[*memoryKeyWatch]struct{}),
+	}
+}
+
+// NewClient returns Client backed by the store, watches end when ctx is done
+func (s *MemoryStore) NewClient(ctx context.Context) Client {
+	return &memoryClient{
+		ctx:     ctx,
+		store:   s,
+		leaseID: atomic.AddInt64(&s.leaseID, 1),
+	}
+}
+
+func (s *MemoryStore) set(key, value string) {
+	s.Lock()
+	s.entries[key] = value
+	s.Unlock()
+	s.notify(key)
+	s.notifyKey(KeyEvent{Type: KeyEventPut, Key: key, Value: value})
+}
+
+func (s *MemoryStore) delete(key string) {
+	s.Lock()
+	delete(s.entries, key)
+	s.Unlock()
+	s.notify(key)
+	s.notifyKey(KeyEvent{Type: KeyEventDelete, Key: key})
+}
+
+func (s *MemoryStore) notify(key string) {
+	s.RLock()
+	defer s.RUnlock()
+	for ch, prefix := range s.watchers {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *MemoryStore) notifyKey(e KeyEvent) {
+	s.RLock()
+	defer s.RUnlock()
+	for w := range s.keyWatchers {
+		if !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+
+		select {
+		case w.ch <- e:
+		default:
+			atomic.StoreInt32(&w.lost, 1)
+		}
+	}
+}
+
+// GetEntries implements the sd Client interface.
+func (c *memoryClient) GetEntries(prefix string) ([]string, error) {
+	c.store.RLock()
+	keys := make([]string, 0, len(c.store.entries))
+	for key := range c.store.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	entries := make([]string, len(keys))
+	for i, key := range keys {
+		entries[i] = c.store.entries[key]
+	}
+	c.store.RUnlock()
+	return entries, nil
+}
+
+// WatchPrefix implements the sd Client interface.
+func (c *memoryClient) WatchPrefix(prefix string, ch chan struct{}) {
+	notify := make(chan struct{}, 1)
+	c.store.Lock()
+	c.store.watchers[notify] = prefix
+	c.store.Unlock()
+	defer func() {
+		c.store.Lock()
+		delete(c.store.watchers, notify)
+		c.store.Unlock()
+	}()
+
+	ch <- struct{}{}
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-notify:
+			select {
+			case ch <- struct{}{}:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// GetKeys implements the KeyWatcher interface.
+func (c *memoryClient) GetKeys(prefix string) (map[string]string, error) {
+	c.store.RLock()
+	defer c.store.RUnlock()
+	keys := make(map[string]string)
+	for key, value := range c.store.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys[key] = value
+		}
+	}
+	return keys, nil
+}
+
+// WatchKeys implements the KeyWatcher interface, a KeyEventResync is sent when a slow
+// reader let the buffer of the watch fill up.
+func (c *memoryClient) WatchKeys(ctx context.Context, prefix string, ch chan<- KeyEvent) {
+	w := &memoryKeyWatch{prefix: prefix, ch: make(chan KeyEvent, memoryKeyWatchBuffer)}
+	c.store.Lock()
+	c.store.keyWatchers[w] = struct{}{}
+	c.store.Unlock()
+	defer func() {
+		c.store.Lock()
+		delete(c.store.keyWatchers, w)
+		c.store.Unlock()
+	}()
+
+	for {
+		var e KeyEvent
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.ctx.Done():
+			return
+		case e = <-w.ch:
+		}
+
+		if atomic.CompareAndSwapInt32(&w.lost, 1, 0) {
+			e = KeyEvent{Type: KeyEventResync}
+			for len(w.ch) > 0 {
+				<-w.ch
+			}
+		}
+
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// PutKey implements the KeyWriter interface.
+func (c *memoryClient) PutKey(key, value string) error {
+	if key == "" {
+		return ErrNoKey
+	}
+
+	c.store.set(key, value)
+	return nil
+}
+
+// DeleteKey implements the KeyWriter interface.
+func (c *memoryClient) DeleteKey(key string) error {
+	if key == "" {
+		return ErrNoKey
+	}
+
+	c.store.Lock()
+	_, ok := c.store.entries[key]
+	c.store.Unlock()
+	if ok {
+		c.store.delete(key)
+	}
+	return nil
+}
+
+func (c *memoryClient) Register(s Service) error {
+	if s.Key == "" {
+		return ErrNoKey
+	}
+
+	if s.Value == "" {
+		return ErrNoValue
+	}
+
+	c.store.set(s.Key, s.Value)
+	return nil
+}
+
+func (c *memoryClient) Deregister(s Service) error {
+	if s.Key == "" {
+		return ErrNoKey
+	}
+
+	if !s.KeepKey {
+		c.store.delete(s.Key)
+	}
+	return nil
+}
+
+func (c *memoryClient) Update(s Service) error {
+	if s.Key == "" {
+		return ErrNoKey
+	}
+
+	if s.Value == "" {
+		return ErrNoValue
+	}
+
+	c.store.set(s.Key, s.Value)
+	return nil
+}
+
+func (c *memoryClient) LeaseID() int64 {
+	return c.leaseID
+}
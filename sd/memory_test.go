@@ -0,0 +1,162 @@
+package sd
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreEntries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := NewMemoryStore()
+	c1, c2 := store.NewClient(ctx), store.NewClient(ctx)
+	if c1.LeaseID() == c2.LeaseID() {
+		t.Fatal("clients share a lease id")
+	}
+
+	for _, s := range []Service{{Key: "/nodes/b", Value: "b"}, {Key: "/nodes/a", Value: "a"}, {Key: "/other/c", Value: "c"}} {
+		if err := c1.Register(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c1.Register(Service{Key: "/nodes/d"}); err != ErrNoValue {
+		t.Fatalf("registered without value %v", err)
+	}
+
+	// the clients of a store see the same entries, sorted by key
+	entries, _ := c2.GetEntries("/nodes/")
+	if len(entries) != 2 || entries[0] != "a" || entries[1] != "b" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	if err := c2.Update(Service{Key: "/nodes/a", Value: "a2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c2.Deregister(Service{Key: "/nodes/b", KeepKey: true})
+	if entries, _ := c1.GetEntries("/nodes/"); len(entries) != 2 || entries[0] != "a2" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	c2.Deregister(Service{Key: "/nodes/b"})
+	if entries, _ := c1.GetEntries("/nodes/"); len(entries) != 1 {
+		t.Fatalf("entry not deregistered %v", entries)
+	}
+}
+
+func TestMemoryStoreWatchPrefix(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := NewMemoryStore()
+	c := store.NewClient(ctx)
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	watcher := store.NewClient(watchCtx)
+	ch := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watcher.WatchPrefix("/nodes/", ch)
+		close(done)
+	}()
+
+	wait := func(what string) {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			t.Fatalf("no notification %s", what)
+		}
+	}
+
+	wait("after the watch started")
+	c.Register(Service{Key: "/nodes/a", Value: "a"})
+	wait("after a register")
+
+	c.Register(Service{Key: "/other/a", Value: "a"})
+	select {
+	case <-ch:
+		t.Fatal("notified of a change outside the prefix")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Deregister(Service{Key: "/nodes/a"})
+	wait("after a deregister")
+
+	stopWatch()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("watch not ended with its client")
+	}
+
+	store.RLock()
+	watchers := len(store.watchers)
+	store.RUnlock()
+	if watchers != 0 {
+		t.Fatalf("%d watchers left", watchers)
+	}
+}
+
+func TestMemoryStoreWatchKeys(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := NewMemoryStore()
+	c := store.NewClient(ctx)
+	kw := c.(KeyWatcher)
+	writer := c.(KeyWriter)
+
+	ch := make(chan KeyEvent)
+	go kw.WatchKeys(ctx, "/keys/", ch)
+	next := func() KeyEvent {
+		select {
+		case e := <-ch:
+			return e
+		case <-ctx.Done():
+			t.Fatal("no key event")
+			return KeyEvent{}
+		}
+	}
+
+	for {
+		store.RLock()
+		watching := len(store.keyWatchers) > 0
+		store.RUnlock()
+		if watching {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	writer.PutKey("/keys/a", "1")
+	if e := next(); e.Type != KeyEventPut || e.Key != "/keys/a" || e.Value != "1" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	writer.DeleteKey("/keys/a")
+	if e := next(); e.Type != KeyEventDelete || e.Key != "/keys/a" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// a reader falling behind the buffer gets a resync instead of the lost events
+	for i := 0; i <= memoryKeyWatchBuffer+1; i++ {
+		writer.PutKey("/keys/b", "2")
+	}
+
+	// the watch may have taken the first change before the buffer filled up
+	e := next()
+	if e.Type == KeyEventPut {
+		e = next()
+	}
+
+	if e.Type != KeyEventResync {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	keys, _ := kw.GetKeys("/keys/")
+	if len(keys) != 1 || keys["/keys/b"] != "2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
@@ -4,4 +4,8 @@ type Service struct {
 	Key   string // unique key, e.g. "/service/foobar/1.2.3.4:8080"
 	Value string // returned to subscribers
 	TTL   *TTLOption
+
+	// KeepKey makes Deregister release the service without deleting its key,
+	// e.g. when another instance registered the key meanwhile
+	KeepKey bool
 }
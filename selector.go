@@ -0,0 +1,193 @@
+package nakamacluster
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidSelector = errors.New("invalid selector")
+
+type selectorOperator int
+
+const (
+	selectorEquals selectorOperator = iota
+	selectorNotEquals
+	selectorIn
+	selectorNotIn
+	selectorExists
+	selectorDoesNotExist
+)
+
+type selectorRequirement struct {
+	key      string
+	operator selectorOperator
+	values   map[string]bool
+}
+
+func (r *selectorRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.operator {
+	case selectorEquals, selectorIn:
+		return ok && r.values[value]
+
+	case selectorNotEquals, selectorNotIn:
+		return !ok || !r.values[value]
+
+	case selectorExists:
+		return ok
+
+	case selectorDoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+// Selector label selector, every requirement must match
+type Selector []selectorRequirement
+
+// Matches reports whether the labels satisfy the selector, an empty selector matches everything
+func (s Selector) Matches(labels map[string]string) bool {
+	for i := range s {
+		if !s[i].matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector parse a comma separated label selector, it supports
+// equality based requirements "tier=premium", "tier==premium", "tier!=free",
+// set based requirements "region in (eu,us)", "region notin (cn)"
+// and existence requirements "gpu", "!gpu"
+func ParseSelector(selector string) (Selector, error) {
+	parts, err := splitSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	s := make(Selector, 0, len(parts))
+	for _, part := range parts {
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, r)
+	}
+	return s, nil
+}
+
+// SelectorFromSet create an equality selector from labels
+func SelectorFromSet(labels map[string]string) Selector {
+	s := make(Selector, 0, len(labels))
+	for k, v := range labels {
+		s = append(s, selectorRequirement{key: k, operator: selectorEquals, values: map[string]bool{v: true}})
+	}
+	return s
+}
+
+func splitSelector(selector string) ([]string, error) {
+	parts := make([]string, 0)
+	depth := 0
+	start := 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("%w: unbalanced parentheses in %q", ErrInvalidSelector, selector)
+			}
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	if depth != 0 {
+		return nil, fmt.Errorf("%w: unbalanced parentheses in %q", ErrInvalidSelector, selector)
+	}
+
+	parts = append(parts, selector[start:])
+	out := parts[:0]
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out, nil
+}
+
+func parseRequirement(s string) (selectorRequirement, error) {
+	invalid := fmt.Errorf("%w: %q", ErrInvalidSelector, s)
+	if strings.HasPrefix(s, "!") {
+		key := strings.TrimSpace(s[1:])
+		if !validLabelKey(key) {
+			return selectorRequirement{}, invalid
+		}
+		return selectorRequirement{key: key, operator: selectorDoesNotExist}, nil
+	}
+
+	for _, op := range []struct {
+		token    string
+		operator selectorOperator
+	}{
+		{"!=", selectorNotEquals},
+		{"==", selectorEquals},
+		{"=", selectorEquals},
+	} {
+		if i := strings.Index(s, op.token); i >= 0 {
+			key := strings.TrimSpace(s[:i])
+			value := strings.TrimSpace(s[i+len(op.token):])
+			if !validLabelKey(key) || strings.ContainsAny(value, "=!(), ") {
+				return selectorRequirement{}, invalid
+			}
+			return selectorRequirement{key: key, operator: op.operator, values: map[string]bool{value: true}}, nil
+		}
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) == 1 {
+		if !validLabelKey(fields[0]) {
+			return selectorRequirement{}, invalid
+		}
+		return selectorRequirement{key: fields[0], operator: selectorExists}, nil
+	}
+
+	if len(fields) < 3 || !validLabelKey(fields[0]) {
+		return selectorRequirement{}, invalid
+	}
+
+	r := selectorRequirement{key: fields[0], values: make(map[string]bool)}
+	switch fields[1] {
+	case "in":
+		r.operator = selectorIn
+	case "notin":
+		r.operator = selectorNotIn
+	default:
+		return selectorRequirement{}, invalid
+	}
+
+	set := strings.TrimSpace(strings.Join(fields[2:], " "))
+	if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+		return selectorRequirement{}, invalid
+	}
+
+	for _, value := range strings.Split(set[1:len(set)-1], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			r.values[value] = true
+		}
+	}
+
+	if len(r.values) < 1 {
+		return selectorRequirement{}, invalid
+	}
+	return r, nil
+}
+
+func validLabelKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, "=!(), ")
+}
@@ -0,0 +1,42 @@
+package nakamacluster
+
+import "testing"
+
+func TestParseSelector(t *testing.T) {
+	labels := map[string]string{"tier": "premium", "region": "eu", "gpu": ""}
+	cases := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"tier=premium", true},
+		{"tier==premium, region=eu", true},
+		{"tier=premium,region=us", false},
+		{"tier!=free", true},
+		{"zone!=a", true},
+		{"region in (eu, us)", true},
+		{"region in (us,cn)", false},
+		{"region notin (cn)", true},
+		{"zone notin (a)", true},
+		{"gpu", true},
+		{"!gpu", false},
+		{"!zone,tier in (premium)", true},
+	}
+
+	for _, c := range cases {
+		s, err := ParseSelector(c.selector)
+		if err != nil {
+			t.Fatalf("%q: %v", c.selector, err)
+		}
+
+		if s.Matches(labels) != c.matches {
+			t.Fatalf("%q: expected %v", c.selector, c.matches)
+		}
+	}
+
+	for _, selector := range []string{"region in (eu", "region in ()", "region within (eu)", "=eu", "a=b=c"} {
+		if _, err := ParseSelector(selector); err == nil {
+			t.Fatalf("%q: expected error", selector)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package nakamacluster
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// SEND_VAR_TO reserved var of broadcasts sent to a subset of the gossip members,
+// it holds the comma separated ids of the targets and the other members drop them
+const SEND_VAR_TO = "__to"
+
+// SendTo send the envelope to the nodes without waiting for replies. Gossip members are sent
+// the envelope directly over the reliable memberlist transport when they are no more than
+// gossip_nodes or the envelope expires, larger subsets get a broadcast only the targets handle.
+// Service nodes are sent the envelope over grpc. Nothing is sent when a node is unknown.
+func (s *Client) SendTo(in *api.Envelope, nodeIDs ...string) error {
+	members := make([]string, 0, len(nodeIDs))
+	nodes := make([]*Meta, 0, len(nodeIDs))
+	seen := make(map[string]bool, len(nodeIDs))
+	for _, id := range nodeIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if s.isMember(id) {
+			members = append(members, id)
+			continue
+		}
+
+		node, ok := s.peers.Get(id)
+		if !ok {
+			return fmt.Errorf("node %s %w", id, ErrNodeNotFound)
+		}
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes {
+		node := node
+		err := s.peers.SendAsync(s.ctx, node, proto.Clone(in).(*api.Envelope), func(out *api.Envelope, err error) {
+			if err != nil {
+				s.logger.Warn("Failed send to node", zap.String("node", node.Id), zap.String("cid", in.Cid), zap.Error(err))
+			}
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(members) < 1 {
+		return nil
+	}
+
+	if in.ExpiresAt > 0 || len(members) <= s.config.GossipNodes {
+		return s.sendToMembers(in, members)
+	}
+
+	broadcast := proto.Clone(in).(*api.Envelope)
+	if broadcast.Vars == nil {
+		broadcast.Vars = make(map[string]string, 1)
+	}
+	broadcast.Vars[SEND_VAR_TO] = strings.Join(members, ",")
+	return s.Broadcast(NewMessage(broadcast))
+}
+
+// SendToName send the envelope to every routable node of the named service like SendTo,
+// unlike Peer.SendToName which sends it to one node. Cordoned nodes are skipped
+func (s *Client) SendToName(in *api.Envelope, name string) error {
+	ids := make([]string, 0)
+	for _, node := range s.peers.GetByName(name) {
+		if node.Status.Routable() && !s.peers.Cordoned(node.Id) {
+			ids = append(ids, node.Id)
+		}
+	}
+
+	if len(ids) < 1 {
+		return fmt.Errorf("service %s %w", name, ErrNodeNotFound)
+	}
+	return s.SendTo(in, ids...)
+}
+
+// sendToMembers send the envelope to every member directly on the send pool and returns
+// the first error, the fan-out is bounded by the workers of the pool
+func (s *Client) sendToMembers(in *api.Envelope, members []string) error {
+	var firstErr error
+	pending := make([]<-chan error, 0, len(members))
+	for _, id := range members {
+		done, err := s.submitDirect(s.ctx, id, proto.Clone(in).(*api.Envelope))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		pending = append(pending, done)
+	}
+
+	for _, done := range pending {
+		select {
+		case err := <-done:
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+	return firstErr
+}
+
+// isMember reports whether the node is a gossip member
+func (s *Client) isMember(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.nodes[id] != nil
+}
+
+// sendToTarget reports whether the node handles the broadcast, broadcasts sent with
+// SendTo are only handled by their targets
+func sendToTarget(in *api.Envelope, id string) bool {
+	to, ok := in.GetVars()[SEND_VAR_TO]
+	if !ok {
+		return true
+	}
+
+	for _, target := range strings.Split(to, ",") {
+		if target == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+// callsServerDelegate reports the cids of the calls it serves
+type callsServerDelegate struct {
+	echoServerDelegate
+	calls chan string
+}
+
+func (d callsServerDelegate) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+	d.calls <- in.Cid
+	return in, nil
+}
+
+func TestSendToTarget(t *testing.T) {
+	if !sendToTarget(&api.Envelope{}, "node1") || !sendToTarget(nil, "node1") {
+		t.Fatal("untargeted broadcast not handled")
+	}
+
+	in := &api.Envelope{Vars: map[string]string{SEND_VAR_TO: "node1,node3"}}
+	for id, expected := range map[string]bool{"node1": true, "node2": false, "node3": true, "node": false} {
+		if sendToTarget(in, id) != expected {
+			t.Fatalf("target %s expected %v", id, expected)
+		}
+	}
+}
+
+func TestSendToNameSkipsCordoned(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := func(id string) (*Server, chan string) {
+		config := testConfig(t)
+		server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), id, "svc", map[string]string{}, *config)
+		calls := make(chan string, 4)
+		server.OnDelegate(callsServerDelegate{calls: calls})
+		return server, calls
+	}
+
+	node1, calls1 := start("node1")
+	defer node1.Stop()
+	node2, calls2 := start("node2")
+	defer node2.Stop()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, AsyncWorkers: 1, AsyncQueueSize: 4})
+	peer.Sync(node1.GetMeta(), node2.GetMeta())
+	peer.setCordons(map[string]bool{"node2": true})
+	client := &Client{ctx: ctx, config: NewConfig(), peers: peer, logger: zap.NewNop()}
+	if err := client.SendToName(&api.Envelope{Cid: "notice"}, "svc"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-calls1:
+	case <-ctx.Done():
+		t.Fatal("routable node not sent the envelope")
+	}
+
+	select {
+	case <-calls2:
+		t.Fatal("cordoned node sent the envelope")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
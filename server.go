@@ -8,12 +8,13 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/doublemo/nakama-cluster/api"
 	"github.com/doublemo/nakama-cluster/sd"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
-	"github.com/shimingyah/pool"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/channelz/service"
 	"google.golang.org/grpc/codes"
@@ -22,6 +23,7 @@ import (
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 )
 
@@ -48,36 +50,176 @@ type Server struct {
 	config     *Config
 	peers      Peer
 	delegate   atomic.Value
+	federation atomic.Value
+	journal    *Journal
+	traces     *TraceBuffer
+	outbox     *Outbox
+	cordons    *CordonList
+	idempotent *IdempotencyCache
+	overload   *OverloadController
+	slo        *SloTracker
+	watchdog   *watchdog
+	varSchema  VarSchema
+	blobs      BlobStore
+	streamAuth StreamAuthenticator
+	streams    sync.Map
+	conflicts  *conflictHandler
+	lifecycle  *lifecycle
+	bootstrap  *bootstrapCoordinator
+	ready      *readiness
+	audit      *AuditLog
+	control    *controlHandler
 	meta       atomic.Value
 	wathcer    *Watcher
 	grpcServer *grpc.Server
+	health     *health.Server
+	events     *EventBus
+	metrics    *Metrics
 	logger     *zap.Logger
 	once       sync.Once
 }
 
 func (s *Server) Stop() {
+	if err := s.StopContext(context.Background()); err != nil {
+		s.logger.Warn("Lifecycle hook failed", zap.Error(err))
+	}
+}
+
+// StopContext stop the server like Stop and return the first error of the leave and stop hooks
+func (s *Server) StopContext(ctx context.Context) error {
+	var err error
 	s.once.Do(func() {
+		if s.health != nil {
+			s.health.Shutdown()
+		}
+
 		if s.cancelFn != nil {
-			s.cancelFn()
+			err = s.lifecycle.stop(ctx, s.cancelFn)
 		}
 	})
+	return err
 }
 
 func (s *Server) OnDelegate(delegate ServerDelegate) {
 	s.delegate.Store(delegate)
 }
 
+// OnFederation serve federation requests of remote gateways on this server
+func (s *Server) OnFederation(federation *Federation) {
+	s.federation.Store(federation)
+}
+
 func (s *Server) GetPeers() Peer {
 	return s.peers
 }
 
+// Outbox returns the outbox, nil when no outbox storage was set with WithOutbox
+func (s *Server) Outbox() *Outbox {
+	return s.outbox
+}
+
+// Slo returns the success ratio, latency and error budget of the routes of Config.SloRoutes
+// handled by the node, nil when no route is tracked
+func (s *Server) Slo() []RouteSlo {
+	return s.slo.Routes()
+}
+
+// Cordons returns the cordon list of the cluster
+func (s *Server) Cordons() *CordonList {
+	return s.cordons
+}
+
 func (s *Server) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+	if in.Cid == HEARTBEAT_CID_PING {
+		return heartbeatReply(in), nil
+	}
+
+	ctx = incomingCallerContext(ctx, s.peers)
+	version := callerProtocol(ctx)
+	if isControlCid(in.Cid) {
+		return s.control.handle(controlCaller(ctx), in)
+	}
+
+	if err := checkEnvelopeVersion(in); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	if Expired(in, time.Duration(s.config.ExpirySkewTolerance)*time.Millisecond) {
+		s.metrics.ExpiredDropped()
+		return nil, status.Error(codes.DeadlineExceeded, "message expired")
+	}
+
+	if in.Cid == journalCidReplay {
+		if s.journal == nil {
+			return nil, api.NewError(api.Error_UNIMPLEMENTED, "journal not enabled")
+		}
+
+		out, err := s.journal.handleReplay(in)
+		return downgradeReply(out, err, version)
+	}
+
+	if in.Cid == ROUTING_CID_TABLE {
+		out, err := s.handleRoutingTable(in)
+		return downgradeReply(out, err, version)
+	}
+
+	if federation, ok := s.federation.Load().(*Federation); ok && federation != nil {
+		if out, ok, err := federation.Handle(ctx, in); ok {
+			return downgradeReply(out, err, version)
+		}
+	}
+
 	fn, ok := s.delegate.Load().(ServerDelegate)
 	if !ok || fn == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Method Call not implemented")
 	}
 
-	return fn.Call(ctx, in)
+	caller, ok := FromContext(ctx)
+	if ok && s.config.DuplicateIdPolicy == DUPLICATE_ID_EPOCH && caller.Node != nil && caller.Epoch != caller.Node.Epoch {
+		return nil, status.Errorf(codes.FailedPrecondition, "stale epoch of node %s", caller.NodeId)
+	}
+
+	node := ""
+	if ok {
+		node = caller.NodeId
+	}
+	s.traces.Record(TRACE_IN, TRACE_GRPC, node, in)
+	if !s.overload.Admit(in.Cid) {
+		return nil, status.Error(codes.ResourceExhausted, ErrOverloaded.Error())
+	}
+
+	if !s.slo.Admit(in.Cid) {
+		return nil, status.Error(codes.Unavailable, ErrRouteBudgetExhausted.Error())
+	}
+
+	start := time.Now()
+	out, err := s.idempotent.Do(ctx, idempotencyKeyOf(in), func() (*api.Envelope, error) {
+		return s.callDelegate(ctx, fn, in)
+	})
+	s.overload.Observe(time.Since(start))
+	s.slo.Observe(in.Cid, time.Since(start), replyError(out, err))
+	return downgradeReply(out, err, version)
+}
+
+// downgradeReply stamp the reply with the version spoken with the caller, a reply
+// the caller can not read is replaced by the error
+func downgradeReply(out *api.Envelope, err error, version uint32) (*api.Envelope, error) {
+	if err := downgradeEnvelope(out, version); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return out, err
+}
+
+// replyError returns err or the error payload of the reply
+func replyError(out *api.Envelope, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if e := out.GetError(); e != nil && e.GetCode() != api.Error_OK {
+		return e
+	}
+	return nil
 }
 
 func (s *Server) Stream(in api.ApiServer_StreamServer) error {
@@ -88,9 +230,48 @@ func (s *Server) Stream(in api.ApiServer_StreamServer) error {
 
 	ctx, cancel := context.WithCancel(s.ctx)
 	defer cancel()
+	streamCtx := incomingCallerContext(in.Context(), s.peers)
+	caller := ""
+	if info, ok := FromContext(streamCtx); ok {
+		caller = info.NodeId
+	}
 	incomingCh := make(chan *api.Envelope, s.config.BroadcastQueueSize)
 	outgoingCh := make(chan *api.Envelope, s.config.BroadcastQueueSize)
 
+	// the sender spends a credit per chunk, the chunks of incomplete messages are granted
+	// back from the loop below which owns the writes to the stream
+	chunkCh := make(chan struct{}, 1)
+	chunks := NewChunkBufferWithLimits(ctx, time.Duration(s.config.ChunkTimeout)*time.Second, s.config.ChunkMaxTotal, s.config.ChunkMaxBytes)
+
+	// the replies are coalesced for callers unpacking them, and callers coalesce their sends
+	// once the header announced this node unpacks them
+	md, _ := metadata.FromIncomingContext(in.Context())
+	streamCtx, expired, stopExpiry, err := authenticateStream(streamCtx, s.streamAuth, md)
+	if err != nil {
+		s.metrics.StreamUnauthenticated("rejected")
+		s.logger.Warn("Rejected stream", zap.String("caller", caller), zap.Error(err))
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	defer stopExpiry()
+
+	// callers older than the stream additions get no credits, batches or chunks
+	version := callerProtocol(streamCtx)
+	legacy := negotiateProtocol(version) < protocolVersionStreams
+	coalesce := streamBatchAccepted(md) && !legacy
+	if err := in.SendHeader(metadata.Pairs(streamBatchHeader, "1")); err != nil {
+		return err
+	}
+
+	maxSize := s.config.MaxStreamMessageSize
+	window := s.streamWindow(in)
+	if legacy {
+		maxSize = 0
+		window.size = 0
+	}
+	if err := window.advertise(); err != nil {
+		return err
+	}
+
 	client := func(out *api.Envelope) bool {
 		select {
 		case outgoingCh <- out:
@@ -99,6 +280,7 @@ func (s *Server) Stream(in api.ApiServer_StreamServer) error {
 		}
 		return true
 	}
+	defer s.trackStream(caller, client)()
 
 	go func() {
 		defer func() {
@@ -112,10 +294,27 @@ func (s *Server) Stream(in api.ApiServer_StreamServer) error {
 				break
 			}
 
-			select {
-			case incomingCh <- payload:
-			case <-ctx.Done():
-				return
+			payload, ok, err := chunks.AddEnvelope("", payload)
+			if err != nil {
+				s.logger.Warn("Error reading chunk from client", zap.Error(err))
+				continue
+			}
+
+			if !ok {
+				window.consume()
+				select {
+				case chunkCh <- struct{}{}:
+				default:
+				}
+				continue
+			}
+
+			for _, payload := range unbatch(payload) {
+				select {
+				case incomingCh <- payload:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
@@ -128,25 +327,192 @@ IncomingLoop:
 				return status.Errorf(codes.Aborted, "Failed read data from incomingCh")
 			}
 
-			if err := fn.Stream(in.Context(), client, msg); err != nil {
+			if err := checkEnvelopeVersion(msg); err != nil {
+				s.logger.Warn("Failed handle message", zap.Error(err))
+				return status.Error(codes.FailedPrecondition, err.Error())
+			}
+
+			reply := client
+			if id := msg.Id; id != "" {
+				reply = func(out *api.Envelope) bool {
+					if out.Id == "" {
+						out.Id = id
+					}
+					return client(out)
+				}
+			}
+
+			if Expired(msg, time.Duration(s.config.ExpirySkewTolerance)*time.Millisecond) {
+				s.metrics.ExpiredDropped()
+				endStreamRequest(reply, msg, api.NewError(api.Error_TIMEOUT, "message expired"))
+				window.consume()
+				if err := window.update(); err != nil {
+					s.logger.Warn("Failed write window to stream", zap.Error(err))
+				}
+				continue
+			}
+
+			s.traces.Record(TRACE_IN, TRACE_STREAM, caller, msg)
+			if !s.overload.Admit(msg.Cid) {
+				endStreamRequest(reply, msg, api.NewError(api.Error_RESOURCE_EXHAUSTED, ErrOverloaded.Error()))
+				window.consume()
+				if err := window.update(); err != nil {
+					s.logger.Warn("Failed write window to stream", zap.Error(err))
+				}
+				continue
+			}
+
+			start := time.Now()
+			if !s.slo.Admit(msg.Cid) {
+				reply(&api.Envelope{Cid: msg.Cid, Payload: &api.Envelope_Error{Error: api.NewError(api.Error_UNAVAILABLE, ErrRouteBudgetExhausted.Error())}})
+				window.consume()
+				if err := window.update(); err != nil {
+					s.logger.Warn("Failed write window to stream", zap.Error(err))
+				}
+				continue
+			}
+
+			if msg.Cid == ROUTING_CID_TABLE {
+				go s.watchRoutingTable(ctx, msg, outgoingCh)
+			} else if isBlobCid(msg.Cid) {
+				reply(s.handleBlob(streamCtx, fn, msg))
+			} else if err := s.streamDelegate(streamCtx, fn, reply, msg); err != nil {
+				s.slo.Observe(msg.Cid, time.Since(start), err)
 				s.logger.Warn("Failed handle message", zap.Error(err))
 				return status.Errorf(codes.InvalidArgument, err.Error())
 			}
 
+			s.overload.Observe(time.Since(start))
+			s.slo.Observe(msg.Cid, time.Since(start), nil)
+			window.consume()
+			if err := window.update(); err != nil {
+				s.logger.Warn("Failed write window to stream", zap.Error(err))
+			}
+
+		case <-chunkCh:
+			if err := window.update(); err != nil {
+				s.logger.Warn("Failed write window to stream", zap.Error(err))
+			}
+
 		case msg := <-outgoingCh:
-			if err := in.Send(msg); err != nil {
-				s.logger.Warn("Failed write to stream", zap.Error(err))
+			batch := []*api.Envelope{msg}
+			if coalesce {
+				batch = drainOutgoing(outgoingCh, batch)
+			}
+
+			if err := downgradeEnvelope(msg, version); err != nil {
+				s.logger.Warn("Failed write to stream", zap.String("caller", caller), zap.Error(err))
+				continue
+			}
+
+			for _, msg := range batch {
+				stampEnvelopeVersion(msg)
+				s.traces.Record(TRACE_OUT, TRACE_STREAM, caller, msg)
+			}
+
+			if len(batch) > 1 {
+				s.metrics.StreamBatch(len(batch))
+				msg = newStreamBatch(batch)
+			}
+
+			envelopes, err := SplitEnvelope(msg, maxSize)
+			if err != nil {
+				s.logger.Warn("Failed split message", zap.Error(err))
+				continue
+			}
+
+			for _, envelope := range envelopes {
+				if err := in.Send(envelope); err != nil {
+					s.logger.Warn("Failed write to stream", zap.Error(err))
+					break
+				}
+			}
+
+			if len(envelopes) > 1 {
+				for _, envelope := range envelopes {
+					api.ReleaseEnvelope(envelope)
+				}
 			}
 
+		case <-expired:
+			s.metrics.StreamUnauthenticated("expired")
+			s.logger.Info("Closed stream with expired session", zap.String("caller", caller))
+			fn.OnStreamClose(streamCtx)
+			return status.Error(codes.Unauthenticated, ErrStreamSessionExpired.Error())
+
 		case <-ctx.Done():
 			break IncomingLoop
 		}
 	}
 
-	fn.OnStreamClose(in.Context())
+	fn.OnStreamClose(streamCtx)
 	return nil
 }
 
+// endStreamRequest end the stream request of the envelope with err, envelopes sent
+// without an id are not requests and get no reply
+func endStreamRequest(reply func(out *api.Envelope) bool, in *api.Envelope, err error) {
+	if in.Id != "" {
+		reply(StreamEnd(err))
+	}
+}
+
+// Replay request the envelopes peers sent to this node since the time from their
+// journals and pass them to the delegate Call, it returns the number of replayed envelopes
+func (s *Server) Replay(ctx context.Context, since time.Time) (int, error) {
+	fn, ok := s.delegate.Load().(ServerDelegate)
+	if !ok || fn == nil {
+		return 0, status.Errorf(codes.InvalidArgument, "Method Call not implemented")
+	}
+
+	local := s.GetMeta()
+	n := 0
+	for _, node := range s.peers.All() {
+		if node.Id == local.Id || node.Type == NODE_TYPE_NAKAMA {
+			continue
+		}
+
+		next := strconv.FormatInt(since.UnixNano(), 10)
+		for next != "" {
+			out, err := s.peers.Send(ctx, node, newJournalReplay([]byte(s.config.JournalKey), local.Id, next))
+
+			if api.IsCode(err, api.Error_UNIMPLEMENTED) {
+				break
+			}
+
+			if err != nil {
+				return n, err
+			}
+
+			for _, envelope := range out.GetBatch().GetEnvelopes() {
+				if _, err := s.callDelegate(ctx, fn, envelope); err != nil {
+					s.logger.Warn("Failed replay message", zap.Error(err), zap.String("node", node.Id))
+				}
+				n++
+			}
+			next = out.Vars[journalVarNext]
+		}
+	}
+	return n, nil
+}
+
+// NewSharding create sharding of the service of the node, it runs until the node stops
+func (s *Server) NewSharding(options ShardingOptions) *Sharding {
+	return NewSharding(s.ctx, s.logger, s.wathcer.sdClient, s.config.Prefix, s.peers, s.events, s.GetMeta, options)
+}
+
+// Events returns the cluster event bus
+func (s *Server) Events() *EventBus {
+	return s.events
+}
+
+// WaitReady block until the nodes were read from sd and the local node registered, so
+// sends do not race an empty peer table. A *ReadyError naming the pending steps is returned
+// when ctx is done or a step gave up first
+func (s *Server) WaitReady(ctx context.Context) error {
+	return s.ready.wait(ctx)
+}
+
 func (s *Server) GetMeta() *Meta {
 	meta, ok := s.meta.Load().(*Meta)
 	if !ok || meta == nil {
@@ -156,68 +522,396 @@ func (s *Server) GetMeta() *Meta {
 	return meta.Clone()
 }
 
+// UpdateMeta change the status and vars of the node, the status must be a legal
+// transition from the current one
 func (s *Server) UpdateMeta(status MetaStatus, vars map[string]string) error {
 	meta := s.GetMeta()
+	if s.bootstrap.pending() && status.Routable() {
+		return ErrBootstrapping
+	}
+
+	if err := meta.Status.CheckTransition(status); err != nil {
+		return err
+	}
+
+	vars, err := protectReservedVars(meta.Vars, vars)
+	if err != nil {
+		return err
+	}
+
+	if err := s.varSchema.Check(vars); err != nil {
+		return err
+	}
+
 	meta.Status = status
 	meta.Vars = vars
+	meta.Version++
 	s.meta.Store(meta)
+	s.peers.Merge(meta)
+
+	s.audit.Record(AUDIT_STATUS, AUDIT_INITIATOR_LOCAL, meta.Id, map[string]string{"status": status.String(), "version": strconv.FormatUint(meta.Version, 10)})
+
+	// the callers of the streams reconnect to the successors once the node left the rings
+	if status == META_STATUS_DRAINING {
+		defer s.handoffStreams(meta)
+	}
+	return s.wathcer.Update(meta)
+}
+
+// SetMaintenance move the node in or out of maintenance, nodes in maintenance get
+// no traffic but keep serving control envelopes
+func (s *Server) SetMaintenance(on bool) error {
+	return setMaintenance(s.GetMeta(), on, s.UpdateMeta)
+}
+
+// SetLogLevel set the level of the logger of the node created WithLogLevel,
+// the previous level is restored after ttl when it is positive
+func (s *Server) SetLogLevel(level zapcore.Level, ttl time.Duration) error {
+	return s.control.setLevel(level, ttl)
+}
+
+// BroadcastLogLevel set the log level of every service node sharing the control key like SetLogLevel
+func (s *Server) BroadcastLogLevel(level zapcore.Level, ttl time.Duration) error {
+	_, err := s.control.broadcastLevel(level, ttl)
+	return err
+}
+
+// UpdateLabels replace the node labels
+func (s *Server) UpdateLabels(labels map[string]string) error {
+	meta := s.GetMeta()
+	meta.Labels = cloneStringMap(labels)
+	meta.Version++
+	s.meta.Store(meta)
+	s.peers.Merge(meta)
 
 	return s.wathcer.Update(meta)
 }
 
 func (s *Server) onUpdate(metas []*Meta) {
+	s.peers.Sync(s.validNodes(metas)...)
+	if drained, ok := sdDrain(s.GetMeta(), metas); ok {
+		s.adoptDrain(drained)
+	}
+}
+
+// adoptDrain take the drain written to sd by an operator, the version moves past the one in sd
+// so the next update of the node neither overwrites the drain nor reuses its version
+func (s *Server) adoptDrain(drained *Meta) {
+	meta := s.GetMeta()
+	meta.Version = drained.Version
+	s.meta.Store(meta)
+	if err := s.UpdateMeta(META_STATUS_DRAINING, meta.Vars); err != nil {
+		s.logger.Warn("Failed to take the drain of sd", zap.Error(err))
+	}
+}
+
+// validNodes returns the nodes of metas the local node may route to
+func (s *Server) validNodes(metas []*Meta) []*Meta {
 	nodes := make([]*Meta, 0, len(metas))
 	for _, meta := range metas {
-		if meta.Type == NODE_TYPE_MICROSERVICES && meta.Name == NAKAMA {
+		if meta.Type != NODE_TYPE_NAKAMA && meta.Name == NAKAMA {
 			s.logger.Warn("Invalid node name", zap.String("ID", meta.Id))
 			continue
 		}
+
+		if err := CheckProtocolVersion(meta.ProtocolVersion); err != nil {
+			s.logger.Warn("Invalid node protocol version", zap.String("ID", meta.Id), zap.Error(err))
+			continue
+		}
+
+		if err := CheckCluster(s.config.ClusterName, meta); err != nil {
+			s.logger.Error("Node of another cluster", zap.String("ID", meta.Id), zap.Error(err))
+			continue
+		}
+
+		if err := CheckNodeType(meta); err != nil {
+			s.logger.Warn("Invalid node type", zap.String("ID", meta.Id), zap.Error(err))
+			continue
+		}
+
+		if err := s.varSchema.Check(meta.Vars); err != nil {
+			s.logger.Warn("Invalid node vars", zap.String("ID", meta.Id), zap.Error(err))
+			continue
+		}
 		nodes = append(nodes, meta)
 	}
-	s.peers.Sync(nodes...)
+	return nodes
 }
 
-func NewServer(ctx context.Context, logger *zap.Logger, sdclient sd.Client, id, name string, vars map[string]string, config Config) *Server {
+func NewServer(ctx context.Context, logger *zap.Logger, sdclient sd.Client, id, name string, vars map[string]string, config Config, opts ...Option) *Server {
 	ctx, cancel := context.WithCancel(ctx)
-	meta := NewNodeMetaFromConfig(id, name, NODE_TYPE_MICROSERVICES, vars, config)
+	o := newOptions(opts...)
+	metrics := NewMetrics(o.metricsScope)
+	events := NewEventBus(ctx, config.BroadcastQueueSize)
+	traces := NewTraceBuffer(config.TraceBufferSize, config.TraceSampleRate)
+	var kafka *KafkaSink
+	if o.kafka != nil {
+		kafka = NewKafkaSink(ctx, logger, o.kafka, KafkaSinkOptions{
+			EventsTopic:    config.KafkaEventsTopic,
+			EnvelopesTopic: config.KafkaEnvelopesTopic,
+			Routes:         config.KafkaRoutes,
+			BatchSize:      config.KafkaBatchSize,
+			BatchTimeout:   time.Duration(config.KafkaBatchTimeout) * time.Millisecond,
+			QueueSize:      config.KafkaQueueSize,
+		}, metrics)
+		events.Subscribe(kafka.PublishEvent)
+	}
+
+	audit := newAuditLog(ctx, logger, o.audit, config, id, metrics)
+	if audit != nil {
+		events.Subscribe(audit.recordEvent)
+	}
+
+	strategy, err := NewStrategy(config.SendStrategy)
+	if err != nil {
+		logger.Fatal("Invalid send strategy", zap.Error(err))
+	}
+
+	ring := RingOptions{Hash: config.RingHash, VirtualNodes: config.RingVirtualNodes}
+	if err := CheckRingOptions(ring); err != nil {
+		logger.Fatal("Invalid ring hash", zap.Error(err))
+	}
+
+	for name, ring := range o.rings {
+		if err := CheckRingOptions(ring); err != nil {
+			logger.Fatal("Invalid ring hash", zap.Error(err), zap.String("service", name))
+		}
+	}
+
+	throttle := o.throttle
+	if throttle == nil && (config.EgressNodeRate > 0 || config.EgressRate > 0) {
+		throttle = NewThrottle(config.EgressNodeRate, config.EgressRate)
+	}
+
+	var journal *Journal
+	if o.journal != nil {
+		journal = NewJournal(ctx, o.journal, time.Duration(config.JournalRetention)*time.Second, config.JournalMaxBytes)
+		journal.key = []byte(config.JournalKey)
+	}
+	nodeType := NODE_TYPE_MICROSERVICES
+	if o.nodeType != 0 {
+		if !o.nodeType.Registered() {
+			logger.Fatal("Invalid node type", zap.Int("type", int(o.nodeType)))
+		}
+		nodeType = o.nodeType
+	}
+	meta := NewNodeMetaFromConfig(id, name, nodeType, vars, config)
+	bootstrap := newBootstrapCoordinator(config)
+	if bootstrap != nil {
+		meta.Status = META_STATUS_BOOTSTRAPPING
+	}
 
-	s := &Server{
+	if err := checkLocalVars(config, meta); err != nil {
+		logger.Fatal("Invalid node vars", zap.Error(err))
+	}
+
+	peerTLS, err := newPeerTLS(config)
+	if err != nil {
+		logger.Fatal("Failed load peer tls", zap.Error(err))
+	}
+
+	var s *Server
+	localMeta := func() *Meta { return s.GetMeta() }
+	source := func() ([]*Meta, error) {
+		metas, err := s.wathcer.GetEntries()
+		if err != nil {
+			return nil, err
+		}
+		return s.validNodes(metas), nil
+	}
+	s = &Server{
 		ctx:      ctx,
 		cancelFn: cancel,
 		peers: NewPeer(ctx, logger, PeerOptions{
-			MaxIdle:              config.GrpcPoolMaxIdle,
-			MaxActive:            config.GrpcPoolMaxActive,
-			MaxConcurrentStreams: config.GrpcPoolMaxConcurrentStreams,
-			Reuse:                config.GrpcPoolReuse,
+			Connections:          config.GrpcPoolSize,
+			DialTimeout:          time.Duration(config.GrpcDialTimeout) * time.Second,
+			TLS:                  peerTLS,
+			Dialer:               o.dialer,
+			DialOptions:          o.dialOptions,
 			MessageQueueSize:     config.MaxGossipPacketSize,
+			MaxStreamMessageSize: config.MaxStreamMessageSize,
+			ChunkTimeout:         time.Duration(config.ChunkTimeout) * time.Second,
+			ChunkMaxTotal:        config.ChunkMaxTotal,
+			ChunkMaxBytes:        config.ChunkMaxBytes,
+			AsyncWorkers:         config.AsyncSendWorkers,
+			AsyncQueueSize:       config.AsyncSendQueueSize,
+			Timeout:              time.Duration(config.RPCTimeout) * time.Millisecond,
+			ResolveInterval:      time.Duration(config.ResolveInterval) * time.Second,
+			Namespace:            config.Namespace,
+			Journal:              journal,
+			Events:               events,
+			Kafka:                kafka,
+			Traces:               traces,
+			LocalMeta:            localMeta,
+			Source:               source,
+			Strategy:             strategy,
+			Strategies:           o.strategies,
+			Throttle:             throttle,
+			StreamIdleTimeout:    time.Duration(config.StreamIdleTimeout) * time.Second,
+			StreamTTL:            time.Duration(config.StreamTTL) * time.Second,
+			StreamStatsRetention: time.Duration(config.StreamStatsRetention) * time.Second,
+			StreamCoalesceLinger: time.Duration(config.StreamCoalesceLinger) * time.Microsecond,
+			HeartbeatInterval:    time.Duration(config.HeartbeatInterval) * time.Second,
+			HeartbeatQuarantine:  heartbeatQuarantine(config),
+			PoolLeakThreshold:    time.Duration(config.GrpcPoolLeakThreshold) * time.Second,
+			Compression:          grpcCompression(logger, config),
+			CompressionMinSize:   config.GrpcCompressionMinSize,
+			Ring:                 ring,
+			Rings:                o.rings,
+			Services:             o.services,
+			RingVars:             config.RingVars,
+			KeyMappers:           o.keyMappers,
+			FlapThreshold:        config.FlapThreshold,
+			FlapWindow:           time.Duration(config.FlapWindow) * time.Second,
+			FlapCooldown:         time.Duration(config.FlapCooldown) * time.Second,
+			Metrics:              metrics,
 		}),
-		logger: logger,
-		config: &config,
+		journal:    journal,
+		traces:     traces,
+		bootstrap:  bootstrap,
+		blobs:      o.blobs,
+		streamAuth: o.streamAuth,
+		events:     events,
+		metrics:    metrics,
+		logger:     logger,
+		config:     &config,
+		varSchema:  config.VarSchema,
+	}
+	s.overload = newOverloadController(ctx, config, s.peers, metrics)
+	s.slo = newSloTracker(config, metrics)
+	s.watchdog = newWatchdog(config, logger, metrics)
+	s.idempotent = NewIdempotencyCache(ctx, time.Duration(config.IdempotencyTTL)*time.Second, config.IdempotencyMaxKeys, metrics)
+	if o.outbox != nil {
+		s.outbox = NewOutbox(ctx, logger, o.outbox, s.peers, OutboxOptions{
+			RetryInterval: time.Duration(config.OutboxRetryInterval) * time.Second,
+			TTL:           time.Duration(config.OutboxTTL) * time.Second,
+		}, metrics)
 	}
 	s.meta.Store(meta)
-	s.wathcer = NewWatcher(ctx, logger, sdclient, config.Prefix, meta)
-	metas, err := s.wathcer.GetEntries()
-	if err != nil {
+	s.audit = audit
+	s.control = &controlHandler{
+		key:    []byte(config.ControlKey),
+		level:  o.logLevel,
+		local:  s.GetMeta,
+		update: s.UpdateMeta,
+		peers:  s.peers,
+		resync: func() { s.wathcer.update() },
+		traces: traces,
+		audit:  audit,
+		logger: logger,
+	}
+	s.cordons = newCordonList(ctx, logger, sdclient, config.Prefix, s.peers)
+	s.control.cordons = s.cordons
+	s.control.slo = s.slo
+	s.lifecycle = newLifecycle(logger, o)
+	if err := s.lifecycle.run(ctx, stageStart); err != nil {
+		logger.Fatal("Failed to start node", zap.Error(err))
+	}
+
+	if err := checkClusterOnStart(sdclient, config.Prefix, meta); err != nil {
+		logger.Fatal("Failed to register node", zap.Error(err))
+	}
+
+	if err := checkDuplicateOnStart(sdclient, config.Prefix, config.DuplicateIdPolicy, meta); err != nil {
+		logger.Fatal("Failed to register node", zap.Error(err))
+	}
+
+	s.conflicts = &conflictHandler{
+		policy: config.DuplicateIdPolicy,
+		local:  s.GetMeta,
+		delegate: func() ConflictDelegate {
+			fn, _ := s.delegate.Load().(ConflictDelegate)
+			return fn
+		},
+		stop:     s.Stop,
+		reassert: func(meta *Meta) error { return s.wathcer.Update(meta) },
+	}
+	retry := newJoinRetry(config)
+	s.wathcer = newWatcher(ctx, logger, sdclient, config.Prefix, meta, retry)
+	s.ready = newReadiness(READY_STEP_SD, READY_STEP_REGISTER)
+	s.ready.lastError(READY_STEP_REGISTER, s.wathcer.RegisterError)
+	s.wathcer.OnResync(func(err error) {
+		events.Publish(Event{Type: EVENT_RESYNC_REQUIRED, Node: s.GetMeta()})
+	})
+	if o.snapshot != nil {
+		s.onUpdate(o.snapshot.Nodes)
+	}
+
+	cache := NewPeerCache(logger, config.PeerCacheFile, time.Duration(config.PeerCacheMaxAge)*time.Second)
+	if nodes := cache.Load(); len(nodes) > 0 {
+		s.onUpdate(nodes)
+	}
+
+	// a node starting from a snapshot or the peer cache does not wait for sd
+	entriesRetry := retry
+	if o.snapshot != nil || s.peers.Size() > 0 {
+		entriesRetry = joinRetry{}
+	}
+
+	var metas []*Meta
+	err = entriesRetry.do(ctx, logger, "sd", func() (err error) {
+		metas, err = s.wathcer.GetEntries()
+		return err
+	})
+	switch {
+	case err == nil:
+		s.ready.done(READY_STEP_SD)
+		s.onUpdate(metas)
+		cache.Save(metas)
+		s.lifecycle.sync(s.ctx, s.GetMeta().Id, metas)
+		if err := s.conflicts.check(metas); err != nil {
+			logger.Warn("Node stepped down", zap.Error(err))
+		}
+
+	case o.snapshot != nil || s.peers.Size() > 0:
+		logger.Warn("Failed to read sd, starting from snapshot", zap.Error(err))
+		s.ready.report(READY_STEP_SD, err)
+
+	default:
 		logger.Fatal(err.Error())
 	}
-	s.onUpdate(metas)
-	s.wathcer.OnUpdate(s.onUpdate)
-	s.grpcServer = newGrpcServer(logger, s, config)
+	s.wathcer.OnUpdate(func(metas []*Meta) {
+		s.ready.done(READY_STEP_SD)
+		s.onUpdate(metas)
+		cache.Save(metas)
+		s.lifecycle.sync(s.ctx, s.GetMeta().Id, metas)
+		if err := s.conflicts.check(metas); err != nil {
+			logger.Warn("Node stepped down", zap.Error(err))
+		}
+	})
+	if s.bootstrap != nil {
+		go s.bootstrap.run(s.ctx, logger, events, s.peers, s.GetMeta, func() error {
+			return s.UpdateMeta(META_STATUS_READYED, s.GetMeta().Vars)
+		})
+	}
+	go func() {
+		select {
+		case <-s.wathcer.Registered():
+			s.ready.done(READY_STEP_REGISTER)
+			events.Publish(Event{Type: EVENT_CLUSTER_JOINED, Node: s.GetMeta()})
+		case <-s.wathcer.registerFailed:
+			s.ready.fail(READY_STEP_REGISTER, s.wathcer.RegisterError())
+		case <-s.ctx.Done():
+		}
+	}()
+	s.grpcServer, s.health = newGrpcServer(logger, s, newObserverApi(s.GetMeta, s.peers, events), config)
 	return s
 }
 
-func newGrpcServer(logger *zap.Logger, srv api.ApiServerServer, c Config) *grpc.Server {
+// newGrpcServer start the cluster listener, the health server is nil unless GrpcHealth is set
+// and the observer is served only when GrpcObserver is set
+func newGrpcServer(logger *zap.Logger, srv api.ApiServerServer, observer api.ObserverServer, c Config) (*grpc.Server, *health.Server) {
 	opts := []grpc.ServerOption{
-		grpc.InitialWindowSize(pool.InitialWindowSize),
-		grpc.InitialConnWindowSize(pool.InitialConnWindowSize),
-		grpc.MaxSendMsgSize(pool.MaxSendMsgSize),
-		grpc.MaxRecvMsgSize(pool.MaxRecvMsgSize),
+		grpc.InitialWindowSize(grpcInitialWindowSize),
+		grpc.InitialConnWindowSize(grpcInitialConnWindowSize),
+		grpc.MaxSendMsgSize(grpcMaxSendMsgSize),
+		grpc.MaxRecvMsgSize(grpcMaxRecvMsgSize),
 		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
 			PermitWithoutStream: true,
 		}),
 		grpc.KeepaliveParams(keepalive.ServerParameters{
-			Time:    pool.KeepAliveTime,
-			Timeout: pool.KeepAliveTimeout,
+			Time:    grpcKeepAliveTime,
+			Timeout: grpcKeepAliveTimeout,
 		}),
 	}
 
@@ -234,6 +928,10 @@ func newGrpcServer(logger *zap.Logger, srv api.ApiServerServer, c Config) *grpc.
 		)
 	}
 
+	if c.GrpcErrorStatus {
+		opts = append(opts, grpc.ChainUnaryInterceptor(errorUnaryServerInterceptor))
+	}
+
 	listen, err := net.Listen("tcp", net.JoinHostPort(c.Addr, strconv.Itoa(c.Port)))
 	if err != nil {
 		logger.Fatal("Failed listen from addr", zap.Error(err), zap.String("addr", c.Addr), zap.Int("port", c.Port))
@@ -243,18 +941,50 @@ func newGrpcServer(logger *zap.Logger, srv api.ApiServerServer, c Config) *grpc.
 	api.RegisterApiServerServer(s, srv)
 	service.RegisterChannelzServiceToServer(s)
 	grpc_prometheus.Register(s)
-	healthpb.RegisterHealthServer(s, health.NewServer())
+	var hs *health.Server
+	if c.GrpcHealth {
+		hs = health.NewServer()
+		hs.SetServingStatus(api.ApiServer_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+		healthpb.RegisterHealthServer(s, hs)
+	}
+
+	if c.GrpcObserver {
+		api.RegisterObserverServer(s, observer)
+	}
+
+	if c.GrpcReflection {
+		reflection.Register(s)
+	}
+
 	go func() {
 		logger.Info("Starting API server for gRPC requests", zap.Int("port", c.Port))
 		if err := s.Serve(listen); err != nil {
 			logger.Fatal("API server listener failed", zap.Error(err))
 		}
 	}()
-	return s
+
+	if c.GrpcUnixSocket != "" {
+		unix, err := listenUnix(c.GrpcUnixSocket)
+		if err != nil {
+			logger.Fatal("Failed listen on unix socket", zap.Error(err), zap.String("path", c.GrpcUnixSocket))
+		}
+
+		go func() {
+			logger.Info("Starting API server for gRPC requests on unix socket", zap.String("path", c.GrpcUnixSocket))
+			if err := s.Serve(unix); err != nil {
+				logger.Fatal("API server unix listener failed", zap.Error(err))
+			}
+		}()
+	}
+	return s, hs
 }
 
 func ensureValidToken(config Config) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		if isHealthMethod(info.FullMethod) {
+			return handler(ctx, req)
+		}
+
 		md, ok := metadata.FromIncomingContext(ctx)
 		if !ok {
 			return nil, ErrMissingMetadata
@@ -279,6 +1009,10 @@ func ensureValidToken(config Config) grpc.UnaryServerInterceptor {
 // func(srv interface{}, ss ServerStream, info *StreamServerInfo, handler StreamHandler)
 func ensureStreamValidToken(config Config) grpc.StreamServerInterceptor {
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if isHealthMethod(info.FullMethod) {
+			return handler(srv, ss)
+		}
+
 		md, ok := metadata.FromIncomingContext(ss.Context())
 		if !ok {
 			return ErrMissingMetadata
@@ -298,3 +1032,9 @@ func ensureStreamValidToken(config Config) grpc.StreamServerInterceptor {
 		return handler(srv, ss)
 	}
 }
+
+// isHealthMethod reports whether the method belongs to the grpc health service,
+// probes like the k8s grpc probe cannot send a token
+func isHealthMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
@@ -0,0 +1,159 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+func TestServerHealthAndReflection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.GrpcReflection = true
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", "svc", map[string]string{}, *config)
+	defer server.Stop()
+
+	conn, err := grpc.DialContext(ctx, net.JoinHostPort(config.Addr, strconv.Itoa(config.Port)), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	check := &healthpb.HealthCheckRequest{Service: api.ApiServer_ServiceDesc.ServiceName}
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, check)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("status %v", resp.Status)
+	}
+
+	stream, err := grpc_reflection_v1alpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stream.Send(&grpc_reflection_v1alpha.ServerReflectionRequest{MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_ListServices{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, service := range reply.GetListServicesResponse().GetService() {
+		if service.Name == api.ApiServer_ServiceDesc.ServiceName {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("%s not listed by reflection", api.ApiServer_ServiceDesc.ServiceName)
+	}
+
+	server.Stop()
+	if resp, err = healthpb.NewHealthClient(conn).Check(ctx, check); err != nil || resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("status after stop %v %v", resp, err)
+	}
+}
+
+// resyncClient sd client that loses changes on demand
+type resyncClient struct {
+	sd.Client
+	onResync chan func(err error)
+}
+
+func (c *resyncClient) OnResync(f func(err error)) {
+	c.onResync <- f
+}
+
+func TestServerResyncEvent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	client := &resyncClient{Client: sd.NewMemoryStore().NewClient(ctx), onResync: make(chan func(err error), 1)}
+	server := NewServer(ctx, zap.NewNop(), client, "node1", "svc", map[string]string{}, *config)
+	defer server.Stop()
+
+	resyncs := make(chan Event, 1)
+	server.Events().Subscribe(func(e Event) {
+		if e.Type == EVENT_RESYNC_REQUIRED {
+			resyncs <- e
+		}
+	})
+
+	(<-client.onResync)(errors.New("compacted"))
+	select {
+	case e := <-resyncs:
+		if e.Node == nil || e.Node.Id != "node1" {
+			t.Fatalf("unexpected resync event %+v", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("resync event not published")
+	}
+}
+
+func TestServerTakesSdDrain(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	store := sd.NewMemoryStore()
+	server := NewServer(ctx, zap.NewNop(), store.NewClient(ctx), "node1", "svc", map[string]string{}, *config)
+	defer server.Stop()
+	if err := server.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// drain the node like nkcluster drain, writing its meta in sd
+	operator := store.NewClient(ctx)
+	drained := server.GetMeta()
+	drained.Status = META_STATUS_DRAINING
+	drained.Version++
+	value, err := drained.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := operator.Update(sd.Service{Key: config.Prefix + drained.Id, Value: string(value)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for server.GetMeta().Status != META_STATUS_DRAINING {
+		select {
+		case <-ctx.Done():
+			t.Fatal("drain of sd not taken")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if meta := server.GetMeta(); meta.Version <= drained.Version {
+		t.Fatalf("expected a version above %d, got %d", drained.Version, meta.Version)
+	}
+
+	values, err := operator.GetEntries(config.Prefix)
+	if err != nil || len(values) != 1 {
+		t.Fatalf("unexpected sd entries %v %v", values, err)
+	}
+
+	if meta := NewNodeMetaFromJSON([]byte(values[0])); meta.Status != META_STATUS_DRAINING || meta.Version != server.GetMeta().Version {
+		t.Fatalf("drain not written back to sd %+v", meta)
+	}
+}
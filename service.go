@@ -0,0 +1,116 @@
+package nakamacluster
+
+import (
+	"context"
+	"sync"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"google.golang.org/protobuf/proto"
+)
+
+// CallHandler handle the envelopes of a cid sent with Call
+type CallHandler func(ctx context.Context, in *api.Envelope) (*api.Envelope, error)
+
+// StreamHandler handle the envelopes of a cid sent on a stream
+type StreamHandler func(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error
+
+// ServiceMux server delegate dispatching the envelopes to the handlers of their cid, the
+// wrappers generated by protoc-gen-nakama-cluster register the methods of a service on it.
+// Envelopes of other cids are passed to the fallback delegate
+type ServiceMux struct {
+	calls    map[string]CallHandler
+	streams  map[string]StreamHandler
+	fallback ServerDelegate
+	sync.RWMutex
+}
+
+// NewServiceMux create the mux, fallback may be nil
+func NewServiceMux(fallback ServerDelegate) *ServiceMux {
+	return &ServiceMux{
+		calls:    make(map[string]CallHandler),
+		streams:  make(map[string]StreamHandler),
+		fallback: fallback,
+	}
+}
+
+// HandleCall register the handler of the calls of the cid
+func (m *ServiceMux) HandleCall(cid string, handler CallHandler) {
+	m.Lock()
+	m.calls[cid] = handler
+	m.Unlock()
+}
+
+// HandleStream register the handler of the stream envelopes of the cid
+func (m *ServiceMux) HandleStream(cid string, handler StreamHandler) {
+	m.Lock()
+	m.streams[cid] = handler
+	m.Unlock()
+}
+
+// Call implements ServerDelegate
+func (m *ServiceMux) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+	m.RLock()
+	handler, ok := m.calls[in.Cid]
+	m.RUnlock()
+	if ok {
+		return handler(ctx, in)
+	}
+
+	if m.fallback != nil {
+		return m.fallback.Call(ctx, in)
+	}
+	return nil, api.Errorf(api.Error_UNIMPLEMENTED, "unknown cid %s", in.Cid)
+}
+
+// Stream implements ServerDelegate
+func (m *ServiceMux) Stream(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error {
+	m.RLock()
+	handler, ok := m.streams[in.Cid]
+	m.RUnlock()
+	if ok {
+		return handler(ctx, client, in)
+	}
+
+	if m.fallback != nil {
+		return m.fallback.Stream(ctx, client, in)
+	}
+
+	client(&api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Error{Error: api.Errorf(api.Error_UNIMPLEMENTED, "unknown cid %s", in.Cid)}})
+	return nil
+}
+
+// OnStreamClose implements ServerDelegate
+func (m *ServiceMux) OnStreamClose(ctx context.Context) {
+	if m.fallback != nil {
+		m.fallback.OnStreamClose(ctx)
+	}
+}
+
+// Invoke send the request to a node of the named service picked by SendToName and
+// decode the reply into out, an error payload of the reply is returned as error
+func Invoke(ctx context.Context, peers Peer, name, cid string, in, out proto.Message, opts ...SendOption) error {
+	envelope := &api.Envelope{Cid: cid}
+	if err := envelope.SetAny(in); err != nil {
+		return err
+	}
+
+	reply, _, err := peers.SendToName(ctx, name, envelope, opts...)
+	if err != nil {
+		return err
+	}
+
+	if e := reply.GetError(); e != nil && e.GetCode() != api.Error_OK {
+		return e
+	}
+	return reply.UnmarshalAnyTo(out)
+}
+
+// InvokeStream send the request on the stream of the client to the node and returns the
+// channel receiving its replies, it is closed when ctx is done or the stream ends
+func InvokeStream(ctx context.Context, peers Peer, clientId string, node *Meta, cid string, in proto.Message) (<-chan *api.Envelope, error) {
+	envelope := &api.Envelope{Cid: cid}
+	if err := envelope.SetAny(in); err != nil {
+		return nil, err
+	}
+	return peers.SendStreamRequest(ctx, clientId, node, envelope, nil)
+}
@@ -0,0 +1,88 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+func TestServiceMux(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mux := NewServiceMux(echoServerDelegate{})
+	mux.HandleCall("svc.Double", func(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+		req := new(api.Window)
+		if err := in.UnmarshalAnyTo(req); err != nil {
+			return nil, api.NewError(api.Error_INVALID_ARGUMENT, err.Error())
+		}
+
+		if req.Credits == 0 {
+			return nil, api.NewError(api.Error_INVALID_ARGUMENT, "no credits")
+		}
+
+		out := &api.Envelope{Cid: in.Cid}
+		return out, out.SetAny(&api.Window{Credits: req.Credits * 2})
+	})
+
+	mux.HandleStream("svc.Count", func(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error {
+		req := new(api.Window)
+		if err := in.UnmarshalAnyTo(req); err != nil {
+			return err
+		}
+
+		for i := uint32(1); i <= req.Credits; i++ {
+			out := &api.Envelope{Cid: in.Cid}
+			if err := out.SetAny(&api.Window{Credits: i}); err != nil {
+				return err
+			}
+			client(out)
+		}
+		return nil
+	})
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(mux)
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MessageQueueSize: 8})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	out := new(api.Window)
+	if err := Invoke(ctx, peer, "svc", "svc.Double", &api.Window{Credits: 21}, out); err != nil || out.Credits != 42 {
+		t.Fatalf("unexpected reply %v %v", out, err)
+	}
+
+	if err := Invoke(ctx, peer, "svc", "svc.Double", &api.Window{}, out); !api.IsCode(err, api.Error_INVALID_ARGUMENT) {
+		t.Fatalf("expected INVALID_ARGUMENT, got %v", err)
+	}
+
+	// envelopes of unregistered cids go to the fallback
+	if reply, err := peer.Send(ctx, node, &api.Envelope{Cid: "other", Payload: &api.Envelope_Bytes{Bytes: []byte("a")}}); err != nil || string(reply.GetBytes()) != "a" {
+		t.Fatalf("fallback not called %v %v", reply, err)
+	}
+
+	ch, err := InvokeStream(ctx, peer, "client1", node, "svc.Count", &api.Window{Credits: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint32(1); i <= 3; i++ {
+		select {
+		case envelope := <-ch:
+			reply := new(api.Window)
+			if err := envelope.UnmarshalAnyTo(reply); err != nil || reply.Credits != i {
+				t.Fatalf("unexpected stream reply %v %v", reply, err)
+			}
+		case <-ctx.Done():
+			t.Fatalf("stream reply %d not received", i)
+		}
+	}
+
+	if _, err := NewServiceMux(nil).Call(ctx, &api.Envelope{Cid: "svc.Double"}); !api.IsCode(err, api.Error_UNIMPLEMENTED) {
+		t.Fatalf("expected UNIMPLEMENTED, got %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package nakamacluster
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+)
+
+const (
+	// SESSION_CID_PREFIX cids reserved for session ownership records
+	SESSION_CID_PREFIX = "__session."
+
+	sessionCidOwner = SESSION_CID_PREFIX + "owner"
+
+	// sessionsState name of the gossip state extension exchanging every record on push/pull
+	sessionsState = "__sessions"
+
+	// sessionTombstoneTTL time a released record is kept so older records of the session are rejected
+	sessionTombstoneTTL = 10 * time.Minute
+)
+
+var ErrSessionOwned = errors.New("session owned by another node")
+
+// SessionOwner ownership record of a user session, records with a higher
+// epoch replace older ones, an empty node means the session was released and
+// the record is kept as a tombstone for sessionTombstoneTTL
+type SessionOwner struct {
+	UserId    string `json:"user_id"`
+	Node      string `json:"node"`
+	Epoch     uint64 `json:"epoch"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// newer reports whether the record replaces other, a release wins ties so a delayed record
+// of a node that left does not come back, other ties are broken by node name
+func (o *SessionOwner) newer(other *SessionOwner) bool {
+	switch {
+	case o.Epoch != other.Epoch:
+		return o.Epoch > other.Epoch
+	case other.Node == "":
+		return false
+	case o.Node == "":
+		return true
+	}
+	return o.Node > other.Node
+}
+
+// SessionStore session ownership records replicated through gossip with epoch fencing,
+// broadcasts spread a change and the push/pull state brings joining nodes up to date
+type SessionStore struct {
+	client       *Client
+	records      map[string]*SessionOwner
+	onInvalidate atomic.Value
+	pruned       time.Time
+	sync.Mutex
+}
+
+// OnInvalidate is invoked when a session owned by the local node is taken over by another node
+func (s *SessionStore) OnInvalidate(f func(userID string, owner SessionOwner)) {
+	s.onInvalidate.Store(f)
+}
+
+// Lookup returns the current owner of the user session
+func (s *SessionStore) Lookup(userID string) (SessionOwner, bool) {
+	s.Lock()
+	defer s.Unlock()
+	record, ok := s.records[userID]
+	if !ok || record.Node == "" {
+		return SessionOwner{}, false
+	}
+	return *record, true
+}
+
+// Claim take ownership of the user session, it fails with ErrSessionOwned
+// when another node owns it, use Steal to take it over
+func (s *SessionStore) Claim(userID string) (SessionOwner, error) {
+	return s.set(userID, s.client.GetLocalNode().Name, false)
+}
+
+// Steal take ownership of the user session from any node, the previous owner is invalidated
+func (s *SessionStore) Steal(userID string) (SessionOwner, error) {
+	return s.set(userID, s.client.GetLocalNode().Name, true)
+}
+
+// Release give up ownership of the user session when it is owned by the local node
+func (s *SessionStore) Release(userID string) error {
+	s.Lock()
+	record, ok := s.records[userID]
+	s.Unlock()
+	if !ok || record.Node != s.client.GetLocalNode().Name {
+		return nil
+	}
+
+	_, err := s.set(userID, "", true)
+	return err
+}
+
+// Validate reports whether the local node still owns the user session at the epoch
+func (s *SessionStore) Validate(userID string, epoch uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	record, ok := s.records[userID]
+	return ok && record.Epoch == epoch && record.Node == s.client.GetLocalNode().Name
+}
+
+func (s *SessionStore) set(userID, node string, steal bool) (SessionOwner, error) {
+	s.Lock()
+	now := time.Now()
+	record := &SessionOwner{UserId: userID, Node: node, Epoch: 1, UpdatedAt: now.Unix()}
+	if current, ok := s.records[userID]; ok {
+		if !steal && current.Node != "" && current.Node != node {
+			s.Unlock()
+			return *current, ErrSessionOwned
+		}
+		record.Epoch = current.Epoch + 1
+	}
+	s.records[userID] = record
+	s.prune(now)
+	s.Unlock()
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return SessionOwner{}, err
+	}
+
+	err = s.client.Broadcast(NewMessage(&api.Envelope{Cid: sessionCidOwner, Payload: &api.Envelope_Bytes{Bytes: b}}))
+	return *record, err
+}
+
+// handle merge a record received from another node
+func (s *SessionStore) handle(node string, in *api.Envelope) {
+	var record SessionOwner
+	if err := json.Unmarshal(in.GetBytes(), &record); err != nil {
+		s.client.logger.Warn("Failed parse session owner", zap.Error(err), zap.String("node", node))
+		return
+	}
+	s.merge(&record)
+}
+
+// merge keep the record when it is newer than the local one, the local node is told
+// when another node took over one of its sessions
+func (s *SessionStore) merge(record *SessionOwner) {
+	local := s.client.GetLocalNode().Name
+	s.Lock()
+	current, ok := s.records[record.UserId]
+	if ok && !record.newer(current) {
+		s.Unlock()
+		return
+	}
+	s.records[record.UserId] = record
+	s.Unlock()
+
+	if !ok || current.Node != local || record.Node == local {
+		return
+	}
+
+	if f, ok := s.onInvalidate.Load().(func(userID string, owner SessionOwner)); ok && f != nil {
+		f(record.UserId, *record)
+	}
+}
+
+// dropNode release the sessions owned by a node that left the cluster, the records are
+// kept as tombstones at their epoch so delayed records of the node are rejected
+func (s *SessionStore) dropNode(node string) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for userID, record := range s.records {
+		if record.Node == node {
+			s.records[userID] = &SessionOwner{UserId: userID, Epoch: record.Epoch, UpdatedAt: now.Unix()}
+		}
+	}
+}
+
+// prune forget the tombstones older than sessionTombstoneTTL, s must be locked
+func (s *SessionStore) prune(now time.Time) {
+	if now.Sub(s.pruned) < sessionTombstoneTTL/10 {
+		return
+	}
+
+	for userID, record := range s.records {
+		if record.Node == "" && now.Sub(time.Unix(record.UpdatedAt, 0)) > sessionTombstoneTTL {
+			delete(s.records, userID)
+		}
+	}
+	s.pruned = now
+}
+
+// encode returns every record and tombstone for the push/pull state
+func (s *SessionStore) encode(join bool) []byte {
+	s.Lock()
+	s.prune(time.Now())
+	records := make([]*SessionOwner, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	b, err := json.Marshal(records)
+	s.Unlock()
+
+	if err != nil {
+		s.client.logger.Warn("Failed marshal session owners", zap.Error(err))
+		return nil
+	}
+	return b
+}
+
+// mergeState merge the records of the push/pull state of another node
+func (s *SessionStore) mergeState(buf []byte, join bool) {
+	var records []*SessionOwner
+	if err := json.Unmarshal(buf, &records); err != nil {
+		s.client.logger.Warn("Failed parse session owners state", zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	for _, record := range records {
+		// an expired tombstone of a node that did not prune yet is not brought back
+		if record.Node == "" && now.Sub(time.Unix(record.UpdatedAt, 0)) > sessionTombstoneTTL {
+			continue
+		}
+		s.merge(record)
+	}
+}
+
+func isSessionCid(cid string) bool {
+	return strings.HasPrefix(cid, SESSION_CID_PREFIX)
+}
+
+// NewSessionStore create session store replicated through the client
+func NewSessionStore(client *Client) *SessionStore {
+	s := &SessionStore{
+		client:  client,
+		records: make(map[string]*SessionOwner),
+	}
+
+	client.RegisterState(sessionsState, GossipState{Encode: s.encode, Merge: s.mergeState})
+	return s
+}
@@ -0,0 +1,102 @@
+package nakamacluster
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestSessionStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newClient := func(id string) *Client {
+		config := testConfig(t)
+		config.JoinRetryInterval = 10
+		return NewClient(ctx, zap.NewNop(), store.NewClient(ctx), id, map[string]string{}, *config)
+	}
+
+	node1 := newClient("node1")
+	defer node1.Stop()
+	<-node1.wathcer.Registered()
+	owner, err := node1.Sessions().Claim("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := node1.Sessions().Claim("user2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node1.Sessions().Release("user2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a node joining after the claims gets the records through the push/pull state
+	node2 := newClient("node2")
+	defer node2.Stop()
+	for {
+		if record, ok := node2.Sessions().Lookup("user1"); ok && record.Node == "node1" && record.Epoch == owner.Epoch {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("session records not synced to the joining node")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if _, ok := node2.Sessions().Lookup("user2"); ok {
+		t.Fatal("released session synced as owned")
+	}
+
+	// the records of a node that left are kept as tombstones rejecting its delayed records
+	node2.Sessions().dropNode("node1")
+	if _, ok := node2.Sessions().Lookup("user1"); ok {
+		t.Fatal("session of the node that left still owned")
+	}
+
+	delayed := owner
+	node2.Sessions().merge(&delayed)
+	if _, ok := node2.Sessions().Lookup("user1"); ok {
+		t.Fatal("delayed record of the node that left accepted")
+	}
+
+	if claimed, err := node2.Sessions().Claim("user1"); err != nil || claimed.Epoch != owner.Epoch+1 {
+		t.Fatalf("unexpected claim %+v %v", claimed, err)
+	}
+
+	// tombstones are forgotten after their ttl and expired ones are not merged back
+	sessions := node2.Sessions()
+	sessions.Lock()
+	for _, record := range sessions.records {
+		if record.Node == "" {
+			record.UpdatedAt = time.Now().Add(-2 * sessionTombstoneTTL).Unix()
+		}
+	}
+	sessions.pruned = time.Time{}
+	sessions.Unlock()
+
+	sessions.encode(false)
+	sessions.Lock()
+	_, kept := sessions.records["user2"]
+	sessions.Unlock()
+	if kept {
+		t.Fatal("expired tombstone not pruned")
+	}
+
+	expired, _ := json.Marshal([]*SessionOwner{{UserId: "user2", Epoch: 9, UpdatedAt: time.Now().Add(-2 * sessionTombstoneTTL).Unix()}})
+	sessions.mergeState(expired, false)
+	sessions.Lock()
+	_, kept = sessions.records["user2"]
+	sessions.Unlock()
+	if kept {
+		t.Fatal("expired tombstone merged back")
+	}
+}
@@ -0,0 +1,495 @@
+package nakamacluster
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+// ShardMap assignment of the shards of a service to its nodes. A shard moving to
+// another node keeps its owner and names the new node in Pending until the owner
+// released it or the handoff deadline passed. Epochs change with the owner or the
+// pending node of a shard and fence the releases of earlier handoffs.
+type ShardMap struct {
+	Service         string   `json:"service"`
+	Shards          int      `json:"shards"`
+	Version         uint64   `json:"version"`
+	Leader          string   `json:"leader"`
+	Owners          []string `json:"owners"`
+	Pending         []string `json:"pending"`
+	Epochs          []uint64 `json:"epochs"`
+	HandoffDeadline int64    `json:"handoff_deadline"`
+}
+
+// shardRelease shards a node released with the epoch of their handoff
+type shardRelease struct {
+	Node     string         `json:"node"`
+	Released map[int]uint64 `json:"released"`
+}
+
+// ShardingOptions options of Sharding
+type ShardingOptions struct {
+	// Shards is the number of virtual shards of the keyspace, it must not change
+	// while the service runs, default 256
+	Shards int
+
+	// HandoffTimeout is the time a node has to release a shard moving away before
+	// the leader moves it anyway, default 30s
+	HandoffTimeout time.Duration
+
+	// OnAcquire is called when the local node became the owner of the shard
+	OnAcquire func(shard int)
+
+	// OnRelease is called when the shard moves away from the local node, the
+	// new owner gets it when OnRelease returned or the handoff timed out
+	OnRelease func(shard int)
+}
+
+// Sharding divides a keyspace into virtual shards and assigns them to the routable
+// nodes of the local service. The node with the lowest id is the leader, it balances
+// the shards on membership changes and stores the map in sd, every node follows it.
+type Sharding struct {
+	ctx      context.Context
+	sdClient sd.Client
+	prefix   string
+	peers    Peer
+	events   *EventBus
+	local    func() *Meta
+	options  ShardingOptions
+	current  *ShardMap
+	owned    map[int]bool
+	released map[int]uint64
+	logger   *zap.Logger
+	sync.RWMutex
+}
+
+// NewSharding create sharding of the service of the local node, prefix is the sd prefix of
+// the nodes and the maps are stored next to it. It runs until ctx is done.
+func NewSharding(ctx context.Context, logger *zap.Logger, sdClient sd.Client, prefix string, peers Peer, events *EventBus, local func() *Meta, options ShardingOptions) *Sharding {
+	if options.Shards < 1 {
+		options.Shards = 256
+	}
+
+	if options.HandoffTimeout <= 0 {
+		options.HandoffTimeout = 30 * time.Second
+	}
+
+	meta := local()
+	s := &Sharding{
+		ctx:      ctx,
+		sdClient: sdClient,
+		prefix:   path.Dir(strings.TrimSuffix(prefix, "/")) + "/shards/" + meta.Namespace + "/" + meta.Name + "/",
+		peers:    peers,
+		events:   events,
+		local:    local,
+		options:  options,
+		owned:    make(map[int]bool),
+		released: make(map[int]uint64),
+		logger:   logger,
+	}
+	go s.run()
+	return s
+}
+
+// ShardOf returns the shard of the key
+func (s *Sharding) ShardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(s.options.Shards))
+}
+
+// OwnerOf returns the node owning the shard, a shard being handed off is owned
+// by the previous node until the handoff completed
+func (s *Sharding) OwnerOf(shard int) (*Meta, bool) {
+	s.RLock()
+	m := s.current
+	s.RUnlock()
+	if m == nil || shard < 0 || shard >= len(m.Owners) || m.Owners[shard] == "" {
+		return nil, false
+	}
+
+	if local := s.local(); local.Id == m.Owners[shard] {
+		return local, true
+	}
+	return s.peers.Get(m.Owners[shard])
+}
+
+// OwnerOfKey returns the node owning the shard of the key
+func (s *Sharding) OwnerOfKey(key string) (*Meta, bool) {
+	return s.OwnerOf(s.ShardOf(key))
+}
+
+// Owned returns the shards owned by the local node in order
+func (s *Sharding) Owned() []int {
+	s.RLock()
+	defer s.RUnlock()
+	shards := make([]int, 0, len(s.owned))
+	for shard := range s.owned {
+		shards = append(shards, shard)
+	}
+	sort.Ints(shards)
+	return shards
+}
+
+// Map returns a copy of the current shard map, nil before a map was read
+func (s *Sharding) Map() *ShardMap {
+	s.RLock()
+	defer s.RUnlock()
+	if s.current == nil {
+		return nil
+	}
+	return s.current.clone()
+}
+
+func (s *Sharding) run() {
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	unsubscribe := s.events.Subscribe(func(e Event) { notify() })
+	defer unsubscribe()
+
+	watchCh := make(chan struct{}, 1)
+	go s.sdClient.WatchPrefix(s.prefix, watchCh)
+
+	interval := s.options.HandoffTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-changed:
+		case <-watchCh:
+		case <-t.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		s.sync()
+	}
+}
+
+// sync read the map, balance it when the local node leads and apply it to the local node
+func (s *Sharding) sync() {
+	m, releases, err := s.read()
+	if err != nil {
+		s.logger.Warn("Failed reading shard map from sd", zap.Error(err))
+		return
+	}
+
+	s.RLock()
+	if m == nil || (s.current != nil && s.current.Version > m.Version) {
+		// the map key may expire with the lease of the leader that wrote it
+		m = s.current.clone()
+	}
+	s.RUnlock()
+
+	local := s.local()
+	members := s.members(local)
+	if len(members) > 0 && members[0] == local.Id {
+		if next, ok := planShards(m, local.Name, s.options.Shards, local.Id, members, releases, time.Now(), s.options.HandoffTimeout); ok {
+			if err := s.write(next); err != nil {
+				s.logger.Warn("Failed writing shard map to sd", zap.Error(err))
+				return
+			}
+			m = next
+		}
+	}
+
+	if m != nil {
+		s.apply(local.Id, m)
+	}
+}
+
+// members returns the ids of the routable nodes of the service in order, cordoned nodes get no shards
+func (s *Sharding) members(local *Meta) []string {
+	ids := make(map[string]bool)
+	if local.Status.Routable() && !s.peers.Cordoned(local.Id) {
+		ids[local.Id] = true
+	}
+
+	for _, node := range s.peers.GetByName(local.Name) {
+		if node.Id != local.Id && node.Namespace == local.Namespace && node.Status.Routable() && !s.peers.Cordoned(node.Id) {
+			ids[node.Id] = true
+		}
+	}
+
+	members := make([]string, 0, len(ids))
+	for id := range ids {
+		members = append(members, id)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (s *Sharding) read() (*ShardMap, map[string]*shardRelease, error) {
+	values, err := s.sdClient.GetEntries(s.prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var m *ShardMap
+	releases := make(map[string]*shardRelease)
+	for _, value := range values {
+		var probe struct {
+			Service string `json:"service"`
+			Node    string `json:"node"`
+		}
+
+		if err := json.Unmarshal([]byte(value), &probe); err != nil {
+			continue
+		}
+
+		if probe.Service != "" {
+			var v ShardMap
+			if json.Unmarshal([]byte(value), &v) == nil && (m == nil || v.Version > m.Version) {
+				m = &v
+			}
+			continue
+		}
+
+		var r shardRelease
+		if probe.Node != "" && json.Unmarshal([]byte(value), &r) == nil {
+			releases[r.Node] = &r
+		}
+	}
+	return m, releases, nil
+}
+
+func (s *Sharding) write(m *ShardMap) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.sdClient.Update(sd.Service{Key: s.prefix + "map", Value: string(b)})
+}
+
+// apply notify the local node of the shards it gained and release the shards moving away
+func (s *Sharding) apply(local string, m *ShardMap) {
+	s.Lock()
+	s.current = m
+	acquired := make([]int, 0)
+	lost := make([]int, 0)
+	release := make([]int, 0)
+	for shard, owner := range m.Owners {
+		switch {
+		case owner == local && !s.owned[shard]:
+			s.owned[shard] = true
+			acquired = append(acquired, shard)
+
+		case owner != local && s.owned[shard]:
+			delete(s.owned, shard)
+			if _, ok := s.released[shard]; !ok {
+				lost = append(lost, shard)
+			}
+			delete(s.released, shard)
+
+		case owner == local && m.Pending[shard] == "":
+			// the handoff was canceled after the shard was released
+			if _, ok := s.released[shard]; ok {
+				delete(s.released, shard)
+				acquired = append(acquired, shard)
+			}
+		}
+
+		if owner == local && m.Pending[shard] != "" && s.released[shard] != m.Epochs[shard] {
+			release = append(release, shard)
+		}
+	}
+	s.Unlock()
+
+	for _, shard := range acquired {
+		if s.options.OnAcquire != nil {
+			s.options.OnAcquire(shard)
+		}
+	}
+
+	for _, shard := range append(lost, release...) {
+		if s.options.OnRelease != nil {
+			s.options.OnRelease(shard)
+		}
+	}
+
+	if len(release) < 1 {
+		return
+	}
+
+	s.Lock()
+	for _, shard := range release {
+		s.released[shard] = m.Epochs[shard]
+	}
+
+	r := &shardRelease{Node: local, Released: make(map[int]uint64, len(s.released))}
+	for shard, epoch := range s.released {
+		r.Released[shard] = epoch
+	}
+	s.Unlock()
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	if err := s.sdClient.Update(sd.Service{Key: s.prefix + "release/" + local, Value: string(b)}); err != nil {
+		s.logger.Warn("Failed writing shard release to sd", zap.Error(err))
+	}
+}
+
+func (m *ShardMap) clone() *ShardMap {
+	if m == nil {
+		return nil
+	}
+
+	c := *m
+	c.Owners = append([]string(nil), m.Owners...)
+	c.Pending = append([]string(nil), m.Pending...)
+	c.Epochs = append([]uint64(nil), m.Epochs...)
+	return &c
+}
+
+// planShards returns the next map of the leader and whether it differs from current. Shards of
+// nodes that left go to the nodes they were handed to or to the least loaded nodes, released
+// and timed out handoffs complete and the shards of nodes above their share are handed to
+// the nodes below it.
+func planShards(current *ShardMap, service string, shards int, leader string, members []string, releases map[string]*shardRelease, now time.Time, timeout time.Duration) (*ShardMap, bool) {
+	if len(members) < 1 {
+		return nil, false
+	}
+
+	next := current.clone()
+	if next == nil || next.Shards != shards {
+		next = &ShardMap{
+			Service: service,
+			Shards:  shards,
+			Owners:  make([]string, shards),
+			Pending: make([]string, shards),
+			Epochs:  make([]uint64, shards),
+		}
+		if current != nil {
+			next.Version = current.Version
+		}
+	}
+
+	next.Leader = leader
+	alive := make(map[string]bool, len(members))
+	for _, id := range members {
+		alive[id] = true
+	}
+
+	expired := next.HandoffDeadline > 0 && now.UnixNano() >= next.HandoffDeadline
+	load := make(map[string]int, len(members))
+	for shard := range next.Owners {
+		owner, pending := next.Owners[shard], next.Pending[shard]
+		if pending != "" && !alive[pending] {
+			pending = ""
+		}
+
+		if pending != "" {
+			r, ok := releases[owner]
+			if !alive[owner] || expired || (ok && r.Released[shard] == next.Epochs[shard]) {
+				owner, pending = pending, ""
+			}
+		}
+
+		if !alive[owner] {
+			owner = ""
+		}
+
+		if owner != next.Owners[shard] || pending != next.Pending[shard] {
+			next.Owners[shard], next.Pending[shard] = owner, pending
+			next.Epochs[shard]++
+		}
+
+		if pending != "" {
+			load[pending]++
+		} else if owner != "" {
+			load[owner]++
+		}
+	}
+
+	leastLoaded := func() string {
+		min := members[0]
+		for _, id := range members[1:] {
+			if load[id] < load[min] {
+				min = id
+			}
+		}
+		return min
+	}
+
+	for shard, owner := range next.Owners {
+		if owner == "" {
+			id := leastLoaded()
+			next.Owners[shard] = id
+			next.Epochs[shard]++
+			load[id]++
+		}
+	}
+
+	share := (shards + len(members) - 1) / len(members)
+	for shard, owner := range next.Owners {
+		if next.Pending[shard] != "" || load[owner] <= share {
+			continue
+		}
+
+		id := leastLoaded()
+		if load[owner]-load[id] < 2 {
+			continue
+		}
+
+		next.Pending[shard] = id
+		next.Epochs[shard]++
+		load[owner]--
+		load[id]++
+	}
+
+	handoff := false
+	for _, pending := range next.Pending {
+		if pending != "" {
+			handoff = true
+			break
+		}
+	}
+
+	switch {
+	case !handoff:
+		next.HandoffDeadline = 0
+	case next.HandoffDeadline == 0 || expired:
+		next.HandoffDeadline = now.Add(timeout).UnixNano()
+	}
+
+	if current != nil && next.Shards == current.Shards && next.Leader == current.Leader && next.HandoffDeadline == current.HandoffDeadline && equalEpochs(next.Epochs, current.Epochs) {
+		return current, false
+	}
+
+	next.Version++
+	return next, true
+}
+
+func equalEpochs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package nakamacluster
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestPlanShards(t *testing.T) {
+	now := time.Now()
+	m, ok := planShards(nil, "svc", 16, "node1", []string{"node1"}, nil, now, time.Second)
+	if !ok || m.Version != 1 {
+		t.Fatalf("expected first map, got %+v", m)
+	}
+
+	for shard, owner := range m.Owners {
+		if owner != "node1" {
+			t.Fatalf("shard %d owned by %q", shard, owner)
+		}
+	}
+
+	if _, ok := planShards(m, "svc", 16, "node1", []string{"node1"}, nil, now, time.Second); ok {
+		t.Fatal("unchanged membership changed the map")
+	}
+
+	m, ok = planShards(m, "svc", 16, "node1", []string{"node1", "node2"}, nil, now, time.Second)
+	if !ok {
+		t.Fatal("map not rebalanced")
+	}
+
+	released := &shardRelease{Node: "node1", Released: make(map[int]uint64)}
+	moving := 0
+	for shard, pending := range m.Pending {
+		if pending == "node2" {
+			moving++
+			if m.Owners[shard] != "node1" {
+				t.Fatalf("shard %d moved before its release", shard)
+			}
+			released.Released[shard] = m.Epochs[shard]
+		}
+	}
+
+	if moving != 8 {
+		t.Fatalf("expected 8 shards handed off, got %d", moving)
+	}
+
+	delete(released.Released, 0)
+	delete(released.Released, 1)
+	m, _ = planShards(m, "svc", 16, "node1", []string{"node1", "node2"}, map[string]*shardRelease{"node1": released}, now, time.Second)
+	owned := map[string]int{}
+	for _, owner := range m.Owners {
+		owned[owner]++
+	}
+
+	if owned["node2"] != len(released.Released) {
+		t.Fatalf("released shards not moved, got %v", owned)
+	}
+
+	m, _ = planShards(m, "svc", 16, "node1", []string{"node1", "node2"}, nil, now.Add(2*time.Second), time.Second)
+	owned = map[string]int{}
+	for shard, owner := range m.Owners {
+		owned[owner]++
+		if m.Pending[shard] != "" {
+			t.Fatalf("shard %d still pending after the deadline", shard)
+		}
+	}
+
+	if owned["node1"] != 8 || owned["node2"] != 8 {
+		t.Fatalf("handoff timeout did not complete the rebalance, got %v", owned)
+	}
+
+	m, _ = planShards(m, "svc", 16, "node2", []string{"node2"}, nil, now, time.Second)
+	for shard, owner := range m.Owners {
+		if owner != "node2" || m.Pending[shard] != "" {
+			t.Fatalf("shard %d of the gone node not reassigned", shard)
+		}
+	}
+}
+
+func TestServerSharding(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	type node struct {
+		server   *Server
+		sharding *Sharding
+		owned    map[int]bool
+		sync.Mutex
+	}
+
+	start := func(id string) *node {
+		config := testConfig(t)
+		n := &node{owned: make(map[int]bool)}
+		n.server = NewServer(ctx, zap.NewNop(), store.NewClient(ctx), id, "svc", map[string]string{}, *config)
+		n.sharding = n.server.NewSharding(ShardingOptions{
+			Shards: 16,
+			OnAcquire: func(shard int) {
+				n.Lock()
+				n.owned[shard] = true
+				n.Unlock()
+			},
+			OnRelease: func(shard int) {
+				n.Lock()
+				delete(n.owned, shard)
+				n.Unlock()
+			},
+		})
+		return n
+	}
+
+	owned := func(n *node) int {
+		n.Lock()
+		defer n.Unlock()
+		return len(n.owned)
+	}
+
+	wait := func(cond func() bool) {
+		for !cond() {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				t.Fatal("shards not balanced")
+			}
+		}
+	}
+
+	node1 := start("node1")
+	defer node1.server.Stop()
+	wait(func() bool { return owned(node1) == 16 })
+
+	node2 := start("node2")
+	wait(func() bool { return owned(node1) == 8 && owned(node2) == 8 })
+	wait(func() bool { return len(node1.sharding.Owned()) == 8 })
+
+	for shard := 0; shard < 16; shard++ {
+		owner, ok := node1.sharding.OwnerOf(shard)
+		if !ok {
+			t.Fatalf("shard %d has no owner", shard)
+		}
+
+		other, ok := node2.sharding.OwnerOf(shard)
+		if !ok || other.Id != owner.Id {
+			t.Fatalf("nodes disagree on the owner of shard %d", shard)
+		}
+
+		local := node1
+		if owner.Id == "node2" {
+			local = node2
+		}
+
+		local.Lock()
+		if !local.owned[shard] {
+			t.Fatalf("shard %d not acquired by %s", shard, owner.Id)
+		}
+		local.Unlock()
+	}
+
+	// a cordoned node gives its shards up like a node leaving
+	if err := node1.server.Cordons().Cordon("node2", "test"); err != nil {
+		t.Fatal(err)
+	}
+	wait(func() bool { return owned(node1) == 16 && owned(node2) == 0 })
+
+	if err := node1.server.Cordons().Uncordon("node2"); err != nil {
+		t.Fatal(err)
+	}
+	wait(func() bool { return owned(node1) == 8 && owned(node2) == 8 })
+
+	node2.server.Stop()
+	wait(func() bool { return owned(node1) == 16 })
+}
@@ -0,0 +1,451 @@
+package nakamacluster
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// virtualClock clock of the simulations, time only moves with Advance and the timers
+// run on the goroutine advancing it in the order they fire
+type virtualClock struct {
+	sync.Mutex
+	now    time.Time
+	seq    int
+	timers []virtualTimer
+}
+
+type virtualTimer struct {
+	at  time.Time
+	seq int
+	f   func()
+}
+
+func newVirtualClock() *virtualClock {
+	return &virtualClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) AfterFunc(d time.Duration, f func()) {
+	c.Lock()
+	defer c.Unlock()
+	c.seq++
+	c.timers = append(c.timers, virtualTimer{at: c.now.Add(d), seq: c.seq, f: f})
+}
+
+// Advance move the time forward by d running the timers due on the way
+func (c *virtualClock) Advance(d time.Duration) {
+	c.Lock()
+	end := c.now.Add(d)
+	c.Unlock()
+	for {
+		c.Lock()
+		sort.Slice(c.timers, func(i, j int) bool {
+			if !c.timers[i].at.Equal(c.timers[j].at) {
+				return c.timers[i].at.Before(c.timers[j].at)
+			}
+			return c.timers[i].seq < c.timers[j].seq
+		})
+
+		if len(c.timers) < 1 || c.timers[0].at.After(end) {
+			c.now = end
+			c.Unlock()
+			return
+		}
+
+		timer := c.timers[0]
+		c.timers = c.timers[1:]
+		if timer.at.After(c.now) {
+			c.now = timer.at
+		}
+		c.Unlock()
+		timer.f()
+	}
+}
+
+// simulation drives a LocalPeer through a membership scenario on virtual time and checks after
+// every step that its nodes, rings and pools converged to the model of the cluster
+type simulation struct {
+	t      *testing.T
+	seed   int64
+	rand   *rand.Rand
+	clock  *virtualClock
+	peer   *LocalPeer
+	epoch  int64
+	nodes  map[string]*Meta
+	known  map[string]*Meta
+	seen   [][]*Meta
+	cut    map[string]bool
+	hold   map[string]time.Time
+	steps  []string
+	cancel context.CancelFunc
+}
+
+func newSimulation(t *testing.T, seed int64, options PeerOptions) *simulation {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &simulation{
+		t:      t,
+		seed:   seed,
+		rand:   rand.New(rand.NewSource(seed)),
+		clock:  newVirtualClock(),
+		peer:   NewPeer(ctx, zap.NewNop(), options),
+		nodes:  make(map[string]*Meta),
+		known:  make(map[string]*Meta),
+		cut:    make(map[string]bool),
+		hold:   make(map[string]time.Time),
+		cancel: cancel,
+	}
+	s.peer.clock = s.clock
+	return s
+}
+
+func (s *simulation) Close() {
+	s.cancel()
+}
+
+func (s *simulation) step(format string, args ...any) {
+	s.steps = append(s.steps, fmt.Sprintf(format, args...))
+}
+
+// members the nodes the discovery of the peer reports, partitioned nodes are not seen
+func (s *simulation) members() []*Meta {
+	nodes := make([]*Meta, 0, len(s.nodes))
+	for id, node := range s.nodes {
+		if !s.cut[id] {
+			nodes = append(nodes, node.Clone())
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	s.rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	return nodes
+}
+
+func (s *simulation) sync() {
+	members := s.members()
+	s.seen = append(s.seen, members)
+	s.peer.Sync(members...)
+	s.synced(members)
+}
+
+// synced apply a sync to the model, the peer knows the synced nodes unless it knows a newer version
+func (s *simulation) synced(members []*Meta) {
+	known := make(map[string]*Meta, len(members))
+	for _, node := range members {
+		if cur, ok := s.known[node.Id]; ok && cur.Newer(node) {
+			node = cur
+		}
+		known[node.Id] = node
+	}
+	s.known = known
+}
+
+// merged apply a gossip update to the model, only newer versions of known nodes are merged
+func (s *simulation) merged(node *Meta) {
+	if cur, ok := s.known[node.Id]; ok && cur.Name == node.Name && node.Newer(cur) {
+		s.known[node.Id] = node
+	}
+}
+
+// stale sync the members the discovery reported earlier, like a lagging watch does
+func (s *simulation) stale() {
+	if len(s.seen) < 1 {
+		return
+	}
+
+	i := s.rand.Intn(len(s.seen))
+	s.step("stale sync of step %d", i)
+	members := make([]*Meta, 0, len(s.seen[i]))
+	for _, node := range s.seen[i] {
+		members = append(members, node.Clone())
+	}
+	s.peer.Sync(members...)
+	s.synced(members)
+}
+
+func (s *simulation) join(id, name string) {
+	s.step("join %s %s", id, name)
+	s.epoch++
+	node := NewNodeMeta(id, name, "127.0.0.1:"+strconv.Itoa(20000+len(s.nodes)), NODE_TYPE_MICROSERVICES, map[string]string{})
+	node.Epoch = s.epoch
+	s.nodes[id] = node
+	s.sync()
+}
+
+func (s *simulation) leave(id string) {
+	s.step("leave %s", id)
+	delete(s.nodes, id)
+	s.sync()
+}
+
+// update gossip a newer version of the node, it reaches the peer with Merge before the
+// discovery catches up unless the node is partitioned
+func (s *simulation) update(id string, status MetaStatus, weight int) {
+	s.step("update %s %s weight=%d", id, status, weight)
+	node := s.nodes[id].Clone()
+	node.Status = status
+	node.Version++
+	node.Vars = map[string]string{"weight": strconv.Itoa(weight)}
+	s.nodes[id] = node
+	if !s.cut[id] {
+		s.peer.Merge(node.Clone())
+		s.merged(node)
+	}
+}
+
+func (s *simulation) partition(ids ...string) {
+	s.step("partition %s", strings.Join(ids, ","))
+	for _, id := range ids {
+		s.cut[id] = true
+	}
+	s.sync()
+}
+
+func (s *simulation) heal() {
+	s.step("heal")
+	s.cut = make(map[string]bool)
+	s.sync()
+}
+
+func (s *simulation) quarantine(id string, d time.Duration) {
+	s.step("quarantine %s %s", id, d)
+	if err := s.peer.Quarantine(id, d); err != nil {
+		s.fail("quarantine %s: %v", id, err)
+	}
+
+	if until := s.clock.Now().Add(d); until.After(s.hold[id]) {
+		s.hold[id] = until
+	}
+}
+
+func (s *simulation) advance(d time.Duration) {
+	s.step("advance %s", d)
+	s.clock.Advance(d)
+}
+
+// dial open the pool to the node like a send does, quarantined nodes are not dialed
+func (s *simulation) dial(id string) {
+	s.step("dial %s", id)
+	if node, ok := s.peer.Get(id); ok && !s.peer.flaps.quarantined(id, s.clock.Now()) {
+		s.peer.makeGrpcPool(node)
+	}
+}
+
+// concurrent gossip updates of the nodes racing a sync of the discovery, the result must not
+// depend on the order they run in
+func (s *simulation) concurrent(ids ...string) {
+	s.step("concurrent %s", strings.Join(ids, ","))
+	updates := make([]*Meta, 0, len(ids))
+	for _, id := range ids {
+		node := s.nodes[id].Clone()
+		node.Version++
+		node.Status = META_STATUS_READYED
+		s.nodes[id] = node
+		if !s.cut[id] {
+			updates = append(updates, node.Clone())
+		}
+	}
+
+	members := s.members()
+	var wg sync.WaitGroup
+	for _, node := range updates {
+		wg.Add(1)
+		go func(node *Meta) {
+			defer wg.Done()
+			s.peer.Merge(node)
+		}(node)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.peer.Sync(members...)
+	}()
+	wg.Wait()
+
+	for _, node := range updates {
+		s.merged(node)
+	}
+	s.synced(members)
+}
+
+func (s *simulation) fail(format string, args ...any) {
+	s.t.Helper()
+	s.t.Fatalf("seed %d: %s\nsteps:\n  %s", s.seed, fmt.Sprintf(format, args...), strings.Join(s.steps, "\n  "))
+}
+
+// check compare the peer with the model, the synced nodes are known with their latest version,
+// the rings hold the routable nodes out of quarantine and only known nodes have pools
+func (s *simulation) check() {
+	s.t.Helper()
+	now := s.clock.Now()
+	want := s.known
+	ring := make(map[string][]string)
+	for id, node := range want {
+		if node.Status.Routable() && !now.Before(s.hold[id]) {
+			ring[node.Name] = append(ring[node.Name], id)
+		}
+	}
+
+	if s.peer.Size() != len(want) {
+		s.fail("peer knows %d nodes, want %d", s.peer.Size(), len(want))
+	}
+
+	for id, node := range want {
+		got, ok := s.peer.Get(id)
+		if !ok {
+			s.fail("node %s missing", id)
+		}
+
+		if got.Status != node.Status || got.Version != node.Version || got.Epoch != node.Epoch {
+			s.fail("node %s is %s v%d/%d, want %s v%d/%d", id, got.Status, got.Epoch, got.Version, node.Status, node.Epoch, node.Version)
+		}
+	}
+
+	v := s.peer.view()
+	for _, name := range []string{"game", "chat"} {
+		n := 0
+		for _, node := range want {
+			if node.Name == name {
+				n++
+			}
+		}
+
+		if s.peer.SizeByName(name) != n {
+			s.fail("service %s has %d nodes, want %d", name, s.peer.SizeByName(name), n)
+		}
+
+		got := make([]string, 0)
+		if r, ok := v.rings[name]; ok && r.Size() > 0 {
+			got, _ = r.GetNodes("", r.Size())
+		}
+
+		sort.Strings(got)
+		sort.Strings(ring[name])
+		if strings.Join(got, ",") != strings.Join(ring[name], ",") {
+			s.fail("ring %s holds [%s], want [%s]", name, strings.Join(got, ","), strings.Join(ring[name], ","))
+		}
+
+		if node, ok := s.peer.GetWithHashRing(name, "key"); ok != (len(ring[name]) > 0) || (ok && !contains(ring[name], node.Id)) {
+			s.fail("ring %s routed to %v", name, node)
+		}
+	}
+
+	s.peer.grpcPool.Range(func(key, value any) bool {
+		if _, ok := want[key.(string)]; !ok {
+			s.fail("pool of unknown node %s left open", key)
+		}
+		return true
+	})
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSimulationScripted(t *testing.T) {
+	s := newSimulation(t, 1, PeerOptions{FlapThreshold: 3, FlapWindow: time.Minute, FlapCooldown: 5 * time.Minute})
+	defer s.Close()
+
+	s.join("node1", "game")
+	s.join("node2", "game")
+	s.join("node3", "chat")
+	s.dial("node1")
+	s.dial("node3")
+	s.check()
+
+	s.update("node1", META_STATUS_READYED, 2)
+	s.update("node2", META_STATUS_DRAINING, 1)
+	s.check()
+
+	// the partitioned node leaves the view and its pool is closed, it comes back on heal
+	s.partition("node3")
+	s.check()
+	s.update("node3", META_STATUS_READYED, 1)
+	s.heal()
+	s.check()
+
+	// node1 joins and leaves more than the threshold within the window and is quarantined
+	s.leave("node1")
+	s.join("node1", "game")
+	s.leave("node1")
+	s.join("node1", "game")
+	s.hold["node1"] = s.clock.Now().Add(5 * time.Minute)
+	s.check()
+
+	s.advance(4 * time.Minute)
+	s.update("node1", META_STATUS_READYED, 1)
+	s.check()
+
+	s.advance(time.Minute)
+	s.check()
+
+	s.quarantine("node3", time.Minute)
+	s.quarantine("node3", 2*time.Minute)
+	s.advance(time.Minute)
+	s.check()
+	s.advance(time.Minute)
+	s.check()
+}
+
+func TestSimulationRandomChurn(t *testing.T) {
+	for seed := int64(1); seed <= 32; seed++ {
+		s := newSimulation(t, seed, PeerOptions{})
+		names := []string{"game", "chat"}
+		statuses := []MetaStatus{META_STATUS_READYED, META_STATUS_SUSPECT, META_STATUS_DRAINING, META_STATUS_MAINTENANCE}
+		for i := 0; i < 200; i++ {
+			id := "node" + strconv.Itoa(s.rand.Intn(8))
+			_, known := s.nodes[id]
+			_, visible := s.peer.Get(id)
+			switch op := s.rand.Intn(10); {
+			case !known:
+				s.join(id, names[s.rand.Intn(len(names))])
+			case op == 0:
+				s.leave(id)
+			case op == 1:
+				s.update(id, statuses[s.rand.Intn(len(statuses))], 1+s.rand.Intn(3))
+			case op == 2:
+				s.partition(id)
+			case op == 3:
+				s.heal()
+			case op == 4 && visible:
+				s.quarantine(id, time.Duration(1+s.rand.Intn(3))*time.Minute)
+			case op == 5:
+				s.advance(time.Duration(s.rand.Intn(90)) * time.Second)
+			case op == 6:
+				s.dial(id)
+			case op == 7:
+				ids := make([]string, 0)
+				for id := range s.nodes {
+					ids = append(ids, id)
+				}
+				sort.Strings(ids)
+				s.concurrent(ids[:1+s.rand.Intn(len(ids))]...)
+			case op == 8:
+				s.stale()
+			default:
+				s.sync()
+			}
+			s.check()
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,255 @@
+package nakamacluster
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+)
+
+// ErrRouteBudgetExhausted the route spent its error budget and its breaker rejects the envelope
+var ErrRouteBudgetExhausted = errors.New("route error budget exhausted")
+
+// sloBuckets buckets of the rolling window, a bucket expires as a whole
+const sloBuckets = 10
+
+// SloOptions routes tracked by the SloTracker and their objective
+type SloOptions struct {
+	// Routes cid patterns of the routes matched with path.Match, every pattern is a route
+	Routes []string
+
+	// Objective ratio of the requests of a route that must succeed, like 0.999
+	Objective float64
+
+	// Latency requests handled slower count against the budget, 0 ignores latency
+	Latency time.Duration
+
+	// Window duration of the rolling window the ratios are measured on
+	Window time.Duration
+
+	// MinRequests requests of the window below which the budget of a route never trips its breaker
+	MinRequests int
+
+	// BreakerCooldown duration a route with an exhausted budget rejects envelopes, 0 never rejects them
+	BreakerCooldown time.Duration
+}
+
+// RouteSlo success ratio, latency and remaining error budget of a route in the window
+type RouteSlo struct {
+	Route        string  `json:"route"`
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	Slow         int64   `json:"slow"`
+	SuccessRatio float64 `json:"success_ratio"`
+
+	// BudgetRemaining share of the error budget left, 1 is untouched and 0 or less is exhausted
+	BudgetRemaining float64       `json:"budget_remaining"`
+	LatencyAvg      time.Duration `json:"latency_avg"`
+	LatencyMax      time.Duration `json:"latency_max"`
+	Tripped         bool          `json:"tripped"`
+}
+
+type sloBucket struct {
+	start      int64
+	requests   int64
+	errors     int64
+	slow       int64
+	latencySum time.Duration
+	latencyMax time.Duration
+}
+
+type sloRoute struct {
+	buckets      [sloBuckets]sloBucket
+	trippedUntil time.Time
+}
+
+// SloTracker measures the requests of the routes handled by the node in a rolling window
+// and trips the breaker of a route once its error budget is exhausted
+type SloTracker struct {
+	options SloOptions
+	routes  map[string]*sloRoute
+	clock   clock
+	metrics *Metrics
+	sync.Mutex
+}
+
+// NewSloTracker create the tracker, it returns nil when no route is tracked
+func NewSloTracker(options SloOptions, metrics *Metrics) *SloTracker {
+	if len(options.Routes) < 1 || options.Window <= 0 || options.Objective <= 0 || options.Objective >= 1 {
+		return nil
+	}
+
+	if metrics == nil {
+		metrics = NewMetrics(nil)
+	}
+
+	t := &SloTracker{options: options, routes: make(map[string]*sloRoute), clock: realClock{}, metrics: metrics}
+	for _, route := range options.Routes {
+		t.routes[route] = &sloRoute{}
+	}
+	return t
+}
+
+// newSloTracker create the tracker of the config, nil when it tracks no route
+func newSloTracker(config Config, metrics *Metrics) *SloTracker {
+	return NewSloTracker(SloOptions{
+		Routes:          config.SloRoutes,
+		Objective:       config.SloObjective,
+		Latency:         time.Duration(config.SloLatency) * time.Millisecond,
+		Window:          time.Duration(config.SloWindow) * time.Second,
+		MinRequests:     config.SloMinRequests,
+		BreakerCooldown: time.Duration(config.SloBreakerCooldown) * time.Second,
+	}, metrics)
+}
+
+// route returns the first route the cid matches
+func (t *SloTracker) route(cid string) (string, bool) {
+	for _, route := range t.options.Routes {
+		if ok, _ := path.Match(route, cid); ok {
+			return route, true
+		}
+	}
+	return "", false
+}
+
+// sloFailure reports whether the error is a failure of the node, errors of the caller like
+// invalid arguments do not spend the budget
+func sloFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch api.AsError(err).GetCode() {
+	case api.Error_UNKNOWN, api.Error_TIMEOUT, api.Error_RESOURCE_EXHAUSTED, api.Error_INTERNAL, api.Error_UNAVAILABLE, api.Error_DATA_LOSS:
+		return true
+	}
+	return false
+}
+
+// Admit reports whether the envelope of the cid is handled, the breaker of its route rejects it
+// while the route cools down
+func (t *SloTracker) Admit(cid string) bool {
+	if t == nil || t.options.BreakerCooldown <= 0 {
+		return true
+	}
+
+	name, ok := t.route(cid)
+	if !ok {
+		return true
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.clock.Now().Before(t.routes[name].trippedUntil) {
+		t.metrics.SloRejected(name)
+		return false
+	}
+	return true
+}
+
+// Observe add the request of the cid handled in d with err to its route
+func (t *SloTracker) Observe(cid string, d time.Duration, err error) {
+	if t == nil {
+		return
+	}
+
+	name, ok := t.route(cid)
+	if !ok {
+		return
+	}
+
+	failed := sloFailure(err)
+	slow := !failed && t.options.Latency > 0 && d > t.options.Latency
+	now := t.clock.Now()
+
+	t.Lock()
+	defer t.Unlock()
+	r := t.routes[name]
+	b := t.bucket(r, now)
+	b.requests++
+	b.latencySum += d
+	if d > b.latencyMax {
+		b.latencyMax = d
+	}
+
+	switch {
+	case failed:
+		b.errors++
+	case slow:
+		b.slow++
+	}
+
+	slo := t.stats(name, r, now)
+	t.metrics.SloRequest(name, failed, slow, d)
+	t.metrics.SloBudget(name, slo.BudgetRemaining)
+	if t.options.BreakerCooldown > 0 && slo.BudgetRemaining <= 0 && slo.Requests >= int64(t.options.MinRequests) && !now.Before(r.trippedUntil) {
+		r.trippedUntil = now.Add(t.options.BreakerCooldown)
+		t.metrics.SloTripped(name)
+	}
+}
+
+// Routes returns the measures of the tracked routes sorted by route
+func (t *SloTracker) Routes() []RouteSlo {
+	if t == nil {
+		return nil
+	}
+
+	now := t.clock.Now()
+	t.Lock()
+	defer t.Unlock()
+	routes := make([]RouteSlo, 0, len(t.routes))
+	for name, r := range t.routes {
+		routes = append(routes, t.stats(name, r, now))
+	}
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+	return routes
+}
+
+// bucket returns the bucket of now, reset when it held an expired part of the window
+func (t *SloTracker) bucket(r *sloRoute, now time.Time) *sloBucket {
+	size := int64(t.options.Window / sloBuckets)
+	if size < 1 {
+		size = 1
+	}
+
+	start := now.UnixNano() / size * size
+	b := &r.buckets[(now.UnixNano()/size)%sloBuckets]
+	if b.start != start {
+		*b = sloBucket{start: start}
+	}
+	return b
+}
+
+// stats sum the buckets of the route inside the window
+func (t *SloTracker) stats(name string, r *sloRoute, now time.Time) RouteSlo {
+	slo := RouteSlo{Route: name, SuccessRatio: 1, BudgetRemaining: 1, Tripped: now.Before(r.trippedUntil)}
+	oldest := now.Add(-t.options.Window).UnixNano()
+	var latency time.Duration
+	for _, b := range r.buckets {
+		if b.requests < 1 || b.start <= oldest {
+			continue
+		}
+
+		slo.Requests += b.requests
+		slo.Errors += b.errors
+		slo.Slow += b.slow
+		latency += b.latencySum
+		if b.latencyMax > slo.LatencyMax {
+			slo.LatencyMax = b.latencyMax
+		}
+	}
+
+	if slo.Requests < 1 {
+		return slo
+	}
+
+	bad := float64(slo.Errors + slo.Slow)
+	slo.SuccessRatio = 1 - bad/float64(slo.Requests)
+	slo.BudgetRemaining = 1 - bad/((1-t.options.Objective)*float64(slo.Requests))
+	slo.LatencyAvg = latency / time.Duration(slo.Requests)
+	return slo
+}
@@ -0,0 +1,67 @@
+package nakamacluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/uber-go/tally/v4"
+)
+
+func TestSloTracker(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	tracker := NewSloTracker(SloOptions{
+		Routes:          []string{"match.*"},
+		Objective:       0.9,
+		Latency:         100 * time.Millisecond,
+		Window:          10 * time.Second,
+		MinRequests:     10,
+		BreakerCooldown: 5 * time.Second,
+	}, NewMetrics(scope))
+	clock := newVirtualClock()
+	tracker.clock = clock
+
+	for i := 0; i < 10; i++ {
+		tracker.Observe("match.join", time.Millisecond, nil)
+	}
+
+	// errors of the caller and untracked routes do not spend the budget
+	tracker.Observe("match.join", time.Millisecond, api.NewError(api.Error_INVALID_ARGUMENT, "bad"))
+	tracker.Observe("chat.send", time.Millisecond, api.NewError(api.Error_INTERNAL, "failed"))
+	if routes := tracker.Routes(); len(routes) != 1 || routes[0].Requests != 11 || routes[0].BudgetRemaining != 1 {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+
+	tracker.Observe("match.join", time.Second, nil)
+	if !tracker.Admit("match.join") {
+		t.Fatal("route rejected before its budget was exhausted")
+	}
+
+	tracker.Observe("match.join", time.Millisecond, api.NewError(api.Error_UNAVAILABLE, "failed"))
+	slo := tracker.Routes()[0]
+	if slo.Errors != 1 || slo.Slow != 1 || slo.BudgetRemaining > 0 || !slo.Tripped || slo.LatencyMax != time.Second {
+		t.Fatalf("unexpected route %+v", slo)
+	}
+
+	if tracker.Admit("match.leave") || !tracker.Admit("chat.send") {
+		t.Fatal("breaker of the route not tripped alone")
+	}
+
+	if _, ok := scope.Snapshot().Counters()["cluster.slo_tripped+route=match.*"]; !ok {
+		t.Fatalf("trip not reported %v", scope.Snapshot().Counters())
+	}
+
+	clock.Advance(5 * time.Second)
+	if !tracker.Admit("match.join") {
+		t.Fatal("route rejected after the cooldown")
+	}
+
+	clock.Advance(10 * time.Second)
+	if slo := tracker.Routes()[0]; slo.Requests != 0 || slo.BudgetRemaining != 1 {
+		t.Fatalf("window not expired %+v", slo)
+	}
+
+	if NewSloTracker(SloOptions{Window: time.Second, Objective: 0.99}, nil) != nil {
+		t.Fatal("tracker without routes created")
+	}
+}
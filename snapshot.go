@@ -0,0 +1,98 @@
+package nakamacluster
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+)
+
+// Snapshot cluster view of a peer, nodes with their vars and versions
+// and the weights of every service hashring
+type Snapshot struct {
+	ProtocolVersion uint32                    `json:"protocol_version"`
+	CreatedAt       time.Time                 `json:"created_at"`
+	Nodes           []*Meta                   `json:"nodes"`
+	Rings           map[string]map[string]int `json:"rings"`
+}
+
+// Marshal create JSON
+func (s *Snapshot) Marshal() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// WriteFile write the snapshot as JSON to the file, the file is replaced atomically
+func (s *Snapshot) WriteFile(name string) error {
+	b, err := s.Marshal()
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// NewSnapshot create snapshot of the nodes, stopped nodes are not part of the rings
+func NewSnapshot(nodes ...*Meta) *Snapshot {
+	s := &Snapshot{
+		ProtocolVersion: ProtocolVersion,
+		CreatedAt:       time.Now().UTC(),
+		Nodes:           make([]*Meta, 0, len(nodes)),
+		Rings:           make(map[string]map[string]int),
+	}
+
+	for _, node := range nodes {
+		s.Nodes = append(s.Nodes, node.Clone())
+		if node.Status == META_STATUS_STOPED {
+			continue
+		}
+
+		if _, ok := s.Rings[node.Name]; !ok {
+			s.Rings[node.Name] = make(map[string]int)
+		}
+		s.Rings[node.Name][node.Id] = nodeWeight(node)
+	}
+
+	sort.Slice(s.Nodes, func(i, j int) bool {
+		return s.Nodes[i].Id < s.Nodes[j].Id
+	})
+	return s
+}
+
+// NewSnapshotFromJSON Created via json stream Snapshot
+func NewSnapshotFromJSON(b []byte) (*Snapshot, error) {
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ReadSnapshotFile read a JSON snapshot from the file
+func ReadSnapshotFile(name string) (*Snapshot, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewSnapshotFromJSON(b)
+}
+
+// Snapshot export the current cluster view
+func (peer *LocalPeer) Snapshot() *Snapshot {
+	return NewSnapshot(peer.All()...)
+}
+
+// Restore replace the cluster view with the snapshot, the rings are rebuilt from the nodes
+func (peer *LocalPeer) Restore(snapshot *Snapshot) {
+	nodes := make([]*Meta, 0, len(snapshot.Nodes))
+	for _, node := range snapshot.Nodes {
+		if node == nil || CheckProtocolVersion(node.ProtocolVersion) != nil {
+			continue
+		}
+		nodes = append(nodes, node.Clone())
+	}
+	peer.Sync(nodes...)
+}
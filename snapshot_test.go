@@ -0,0 +1,54 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nodes := []*Meta{
+		NewNodeMeta("2", "chat", "127.0.0.1:7002", NODE_TYPE_MICROSERVICES, map[string]string{"weight": "3"}),
+		NewNodeMeta("1", "chat", "127.0.0.1:7001", NODE_TYPE_MICROSERVICES, map[string]string{}),
+		NewNodeMeta("3", "chat", "127.0.0.1:7003", NODE_TYPE_MICROSERVICES, map[string]string{}),
+	}
+	nodes[2].Status = META_STATUS_STOPED
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	peer.Sync(nodes...)
+	b, err := peer.Snapshot().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := NewSnapshotFromJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snapshot.Nodes) != 3 || snapshot.Nodes[0].Id != "1" {
+		t.Fatalf("unexpected nodes %v", snapshot.Nodes)
+	}
+
+	if ring := snapshot.Rings["chat"]; len(ring) != 2 || ring["2"] != 3 {
+		t.Fatalf("unexpected ring %v", ring)
+	}
+
+	restored := NewPeer(ctx, zap.NewNop(), PeerOptions{})
+	restored.Restore(snapshot)
+	if restored.Size() != 3 {
+		t.Fatalf("expected 3 nodes, got %d", restored.Size())
+	}
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		want, _ := peer.GetWithHashRing("chat", k)
+		got, ok := restored.GetWithHashRing("chat", k)
+		if !ok || got.Id != want.Id {
+			t.Fatalf("key %s: expected owner %s", k, want.Id)
+		}
+	}
+}
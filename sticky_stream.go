@@ -0,0 +1,203 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+)
+
+// ErrStickyStreamClosed the sticky stream was closed
+var ErrStickyStreamClosed = errors.New("sticky stream closed")
+
+// StickyStream stream pinned to the node of the ring of a service owning a key. When the
+// ownership of the key moves, like a node joining, leaving, draining or being cordoned,
+// the stream is reopened on the new owner and the old one closed, messages of both
+// streams are received on the same channel
+type StickyStream struct {
+	peer     *LocalPeer
+	ctx      context.Context
+	cancel   context.CancelFunc
+	name     string
+	key      string
+	md       metadata.MD
+	onRepin  func(from, to *Meta)
+	out      chan *api.Envelope
+	node     *Meta
+	clientId string
+	ps       *peerStream
+	closed   bool
+	wg       sync.WaitGroup
+	sync.Mutex
+}
+
+// OpenStickyStream open a stream to the node of the ring of the name owning the key, onRepin
+// is called with the old and the new owner every time the stream moved and may be nil
+func (peer *LocalPeer) OpenStickyStream(ctx context.Context, name, key string, md metadata.MD, onRepin func(from, to *Meta)) (*StickyStream, error) {
+	// taken before the owner is looked up so no change of the ring is missed
+	changed := peer.viewChange()
+	node, ok := peer.GetWithHashRing(name, key)
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &StickyStream{
+		peer:    peer,
+		ctx:     ctx,
+		cancel:  cancel,
+		name:    name,
+		key:     key,
+		md:      md,
+		onRepin: onRepin,
+		out:     make(chan *api.Envelope, peer.serviceOptions(name).MessageQueueSize),
+	}
+
+	s.Lock()
+	err := s.pin(node)
+	s.Unlock()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go s.watch(changed)
+	go func() {
+		<-ctx.Done()
+		s.Lock()
+		s.closed = true
+		if s.ps != nil {
+			s.ps.close()
+		}
+		s.Unlock()
+		s.wg.Wait()
+		close(s.out)
+	}()
+	return s, nil
+}
+
+// Node returns the node the stream is pinned to
+func (s *StickyStream) Node() *Meta {
+	s.Lock()
+	defer s.Unlock()
+	return s.node.Clone()
+}
+
+// Recv returns the channel receiving the messages of the owners, it is closed once the stream is closed
+func (s *StickyStream) Recv() <-chan *api.Envelope {
+	return s.out
+}
+
+// Send send the envelope to the owner of the key, the stream is reopened first when the node
+// ended it, like after a redirect of a draining node
+func (s *StickyStream) Send(ctx context.Context, in *api.Envelope) error {
+	s.Lock()
+	if s.closed || s.ctx.Err() != nil {
+		s.Unlock()
+		return ErrStickyStreamClosed
+	}
+
+	var from, to *Meta
+	if v, ok := s.peer.grpcStreams.Load(s.clientId); !ok || v != s.ps {
+		node, ok := s.peer.GetWithHashRing(s.name, s.key)
+		if !ok {
+			s.Unlock()
+			return ErrNodeNotFound
+		}
+
+		from = s.node
+		if err := s.pin(node); err != nil {
+			s.Unlock()
+			return err
+		}
+		to = s.node
+	}
+
+	ps := s.ps
+	s.Unlock()
+	s.repinned(from, to)
+	return s.peer.sendStream(ctx, ps, in)
+}
+
+// Close close the stream
+func (s *StickyStream) Close() {
+	s.cancel()
+}
+
+// watch follow the owner of the key until the stream is closed
+func (s *StickyStream) watch(changed <-chan struct{}) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-changed:
+		}
+
+		changed = s.peer.viewChange()
+		node, ok := s.peer.GetWithHashRing(s.name, s.key)
+		if !ok {
+			// the stream stays on the last owner until the service has a node again
+			continue
+		}
+
+		s.Lock()
+		if s.closed || s.node.Id == node.Id {
+			s.Unlock()
+			continue
+		}
+
+		from := s.node
+		if err := s.pin(node); err != nil {
+			s.Unlock()
+			s.peer.logger.Warn("Failed repin sticky stream", zap.Error(err), zap.String("key", s.key), zap.String("node", node.Id))
+			continue
+		}
+		to := s.node
+		s.Unlock()
+		s.repinned(from, to)
+	}
+}
+
+// pin open the stream to the node and close the previous one, s must be locked
+func (s *StickyStream) pin(node *Meta) error {
+	// every stream has its own client id so its chunks never mix with those of the previous one
+	clientId := "sticky." + s.name + "." + s.key + "." + uuid.Must(uuid.NewV4()).String()
+	ps, ch, err := s.peer.openStream(s.peer.ctx, clientId, node, s.md, false)
+	if err != nil {
+		return err
+	}
+
+	if s.ps != nil {
+		s.ps.close()
+	}
+
+	s.node, s.clientId, s.ps = node, clientId, ps
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for envelope := range ch {
+			select {
+			case s.out <- envelope:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *StickyStream) repinned(from, to *Meta) {
+	if from == nil || to == nil {
+		return
+	}
+
+	s.peer.options.Metrics.StickyStreamRepinned(s.name)
+	s.peer.logger.Info("Repinned sticky stream", zap.String("key", s.key), zap.String("from", from.Id), zap.String("to", to.Id))
+	if s.onRepin != nil {
+		s.onRepin(from.Clone(), to.Clone())
+	}
+}
@@ -0,0 +1,87 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestStickyStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	newServer := func(id string) *Server {
+		config := testConfig(t)
+		server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), id, "svc", map[string]string{}, *config)
+		server.OnDelegate(streamEchoDelegate{})
+		return server
+	}
+
+	server1 := newServer("node1")
+	defer server1.Stop()
+	server2 := newServer("node2")
+	defer server2.Stop()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MessageQueueSize: 8})
+	peer.Sync(server1.GetMeta(), server2.GetMeta())
+
+	repinned := make(chan [2]string, 1)
+	stream, err := peer.OpenStickyStream(ctx, "svc", "match1", nil, func(from, to *Meta) {
+		repinned <- [2]string{from.Id, to.Id}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	owner, _ := peer.GetWithHashRing("svc", "match1")
+	if stream.Node().Id != owner.Id {
+		t.Fatalf("stream pinned to %s, owner is %s", stream.Node().Id, owner.Id)
+	}
+
+	echo := func(cid string) {
+		if err := stream.Send(ctx, &api.Envelope{Cid: cid}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case out := <-stream.Recv():
+			if out.Cid != cid {
+				t.Fatalf("unexpected echo %s", out.Cid)
+			}
+		case <-ctx.Done():
+			t.Fatalf("echo %s not received", cid)
+		}
+	}
+	echo("1")
+
+	// the owner leaves, the stream follows the key to the other node
+	peer.Delete(owner.Id)
+	select {
+	case ids := <-repinned:
+		if ids[0] != owner.Id || ids[1] == owner.Id || stream.Node().Id != ids[1] {
+			t.Fatalf("unexpected repin %v", ids)
+		}
+	case <-ctx.Done():
+		t.Fatal("stream not repinned")
+	}
+	echo("2")
+
+	stream.Close()
+	select {
+	case _, ok := <-stream.Recv():
+		if ok {
+			t.Fatal("message received after close")
+		}
+	case <-ctx.Done():
+		t.Fatal("channel not closed")
+	}
+
+	if err := stream.Send(ctx, &api.Envelope{Cid: "3"}); err != ErrStickyStreamClosed {
+		t.Fatalf("expected ErrStickyStreamClosed, got %v", err)
+	}
+}
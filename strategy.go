@@ -0,0 +1,276 @@
+package nakamacluster
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	STRATEGY_ROUND_ROBIN = "round_robin" // nodes of the service take turns
+	STRATEGY_RANDOM      = "random"      // a random node of the service
+	STRATEGY_LATENCY     = "latency"     // the healthy node with the lowest heartbeat rtt
+)
+
+// DefaultLatencyExplore share of the picks of the latency strategy spread over every healthy node
+const DefaultLatencyExplore = 0.1
+
+// Strategy picks the node serving a request among the candidate nodes of a service,
+// candidates is never empty and pick must not modify it
+type Strategy interface {
+	Pick(name string, candidates []*Meta, in *api.Envelope) *Meta
+}
+
+// NewStrategy returns the strategy registered under the name
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", STRATEGY_ROUND_ROBIN:
+		return NewRoundRobinStrategy(), nil
+
+	case STRATEGY_RANDOM:
+		return RandomStrategy{}, nil
+
+	case STRATEGY_LATENCY:
+		return NewLatencyStrategy(nil, DefaultLatencyExplore), nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q", name)
+}
+
+// RoundRobinStrategy hands out the nodes of every service in turn
+type RoundRobinStrategy struct {
+	counters sync.Map
+}
+
+// NewRoundRobinStrategy create round robin strategy
+func NewRoundRobinStrategy() *RoundRobinStrategy {
+	return &RoundRobinStrategy{}
+}
+
+func (s *RoundRobinStrategy) Pick(name string, candidates []*Meta, in *api.Envelope) *Meta {
+	v, _ := s.counters.LoadOrStore(name, new(uint64))
+	n := atomic.AddUint64(v.(*uint64), 1)
+	return candidates[int((n-1)%uint64(len(candidates)))]
+}
+
+// RandomStrategy picks a random node
+type RandomStrategy struct{}
+
+func (RandomStrategy) Pick(name string, candidates []*Meta, in *api.Envelope) *Meta {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// LinkSource reports the heartbeat state of the links to the nodes, implemented by LocalPeer
+type LinkSource interface {
+	Link(id string) (PeerLink, bool)
+}
+
+// linkAware strategies use the links of the peer they are used with
+type linkAware interface {
+	bindLinks(links LinkSource)
+}
+
+// LatencyStrategy picks the node with the lowest smoothed rtt among the nodes whose link
+// is not degraded. A share of the picks goes round robin to every healthy node so the
+// rtt of all of them stays measured, nodes without rtt are only picked that way.
+type LatencyStrategy struct {
+	explore  float64
+	links    LinkSource
+	bind     sync.Once
+	fallback *RoundRobinStrategy
+}
+
+// NewLatencyStrategy create latency strategy, a nil links uses the peer the strategy is
+// used with. explore is the share of round robin picks between 0 and 1.
+func NewLatencyStrategy(links LinkSource, explore float64) *LatencyStrategy {
+	if explore < 0 {
+		explore = 0
+	} else if explore > 1 {
+		explore = 1
+	}
+
+	s := &LatencyStrategy{explore: explore, fallback: NewRoundRobinStrategy()}
+	if links != nil {
+		s.bindLinks(links)
+	}
+	return s
+}
+
+func (s *LatencyStrategy) bindLinks(links LinkSource) {
+	s.bind.Do(func() {
+		s.links = links
+	})
+}
+
+func (s *LatencyStrategy) Pick(name string, candidates []*Meta, in *api.Envelope) *Meta {
+	if s.links == nil {
+		return s.fallback.Pick(name, candidates, in)
+	}
+
+	var (
+		best    *Meta
+		bestRTT time.Duration
+	)
+	healthy := make([]*Meta, 0, len(candidates))
+	for _, node := range candidates {
+		link, ok := s.links.Link(node.Id)
+		if ok && link.Degraded() {
+			continue
+		}
+
+		healthy = append(healthy, node)
+		if ok && !link.LastSeen.IsZero() && (best == nil || link.RTT < bestRTT) {
+			best, bestRTT = node, link.RTT
+		}
+	}
+
+	if len(healthy) < 1 {
+		healthy = candidates
+	}
+
+	if best == nil || (s.explore > 0 && rand.Float64() < s.explore) {
+		return s.fallback.Pick(name, healthy, in)
+	}
+	return best
+}
+
+// SendOption configures SendToName
+type SendOption func(o *sendOptions)
+
+type sendOptions struct {
+	strategy Strategy
+	key      string
+	attempts int
+}
+
+// WithSendStrategy pick the node with the strategy instead of PeerOptions.Strategy
+func WithSendStrategy(strategy Strategy) SendOption {
+	return func(o *sendOptions) {
+		o.strategy = strategy
+	}
+}
+
+// WithSendKey send to the owner of the key on the hashring of the service first,
+// the strategy only picks the nodes tried on failover
+func WithSendKey(key string) SendOption {
+	return func(o *sendOptions) {
+		o.key = key
+	}
+}
+
+// WithSendAttempts limit the number of nodes tried, default every node of the service
+func WithSendAttempts(attempts int) SendOption {
+	return func(o *sendOptions) {
+		o.attempts = attempts
+	}
+}
+
+// SendToName send the envelope to a node of the named service picked by the strategy,
+// when the node is unavailable the envelope is sent to another node of the service.
+// It returns the reply and the node that served the call, or the last node tried.
+func (peer *LocalPeer) SendToName(ctx context.Context, name string, in *api.Envelope, opts ...SendOption) (*api.Envelope, *Meta, error) {
+	o := &sendOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.strategy == nil {
+		o.strategy = peer.strategy(name)
+	} else if s, ok := o.strategy.(linkAware); ok {
+		s.bindLinks(peer)
+	}
+
+	candidates := make([]*Meta, 0)
+	for _, node := range peer.GetByName(name) {
+		if peer.routable(node, time.Now()) {
+			candidates = append(candidates, node)
+		}
+	}
+
+	if len(candidates) < 1 {
+		return nil, nil, fmt.Errorf("service %s %w", name, ErrNodeNotFound)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Id < candidates[j].Id
+	})
+
+	attempts := o.attempts
+	if attempts < 1 || attempts > len(candidates) {
+		attempts = len(candidates)
+	}
+
+	var (
+		node *Meta
+		err  error
+	)
+	for i := 0; i < attempts && len(candidates) > 0; i++ {
+		node = nil
+		if i == 0 && o.key != "" {
+			if owner, ok := peer.GetWithHashRing(name, o.key); ok {
+				node = findMeta(candidates, owner.Id)
+			}
+		}
+
+		if node == nil {
+			node = o.strategy.Pick(name, candidates, in)
+		}
+
+		var out *api.Envelope
+		out, err = peer.Send(ctx, node, in)
+		if err == nil || !isUnavailable(ctx, err) {
+			return out, node, err
+		}
+
+		peer.logger.Debug("Failover from unavailable node", zap.String("service", name), zap.String("node", node.Id), zap.Error(err))
+		candidates = removeMeta(candidates, node.Id)
+	}
+	return nil, node, err
+}
+
+// strategy returns the strategy of the named service
+func (peer *LocalPeer) strategy(name string) Strategy {
+	if s, ok := peer.options.Strategies[name]; ok {
+		return s
+	}
+	return peer.options.Strategy
+}
+
+// isUnavailable reports whether the call failed because the node could not serve it,
+// errors returned by the node itself and a done ctx are not retried elsewhere
+func isUnavailable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if _, ok := status.FromError(err); !ok {
+		return true
+	}
+	return api.IsCode(err, api.Error_UNAVAILABLE)
+}
+
+func findMeta(nodes []*Meta, id string) *Meta {
+	for _, node := range nodes {
+		if node.Id == id {
+			return node
+		}
+	}
+	return nil
+}
+
+func removeMeta(nodes []*Meta, id string) []*Meta {
+	rest := make([]*Meta, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Id != id {
+			rest = append(rest, node)
+		}
+	}
+	return rest
+}
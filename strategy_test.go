@@ -0,0 +1,167 @@
+package nakamacluster
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+type echoServerDelegate struct{}
+
+func (echoServerDelegate) Call(ctx context.Context, in *api.Envelope) (*api.Envelope, error) {
+	return in, nil
+}
+
+func (echoServerDelegate) Stream(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error {
+	return nil
+}
+
+func (echoServerDelegate) OnStreamClose(ctx context.Context) {}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// testConfig returns the default config of a test node listening on a free loopback port
+func testConfig(t *testing.T) *Config {
+	config := NewConfig()
+	config.Addr = "127.0.0.1"
+	config.Port = freePort(t)
+	return config
+}
+
+// newTestServer start the node1 server of the svc service on its own memory store, mutate
+// adjusts the config of testConfig when not nil. The server is stopped when the test ends
+func newTestServer(t *testing.T, mutate func(*Config), opts ...Option) *Server {
+	config := testConfig(t)
+	if mutate != nil {
+		mutate(config)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", "svc", map[string]string{}, *config, opts...)
+	t.Cleanup(func() {
+		server.Stop()
+		cancel()
+	})
+	return server
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	nodes := []*Meta{{Id: "a"}, {Id: "b"}, {Id: "c"}}
+	s := NewRoundRobinStrategy()
+	for i, expected := range []string{"a", "b", "c", "a"} {
+		if node := s.Pick("svc", nodes, nil); node.Id != expected {
+			t.Fatalf("pick %d got %s expected %s", i, node.Id, expected)
+		}
+	}
+
+	if node := s.Pick("other", nodes, nil); node.Id != "a" {
+		t.Fatalf("services share the counter, got %s", node.Id)
+	}
+}
+
+func TestSendToNameFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := testConfig(t)
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "live", "svc", map[string]string{}, *config)
+	server.OnDelegate(echoServerDelegate{})
+	defer server.Stop()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, Timeout: 2 * time.Second})
+	dead := NewNodeMeta("dead", "svc", "127.0.0.1:"+strconv.Itoa(freePort(t)), NODE_TYPE_MICROSERVICES, map[string]string{})
+	live := NewNodeMeta("live", "svc", "127.0.0.1:"+strconv.Itoa(config.Port), NODE_TYPE_MICROSERVICES, map[string]string{})
+	peer.Sync(dead, live)
+
+	out, node, err := peer.SendToName(ctx, "svc", &api.Envelope{Cid: "echo"}, WithSendStrategy(firstStrategy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node.Id != "live" || out.Cid != "echo" {
+		t.Fatalf("served by %s reply %v", node.Id, out)
+	}
+
+	if _, node, err = peer.SendToName(ctx, "svc", &api.Envelope{Cid: "echo"}, WithSendStrategy(firstStrategy{}), WithSendAttempts(1)); err == nil || node.Id != "dead" {
+		t.Fatalf("expected failure on dead node, got %v from %v", err, node)
+	}
+
+	if _, _, err := peer.SendToName(ctx, "missing", &api.Envelope{}); err == nil {
+		t.Fatal("expected node not found")
+	}
+}
+
+// firstStrategy picks the candidates in id order
+type firstStrategy struct{}
+
+func (firstStrategy) Pick(name string, candidates []*Meta, in *api.Envelope) *Meta {
+	return candidates[0]
+}
+
+// linkSource fixed links of the nodes
+type linkSource map[string]PeerLink
+
+func (s linkSource) Link(id string) (PeerLink, bool) {
+	link, ok := s[id]
+	return link, ok
+}
+
+func TestLatencyStrategy(t *testing.T) {
+	nodes := []*Meta{{Id: "a"}, {Id: "b"}, {Id: "c"}}
+	now := time.Now()
+	links := linkSource{
+		"a": {RTT: 5 * time.Millisecond, LastSeen: now, Failures: heartbeatDegradedFailures},
+		"b": {RTT: 20 * time.Millisecond, LastSeen: now},
+		"c": {RTT: 10 * time.Millisecond, LastSeen: now},
+	}
+
+	s := NewLatencyStrategy(links, 0)
+	for i := 0; i < 10; i++ {
+		if node := s.Pick("svc", nodes, nil); node.Id != "c" {
+			t.Fatalf("pick %d got %s expected c", i, node.Id)
+		}
+	}
+
+	picked := make(map[string]int)
+	s = NewLatencyStrategy(links, 1)
+	for i := 0; i < 10; i++ {
+		picked[s.Pick("svc", nodes, nil).Id]++
+	}
+
+	if picked["a"] > 0 || picked["b"] != 5 || picked["c"] != 5 {
+		t.Fatalf("exploration should spread over healthy nodes, got %v", picked)
+	}
+
+	unmeasured := NewLatencyStrategy(linkSource{}, 0)
+	if node := unmeasured.Pick("svc", nodes, nil); node.Id != "a" {
+		t.Fatalf("expected round robin without rtt, got %s", node.Id)
+	}
+}
+
+func TestSendToNameStrategyPerService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	latency := NewLatencyStrategy(nil, 0)
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Strategies: map[string]Strategy{"svc": latency}})
+	if latency.links != LinkSource(peer) {
+		t.Fatal("latency strategy not bound to the peer")
+	}
+
+	if peer.strategy("svc") != latency || peer.strategy("other") != peer.options.Strategy {
+		t.Fatal("unexpected strategy of the service")
+	}
+}
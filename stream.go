@@ -0,0 +1,259 @@
+package nakamacluster
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+)
+
+// STREAM_CID_END cid of the last reply to a stream request, the reply channel of the request
+// is closed once it is received. It carries the error of the request when it failed
+const STREAM_CID_END = "__stream.end"
+
+// StreamEnd returns the last reply to a stream request, carrying err when the request failed
+func StreamEnd(err error) *api.Envelope {
+	out := &api.Envelope{Cid: STREAM_CID_END}
+	if err != nil {
+		out.Payload = &api.Envelope_Error{Error: api.AsError(err)}
+	}
+	return out
+}
+
+// peerStream outgoing stream to a remote node, sends are paused while
+// the credits advertised by the receiver are exhausted
+type peerStream struct {
+	node    string
+	service string
+	version uint32
+	stream  api.ApiServer_StreamClient
+	cancel  context.CancelFunc
+	created time.Time
+	active  int64
+	credits int64
+	granted chan struct{}
+	stalled *int64
+	metrics *Metrics
+	stats   *streamCounters
+
+	// pending stream requests by envelope id
+	pending   map[string]*streamRequest
+	pendingMu sync.Mutex
+
+	// envelopes waiting to be written together, see coalesce
+	linger        time.Duration
+	batch         []*api.Envelope
+	batchBytes    int
+	batchMaxBytes int
+	batchTimer    *time.Timer
+	batchErr      error
+	sync.Mutex
+}
+
+// Send write the envelope once the receiver granted a credit for it, on a coalescing stream
+// the envelope may be written later with the next ones and must not be modified after it
+func (s *peerStream) Send(ctx context.Context, in *api.Envelope) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+
+	s.touch()
+	s.Lock()
+	defer s.Unlock()
+	return s.send(in)
+}
+
+// touch record activity on the stream
+func (s *peerStream) touch() {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+// expired reports whether the stream was idle for longer than idle or is older than ttl,
+// a zero duration disables the check
+func (s *peerStream) expired(now time.Time, idle, ttl time.Duration) bool {
+	if idle > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&s.active))) > idle {
+		return true
+	}
+	return ttl > 0 && now.Sub(s.created) > ttl
+}
+
+// close write the pending batch and cancel the stream, the receiving goroutine cleans up after it
+func (s *peerStream) close() {
+	s.flush()
+	s.cancel()
+}
+
+// grant add credits advertised by the receiver, the window is
+// unlimited until the receiver advertised it for the first time
+func (s *peerStream) grant(credits uint32) {
+	if !atomic.CompareAndSwapInt64(&s.credits, -1, int64(credits)) {
+		atomic.AddInt64(&s.credits, int64(credits))
+	}
+
+	select {
+	case s.granted <- struct{}{}:
+	default:
+	}
+}
+
+func (s *peerStream) acquire(ctx context.Context) error {
+	var stalledAt time.Time
+	defer func() {
+		if !stalledAt.IsZero() {
+			s.metrics.StreamStall(atomic.AddInt64(s.stalled, -1))
+			s.metrics.StreamStallDuration(time.Since(stalledAt))
+		}
+	}()
+
+	for {
+		credits := atomic.LoadInt64(&s.credits)
+		if credits < 0 {
+			return nil
+		}
+
+		if credits > 0 {
+			if atomic.CompareAndSwapInt64(&s.credits, credits, credits-1) {
+				return nil
+			}
+			continue
+		}
+
+		if stalledAt.IsZero() {
+			stalledAt = time.Now()
+			s.metrics.StreamStall(atomic.AddInt64(s.stalled, 1))
+		}
+
+		select {
+		case <-s.granted:
+		case <-s.stream.Context().Done():
+			return s.stream.Context().Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// streamRequest reply channel of a stream request, done is closed once the channel is
+type streamRequest struct {
+	ch   chan *api.Envelope
+	done chan struct{}
+}
+
+// register create the reply channel of the request id, done is closed along with it
+func (s *peerStream) register(id string, size int) (ch chan *api.Envelope, done <-chan struct{}) {
+	req := &streamRequest{ch: make(chan *api.Envelope, size), done: make(chan struct{})}
+	s.pendingMu.Lock()
+	s.pending[id] = req
+	s.pendingMu.Unlock()
+	return req.ch, req.done
+}
+
+// unregister close the reply channel of the request id
+func (s *peerStream) unregister(id string) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if req, ok := s.pending[id]; ok {
+		delete(s.pending, id)
+		req.close()
+	}
+}
+
+func (req *streamRequest) close() {
+	close(req.ch)
+	close(req.done)
+}
+
+// dispatch deliver the envelope to the reply channel of its request, a STREAM_CID_END
+// envelope closes the channel and is only delivered when it carries an error.
+// It reports false when no request is waiting for the envelope
+func (s *peerStream) dispatch(in *api.Envelope) (bool, error) {
+	if in.Id == "" {
+		return false, nil
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	req, ok := s.pending[in.Id]
+	if !ok {
+		return false, nil
+	}
+
+	var err error
+	if in.Cid != STREAM_CID_END || in.GetError() != nil {
+		select {
+		case req.ch <- in:
+		default:
+			err = ErrMessageQueueFull
+		}
+	}
+
+	if in.Cid == STREAM_CID_END {
+		delete(s.pending, in.Id)
+		req.close()
+	}
+	return true, err
+}
+
+// closePending close the reply channels of every request
+func (s *peerStream) closePending() {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for id, req := range s.pending {
+		delete(s.pending, id)
+		req.close()
+	}
+}
+
+func newPeerStream(node string, stream api.ApiServer_StreamClient, cancel context.CancelFunc, stalled *int64, metrics *Metrics) *peerStream {
+	now := time.Now()
+	return &peerStream{
+		node:    node,
+		stream:  stream,
+		cancel:  cancel,
+		created: now,
+		active:  now.UnixNano(),
+		credits: -1,
+		granted: make(chan struct{}, 1),
+		stalled: stalled,
+		metrics: metrics,
+		pending: make(map[string]*streamRequest),
+	}
+}
+
+// streamWindow receiver side of the stream flow control, consumed
+// messages are granted back to the sender once half the window is used
+type streamWindow struct {
+	stream   api.ApiServer_StreamServer
+	size     uint32
+	consumed uint32
+}
+
+func (w *streamWindow) advertise() error {
+	if w.size < 1 {
+		return nil
+	}
+	return w.stream.Send(&api.Envelope{Payload: &api.Envelope_Window{Window: &api.Window{Credits: w.size}}})
+}
+
+func (w *streamWindow) consume() {
+	atomic.AddUint32(&w.consumed, 1)
+}
+
+func (w *streamWindow) update() error {
+	if w.size < 1 || atomic.LoadUint32(&w.consumed) < (w.size+1)/2 {
+		return nil
+	}
+
+	credits := atomic.SwapUint32(&w.consumed, 0)
+	return w.stream.Send(&api.Envelope{Payload: &api.Envelope_Window{Window: &api.Window{Credits: credits}}})
+}
+
+func (s *Server) streamWindow(stream api.ApiServer_StreamServer) *streamWindow {
+	size := 0
+	if s.config.StreamWindowSize > 0 {
+		size = s.config.StreamWindowSize
+	}
+	return &streamWindow{stream: stream, size: uint32(size)}
+}
@@ -0,0 +1,86 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	// ErrStreamUnauthenticated the authenticator rejected the metadata of the stream
+	ErrStreamUnauthenticated = errors.New("stream unauthenticated")
+
+	// ErrStreamSessionExpired the credentials of the stream expired while it was open
+	ErrStreamSessionExpired = errors.New("stream session expired")
+)
+
+// StreamSession identity of the caller of a stream built by the StreamAuthenticator
+// when the stream is opened, the Delegate.Stream handler reads it with StreamSessionFromContext
+type StreamSession struct {
+	// Subject identity the credentials were issued to
+	Subject string
+
+	// Claims attributes of the credentials
+	Claims map[string]string
+
+	// ExpiresAt time the credentials expire, the stream is closed then. Zero never expires
+	ExpiresAt time.Time
+}
+
+// Expired reports whether the credentials of the session expired at now
+func (s *StreamSession) Expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// StreamAuthenticator authenticate the incoming metadata of the streams opened on the server,
+// an error rejects the stream with codes.Unauthenticated
+type StreamAuthenticator interface {
+	Authenticate(ctx context.Context, md metadata.MD) (*StreamSession, error)
+}
+
+// StreamAuthenticatorFunc adapter to use a func as StreamAuthenticator
+type StreamAuthenticatorFunc func(ctx context.Context, md metadata.MD) (*StreamSession, error)
+
+// Authenticate implements StreamAuthenticator
+func (fn StreamAuthenticatorFunc) Authenticate(ctx context.Context, md metadata.MD) (*StreamSession, error) {
+	return fn(ctx, md)
+}
+
+type streamSessionKey struct{}
+
+// StreamSessionFromContext returns the session of the stream served with ctx
+func StreamSessionFromContext(ctx context.Context) (*StreamSession, bool) {
+	session, ok := ctx.Value(streamSessionKey{}).(*StreamSession)
+	return session, ok && session != nil
+}
+
+// authenticateStream returns ctx carrying the session of the stream and the channel fired when
+// its credentials expire, a nil channel when no authenticator is set or the session never expires
+func authenticateStream(ctx context.Context, auth StreamAuthenticator, md metadata.MD) (context.Context, <-chan time.Time, func(), error) {
+	if auth == nil {
+		return ctx, nil, func() {}, nil
+	}
+
+	session, err := auth.Authenticate(ctx, md)
+	if err != nil {
+		return ctx, nil, nil, err
+	}
+
+	if session == nil {
+		return ctx, nil, nil, ErrStreamUnauthenticated
+	}
+
+	if session.Expired(time.Now()) {
+		return ctx, nil, nil, ErrStreamSessionExpired
+	}
+
+	ctx = context.WithValue(ctx, streamSessionKey{}, session)
+	if session.ExpiresAt.IsZero() {
+		return ctx, nil, func() {}, nil
+	}
+
+	timer := time.NewTimer(time.Until(session.ExpiresAt))
+	return ctx, timer.C, func() { timer.Stop() }, nil
+}
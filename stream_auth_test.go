@@ -0,0 +1,89 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+)
+
+// sessionEchoDelegate server delegate replying the subject of the session of the stream
+type sessionEchoDelegate struct {
+	echoServerDelegate
+}
+
+func (sessionEchoDelegate) Stream(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error {
+	session, ok := StreamSessionFromContext(ctx)
+	if !ok {
+		client(&api.Envelope{Cid: in.Cid})
+		return nil
+	}
+
+	client(&api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Bytes{Bytes: []byte(session.Subject)}})
+	return nil
+}
+
+func TestStreamAuthenticator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	auth := StreamAuthenticatorFunc(func(ctx context.Context, md metadata.MD) (*StreamSession, error) {
+		if v := md.Get("x-session"); len(v) < 1 || v[0] != "user1" {
+			return nil, ErrStreamUnauthenticated
+		}
+		return &StreamSession{Subject: "user1", ExpiresAt: time.Now().Add(300 * time.Millisecond)}, nil
+	})
+
+	server := newTestServer(t, nil, WithStreamAuthenticator(auth))
+	server.OnDelegate(sessionEchoDelegate{})
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MessageQueueSize: 8})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	_, ch, err := peer.SendStream(ctx, "client1", node, &api.Envelope{Cid: "1"}, metadata.Pairs("x-session", "user1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case out := <-ch:
+		if string(out.GetBytes()) != "user1" {
+			t.Fatalf("unexpected session %q", out.GetBytes())
+		}
+	case <-ctx.Done():
+		t.Fatal("no reply on the authenticated stream")
+	}
+
+	// the stream is closed once the session expired
+	start := time.Now()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("unexpected reply")
+		}
+	case <-ctx.Done():
+		t.Fatal("stream not closed after the session expired")
+	}
+
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("stream closed late")
+	}
+
+	_, ch, err = peer.SendStream(ctx, "client2", node, &api.Envelope{Cid: "1"}, metadata.Pairs("x-session", "user2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case out, ok := <-ch:
+		if ok {
+			t.Fatalf("rejected stream replied %v", out)
+		}
+	case <-ctx.Done():
+		t.Fatal("rejected stream not closed")
+	}
+}
@@ -0,0 +1,141 @@
+package nakamacluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// STREAM_CID_BATCH cid of the stream envelopes carrying coalesced envelopes in their batch
+	STREAM_CID_BATCH = "__stream.batch"
+
+	// streamBatchHeader stream metadata announcing the node unpacks coalesced envelopes, the
+	// caller sends it when it opens the stream and the server in the header of the stream
+	streamBatchHeader = "x-nakama-stream-batch"
+
+	// streamBatchMaxEnvelopes envelopes written together at most
+	streamBatchMaxEnvelopes = 128
+
+	// streamBatchMaxBytes size of the envelopes after which a batch is written without lingering
+	streamBatchMaxBytes = 64 << 10
+)
+
+// newStreamBatch returns the envelope carrying the envelopes
+func newStreamBatch(envelopes []*api.Envelope) *api.Envelope {
+	out := &api.Envelope{Cid: STREAM_CID_BATCH, Payload: &api.Envelope_Batch{Batch: &api.Batch{Envelopes: envelopes}}}
+	stampEnvelopeVersion(out)
+	return out
+}
+
+// unbatch returns the envelopes coalesced in the envelope, or the envelope itself
+func unbatch(in *api.Envelope) []*api.Envelope {
+	if in.Cid != STREAM_CID_BATCH {
+		return []*api.Envelope{in}
+	}
+	return in.GetBatch().GetEnvelopes()
+}
+
+// streamBatchAccepted reports whether the metadata announces the sender unpacks coalesced envelopes
+func streamBatchAccepted(md metadata.MD) bool {
+	return len(md.Get(streamBatchHeader)) > 0
+}
+
+// withStreamBatch returns the outgoing context of a stream announcing coalesced envelopes are unpacked
+func withStreamBatch(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, streamBatchHeader, "1")
+}
+
+// coalesce enable the coalescing of the sends once the receiver announced it unpacks batches,
+// sends linger for up to linger waiting for more envelopes written in the same batch
+func (s *peerStream) coalesce(linger time.Duration, maxBytes int) {
+	if maxBytes <= 0 || maxBytes > streamBatchMaxBytes {
+		maxBytes = streamBatchMaxBytes
+	}
+
+	s.Lock()
+	s.linger = linger
+	s.batchMaxBytes = maxBytes
+	s.Unlock()
+}
+
+// send write the envelope or add it to the batch, the stream must be locked
+func (s *peerStream) send(in *api.Envelope) error {
+	if s.batchErr != nil {
+		return s.batchErr
+	}
+
+	// chunks are released by the sender once they were sent and never linger
+	if s.linger <= 0 || in.GetChunk() != nil {
+		if err := s.flushLocked(); err != nil {
+			return err
+		}
+		return s.stream.Send(in)
+	}
+
+	s.batch = append(s.batch, in)
+	s.batchBytes += proto.Size(in)
+	if len(s.batch) >= streamBatchMaxEnvelopes || s.batchBytes >= s.batchMaxBytes {
+		return s.flushLocked()
+	}
+
+	if s.batchTimer == nil {
+		s.batchTimer = time.AfterFunc(s.linger, s.flush)
+	}
+	return nil
+}
+
+// flush write the envelopes of the batch
+func (s *peerStream) flush() {
+	s.Lock()
+	defer s.Unlock()
+	s.flushLocked()
+}
+
+// flushLocked write the envelopes of the batch, a failed write fails the later sends
+func (s *peerStream) flushLocked() error {
+	if s.batchTimer != nil {
+		s.batchTimer.Stop()
+		s.batchTimer = nil
+	}
+
+	if len(s.batch) < 1 {
+		return nil
+	}
+
+	out := s.batch[0]
+	if len(s.batch) > 1 {
+		out = newStreamBatch(s.batch)
+	}
+
+	s.metrics.StreamBatch(len(s.batch))
+	s.batch = nil
+	s.batchBytes = 0
+	if err := s.stream.Send(out); err != nil {
+		s.batchErr = err
+		return err
+	}
+	return nil
+}
+
+// drainOutgoing add the envelopes already waiting on ch to the batch without waiting for more
+func drainOutgoing(ch chan *api.Envelope, batch []*api.Envelope) []*api.Envelope {
+	size := 0
+	for _, envelope := range batch {
+		size += proto.Size(envelope)
+	}
+
+	for len(batch) < streamBatchMaxEnvelopes && size < streamBatchMaxBytes {
+		select {
+		case msg := <-ch:
+			batch = append(batch, msg)
+			size += proto.Size(msg)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
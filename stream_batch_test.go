@@ -0,0 +1,90 @@
+package nakamacluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+// streamEchoDelegate server delegate writing every stream message back to the caller
+type streamEchoDelegate struct {
+	echoServerDelegate
+}
+
+func (streamEchoDelegate) Stream(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error {
+	client(&api.Envelope{Cid: in.Cid, Payload: in.Payload})
+	return nil
+}
+
+func TestStreamCoalescing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(streamEchoDelegate{})
+
+	scope := tally.NewTestScope("", nil)
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MessageQueueSize: 64, StreamCoalesceLinger: 20 * time.Millisecond, Metrics: NewMetrics(scope)})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	_, ch, err := peer.SendStream(ctx, "client1", node, &api.Envelope{Cid: "0"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first sends go out one by one until the header of the server was read
+	if out := <-ch; out.Cid != "0" {
+		t.Fatalf("unexpected echo %s", out.Cid)
+	}
+
+	const n = 50
+	for i := 1; i <= n; i++ {
+		if _, _, err := peer.SendStream(ctx, "client1", node, &api.Envelope{Cid: strconv.Itoa(i)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 1; i <= n; i++ {
+		select {
+		case out := <-ch:
+			if out.Cid != strconv.Itoa(i) {
+				t.Fatalf("echo %s out of order, expected %d", out.Cid, i)
+			}
+		case <-ctx.Done():
+			t.Fatalf("echo %d not received", i)
+		}
+	}
+
+	h := scope.Snapshot().Histograms()["cluster.stream_batch_size+"]
+	if h == nil {
+		t.Fatal("no batch written")
+	}
+
+	batched := int64(0)
+	for bucket, count := range h.Values() {
+		if bucket > 1 {
+			batched += count
+		}
+	}
+	if batched < 1 {
+		t.Fatalf("sends not coalesced %v", h.Values())
+	}
+}
+
+func TestUnbatch(t *testing.T) {
+	in := &api.Envelope{Cid: "a"}
+	if envelopes := unbatch(in); len(envelopes) != 1 || envelopes[0] != in {
+		t.Fatalf("plain envelope unbatched %v", envelopes)
+	}
+
+	batch := newStreamBatch([]*api.Envelope{{Cid: "a"}, {Cid: "b"}})
+	if envelopes := unbatch(batch); len(envelopes) != 2 || envelopes[1].Cid != "b" {
+		t.Fatalf("unexpected envelopes %v", envelopes)
+	}
+}
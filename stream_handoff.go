@@ -0,0 +1,67 @@
+package nakamacluster
+
+import (
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// STREAM_CID_REDIRECT cid of the envelope a draining node writes to its streams naming
+	// the node the callers should open their streams on instead
+	STREAM_CID_REDIRECT = "__stream.redirect"
+
+	STREAM_VAR_NODE = "node" // id of the successor node
+	STREAM_VAR_ADDR = "addr" // addr of the successor node
+)
+
+// StreamRedirect returns the successor node named by a redirect envelope received on a stream
+func StreamRedirect(in *api.Envelope) (node, addr string, ok bool) {
+	if in.GetCid() != STREAM_CID_REDIRECT {
+		return "", "", false
+	}
+	return in.Vars[STREAM_VAR_NODE], in.Vars[STREAM_VAR_ADDR], true
+}
+
+// serverStream stream opened on the server, key places it on the ring of the node
+// to find its successor when the node drains
+type serverStream struct {
+	key    string
+	client func(out *api.Envelope) bool
+}
+
+// trackStream register the stream until the returned func is called
+func (s *Server) trackStream(caller string, client func(out *api.Envelope) bool) func() {
+	id := uuid.Must(uuid.NewV4()).String()
+	key := caller
+	if key == "" {
+		key = id
+	}
+
+	s.streams.Store(id, &serverStream{key: key, client: client})
+	return func() {
+		s.streams.Delete(id)
+	}
+}
+
+// handoffStreams write to every open stream the redirect to its successor on the ring of the
+// node, the node must already be out of the ring so callers reconnect before it stops
+func (s *Server) handoffStreams(local *Meta) {
+	s.streams.Range(func(k, v interface{}) bool {
+		stream := v.(*serverStream)
+		node, ok := s.peers.GetWithHashRing(local.Name, stream.key)
+		if !ok || node.Id == local.Id {
+			s.logger.Warn("No successor for stream of draining node", zap.String("key", stream.key))
+			return true
+		}
+
+		out := &api.Envelope{Cid: STREAM_CID_REDIRECT, Vars: map[string]string{STREAM_VAR_NODE: node.Id, STREAM_VAR_ADDR: node.Addr}}
+		if !stream.client(out) {
+			s.logger.Warn("Failed write stream redirect", zap.String("key", stream.key), zap.String("successor", node.Id))
+			return true
+		}
+
+		s.metrics.StreamRedirected()
+		return true
+	})
+}
@@ -0,0 +1,73 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestStreamHandoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := sd.NewMemoryStore()
+	newServer := func(id string) *Server {
+		config := testConfig(t)
+		server := NewServer(ctx, zap.NewNop(), store.NewClient(ctx), id, "svc", map[string]string{}, *config)
+		server.OnDelegate(streamEchoDelegate{})
+		return server
+	}
+
+	server1 := newServer("node1")
+	defer server1.Stop()
+	server2 := newServer("node2")
+	defer server2.Stop()
+	for {
+		if _, ok := server1.GetPeers().Get("node2"); ok {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("node2 not discovered")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MessageQueueSize: 8})
+	node1 := server1.GetMeta()
+	peer.Sync(node1, server2.GetMeta())
+
+	_, ch, err := peer.SendStream(ctx, "client1", node1, &api.Envelope{Cid: "1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := <-ch; out.Cid != "1" {
+		t.Fatalf("unexpected echo %s", out.Cid)
+	}
+
+	if err := server1.UpdateMeta(META_STATUS_DRAINING, server1.GetMeta().Vars); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case out := <-ch:
+		node, addr, ok := StreamRedirect(out)
+		if !ok || node != "node2" || addr != server2.GetMeta().Addr {
+			t.Fatalf("unexpected redirect %v", out)
+		}
+	case <-ctx.Done():
+		t.Fatal("stream not redirected")
+	}
+
+	// the redirected stream is not reused for the next sends
+	created, _, err := peer.SendStream(ctx, "client1", server2.GetMeta(), &api.Envelope{Cid: "2"}, nil)
+	if err != nil || !created {
+		t.Fatalf("stream to the successor not opened %v %v", created, err)
+	}
+}
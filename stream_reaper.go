@@ -0,0 +1,65 @@
+package nakamacluster
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// reapLoop close expired streams until the peer is done, it checks them at half the shortest
+// idle timeout or ttl of any service
+func (peer *LocalPeer) reapLoop() {
+	var interval time.Duration
+	shortest := func(d time.Duration) {
+		if d > 0 && (interval <= 0 || d < interval) {
+			interval = d
+		}
+	}
+
+	shortest(peer.options.StreamIdleTimeout)
+	shortest(peer.options.StreamTTL)
+	shortest(peer.options.StreamStatsRetention)
+	for _, o := range peer.services {
+		shortest(o.StreamIdleTimeout)
+		shortest(o.StreamTTL)
+	}
+
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			peer.reapStreams(now)
+
+		case <-peer.ctx.Done():
+			return
+		}
+	}
+}
+
+// reapStreams close the streams idle longer than StreamIdleTimeout or older than StreamTTL of
+// their service, release the stream context of the nodes without open streams and forget the
+// stream stats past their retention
+func (peer *LocalPeer) reapStreams(now time.Time) {
+	peer.forgetStreamStats(now)
+	peer.grpcStreams.Range(func(key, value any) bool {
+		ps := value.(*peerStream)
+		if o := peer.serviceOptions(ps.service); ps.expired(now, o.StreamIdleTimeout, o.StreamTTL) {
+			peer.logger.Debug("Closing expired stream", zap.Any("client", key), zap.String("node", ps.node))
+			peer.grpcStreams.Delete(key)
+			ps.close()
+		}
+		return true
+	})
+
+	peer.streamsMu.Lock()
+	defer peer.streamsMu.Unlock()
+	peer.grpcStreamCancelFn.Range(func(key, value any) bool {
+		if sc := value.(*streamContext); atomic.LoadInt64(&sc.refs) < 1 {
+			peer.grpcStreamCancelFn.Delete(key)
+			sc.cancel()
+		}
+		return true
+	})
+}
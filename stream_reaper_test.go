@@ -0,0 +1,54 @@
+package nakamacluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestReapIdleStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := testConfig(t)
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", "svc", map[string]string{}, *config)
+	server.OnDelegate(echoServerDelegate{})
+	defer server.Stop()
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, StreamIdleTimeout: time.Minute})
+	node := NewNodeMeta("node1", "svc", "127.0.0.1:"+strconv.Itoa(config.Port), NODE_TYPE_MICROSERVICES, map[string]string{})
+	peer.Sync(node)
+	if _, _, err := peer.SendStream(ctx, "client1", node, &api.Envelope{Cid: "echo"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	peer.reapStreams(time.Now())
+	if _, ok := peer.grpcStreams.Load("client1"); !ok {
+		t.Fatal("active stream reaped")
+	}
+
+	peer.reapStreams(time.Now().Add(2 * time.Minute))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		peer.reapStreams(time.Now())
+		_, streamOk := peer.grpcStreams.Load("client1")
+		_, ctxOk := peer.grpcStreamCancelFn.Load("node1")
+		if !streamOk && !ctxOk {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("idle stream not cleaned up, stream %v context %v", streamOk, ctxOk)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if created, _, err := peer.SendStream(ctx, "client1", node, &api.Envelope{Cid: "echo"}, nil); err != nil || !created {
+		t.Fatalf("reopen stream created %v %v", created, err)
+	}
+}
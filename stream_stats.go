@@ -0,0 +1,144 @@
+package nakamacluster
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamStats traffic of the streams opened under a client id, kept once its streams closed
+// until PeerOptions.StreamStatsRetention passed without activity
+type StreamStats struct {
+	ClientId string `json:"client_id"`
+
+	// Node and Service of the last stream opened by the client
+	Node    string `json:"node"`
+	Service string `json:"service"`
+
+	// Open streams of the client and Opened the streams opened so far
+	Open   int64 `json:"open"`
+	Opened int64 `json:"opened"`
+
+	MessagesIn   int64     `json:"messages_in"`
+	MessagesOut  int64     `json:"messages_out"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	Errors       int64     `json:"errors"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// streamCounters counters of the streams of a client id, updated by its peer streams
+type streamCounters struct {
+	open, opened          int64
+	messagesIn, bytesIn   int64
+	messagesOut, bytesOut int64
+	errors, active        int64
+	node, service         string
+	metrics               *Metrics
+	sync.Mutex
+}
+
+func (c *streamCounters) received(messages, bytes int) {
+	atomic.AddInt64(&c.messagesIn, int64(messages))
+	atomic.AddInt64(&c.bytesIn, int64(bytes))
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	c.metrics.StreamTraffic(c.serviceName(), "in", messages, bytes)
+}
+
+func (c *streamCounters) sent(bytes int) {
+	atomic.AddInt64(&c.messagesOut, 1)
+	atomic.AddInt64(&c.bytesOut, int64(bytes))
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	c.metrics.StreamTraffic(c.serviceName(), "out", 1, bytes)
+}
+
+func (c *streamCounters) failed() {
+	atomic.AddInt64(&c.errors, 1)
+	c.metrics.StreamError(c.serviceName())
+}
+
+func (c *streamCounters) serviceName() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.service
+}
+
+func (c *streamCounters) stats(clientId string) StreamStats {
+	c.Lock()
+	node, service := c.node, c.service
+	c.Unlock()
+	return StreamStats{
+		ClientId:     clientId,
+		Node:         node,
+		Service:      service,
+		Open:         atomic.LoadInt64(&c.open),
+		Opened:       atomic.LoadInt64(&c.opened),
+		MessagesIn:   atomic.LoadInt64(&c.messagesIn),
+		MessagesOut:  atomic.LoadInt64(&c.messagesOut),
+		BytesIn:      atomic.LoadInt64(&c.bytesIn),
+		BytesOut:     atomic.LoadInt64(&c.bytesOut),
+		Errors:       atomic.LoadInt64(&c.errors),
+		LastActivity: time.Unix(0, atomic.LoadInt64(&c.active)),
+	}
+}
+
+// streamOpened returns the counters of the client id counting a new stream to the node
+func (peer *LocalPeer) streamOpened(clientId string, node *Meta) *streamCounters {
+	peer.streamStatsMu.Lock()
+	defer peer.streamStatsMu.Unlock()
+	v, _ := peer.streamStats.LoadOrStore(clientId, &streamCounters{metrics: peer.options.Metrics})
+	c := v.(*streamCounters)
+	c.Lock()
+	c.node, c.service = node.Id, node.Name
+	c.Unlock()
+	atomic.AddInt64(&c.open, 1)
+	atomic.AddInt64(&c.opened, 1)
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	return c
+}
+
+// streamClosed count the stream of the client id closed, the counters are forgotten at once
+// without a StreamStatsRetention
+func (peer *LocalPeer) streamClosed(clientId string, c *streamCounters) {
+	peer.streamStatsMu.Lock()
+	defer peer.streamStatsMu.Unlock()
+	if atomic.AddInt64(&c.open, -1) < 1 && peer.options.StreamStatsRetention <= 0 {
+		peer.streamStats.Delete(clientId)
+	}
+}
+
+// forgetStreamStats drop the counters of the client ids without open streams and
+// without activity for the StreamStatsRetention
+func (peer *LocalPeer) forgetStreamStats(now time.Time) {
+	peer.streamStatsMu.Lock()
+	defer peer.streamStatsMu.Unlock()
+	peer.streamStats.Range(func(key, value any) bool {
+		c := value.(*streamCounters)
+		if atomic.LoadInt64(&c.open) < 1 && now.Sub(time.Unix(0, atomic.LoadInt64(&c.active))) > peer.options.StreamStatsRetention {
+			peer.streamStats.Delete(key)
+		}
+		return true
+	})
+}
+
+// StreamStats returns the traffic of the streams of the client ids starting with the prefix,
+// the busiest first by bytes sent and received
+func (peer *LocalPeer) StreamStats(prefix string) []StreamStats {
+	stats := make([]StreamStats, 0)
+	peer.streamStats.Range(func(key, value any) bool {
+		if clientId := key.(string); strings.HasPrefix(clientId, prefix) {
+			stats = append(stats, value.(*streamCounters).stats(clientId))
+		}
+		return true
+	})
+
+	sort.Slice(stats, func(i, j int) bool {
+		if a, b := stats[i].BytesIn+stats[i].BytesOut, stats[j].BytesIn+stats[j].BytesOut; a != b {
+			return a > b
+		}
+		return stats[i].ClientId < stats[j].ClientId
+	})
+	return stats
+}
@@ -0,0 +1,82 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+func TestStreamStats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(streamEchoDelegate{})
+
+	scope := tally.NewTestScope("", nil)
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MessageQueueSize: 8, StreamStatsRetention: time.Minute, Metrics: NewMetrics(scope)})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	echo := func(clientId string, n int) {
+		var ch chan *api.Envelope
+		for i := 0; i < n; i++ {
+			_, c, err := peer.SendStream(ctx, clientId, node, &api.Envelope{Cid: "echo", Payload: &api.Envelope_Bytes{Bytes: []byte("hello")}}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c != nil {
+				ch = c
+			}
+		}
+
+		for i := 0; i < n; i++ {
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				t.Fatalf("echo %d of %s not received", i, clientId)
+			}
+		}
+	}
+	echo("game.a", 3)
+	echo("game.b", 1)
+	echo("chat.c", 1)
+
+	stats := peer.StreamStats("game.")
+	if len(stats) != 2 || stats[0].ClientId != "game.a" || stats[1].ClientId != "game.b" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	a := stats[0]
+	if a.MessagesOut != 3 || a.MessagesIn != 3 || a.BytesOut <= 0 || a.BytesIn <= 0 || a.Open != 1 || a.Opened != 1 || a.Node != "node1" || a.Service != "svc" || a.Errors != 0 {
+		t.Fatalf("unexpected stats %+v", a)
+	}
+
+	if _, ok := scope.Snapshot().Counters()["cluster.stream_messages+direction=out,service=svc"]; !ok {
+		t.Fatalf("traffic not reported %v", scope.Snapshot().Counters())
+	}
+
+	// the stats of a closed client are kept for the retention
+	v, _ := peer.grpcStreams.Load("game.b")
+	v.(*peerStream).close()
+	for {
+		if stats := peer.StreamStats("game.b"); len(stats) == 1 && stats[0].Open == 0 {
+			break
+		}
+
+		if ctx.Err() != nil {
+			t.Fatal("stream not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	peer.forgetStreamStats(time.Now().Add(2 * time.Minute))
+	if stats := peer.StreamStats(""); len(stats) != 2 || stats[0].ClientId != "game.a" {
+		t.Fatalf("unexpected stats after the retention %+v", stats)
+	}
+}
@@ -0,0 +1,144 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+// demuxServerDelegate replies twice to every stream request and ends it, failing the "fail" cid
+type demuxServerDelegate struct{ echoServerDelegate }
+
+func (demuxServerDelegate) Stream(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error {
+	go func() {
+		if in.Cid == "fail" {
+			client(StreamEnd(errors.New("failed")))
+			return
+		}
+
+		for i := 0; i < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			client(&api.Envelope{Cid: in.Cid})
+		}
+		client(StreamEnd(nil))
+	}()
+	return nil
+}
+
+func TestStreamRequestDemux(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, nil)
+	server.OnDelegate(demuxServerDelegate{})
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	cids := []string{"a", "b", "c", "d"}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(cids))
+	for _, cid := range cids {
+		wg.Add(1)
+		go func(cid string) {
+			defer wg.Done()
+			ch, err := peer.SendStreamRequest(ctx, "client1", node, &api.Envelope{Cid: cid}, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			replies := 0
+			for out := range ch {
+				if out.Cid != cid {
+					errs <- errors.New("reply " + out.Cid + " to request " + cid)
+					return
+				}
+				replies++
+			}
+
+			if ctx.Err() != nil || replies != 2 {
+				errs <- errors.New("request " + cid + " not ended after its replies")
+			}
+		}(cid)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if stats := peer.StreamStats("client1"); len(stats) != 1 || stats[0].Opened != 1 {
+		t.Fatalf("concurrent requests opened several streams %+v", stats)
+	}
+
+	v, ok := peer.grpcStreams.Load("client1")
+	if !ok {
+		t.Fatal("stream not kept for later requests")
+	}
+
+	ps := v.(*peerStream)
+	ps.pendingMu.Lock()
+	pending := len(ps.pending)
+	ps.pendingMu.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d requests still pending", pending)
+	}
+
+	ch, err := peer.SendStreamRequest(ctx, "client1", node, &api.Envelope{Cid: "fail"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, ok := <-ch
+	if !ok || out.GetError().GetMessage() != "failed" {
+		t.Fatalf("error of the request not delivered %v", out)
+	}
+
+	if _, ok := <-ch; ok {
+		t.Fatal("channel not closed after the failed request")
+	}
+}
+
+func TestStreamChunksBeyondWindow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.StreamWindowSize = 4
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", "svc", map[string]string{}, *config)
+	server.OnDelegate(demuxServerDelegate{})
+	defer server.Stop()
+
+	// the message is split into far more chunks than the receiver window
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, MaxStreamMessageSize: chunkOverhead + 64})
+	node := server.GetMeta()
+	peer.Sync(node)
+
+	// the first request waits for the window advertised by the receiver
+	for _, in := range []*api.Envelope{
+		{Cid: "small"},
+		{Cid: "big", Payload: &api.Envelope_Bytes{Bytes: make([]byte, 64*config.StreamWindowSize*4)}},
+	} {
+		ch, err := peer.SendStreamRequest(ctx, "client1", node, in, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		replies := 0
+		for range ch {
+			replies++
+		}
+
+		if ctx.Err() != nil || replies != 2 {
+			t.Fatalf("message %s not delivered, %d replies", in.Cid, replies)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package nakamacluster
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Throttle limits the bytes per second sent to every destination node and to all
+// nodes together, a limit of 0 disables it. Every bucket allows a burst of one second.
+type Throttle struct {
+	nodeRate int
+	global   *byteBucket
+	limits   sync.Map
+	buckets  sync.Map
+}
+
+// NewThrottle create throttle, nodeRate limits every destination node and globalRate all of them
+func NewThrottle(nodeRate, globalRate int) *Throttle {
+	t := &Throttle{nodeRate: nodeRate}
+	if globalRate > 0 {
+		t.global = newByteBucket(globalRate)
+	}
+	return t
+}
+
+// SetNodeLimit override the limit of the node, a negative limit disables throttling
+// the node and 0 restores the default limit
+func (t *Throttle) SetNodeLimit(id string, bytesPerSecond int) {
+	if bytesPerSecond == 0 {
+		t.limits.Delete(id)
+	} else {
+		t.limits.Store(id, bytesPerSecond)
+	}
+	t.buckets.Delete(id)
+}
+
+// Delete forget the sending state of the node, its limit override is kept
+func (t *Throttle) Delete(id string) {
+	if t == nil {
+		return
+	}
+	t.buckets.Delete(id)
+}
+
+// Wait block until n bytes may be sent to the node and return how long it waited,
+// the bytes are given back when ctx is done first
+func (t *Throttle) Wait(ctx context.Context, node string, n int) (time.Duration, error) {
+	if t == nil || n < 1 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	buckets := [2]*byteBucket{t.bucket(node), t.global}
+	var delay time.Duration
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+
+		if d := b.reserve(now, n); d > delay {
+			delay = d
+		}
+	}
+
+	if delay <= 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay, nil
+
+	case <-ctx.Done():
+		for _, b := range buckets {
+			if b != nil {
+				b.refund(n)
+			}
+		}
+		return 0, ctx.Err()
+	}
+}
+
+func (t *Throttle) bucket(node string) *byteBucket {
+	if b, ok := t.buckets.Load(node); ok {
+		return b.(*byteBucket)
+	}
+
+	rate := t.nodeRate
+	if v, ok := t.limits.Load(node); ok {
+		rate = v.(int)
+	}
+
+	if rate < 1 {
+		return nil
+	}
+
+	b, _ := t.buckets.LoadOrStore(node, newByteBucket(rate))
+	return b.(*byteBucket)
+}
+
+// byteBucket token bucket of bytes, tokens may go negative so a message larger
+// than the burst waits for the debt instead of never being sent
+type byteBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func newByteBucket(rate int) *byteBucket {
+	return &byteBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve take n bytes and return how long the caller must wait before sending them
+func (b *byteBucket) reserve(now time.Time, n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		b.last = now
+	}
+
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *byteBucket) refund(n int) {
+	b.Lock()
+	b.tokens += float64(n)
+	b.Unlock()
+}
@@ -0,0 +1,50 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestThrottleNodeLimit(t *testing.T) {
+	throttle := NewThrottle(1000, 0)
+	ctx := context.Background()
+	if d, err := throttle.Wait(ctx, "node1", 1000); err != nil || d != 0 {
+		t.Fatalf("burst waited %v %v", d, err)
+	}
+
+	if d, err := throttle.Wait(ctx, "node2", 1000); err != nil || d != 0 {
+		t.Fatalf("nodes share the limit, waited %v %v", d, err)
+	}
+
+	start := time.Now()
+	if _, err := throttle.Wait(ctx, "node1", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("waited %v expected about 100ms", elapsed)
+	}
+
+	throttle.SetNodeLimit("node1", -1)
+	if d, err := throttle.Wait(ctx, "node1", 1<<20); err != nil || d != 0 {
+		t.Fatalf("unlimited node waited %v %v", d, err)
+	}
+}
+
+func TestThrottleGlobalLimit(t *testing.T) {
+	throttle := NewThrottle(0, 1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if d, err := throttle.Wait(ctx, "node1", 1000); err != nil || d != 0 {
+		t.Fatalf("burst waited %v %v", d, err)
+	}
+
+	if _, err := throttle.Wait(ctx, "node2", 1000); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	if d := throttle.global.reserve(time.Now(), 0); d != 0 {
+		t.Fatalf("cancelled wait kept its bytes, debt %v", d)
+	}
+}
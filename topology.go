@@ -0,0 +1,183 @@
+package nakamacluster
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// TOPOLOGY_ZONE_LABEL node label holding the zone of the node
+const TOPOLOGY_ZONE_LABEL = "zone"
+
+// topologyRingSamples number of keys hashed to estimate the ring share of every node
+const topologyRingSamples = 1024
+
+// TopologyNode node of the cluster graph, the json names are the fields of a grafana node graph
+type TopologyNode struct {
+	Id      string `json:"id"`
+	Service string `json:"title"`
+	Zone    string `json:"subtitle"`
+
+	// RingShare percent of the keys of the service ring owned by the node
+	RingShare       float64 `json:"mainstat"`
+	Status          string  `json:"secondarystat"`
+	Addr            string  `json:"detail__addr"`
+	Type            string  `json:"detail__type"`
+	Version         uint64  `json:"detail__version"`
+	ProtocolVersion uint32  `json:"detail__protocol_version"`
+}
+
+// TopologyEdge link between two nodes measured by the heartbeats of the source
+type TopologyEdge struct {
+	Id     string `json:"id"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+
+	// RTT round trip time in milliseconds
+	RTT float64 `json:"mainstat"`
+}
+
+// Topology graph of the cluster, the nodes are ordered by service and id and the edges by id
+type Topology struct {
+	Nodes []TopologyNode `json:"nodes"`
+	Edges []TopologyEdge `json:"edges"`
+}
+
+// NewTopology create the graph of the cluster as seen by the local node, its edges are the
+// links of the local node to the peers with a measured round trip time
+func NewTopology(local *Meta, peers Peer) *Topology {
+	nodes := peers.All()
+	if _, ok := peers.Get(local.Id); !ok {
+		nodes = append(nodes, local)
+	}
+
+	// the shares are sampled from the rings as they are, not through the key mappers
+	lookup := peers.GetWithHashRing
+	if p, ok := peers.(*LocalPeer); ok {
+		lookup = p.ringOwner
+	}
+
+	shares := make(map[string]float64, len(nodes))
+	services := make(map[string]bool)
+	for _, node := range nodes {
+		if services[node.Name] {
+			continue
+		}
+
+		services[node.Name] = true
+		for i := 0; i < topologyRingSamples; i++ {
+			if owner, ok := lookup(node.Name, strconv.Itoa(i)); ok {
+				shares[owner.Id] += 100.0 / topologyRingSamples
+			}
+		}
+	}
+
+	t := &Topology{Nodes: make([]TopologyNode, 0, len(nodes)), Edges: make([]TopologyEdge, 0)}
+	for _, node := range nodes {
+		t.Nodes = append(t.Nodes, TopologyNode{
+			Id:              node.Id,
+			Service:         node.Name,
+			Zone:            node.Labels[TOPOLOGY_ZONE_LABEL],
+			RingShare:       shares[node.Id],
+			Status:          node.Status.String(),
+			Addr:            node.Addr,
+			Type:            node.Type.String(),
+			Version:         node.Version,
+			ProtocolVersion: node.ProtocolVersion,
+		})
+
+		if node.Id == local.Id {
+			continue
+		}
+
+		if rtt, ok := peers.RTT(node.Id); ok {
+			t.Edges = append(t.Edges, TopologyEdge{
+				Id:     local.Id + "->" + node.Id,
+				Source: local.Id,
+				Target: node.Id,
+				RTT:    float64(rtt.Microseconds()) / 1000,
+			})
+		}
+	}
+
+	t.sort()
+	return t
+}
+
+// MergeTopology merge the graphs of several nodes, a node is taken from the first graph
+// containing it and the edges of every graph are kept
+func MergeTopology(topologies ...*Topology) *Topology {
+	t := &Topology{Nodes: make([]TopologyNode, 0), Edges: make([]TopologyEdge, 0)}
+	nodes := make(map[string]bool)
+	edges := make(map[string]bool)
+	for _, topology := range topologies {
+		for _, node := range topology.Nodes {
+			if !nodes[node.Id] {
+				nodes[node.Id] = true
+				t.Nodes = append(t.Nodes, node)
+			}
+		}
+
+		for _, edge := range topology.Edges {
+			if !edges[edge.Id] {
+				edges[edge.Id] = true
+				t.Edges = append(t.Edges, edge)
+			}
+		}
+	}
+
+	t.sort()
+	return t
+}
+
+// DOT returns the graph in the graphviz dot language, the nodes of a zone are clustered
+func (t *Topology) DOT() string {
+	zones := make(map[string][]TopologyNode)
+	names := make([]string, 0)
+	for _, node := range t.Nodes {
+		if _, ok := zones[node.Zone]; !ok {
+			names = append(names, node.Zone)
+		}
+		zones[node.Zone] = append(zones[node.Zone], node)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	b.WriteString("digraph cluster {\n")
+	for i, zone := range names {
+		indent := "\t"
+		if zone != "" {
+			fmt.Fprintf(&b, "\tsubgraph cluster_%d {\n\t\tlabel=%q;\n", i, zone)
+			indent = "\t\t"
+		}
+
+		for _, node := range zones[zone] {
+			label := fmt.Sprintf("%s\n%s v%d\n%s %.1f%%", node.Id, node.Service, node.Version, node.Status, node.RingShare)
+			fmt.Fprintf(&b, "%s%q [label=%q];\n", indent, node.Id, label)
+		}
+
+		if zone != "" {
+			b.WriteString("\t}\n")
+		}
+	}
+
+	for _, edge := range t.Edges {
+		fmt.Fprintf(&b, "\t%q -> %q [label=\"%.2fms\"];\n", edge.Source, edge.Target, edge.RTT)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (t *Topology) sort() {
+	sort.Slice(t.Nodes, func(i, j int) bool {
+		if t.Nodes[i].Service == t.Nodes[j].Service {
+			return t.Nodes[i].Id < t.Nodes[j].Id
+		}
+		return t.Nodes[i].Service < t.Nodes[j].Service
+	})
+
+	sort.Slice(t.Edges, func(i, j int) bool {
+		return t.Edges[i].Id < t.Edges[j].Id
+	})
+}
@@ -0,0 +1,61 @@
+package nakamacluster
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestTopology(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nodes := []*Meta{
+		NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, nil),
+		NewNodeMeta("node2", "svc", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, nil),
+		NewNodeMeta("node3", "chat", "127.0.0.1:3", NODE_TYPE_MICROSERVICES, nil),
+	}
+	nodes[0].Labels = map[string]string{TOPOLOGY_ZONE_LABEL: "a"}
+	nodes[1].Labels = map[string]string{TOPOLOGY_ZONE_LABEL: "b"}
+
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1})
+	peer.Sync(nodes[1:]...)
+	peer.recordPing("node2", 1500*time.Microsecond, nil)
+
+	local := NewTopology(nodes[0], peer)
+	if len(local.Nodes) != 3 || local.Nodes[0].Id != "node3" || local.Nodes[1].Id != "node1" {
+		t.Fatalf("unexpected nodes %+v", local.Nodes)
+	}
+
+	if local.Nodes[1].Zone != "a" || local.Nodes[1].RingShare != 0 {
+		t.Fatalf("local node not on the ring %+v", local.Nodes[1])
+	}
+
+	if local.Nodes[0].RingShare != 100 || math.Abs(local.Nodes[2].RingShare-100) > 1e-9 {
+		t.Fatalf("unexpected ring shares %+v", local.Nodes)
+	}
+
+	if len(local.Edges) != 1 || local.Edges[0].Source != "node1" || local.Edges[0].Target != "node2" || local.Edges[0].RTT != 1.5 {
+		t.Fatalf("unexpected edges %+v", local.Edges)
+	}
+
+	other := &Topology{Edges: []TopologyEdge{
+		{Id: "node1->node2", Source: "node1", Target: "node2", RTT: 9},
+		{Id: "node2->node3", Source: "node2", Target: "node3", RTT: 2},
+	}}
+	merged := MergeTopology(local, other)
+	if len(merged.Nodes) != 3 || len(merged.Edges) != 2 || merged.Edges[0].RTT != 1.5 {
+		t.Fatalf("unexpected merge %+v", merged)
+	}
+
+	dot := merged.DOT()
+	for _, want := range []string{"subgraph cluster_1 {\n\t\tlabel=\"a\";", "\"node2\" -> \"node3\" [label=\"2.00ms\"];", "\t\"node3\" [label="} {
+		if !strings.Contains(dot, want) {
+			t.Fatalf("dot misses %q\n%s", want, dot)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package nakamacluster
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"google.golang.org/protobuf/proto"
+)
+
+// trace directions
+const (
+	TRACE_IN  = "in"
+	TRACE_OUT = "out"
+)
+
+// trace transports
+const (
+	TRACE_GRPC   = "grpc"
+	TRACE_STREAM = "stream"
+	TRACE_GOSSIP = "gossip"
+)
+
+// Trace envelope recorded by the trace buffer
+type Trace struct {
+	// Time unix time in milliseconds the envelope was sent or received at
+	Time int64 `json:"time"`
+
+	// Direction TRACE_IN or TRACE_OUT
+	Direction string `json:"direction"`
+
+	// Transport TRACE_GRPC, TRACE_STREAM or TRACE_GOSSIP
+	Transport string `json:"transport"`
+
+	// Node the remote node, the sender of inbound envelopes and the target of outbound ones,
+	// empty for gossip broadcasts
+	Node string            `json:"node,omitempty"`
+	Id   string            `json:"id,omitempty"`
+	Cid  string            `json:"cid"`
+	Vars map[string]string `json:"vars,omitempty"`
+	Size int               `json:"size"`
+
+	// Envelope the marshaled envelope when its payload was sampled
+	Envelope []byte `json:"envelope,omitempty"`
+}
+
+// TraceQuery filter of the traces, zero fields match every trace
+type TraceQuery struct {
+	Node      string
+	Direction string
+
+	// Cid matches the traces whose cid starts with it
+	Cid string
+
+	// Since and Until unix times in milliseconds of the oldest and newest traces
+	Since int64
+	Until int64
+
+	// Limit maximum number of the newest matching traces returned, 0 is unlimited
+	Limit int
+}
+
+func (q TraceQuery) match(t *Trace) bool {
+	switch {
+	case q.Node != "" && t.Node != q.Node:
+	case q.Direction != "" && t.Direction != q.Direction:
+	case q.Cid != "" && !strings.HasPrefix(t.Cid, q.Cid):
+	case q.Since > 0 && t.Time < q.Since:
+	case q.Until > 0 && t.Time > q.Until:
+	default:
+		return true
+	}
+	return false
+}
+
+// TraceBuffer bounded in-memory buffer of the recent inbound and outbound envelopes, the oldest
+// traces are overwritten once it is full. Only the headers are kept unless the payload is sampled
+type TraceBuffer struct {
+	traces []Trace
+	next   int
+	full   bool
+	sample int
+	rand   *rand.Rand
+	sync.Mutex
+}
+
+// NewTraceBuffer create trace buffer keeping size traces, one in sample envelopes is kept
+// with its payload and 0 keeps none. A buffer of size 0 is nil and records nothing
+func NewTraceBuffer(size, sample int) *TraceBuffer {
+	if size < 1 {
+		return nil
+	}
+
+	return &TraceBuffer{
+		traces: make([]Trace, size),
+		sample: sample,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Record add the envelope sent to or received from the node to the buffer
+func (b *TraceBuffer) Record(direction, transport, node string, in *api.Envelope) {
+	if b == nil || in == nil {
+		return
+	}
+
+	t := Trace{
+		Time:      time.Now().UnixMilli(),
+		Direction: direction,
+		Transport: transport,
+		Node:      node,
+		Id:        in.Id,
+		Cid:       in.Cid,
+		Size:      proto.Size(in),
+	}
+
+	if len(in.Vars) > 0 {
+		t.Vars = make(map[string]string, len(in.Vars))
+		for k, v := range in.Vars {
+			if k != CONTROL_VAR_SIGNATURE {
+				t.Vars[k] = v
+			}
+		}
+	}
+
+	b.Lock()
+	sampled := b.sample > 0 && b.rand.Intn(b.sample) == 0
+	b.Unlock()
+	if sampled {
+		t.Envelope, _ = proto.Marshal(in)
+	}
+
+	b.Lock()
+	b.traces[b.next] = t
+	if b.next++; b.next == len(b.traces) {
+		b.next = 0
+		b.full = true
+	}
+	b.Unlock()
+}
+
+// Query returns the traces matching the query from the oldest to the newest
+func (b *TraceBuffer) Query(q TraceQuery) []Trace {
+	if b == nil {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	traces := make([]Trace, 0)
+	n := b.next
+	if b.full {
+		n = len(b.traces)
+	}
+
+	// walk from the newest so the limit keeps the latest traces
+	for i := 0; i < n; i++ {
+		t := &b.traces[(b.next-1-i+len(b.traces))%len(b.traces)]
+		if !q.match(t) {
+			continue
+		}
+
+		traces = append(traces, *t)
+		if q.Limit > 0 && len(traces) >= q.Limit {
+			break
+		}
+	}
+
+	for i, j := 0, len(traces)-1; i < j; i, j = i+1, j-1 {
+		traces[i], traces[j] = traces[j], traces[i]
+	}
+	return traces
+}
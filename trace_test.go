@@ -0,0 +1,74 @@
+package nakamacluster
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTraceBuffer(t *testing.T) {
+	b := NewTraceBuffer(4, 1)
+	for i := 0; i < 6; i++ {
+		node := "node" + strconv.Itoa(i%2)
+		b.Record(TRACE_OUT, TRACE_GRPC, node, &api.Envelope{Id: strconv.Itoa(i), Cid: "game.move", Vars: map[string]string{"k": "v", CONTROL_VAR_SIGNATURE: "s"}})
+	}
+	b.Record(TRACE_IN, TRACE_GOSSIP, "node1", &api.Envelope{Id: "6", Cid: "chat.send"})
+
+	traces := b.Query(TraceQuery{})
+	if len(traces) != 4 || traces[0].Id != "3" || traces[3].Id != "6" {
+		t.Fatalf("unexpected traces %+v", traces)
+	}
+
+	if _, ok := traces[0].Vars[CONTROL_VAR_SIGNATURE]; ok || traces[0].Vars["k"] != "v" {
+		t.Fatalf("unexpected vars %v", traces[0].Vars)
+	}
+
+	var in api.Envelope
+	if err := proto.Unmarshal(traces[0].Envelope, &in); err != nil || in.Id != "3" {
+		t.Fatalf("payload not sampled %v", err)
+	}
+
+	if traces = b.Query(TraceQuery{Node: "node1", Cid: "game."}); len(traces) != 2 || traces[0].Id != "3" || traces[1].Id != "5" {
+		t.Fatalf("unexpected traces of node1 %+v", traces)
+	}
+
+	if traces = b.Query(TraceQuery{Direction: TRACE_OUT, Limit: 1}); len(traces) != 1 || traces[0].Id != "5" {
+		t.Fatalf("limit did not keep the newest %+v", traces)
+	}
+
+	if traces = b.Query(TraceQuery{Since: time.Now().Add(time.Minute).UnixMilli()}); len(traces) != 0 {
+		t.Fatalf("unexpected traces after since %+v", traces)
+	}
+
+	var none *TraceBuffer
+	none.Record(TRACE_IN, TRACE_GRPC, "node1", &api.Envelope{})
+	if NewTraceBuffer(0, 0) != nil || none.Query(TraceQuery{}) != nil {
+		t.Fatal("disabled buffer recorded traces")
+	}
+}
+
+func TestControlTraces(t *testing.T) {
+	local := NewNodeMeta("node1", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{})
+	c := &controlHandler{key: []byte("secret"), local: func() *Meta { return local }, traces: NewTraceBuffer(8, 0), logger: zap.NewNop()}
+	c.traces.Record(TRACE_IN, TRACE_GRPC, "node2", &api.Envelope{Cid: "game.move"})
+	c.traces.Record(TRACE_IN, TRACE_GRPC, "node3", &api.Envelope{Cid: "game.move"})
+
+	out, err := c.handle("node2", NewControlEnvelope(c.key, CONTROL_CID_TRACES, "node1", map[string]string{CONTROL_VAR_PEER: "node3", CONTROL_VAR_SINCE: "1m"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var traces []Trace
+	if err := json.Unmarshal(out.GetBytes(), &traces); err != nil || len(traces) != 1 || traces[0].Node != "node3" {
+		t.Fatalf("unexpected traces %s %v", out.GetBytes(), err)
+	}
+
+	if _, err := c.handle("node2", NewControlEnvelope(c.key, CONTROL_CID_TRACES, "node1", map[string]string{CONTROL_VAR_LIMIT: "x"})); !api.IsCode(err, api.Error_INVALID_ARGUMENT) {
+		t.Fatalf("expected invalid argument, got %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+package nakamacluster
+
+import "github.com/hashicorp/memberlist"
+
+// Transport carries the gossip of the client, set with WithTransport. Implementations deliver
+// the packets and streams of memberlist and must reach the nakama nodes at the addresses they
+// announce, the address of the local node is taken from FinalAdvertiseAddr
+type Transport = memberlist.Transport
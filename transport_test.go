@@ -0,0 +1,42 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"github.com/hashicorp/memberlist"
+	"go.uber.org/zap"
+)
+
+func TestTransport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the mock network is not safe to extend while a client dials through it
+	network := &memberlist.MockNetwork{}
+	transports := map[string]Transport{"node1": network.NewTransport("node1"), "node2": network.NewTransport("node2")}
+	store := sd.NewMemoryStore()
+	newClient := func(id string) *Client {
+		config := testConfig(t)
+		config.JoinRetryInterval = 10
+		return NewClient(ctx, zap.NewNop(), store.NewClient(ctx), id, map[string]string{}, *config, WithTransport(transports[id]))
+	}
+
+	node1 := newClient("node1")
+	defer node1.Stop()
+	<-node1.wathcer.Registered()
+	if addr := node1.GetMeta().Addr; addr != "127.0.0.1:1" {
+		t.Fatalf("node not announced at the transport address, got %s", addr)
+	}
+
+	node2 := newClient("node2")
+	defer node2.Stop()
+	for node1.memberlist.NumMembers() < 2 || node2.memberlist.NumMembers() < 2 {
+		if ctx.Err() != nil {
+			t.Fatal("nodes did not join over the transport")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,62 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// hostId returns the host of the node, the hostname when it serves on a unix socket
+// and no host id is configured
+func hostId(c Config) string {
+	if c.HostId != "" || c.GrpcUnixSocket == "" {
+		return c.HostId
+	}
+
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// colocatedSocket returns the unix socket of the node when it runs on the host of local
+func colocatedSocket(local, node *Meta) (string, bool) {
+	if local == nil || local.Id == node.Id {
+		return "", false
+	}
+
+	path := node.Vars[VAR_UNIX_SOCKET]
+	host := node.Vars[VAR_HOST]
+	if path == "" || host == "" || host != local.Vars[VAR_HOST] {
+		return "", false
+	}
+	return path, true
+}
+
+// unixDialer dial the unix socket whatever the address of the node, the address is dialed with
+// fallback when the socket can not be reached, e.g. containers sharing a host id but not the socket
+func unixDialer(path string, fallback func(ctx context.Context, addr string) (net.Conn, error)) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", path)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+
+		if fallback != nil {
+			return fallback(ctx, addr)
+		}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+}
+
+// listenUnix listen on the unix socket, the socket left by a node that did not stop cleanly is removed first
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,66 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestUnixSocket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.HostId = "host1"
+	config.GrpcUnixSocket = filepath.Join(t.TempDir(), "node1.sock")
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", "svc", map[string]string{}, *config)
+	server.OnDelegate(echoServerDelegate{})
+	defer server.Stop()
+
+	node := server.GetMeta()
+	if node.Vars[VAR_HOST] != "host1" || node.Vars[VAR_UNIX_SOCKET] != config.GrpcUnixSocket {
+		t.Fatalf("unix socket not advertised %v", node.Vars)
+	}
+
+	// the tcp address is unreachable, only the unix socket answers
+	node.Addr = "127.0.0.1:1"
+	newPeer := func(host string) *LocalPeer {
+		local := NewNodeMeta("client1", "client", "127.0.0.1:2", NODE_TYPE_MICROSERVICES, map[string]string{VAR_HOST: host})
+		return NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1, DialTimeout: 200 * time.Millisecond, LocalMeta: func() *Meta { return local }})
+	}
+
+	colocated := newPeer("host1")
+	colocated.Sync(node)
+	if reply, err := colocated.Send(ctx, node, &api.Envelope{Cid: "a", Payload: &api.Envelope_Bytes{Bytes: []byte("a")}}); err != nil || string(reply.GetBytes()) != "a" {
+		t.Fatalf("unexpected reply %v %v", reply, err)
+	}
+
+	// a socket not shared with the node falls back to its tcp address
+	unreachable := server.GetMeta()
+	unreachable.Vars = map[string]string{VAR_HOST: "host1", VAR_UNIX_SOCKET: filepath.Join(t.TempDir(), "missing.sock")}
+	fallback := newPeer("host1")
+	fallback.Sync(unreachable)
+	if reply, err := fallback.Send(ctx, unreachable, &api.Envelope{Cid: "a", Payload: &api.Envelope_Bytes{Bytes: []byte("a")}}); err != nil || string(reply.GetBytes()) != "a" {
+		t.Fatalf("unexpected reply over tcp fallback %v %v", reply, err)
+	}
+
+	remote := newPeer("host2")
+	remote.Sync(node)
+	if _, err := remote.Send(ctx, node, &api.Envelope{Cid: "a"}); err == nil {
+		t.Fatal("node of another host called over the unix socket")
+	}
+
+	if err := server.UpdateMeta(META_STATUS_READYED, map[string]string{VAR_HOST: "host2"}); !errors.Is(err, ErrReservedVar) {
+		t.Fatalf("expected ErrReservedVar, got %v", err)
+	}
+
+	if err := server.UpdateMeta(META_STATUS_READYED, map[string]string{}); err != nil || server.GetMeta().Vars[VAR_UNIX_SOCKET] == "" {
+		t.Fatalf("unix socket var not kept %v %v", server.GetMeta().Vars, err)
+	}
+}
@@ -0,0 +1,174 @@
+package nakamacluster
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	VAR_WEIGHT = "weight" // weight of the node on the hashrings, a positive integer
+	VAR_DOMAIN = "domain" // domain of the node set from Config.Domain, it can not change after start
+
+	VAR_HOST        = "host"        // host of the node set from Config.HostId, it can not change after start
+	VAR_UNIX_SOCKET = "unix_socket" // unix socket of the node set from Config.GrpcUnixSocket, it can not change after start
+)
+
+// reservedVars vars set from the config that UpdateMeta keeps
+var reservedVars = []string{VAR_DOMAIN, VAR_HOST, VAR_UNIX_SOCKET}
+
+// var types of a VarSchema
+const (
+	VAR_TYPE_STRING   = "string"
+	VAR_TYPE_INT      = "int"
+	VAR_TYPE_BOOL     = "bool"
+	VAR_TYPE_DURATION = "duration"
+)
+
+var (
+	ErrMissingVar  = errors.New("missing var")
+	ErrInvalidVar  = errors.New("invalid var")
+	ErrReservedVar = errors.New("reserved var")
+)
+
+// Vars typed accessors of the vars of a node, a missing key is ErrMissingVar and
+// a value not of the type ErrInvalidVar
+type Vars map[string]string
+
+// TypedVars returns the vars of the node with typed accessors
+func (n *Meta) TypedVars() Vars {
+	return Vars(n.Vars)
+}
+
+func (v Vars) GetString(key string) (string, error) {
+	value, ok := v[key]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrMissingVar, key)
+	}
+	return value, nil
+}
+
+func (v Vars) GetInt(key string) (int, error) {
+	value, err := v.GetString(key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s is not an int, got %q", ErrInvalidVar, key, value)
+	}
+	return n, nil
+}
+
+func (v Vars) GetBool(key string) (bool, error) {
+	value, err := v.GetString(key)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s is not a bool, got %q", ErrInvalidVar, key, value)
+	}
+	return b, nil
+}
+
+// GetDuration returns the var parsed like 10s or 1m30s
+func (v Vars) GetDuration(key string) (time.Duration, error) {
+	value, err := v.GetString(key)
+	if err != nil {
+		return 0, err
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s is not a duration, got %q", ErrInvalidVar, key, value)
+	}
+	return d, nil
+}
+
+// VarSchema types of the vars every node must announce by key, nodes missing one or
+// announcing one not of its type are rejected when they join
+type VarSchema map[string]string
+
+// CheckVarSchema returns ErrInvalidVar when a type of the schema is unknown
+func CheckVarSchema(s VarSchema) error {
+	for key, t := range s {
+		switch t {
+		case VAR_TYPE_STRING, VAR_TYPE_INT, VAR_TYPE_BOOL, VAR_TYPE_DURATION:
+		default:
+			return fmt.Errorf("%w: unknown type %q of %s", ErrInvalidVar, t, key)
+		}
+	}
+	return nil
+}
+
+// Check returns the error of the first var of the schema by key the vars miss or have of another
+// type, a weight that is not a positive integer is invalid with or without schema
+func (s VarSchema) Check(vars map[string]string) error {
+	v := Vars(vars)
+	if value, ok := v[VAR_WEIGHT]; ok {
+		if weight, err := v.GetInt(VAR_WEIGHT); err != nil || weight < 1 {
+			return fmt.Errorf("%w: %s is not a positive int, got %q", ErrInvalidVar, VAR_WEIGHT, value)
+		}
+	}
+
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var err error
+		switch s[key] {
+		case VAR_TYPE_INT:
+			_, err = v.GetInt(key)
+		case VAR_TYPE_BOOL:
+			_, err = v.GetBool(key)
+		case VAR_TYPE_DURATION:
+			_, err = v.GetDuration(key)
+		default:
+			_, err = v.GetString(key)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLocalVars check the schema of the config and the vars of the local node against it
+func checkLocalVars(c Config, meta *Meta) error {
+	if err := CheckVarSchema(c.VarSchema); err != nil {
+		return err
+	}
+	return VarSchema(c.VarSchema).Check(meta.Vars)
+}
+
+// protectReservedVars returns a copy of the new vars of the node keeping the reserved vars
+// of the current vars, changing one of them is ErrReservedVar
+func protectReservedVars(current, vars map[string]string) (map[string]string, error) {
+	for _, key := range reservedVars {
+		reserved, ok := current[key]
+		if value, set := vars[key]; set && (!ok || value != reserved) {
+			return nil, fmt.Errorf("%w: %s can not change", ErrReservedVar, key)
+		}
+	}
+
+	next := make(map[string]string, len(vars)+len(reservedVars))
+	for k, v := range vars {
+		next[k] = v
+	}
+
+	for _, key := range reservedVars {
+		if reserved, ok := current[key]; ok {
+			next[key] = reserved
+		}
+	}
+	return next, nil
+}
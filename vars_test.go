@@ -0,0 +1,88 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/sd"
+	"go.uber.org/zap"
+)
+
+func TestVars(t *testing.T) {
+	v := Vars{"n": "3", "on": "true", "ttl": "1m30s", "bad": "x"}
+	if n, err := v.GetInt("n"); err != nil || n != 3 {
+		t.Fatalf("GetInt %v %v", n, err)
+	}
+
+	if b, err := v.GetBool("on"); err != nil || !b {
+		t.Fatalf("GetBool %v %v", b, err)
+	}
+
+	if d, err := v.GetDuration("ttl"); err != nil || d != 90*time.Second {
+		t.Fatalf("GetDuration %v %v", d, err)
+	}
+
+	if _, err := v.GetInt("bad"); !errors.Is(err, ErrInvalidVar) {
+		t.Fatalf("malformed int %v", err)
+	}
+
+	if _, err := v.GetBool("missing"); !errors.Is(err, ErrMissingVar) {
+		t.Fatalf("missing bool %v", err)
+	}
+
+	schema := VarSchema{"region": VAR_TYPE_STRING, "slots": VAR_TYPE_INT}
+	if err := schema.Check(map[string]string{"region": "eu", "slots": "8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := schema.Check(map[string]string{"slots": "8"}); !errors.Is(err, ErrMissingVar) {
+		t.Fatalf("missing region %v", err)
+	}
+
+	if err := schema.Check(map[string]string{"region": "eu", "slots": "many"}); !errors.Is(err, ErrInvalidVar) {
+		t.Fatalf("malformed slots %v", err)
+	}
+
+	if err := VarSchema(nil).Check(map[string]string{VAR_WEIGHT: "heavy"}); !errors.Is(err, ErrInvalidVar) {
+		t.Fatalf("malformed weight %v", err)
+	}
+
+	if err := CheckVarSchema(VarSchema{"slots": "float"}); !errors.Is(err, ErrInvalidVar) {
+		t.Fatalf("unknown type %v", err)
+	}
+}
+
+func TestServerVars(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := testConfig(t)
+	config.Domain = "games"
+	config.VarSchema = map[string]string{"slots": VAR_TYPE_INT}
+	server := NewServer(ctx, zap.NewNop(), sd.NewMemoryStore().NewClient(ctx), "node1", "svc", map[string]string{"slots": "8"}, *config)
+	defer server.Stop()
+
+	if err := server.UpdateMeta(META_STATUS_READYED, map[string]string{"slots": "8", VAR_WEIGHT: "0"}); !errors.Is(err, ErrInvalidVar) {
+		t.Fatalf("zero weight %v", err)
+	}
+
+	if err := server.UpdateMeta(META_STATUS_READYED, map[string]string{"slots": "8", VAR_DOMAIN: "chat"}); !errors.Is(err, ErrReservedVar) {
+		t.Fatalf("domain changed %v", err)
+	}
+
+	if err := server.UpdateMeta(META_STATUS_READYED, map[string]string{"slots": "16"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if vars := server.GetMeta().TypedVars(); vars[VAR_DOMAIN] != "games" {
+		t.Fatalf("domain lost %v", vars)
+	}
+
+	bad := NewNodeMeta("node2", "svc", "127.0.0.1:1", NODE_TYPE_MICROSERVICES, map[string]string{"slots": "eight"})
+	server.onUpdate([]*Meta{server.GetMeta(), bad})
+	if _, ok := server.peers.Get("node2"); ok {
+		t.Fatal("node with invalid vars joined")
+	}
+}
@@ -0,0 +1,91 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/doublemo/nakama-cluster/api"
+)
+
+const (
+	// ProtocolVersion version of the cluster protocol spoken by this node
+	ProtocolVersion uint32 = 2
+
+	// MinProtocolVersion oldest protocol version this node can talk to
+	MinProtocolVersion uint32 = 1
+
+	// protocolVersionStreams version adding chunk frames, stream window credits, stream
+	// batches and json and any payloads, older peers are sent none of them
+	protocolVersionStreams uint32 = 2
+)
+
+var ErrIncompatibleProtocol = errors.New("incompatible protocol version")
+
+// CheckProtocolVersion returns an error when the version can not be handled by this node,
+// version 0 is sent by nodes older than the versioning and handled as version 1
+func CheckProtocolVersion(version uint32) error {
+	if version == 0 {
+		version = 1
+	}
+
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return fmt.Errorf("%w: peer speaks %d, supported %d-%d", ErrIncompatibleProtocol, version, MinProtocolVersion, ProtocolVersion)
+	}
+	return nil
+}
+
+// negotiateProtocol returns the version spoken with a peer announcing the version,
+// version 0 is sent by nodes older than the versioning and handled as version 1
+func negotiateProtocol(version uint32) uint32 {
+	if version == 0 {
+		return 1
+	}
+
+	if version > ProtocolVersion {
+		return ProtocolVersion
+	}
+	return version
+}
+
+// downgradeEnvelope stamp the envelope with the version spoken with a peer announcing the
+// version, it returns ErrIncompatibleProtocol when the payload is unknown to the peer
+func downgradeEnvelope(in *api.Envelope, version uint32) error {
+	if in == nil {
+		return nil
+	}
+
+	version = negotiateProtocol(version)
+	if version < protocolVersionStreams {
+		switch in.Payload.(type) {
+		case *api.Envelope_Json, *api.Envelope_Any, *api.Envelope_Chunk, *api.Envelope_Window, *api.Envelope_Batch:
+			return fmt.Errorf("%w: %T payload needs %d, peer speaks %d", ErrIncompatibleProtocol, in.Payload, protocolVersionStreams, version)
+		}
+	}
+
+	if in.Version == 0 || in.Version > version {
+		in.Version = version
+	}
+	return nil
+}
+
+// callerProtocol returns the protocol version announced by the caller of the request served with ctx
+func callerProtocol(ctx context.Context) uint32 {
+	if caller, ok := FromContext(ctx); ok {
+		return caller.ProtocolVersion
+	}
+	return 0
+}
+
+func checkEnvelopeVersion(in *api.Envelope) error {
+	if in == nil {
+		return nil
+	}
+	return CheckProtocolVersion(in.Version)
+}
+
+func stampEnvelopeVersion(in *api.Envelope) {
+	if in != nil && in.Version == 0 {
+		in.Version = ProtocolVersion
+	}
+}
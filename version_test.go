@@ -0,0 +1,89 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/doublemo/nakama-cluster/api"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// largeReplyServerDelegate replies to every stream message with a payload of 4KB
+type largeReplyServerDelegate struct{ echoServerDelegate }
+
+func (largeReplyServerDelegate) Stream(ctx context.Context, client func(out *api.Envelope) bool, in *api.Envelope) error {
+	client(&api.Envelope{Cid: in.Cid, Payload: &api.Envelope_Bytes{Bytes: make([]byte, 4096)}})
+	return nil
+}
+
+func TestProtocolVersion(t *testing.T) {
+	if err := CheckProtocolVersion(0); err != nil {
+		t.Fatalf("node older than the versioning rejected %v", err)
+	}
+
+	if err := CheckProtocolVersion(ProtocolVersion + 1); !errors.Is(err, ErrIncompatibleProtocol) {
+		t.Fatalf("expected ErrIncompatibleProtocol, got %v", err)
+	}
+
+	in := &api.Envelope{Cid: "chat", Payload: &api.Envelope_Bytes{Bytes: []byte("hi")}}
+	if err := downgradeEnvelope(in, 0); err != nil || in.Version != 1 {
+		t.Fatalf("unexpected downgrade %d %v", in.Version, err)
+	}
+
+	in = &api.Envelope{Cid: "chat", Payload: &api.Envelope_Json{Json: &api.Json{}}}
+	if err := downgradeEnvelope(in, 0); !errors.Is(err, ErrIncompatibleProtocol) {
+		t.Fatalf("json payload sent to a v0 node %v", err)
+	}
+
+	if err := downgradeEnvelope(in, ProtocolVersion); err != nil || in.Version != ProtocolVersion {
+		t.Fatalf("unexpected downgrade %d %v", in.Version, err)
+	}
+}
+
+func TestProtocolVersionLegacyPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := newTestServer(t, func(c *Config) {
+		c.MaxStreamMessageSize = 1024
+	})
+	server.OnDelegate(largeReplyServerDelegate{})
+
+	// a v0 node opens the stream without announcing itself and knows no window or chunk frames
+	conn, err := grpc.DialContext(ctx, server.GetMeta().Addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stream, err := api.NewApiServerClient(conn).Stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stream.Send(&api.Envelope{Cid: "chat"}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.GetWindow() != nil || out.GetChunk() != nil || len(out.GetBytes()) != 4096 || out.Version != 1 {
+		t.Fatalf("unexpected reply to a v0 node %v", out)
+	}
+
+	// a v0 node is sent no payload it can not read
+	peer := NewPeer(ctx, zap.NewNop(), PeerOptions{Connections: 1})
+	legacy := server.GetMeta()
+	legacy.ProtocolVersion = 0
+	peer.Sync(legacy)
+	if _, err := peer.Send(ctx, legacy, &api.Envelope{Cid: "chat", Payload: &api.Envelope_Json{Json: &api.Json{}}}); !errors.Is(err, ErrIncompatibleProtocol) {
+		t.Fatalf("expected ErrIncompatibleProtocol, got %v", err)
+	}
+}
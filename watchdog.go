@@ -0,0 +1,59 @@
+package nakamacluster
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// watchdog times the delegate callbacks, a callback running past the threshold is logged and
+// counted as stuck, and its context is cancelled when cancel is set
+type watchdog struct {
+	threshold time.Duration
+	cancel    bool
+	logger    *zap.Logger
+	metrics   *Metrics
+}
+
+func newWatchdog(c Config, logger *zap.Logger, metrics *Metrics) *watchdog {
+	return &watchdog{
+		threshold: time.Duration(c.WatchdogThreshold) * time.Millisecond,
+		cancel:    c.WatchdogCancel,
+		logger:    logger,
+		metrics:   metrics,
+	}
+}
+
+// watch time the callback handling the cid, done reports its latency and must be called once it
+// returned. The returned context is cancelled past the threshold when the watchdog cancels
+func (w *watchdog) watch(ctx context.Context, callback, cid string) (context.Context, func()) {
+	if w == nil {
+		return ctx, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	start := time.Now()
+	var timer *time.Timer
+	if w.threshold > 0 {
+		timer = time.AfterFunc(w.threshold, func() {
+			w.logger.Warn("Delegate handler stuck",
+				zap.String("callback", callback),
+				zap.String("cid", cid),
+				zap.Duration("threshold", w.threshold),
+				zap.Bool("cancelled", w.cancel))
+			w.metrics.DelegateStuck(callback)
+			if w.cancel {
+				cancel()
+			}
+		})
+	}
+
+	return ctx, func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		cancel()
+		w.metrics.DelegateLatency(callback, time.Since(start))
+	}
+}
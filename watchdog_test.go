@@ -0,0 +1,52 @@
+package nakamacluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/uber-go/tally/v4"
+	"go.uber.org/zap"
+)
+
+func TestWatchdog(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	w := newWatchdog(Config{WatchdogThreshold: 20, WatchdogCancel: true}, zap.NewNop(), NewMetrics(scope))
+
+	ctx, done := w.watch(context.Background(), DELEGATE_CALL, "stuck")
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stuck handler not cancelled")
+	}
+	done()
+
+	_, done = w.watch(context.Background(), DELEGATE_CALL, "fast")
+	done()
+	time.Sleep(40 * time.Millisecond)
+
+	snapshot := scope.Snapshot()
+	if c := snapshot.Counters()["cluster.delegate_stuck+callback=call"]; c == nil || c.Value() != 1 {
+		t.Fatalf("unexpected stuck counter %v", c)
+	}
+
+	h := snapshot.Histograms()["cluster.delegate_latency+callback=call"]
+	if h == nil {
+		t.Fatal("latency not reported")
+	}
+
+	n := int64(0)
+	for _, count := range h.Durations() {
+		n += count
+	}
+	if n != 2 {
+		t.Fatalf("%d latencies reported", n)
+	}
+
+	var disabled *watchdog
+	if ctx, done := disabled.watch(context.Background(), DELEGATE_CALL, "x"); ctx.Err() != nil {
+		t.Fatal("disabled watchdog cancelled")
+	} else {
+		done()
+	}
+}
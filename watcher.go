@@ -17,9 +17,18 @@ type Watcher struct {
 	cancelFn context.CancelFunc
 	sdClient sd.Client
 	onUpdate atomic.Value
+	onResync atomic.Value
 	prefix   string
 	logger   *zap.Logger
-	once     sync.Once
+	retry    joinRetry
+
+	// registered is closed once the node is registered in sd, registerFailed once the
+	// registration gave up and registerErr holds the last error of the attempts
+	registered     chan struct{}
+	registerFailed chan struct{}
+	registerErr    error
+	registerMu     sync.Mutex
+	once           sync.Once
 }
 
 func (s *Watcher) Stop() {
@@ -34,6 +43,29 @@ func (s *Watcher) OnUpdate(f func(meta []*Meta)) {
 	s.onUpdate.Store(f)
 }
 
+// OnResync set f called when the sd watch lost changes, the view is read again in full after it
+func (s *Watcher) OnResync(f func(err error)) {
+	s.onResync.Store(f)
+}
+
+// Registered returns a channel closed once the node is registered in sd
+func (s *Watcher) Registered() <-chan struct{} {
+	return s.registered
+}
+
+// RegisterError returns the last error registering the node in sd, nil once it is registered
+func (s *Watcher) RegisterError() error {
+	s.registerMu.Lock()
+	defer s.registerMu.Unlock()
+	return s.registerErr
+}
+
+func (s *Watcher) setRegisterError(err error) {
+	s.registerMu.Lock()
+	s.registerErr = err
+	s.registerMu.Unlock()
+}
+
 func (s *Watcher) GetEntries() ([]*Meta, error) {
 	values, err := s.sdClient.GetEntries(s.prefix)
 	if err != nil {
@@ -68,7 +100,33 @@ func (s *Watcher) Update(meta *Meta) error {
 	return s.sdClient.Update(service)
 }
 
+// watch register meta in sd, a nil meta only watches, and notify the changes until the watcher stops
 func (s *Watcher) watch(meta *Meta) {
+	if meta != nil {
+		defer s.register(meta)()
+	} else {
+		close(s.registered)
+	}
+
+	if n, ok := s.sdClient.(sd.ResyncNotifier); ok {
+		n.OnResync(s.resync)
+	}
+
+	watchCh := make(chan struct{}, 1)
+	go s.sdClient.WatchPrefix(s.prefix, watchCh)
+
+	for {
+		select {
+		case <-watchCh:
+			s.update()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// register meta in sd retrying failures, the returned function deregisters it
+func (s *Watcher) register(meta *Meta) func() {
 	metaValue, err := meta.Marshal()
 	if err != nil {
 		s.logger.Fatal("Failed marshal meta", zap.Error(err))
@@ -79,22 +137,41 @@ func (s *Watcher) watch(meta *Meta) {
 	service.Value = string(metaValue)
 	service.TTL = sd.NewTTLOption(3*time.Second, 10*time.Second)
 
-	s.sdClient.Register(service)
-	defer func() {
+	err = s.retry.do(s.ctx, s.logger, "register", func() error {
+		err := s.sdClient.Register(service)
+		s.setRegisterError(err)
+		return err
+	})
+	if err != nil {
+		s.logger.Error("Failed to register node", zap.Error(err))
+		close(s.registerFailed)
+	} else {
+		close(s.registered)
+	}
+
+	return func() {
+		// the key is left to another node that registered the id since, see conflictHandler
+		if epoch, ok := s.registeredEpoch(meta.Id); ok && epoch != meta.Epoch {
+			s.logger.Info("Node id registered by another node, keeping its registration", zap.String("id", meta.Id))
+			service.KeepKey = true
+		}
 		s.sdClient.Deregister(service)
-	}()
+	}
+}
 
-	watchCh := make(chan struct{}, 1)
-	go s.sdClient.WatchPrefix(s.prefix, watchCh)
+// registeredEpoch returns the epoch of the node of the id registered in sd
+func (s *Watcher) registeredEpoch(id string) (int64, bool) {
+	metas, err := s.GetEntries()
+	if err != nil {
+		return 0, false
+	}
 
-	for {
-		select {
-		case <-watchCh:
-			s.update()
-		case <-s.ctx.Done():
-			return
+	for _, meta := range metas {
+		if meta.Id == id {
+			return meta.Epoch, true
 		}
 	}
+	return 0, false
 }
 
 func (s *Watcher) update() {
@@ -110,11 +187,26 @@ func (s *Watcher) update() {
 	handler(meta)
 }
 
+func (s *Watcher) resync(err error) {
+	s.logger.Warn("Sd watch lost changes, reading nodes again", zap.Error(err))
+	if handler, ok := s.onResync.Load().(func(err error)); ok && handler != nil {
+		handler(err)
+	}
+}
+
 func NewWatcher(ctx context.Context, logger *zap.Logger, sdClient sd.Client, prefix string, meta *Meta) *Watcher {
+	return newWatcher(ctx, logger, sdClient, prefix, meta, joinRetry{})
+}
+
+// newWatcher create watcher retrying a failed registration of meta with retry, a nil meta is not registered
+func newWatcher(ctx context.Context, logger *zap.Logger, sdClient sd.Client, prefix string, meta *Meta, retry joinRetry) *Watcher {
 	watcher := &Watcher{
-		sdClient: sdClient,
-		prefix:   prefix,
-		logger:   logger,
+		sdClient:       sdClient,
+		prefix:         prefix,
+		logger:         logger,
+		retry:          retry,
+		registered:     make(chan struct{}),
+		registerFailed: make(chan struct{}),
 	}
 	watcher.ctx, watcher.cancelFn = context.WithCancel(ctx)
 	go watcher.watch(meta)
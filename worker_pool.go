@@ -0,0 +1,218 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+var ErrWorkerPoolClosed = errors.New("worker pool closed")
+
+// WorkerPool runs jobs on a fixed number of goroutines,
+// jobs wait in a bounded queue when every worker is busy
+type WorkerPool struct {
+	ctx     context.Context
+	name    string
+	size    int
+	busy    int64
+	queue   chan func()
+	metrics *Metrics
+}
+
+// Submit queue the job, it blocks while the queue is full
+func (p *WorkerPool) Submit(ctx context.Context, job func()) error {
+	select {
+	case p.queue <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.ctx.Done():
+		return ErrWorkerPoolClosed
+	}
+
+	p.report()
+	return nil
+}
+
+// TrySubmit queue the job, it returns false when the queue is full
+func (p *WorkerPool) TrySubmit(job func()) bool {
+	select {
+	case p.queue <- job:
+	default:
+		return false
+	}
+
+	p.report()
+	return true
+}
+
+// Busy returns the number of workers running a job
+func (p *WorkerPool) Busy() int {
+	return int(atomic.LoadInt64(&p.busy))
+}
+
+// Queued returns the number of jobs waiting for a worker
+func (p *WorkerPool) Queued() int {
+	return len(p.queue)
+}
+
+// Capacity returns the number of jobs the queue holds
+func (p *WorkerPool) Capacity() int {
+	return cap(p.queue)
+}
+
+func (p *WorkerPool) report() {
+	p.metrics.WorkerPoolUtilization(p.name, p.Busy(), p.Queued(), p.size)
+}
+
+func (p *WorkerPool) work() {
+	for {
+		select {
+		case job := <-p.queue:
+			atomic.AddInt64(&p.busy, 1)
+			p.report()
+			job()
+			atomic.AddInt64(&p.busy, -1)
+			p.report()
+
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// NewWorkerPool create worker pool, the workers exit when ctx is done
+func NewWorkerPool(ctx context.Context, name string, size, queueSize int, metrics *Metrics) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	p := &WorkerPool{
+		ctx:     ctx,
+		name:    name,
+		size:    size,
+		queue:   make(chan func(), queueSize),
+		metrics: metrics,
+	}
+
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// KeyedWorkerPool runs jobs on a fixed number of goroutines, jobs of the same
+// key always run on the same worker so they run in submission order
+type KeyedWorkerPool struct {
+	ctx     context.Context
+	name    string
+	busy    int64
+	queues  []chan func()
+	metrics *Metrics
+}
+
+// Submit queue the job on the worker of the key, it blocks while its queue is full
+func (p *KeyedWorkerPool) Submit(ctx context.Context, key string, job func()) error {
+	select {
+	case p.queue(key) <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.ctx.Done():
+		return ErrWorkerPoolClosed
+	}
+
+	p.report()
+	return nil
+}
+
+// TrySubmit queue the job on the worker of the key, it returns false when its queue is full
+func (p *KeyedWorkerPool) TrySubmit(key string, job func()) bool {
+	select {
+	case p.queue(key) <- job:
+	default:
+		p.metrics.WorkerPoolRejected(p.name)
+		return false
+	}
+
+	p.report()
+	return true
+}
+
+// queue returns the queue of the worker of the key
+func (p *KeyedWorkerPool) queue(key string) chan func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// Busy returns the number of workers running a job
+func (p *KeyedWorkerPool) Busy() int {
+	return int(atomic.LoadInt64(&p.busy))
+}
+
+// Queued returns the number of jobs waiting for a worker
+func (p *KeyedWorkerPool) Queued() int {
+	n := 0
+	for _, queue := range p.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Capacity returns the number of jobs the queues hold
+func (p *KeyedWorkerPool) Capacity() int {
+	n := 0
+	for _, queue := range p.queues {
+		n += cap(queue)
+	}
+	return n
+}
+
+func (p *KeyedWorkerPool) report() {
+	p.metrics.WorkerPoolUtilization(p.name, p.Busy(), p.Queued(), len(p.queues))
+}
+
+func (p *KeyedWorkerPool) work(queue chan func()) {
+	for {
+		select {
+		case job := <-queue:
+			atomic.AddInt64(&p.busy, 1)
+			p.report()
+			job()
+			atomic.AddInt64(&p.busy, -1)
+			p.report()
+
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// NewKeyedWorkerPool create keyed worker pool, every worker queues up to queueSize jobs
+// and the workers exit when ctx is done
+func NewKeyedWorkerPool(ctx context.Context, name string, size, queueSize int, metrics *Metrics) *KeyedWorkerPool {
+	if size < 1 {
+		size = 1
+	}
+
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	p := &KeyedWorkerPool{
+		ctx:     ctx,
+		name:    name,
+		queues:  make([]chan func(), size),
+		metrics: metrics,
+	}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueSize)
+		go p.work(p.queues[i])
+	}
+	return p
+}
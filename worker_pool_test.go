@@ -0,0 +1,96 @@
+package nakamacluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedWorkerPoolOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := NewKeyedWorkerPool(ctx, "test", 4, 100, NewMetrics(nil))
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		seen = make(map[string][]int)
+	)
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"node1", "node2", "node3"} {
+			key, i := key, i
+			wg.Add(1)
+			if !p.TrySubmit(key, func() {
+				defer wg.Done()
+				mu.Lock()
+				seen[key] = append(seen[key], i)
+				mu.Unlock()
+			}) {
+				t.Fatal("queue full")
+			}
+		}
+	}
+
+	wg.Wait()
+	for key, values := range seen {
+		for i, v := range values {
+			if v != i {
+				t.Fatalf("%s ran job %d at position %d", key, v, i)
+			}
+		}
+	}
+}
+
+func TestKeyedWorkerPoolFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+	p := NewKeyedWorkerPool(ctx, "test", 1, 1, NewMetrics(nil))
+	started := make(chan struct{})
+	p.TrySubmit("node1", func() {
+		close(started)
+		<-block
+	})
+	<-started
+
+	if !p.TrySubmit("node1", func() {}) {
+		t.Fatal("queue rejected the first waiting job")
+	}
+
+	if p.TrySubmit("node2", func() {}) {
+		t.Fatal("full queue accepted a job")
+	}
+}
+
+func TestKeyedWorkerPoolSubmit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	block := make(chan struct{})
+	p := NewKeyedWorkerPool(ctx, "test", 1, 1, NewMetrics(nil))
+	started := make(chan struct{})
+	p.Submit(ctx, "node1", func() {
+		close(started)
+		<-block
+	})
+	<-started
+	p.Submit(ctx, "node1", func() {})
+
+	// the submit waits for room in the queue of the worker until its context ends
+	submitCtx, submitCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer submitCancel()
+	if err := p.Submit(submitCtx, "node1", func() {}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected submit error %v", err)
+	}
+
+	close(block)
+	done := make(chan struct{})
+	if err := p.Submit(ctx, "node1", func() { close(done) }); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}